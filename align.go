@@ -0,0 +1,215 @@
+package awsomlp
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultAlignSimilarity is the minimum token similarity of templates aligned
+// by similarity when Align is called with 0
+const DefaultAlignSimilarity = 0.7
+
+// AlignMethod is how a template was mapped onto a template of a previous model
+type AlignMethod int
+
+const (
+	AlignNone        AlignMethod = iota // No previous template matched; the template gets a new event ID
+	AlignExact                          // The previous template is identical
+	AlignSubsumption                    // One of the templates subsumes the other
+	AlignSimilarity                     // The templates share most of their tokens
+)
+
+// String returns the name of the method
+func (m AlignMethod) String() string {
+	switch m {
+	case AlignExact:
+		return "exact"
+	case AlignSubsumption:
+		return "subsumption"
+	case AlignSimilarity:
+		return "similarity"
+	default:
+		return "none"
+	}
+}
+
+// Alignment maps a pattern of the current model onto an event ID of a previous model
+type Alignment struct {
+	PatternID        int // ID of the pattern in the current model
+	Template         string
+	EventID          int    // ID of the matched previous pattern, or a new ID unused by the previous model
+	PreviousTemplate string // Template of the matched previous pattern, empty for AlignNone
+	Method           AlignMethod
+	Score            float64 // Token similarity of the templates, 1 for exact matches and 0 for AlignNone
+}
+
+// alignTemplate is a pattern taking part in the alignment
+type alignTemplate struct {
+	id       int
+	template string
+	tokens   []string
+}
+
+// Align maps the templates of the parser onto the event IDs of a previous
+// model, so that identifiers stored by consumers such as dashboards stay
+// stable when the templates shift slightly between runs. Every pattern is
+// matched against the previous patterns not taken yet, first by identical
+// template, then by subsumption in either direction, preferring the most
+// specific previous template, and finally by token similarity of at least
+// minSimilarity (DefaultAlignSimilarity if 0), highest first. Patterns left
+// over get new event IDs following those of the previous model.
+//
+// Each previous event ID is assigned at most once. The alignments are ordered
+// by PatternID.
+func (lp *AWSOMLP) Align(previous *AWSOMLP, minSimilarity float64) []Alignment {
+	if minSimilarity == 0 {
+		minSimilarity = DefaultAlignSimilarity
+	}
+	current := alignTemplates(lp)
+	candidates := alignTemplates(previous)
+
+	alignments := make([]Alignment, len(current))
+	aligned := make([]bool, len(current))
+	taken := make([]bool, len(candidates))
+	assign := func(i, j int, method AlignMethod, score float64) {
+		alignments[i] = Alignment{
+			PatternID:        current[i].id,
+			Template:         current[i].template,
+			EventID:          candidates[j].id,
+			PreviousTemplate: candidates[j].template,
+			Method:           method,
+			Score:            score,
+		}
+		aligned[i], taken[j] = true, true
+	}
+
+	// Identical templates
+	byTemplate := make(map[string][]int)
+	for j, candidate := range candidates {
+		byTemplate[candidate.template] = append(byTemplate[candidate.template], j)
+	}
+	for i, tmpl := range current {
+		for _, j := range byTemplate[tmpl.template] {
+			if !taken[j] {
+				assign(i, j, AlignExact, 1)
+				break
+			}
+		}
+	}
+
+	// Subsumption in either direction
+	currentSubsumers := make([]*subsumer, len(current))
+	for i, tmpl := range current {
+		currentSubsumers[i] = newSubsumer(tmpl.template)
+	}
+	candidateSubsumers := make([]*subsumer, len(candidates))
+	for j, candidate := range candidates {
+		candidateSubsumers[j] = newSubsumer(candidate.template)
+	}
+	for i, tmpl := range current {
+		if aligned[i] {
+			continue
+		}
+		best := -1
+		for j, candidate := range candidates {
+			if taken[j] || !(candidateSubsumers[j].subsumes(tmpl.template) || currentSubsumers[i].subsumes(candidate.template)) {
+				continue
+			}
+			if best < 0 || moreSpecific(candidate.template, candidates[best].template) {
+				best = j
+			}
+		}
+		if best >= 0 {
+			assign(i, best, AlignSubsumption, tokenSimilarity(tmpl.tokens, candidates[best].tokens))
+		}
+	}
+
+	// Token similarity, best pairs first
+	type pair struct {
+		i, j  int
+		score float64
+	}
+	var pairs []pair
+	for i, tmpl := range current {
+		if aligned[i] {
+			continue
+		}
+		for j, candidate := range candidates {
+			if taken[j] {
+				continue
+			}
+			if score := tokenSimilarity(tmpl.tokens, candidate.tokens); score >= minSimilarity {
+				pairs = append(pairs, pair{i, j, score})
+			}
+		}
+	}
+	sort.Slice(pairs, func(a, b int) bool {
+		if pairs[a].score != pairs[b].score {
+			return pairs[a].score > pairs[b].score
+		}
+		if pairs[a].i != pairs[b].i {
+			return pairs[a].i < pairs[b].i
+		}
+		return pairs[a].j < pairs[b].j
+	})
+	for _, p := range pairs {
+		if !aligned[p.i] && !taken[p.j] {
+			assign(p.i, p.j, AlignSimilarity, p.score)
+		}
+	}
+
+	// New event IDs for the rest
+	nextID := previous.nextID
+	for _, candidate := range candidates {
+		if candidate.id >= nextID {
+			nextID = candidate.id + 1
+		}
+	}
+	for i, tmpl := range current {
+		if !aligned[i] {
+			alignments[i] = Alignment{PatternID: tmpl.id, Template: tmpl.template, EventID: nextID, Method: AlignNone}
+			nextID++
+		}
+	}
+	return alignments
+}
+
+// alignTemplates returns the templates of the patterns of a parser ordered by ID
+func alignTemplates(lp *AWSOMLP) []alignTemplate {
+	patterns := lp.GetPatternsSorted(OrderByFirstSeen)
+	templates := make([]alignTemplate, 0, len(patterns))
+	for _, pattern := range patterns {
+		template := strings.TrimSpace(pattern.Template)
+		if len(pattern.Events) > 0 {
+			template = lp.result(0, pattern.Events[0], pattern).Template
+		}
+		templates = append(templates, alignTemplate{id: pattern.ID, template: template, tokens: strings.Fields(template)})
+	}
+	return templates
+}
+
+// tokenSimilarity returns the share of tokens two templates have in common in
+// the same order: twice the length of their longest common subsequence
+// divided by their total number of tokens
+func tokenSimilarity(a, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 1
+	}
+	// One row of the LCS table at a time
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				curr[j+1] = prev[j] + 1
+			case prev[j+1] >= curr[j]:
+				curr[j+1] = prev[j+1]
+			default:
+				curr[j+1] = curr[j]
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return 2 * float64(prev[len(b)]) / float64(len(a)+len(b))
+}
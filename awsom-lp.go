@@ -6,21 +6,30 @@
 package awsomlp
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // SortingStrategy defines the strategy for sorting events in patterns
 type SortingStrategy int
 
 const (
-	SortNone        SortingStrategy = iota // Use first event (original behavior)
-	SortByLength                           // Sort by number of tokens
-	SortLexical                            // Lexicographic sorting
-	SortByDynTokens                        // Sort by number of dynamic tokens
+	SortNone           SortingStrategy = iota // Use first event (original behavior)
+	SortByLength                              // Sort by number of tokens
+	SortLexical                               // Lexicographic sorting
+	SortByDynTokens                           // Sort by number of dynamic tokens
+	SortByMostTokens                          // Use the event with the most tokens
+	SortByMedianLength                        // Use the event with the median number of tokens
+	SortByStaticRatio                         // Use the event with the highest share of tokens found in every event
 )
 
 // FreqThresholdStrategy defines how to calculate frequency threshold for static tokens
@@ -36,6 +45,7 @@ const (
 // Config holds configuration parameters for AWSOM-LP
 type Config struct {
 	MinSimilarity                  float64               // Similarity threshold (default 1.0 as in paper)
+	SimilarityStrategy             SimilarityStrategy    // How the threshold adapts to each pattern (default SimilarityFixed)
 	SortingStrategy                SortingStrategy       // Strategy for sorting events in patterns (default SortNone)
 	CustomRegexes                  []string              // Additional regex patterns for trivial variables
 	HeaderRegex                    string                // Regex for extracting log header (default DefaultHeaderRegex)
@@ -44,14 +54,50 @@ type Config struct {
 	MinTemplateTokens              int                   // Minimum number of non-placeholder tokens (default 1)
 	FreqThresholdStrategy          FreqThresholdStrategy // Strategy for frequency threshold calculation (default FreqMin)
 	FreqPercentile                 float64               // Percentile for FreqPercentile strategy (default 0.5)
+	FreqCounting                   FreqCounting          // Count token frequencies per group or per position (default FreqCountGlobal)
+	FreqSketchThreshold            int                   // Distinct tokens after which a pattern counts frequencies in a count-min sketch (default 0 = never)
 	StrictAlphabeticalMatching     bool                  // Require exact alphabetical token matching (default false for paper compliance)
+	BucketByTokenCount             bool                  // Only compare events with patterns of about the same token count, as Drain does (default false)
+	TokenCountTolerance            int                   // Maximum token count difference with BucketByTokenCount (default 0 = identical)
+	ApproximateGrouping            bool                  // Compare events only with candidate patterns found by MinHash LSH (default false)
+	LSHBands                       int                   // Number of LSH bands for ApproximateGrouping (default 16)
+	LSHRows                        int                   // MinHash values per LSH band (default 4)
 	ApplyFreqAnalysisToSmallGroups bool                  // Apply frequency analysis to groups < MinGroupSize (default true for paper compliance)
+	EntropyThreshold               float64               // Per-position token entropy in bits from which static tokens become placeholders (default 0 = disabled)
+	MaxLineLength                  int                   // Maximum line length in bytes before truncation (default 10000, -1 = unlimited)
+	MaxTokens                      int                   // Maximum number of tokens per line; longer lines keep their first MaxTokens tokens and a final <*> (default 0 = unlimited)
+	RejectOversized                bool                  // Skip lines with more than MaxTokens tokens instead of truncating them (default false)
+	OnOversized                    func(*LogEvent, int)  // Called for every line with more than MaxTokens tokens with its original token count, after truncation (optional)
+	MaxEventsPerPattern            int                   // Maximum number of events retained per pattern (default 0 = unlimited)
+	MaxExamplesPerPattern          int                   // Maximum number of raw example lines sampled per pattern (default 3)
+	PatternTTL                     time.Duration         // Expire patterns not seen for this long (default 0 = never)
+	PatternTTLLines                int                   // Expire patterns not seen within this many lines (default 0 = never)
+	DecayHalfLife                  time.Duration         // Half-life of the exponential decay of Pattern.Weight (default 0 = no decay)
+	OnExpire                       func(p *Pattern)      // Called for every expired pattern (optional)
+	Pipeline                       []Stage               // Preprocessing stages in order (default DefaultPipeline())
+	Canonical                      bool                  // Group events in sorted order so templates do not depend on input order (default false)
+	Deterministic                  bool                  // Canonical grouping without wall-clock timestamps, so any order of the same lines gives byte-identical results (default false)
+	BeforeGroup                    func(event *LogEvent) // Called for each preprocessed event before it is assigned to a pattern (optional)
+	AfterTemplate                  func(p *Pattern)      // Called whenever a pattern's template is (re)generated; may rewrite p.Template (optional)
+	Segmentation                   Segmentation          // Split mixed streams into segments with separate patterns (default SegmentNone)
+	SegmentField                   string                // Header field identifying the source for SegmentByField
+	CalendarWords                  CalendarWordMasking   // How month and weekday names outside of timestamps are masked (default CalendarWordsAlways)
+	PathMinSegments                int                   // Minimum number of segments of a Unix path to mask it; Windows and UNC paths are masked from one (default 3)
+	KeepPaths                      bool                  // Never mask file paths (default false)
+	MaskThreads                    bool                  // Mask the numbers of thread names and thread and goroutine IDs (default false)
+	MaskQuoted                     bool                  // Mask the contents of single- and double-quoted strings, keeping the quotes (default false)
+	Brackets                       []BracketRule         // Bracket contents masked as trivial variables (default DefaultBrackets(), empty = none)
+	ColumnRules                    []ColumnRule          // Token positions masked on matching lines after tokenization, e.g. free-text fields (default none)
+	SingletonSimilarity            float64               // Token similarity from which single-line patterns are merged into a larger pattern after grouping (default 0 = never)
+	OnProgress                     func(p Progress)      // Called periodically while Parse, ParseEvents and ParseChunked group lines, and when they end (optional)
+	ProgressInterval               time.Duration         // Minimum interval between OnProgress calls (default 0 = DefaultProgressInterval)
 }
 
 // DefaultConfig returns the default configuration that balances paper compliance with practicality
 func DefaultConfig() Config {
 	return Config{
 		MinSimilarity:                  1.0,                // 100% similarity as in the paper
+		SimilarityStrategy:             SimilarityFixed,    // Same threshold for all patterns (paper-compliant)
 		SortingStrategy:                SortNone,           // Use first event (original behavior)
 		CustomRegexes:                  []string{},         // No additional regexes
 		HeaderRegex:                    DefaultHeaderRegex, // Universal header pattern
@@ -60,17 +106,32 @@ func DefaultConfig() Config {
 		MinTemplateTokens:              1,                  // Must have at least 1 real token
 		FreqThresholdStrategy:          FreqMin,            // Minimum frequency strategy (paper-compliant)
 		FreqPercentile:                 0.5,                // Default percentile (median)
+		FreqCounting:                   FreqCountGlobal,    // Count tokens anywhere in the line (paper-compliant)
 		StrictAlphabeticalMatching:     false,              // Disable additional token matching (paper-compliant)
 		ApplyFreqAnalysisToSmallGroups: true,               // Apply frequency analysis to all groups (paper-compliant)
+		MaxLineLength:                  10000,              // 10KB per line
+		MaxEventsPerPattern:            0,                  // Retain all events
+		MaxExamplesPerPattern:          3,                  // A few examples for reports
+		PathMinSegments:                3,                  // Short Unix paths are often parts of messages
+		LSHBands:                       16,                 // LSH bands for ApproximateGrouping
+		LSHRows:                        4,                  // MinHash values per band
+		Pipeline:                       DefaultPipeline(),  // Header, trivial, custom, tokenize
+		Brackets:                       DefaultBrackets(),  // Words in parentheses
 	}
 }
 
 // LogEvent represents a processed log event
 type LogEvent struct {
-	Raw      string   // Original log string
-	Content  string   // Content after header removal
-	Tokens   []string // Tokens after splitting
-	Template string   // Final template
+	Raw       string            // Original log string
+	Content   string            // Content after header removal
+	Tokens    []string          // Tokens after splitting
+	Template  string            // Final template
+	Truncated bool              // Whether the line was cut to MaxLineLength before preprocessing or to MaxTokens after it
+	Fields    map[string]string // Named header fields captured by HeaderRegex (nil if none)
+	PatternID int               // ID of the pattern the event was assigned to
+	Segment   string            // Segment of the event when Segmentation is enabled
+	seq       int               // Value of the parser's line counter when the event was assigned
+	oversized int               // Token count before truncation of a line with more than MaxTokens tokens (0 otherwise)
 }
 
 // Pattern represents a group of similar log events
@@ -78,15 +139,59 @@ type Pattern struct {
 	ID        int
 	Events    []*LogEvent
 	Template  string
-	Frequency map[string]int // Token frequency in this group
+	Frequency map[string]int // Token frequency in this group (cumulative, including discarded events; empty once counted in a sketch)
+	Count     int            // Number of lines assigned to the pattern, including duplicates and events not retained in Events
+	Examples  []string       // Raw example lines, a uniform sample of at most MaxExamplesPerPattern lines
+	FirstSeen time.Time      // Time the first line was assigned
+	LastSeen  time.Time      // Time the last line was assigned
+	Weight    float64        // Occurrence weight as of LastSeen, decayed with DecayHalfLife (equals Count without decay)
+	Segment   string         // Segment the pattern belongs to when Segmentation is enabled
+	lastLine  int            // Value of the parser's line counter when the pattern was last seen
+
+	PositionFrequency []map[string]int // Token frequency per position, counted with FreqCountPositional
+	sketch            *countMinSketch  // Token frequency replacing Frequency beyond FreqSketchThreshold distinct tokens
+
+	// Similarity of members to the representative, for SimilarityByVariance
+	simSamples int     // Number of members compared
+	simMean    float64 // Mean similarity
+	simM2      float64 // Sum of squared deviations from the mean
+}
+
+// PatternOrder defines the order of patterns returned by GetPatternsSorted
+type PatternOrder int
+
+const (
+	OrderByFirstSeen PatternOrder = iota // Order of first appearance (pattern ID)
+	OrderByCount                         // Number of lines assigned, most frequent first
+	OrderBySize                          // Number of retained events, largest first
+	OrderByWeight                        // Decayed occurrence weight (see DecayHalfLife), heaviest first
+)
+
+// TemplateCount holds a template and the number of lines it covers
+type TemplateCount struct {
+	Template string
+	Count    int
 }
 
 // AWSOMLP represents the main parser structure
 type AWSOMLP struct {
 	patterns      []*Pattern
 	headerRegex   *regexp.Regexp
-	customRegexes []*regexp.Regexp // Only custom regexes from config
-	config        Config           // Configuration parameters
+	customRegexes []*regexp.Regexp      // Only custom regexes from config
+	pathPatterns  []maskPattern         // Path masking patterns for PathMinSegments
+	brackets      []bracketMask         // Compiled Brackets rules
+	columns       []columnMask          // Compiled ColumnRules
+	config        Config                // Configuration parameters
+	truncated     int                   // Number of lines truncated to MaxLineLength
+	oversized     int                   // Number of lines with more than MaxTokens tokens
+	rng           *rand.Rand            // Source for example sampling, fixed seed for reproducible results
+	now           func() time.Time      // Clock for pattern timestamps and decay
+	lines         int                   // Number of lines assigned to patterns so far
+	nextID        int                   // ID of the next pattern; IDs are not reused after expiration
+	buckets       map[int][]*Pattern    // Patterns by token count for BucketByTokenCount (nil until built)
+	lsh           map[uint64][]*Pattern // Patterns by LSH band key for ApproximateGrouping (nil until built)
+	progress      *progressTracker      // Progress of the running parse call with OnProgress (nil otherwise)
+	mu            sync.Mutex            // Guards the model in Feed, ExportState and ImportState
 }
 
 // NewAWSOMLP creates a new parser instance with default configuration
@@ -95,6 +200,10 @@ func NewAWSOMLP() *AWSOMLP {
 		patterns:      make([]*Pattern, 0),
 		config:        DefaultConfig(),
 		customRegexes: []*regexp.Regexp{}, // Start with empty custom regexes
+		pathPatterns:  pathPatterns(DefaultPathMinSegments),
+		brackets:      defaultBracketMasks,
+		rng:           rand.New(rand.NewPCG(0, 0)),
+		now:           time.Now,
 	}
 
 	return lp
@@ -127,42 +236,133 @@ func (lp *AWSOMLP) WithConfig(config Config) error {
 	if config.FreqPercentile == 0 {
 		config.FreqPercentile = defaultConfig.FreqPercentile
 	}
+	if config.LSHBands == 0 {
+		config.LSHBands = defaultConfig.LSHBands
+	}
+	if config.LSHRows == 0 {
+		config.LSHRows = defaultConfig.LSHRows
+	}
+	if config.MaxExamplesPerPattern == 0 {
+		config.MaxExamplesPerPattern = defaultConfig.MaxExamplesPerPattern
+	}
+	if config.MaxLineLength == 0 {
+		config.MaxLineLength = defaultConfig.MaxLineLength
+	}
+	if config.Pipeline == nil {
+		config.Pipeline = defaultConfig.Pipeline
+	}
+	if config.PathMinSegments == 0 {
+		config.PathMinSegments = defaultConfig.PathMinSegments
+	}
+	if config.Brackets == nil {
+		config.Brackets = defaultConfig.Brackets
+	}
 
 	// Validate configuration parameters
 	if config.MinSimilarity < 0 || config.MinSimilarity > 1 {
-		return fmt.Errorf("MinSimilarity must be between 0 and 1, got %f", config.MinSimilarity)
+		return fmt.Errorf("%w: MinSimilarity must be between 0 and 1, got %f", ErrInvalidConfig, config.MinSimilarity)
 	}
 	if config.MinGroupSize < 1 {
-		return fmt.Errorf("MinGroupSize must be at least 1, got %d", config.MinGroupSize)
+		return fmt.Errorf("%w: MinGroupSize must be at least 1, got %d", ErrInvalidConfig, config.MinGroupSize)
 	}
 	if config.MaxPlaceholderRatio < 0 || config.MaxPlaceholderRatio > 1 {
-		return fmt.Errorf("MaxPlaceholderRatio must be between 0 and 1, got %f", config.MaxPlaceholderRatio)
+		return fmt.Errorf("%w: MaxPlaceholderRatio must be between 0 and 1, got %f", ErrInvalidConfig, config.MaxPlaceholderRatio)
 	}
 	if config.MinTemplateTokens < 0 {
-		return fmt.Errorf("MinTemplateTokens must be non-negative, got %d", config.MinTemplateTokens)
+		return fmt.Errorf("%w: MinTemplateTokens must be non-negative, got %d", ErrInvalidConfig, config.MinTemplateTokens)
 	}
 	if config.FreqPercentile < 0 || config.FreqPercentile > 1 {
-		return fmt.Errorf("FreqPercentile must be between 0 and 1, got %f", config.FreqPercentile)
+		return fmt.Errorf("%w: FreqPercentile must be between 0 and 1, got %f", ErrInvalidConfig, config.FreqPercentile)
+	}
+	if config.FreqSketchThreshold < 0 {
+		return fmt.Errorf("%w: FreqSketchThreshold must be non-negative, got %d", ErrInvalidConfig, config.FreqSketchThreshold)
+	}
+	if config.TokenCountTolerance < 0 {
+		return fmt.Errorf("%w: TokenCountTolerance must be non-negative, got %d", ErrInvalidConfig, config.TokenCountTolerance)
+	}
+	if config.LSHBands < 0 || config.LSHRows < 0 {
+		return fmt.Errorf("%w: LSHBands and LSHRows must be positive", ErrInvalidConfig)
+	}
+	if config.EntropyThreshold < 0 {
+		return fmt.Errorf("%w: EntropyThreshold must be non-negative, got %f", ErrInvalidConfig, config.EntropyThreshold)
+	}
+	if config.MaxLineLength < -1 {
+		return fmt.Errorf("%w: MaxLineLength must be positive, or -1 for unlimited, got %d", ErrInvalidConfig, config.MaxLineLength)
+	}
+	if config.MaxTokens < 0 {
+		return fmt.Errorf("%w: MaxTokens must be non-negative, got %d", ErrInvalidConfig, config.MaxTokens)
+	}
+	if config.MaxEventsPerPattern < 0 {
+		return fmt.Errorf("%w: MaxEventsPerPattern must be non-negative, got %d", ErrInvalidConfig, config.MaxEventsPerPattern)
+	}
+	if config.PathMinSegments < 1 {
+		return fmt.Errorf("%w: PathMinSegments must be at least 1, got %d", ErrInvalidConfig, config.PathMinSegments)
+	}
+	if config.SingletonSimilarity < 0 || config.SingletonSimilarity > 1 {
+		return fmt.Errorf("%w: SingletonSimilarity must be between 0 and 1, got %f", ErrInvalidConfig, config.SingletonSimilarity)
+	}
+	if config.ProgressInterval < 0 {
+		return fmt.Errorf("%w: ProgressInterval must be non-negative, got %s", ErrInvalidConfig, config.ProgressInterval)
+	}
+	if config.PatternTTL < 0 || config.PatternTTLLines < 0 || config.DecayHalfLife < 0 {
+		return fmt.Errorf("%w: PatternTTL, PatternTTLLines and DecayHalfLife must be non-negative", ErrInvalidConfig)
+	}
+	if config.Deterministic && (config.PatternTTL > 0 || config.DecayHalfLife > 0) {
+		return fmt.Errorf("%w: PatternTTL and DecayHalfLife depend on wall-clock time and cannot be used with Deterministic", ErrInvalidConfig)
+	}
+	if config.MaxExamplesPerPattern < 0 {
+		return fmt.Errorf("%w: MaxExamplesPerPattern must be positive, got %d", ErrInvalidConfig, config.MaxExamplesPerPattern)
+	}
+	if config.FreqCounting < FreqCountGlobal || config.FreqCounting > FreqCountPositional {
+		return fmt.Errorf("%w: unknown FreqCounting %d", ErrInvalidConfig, config.FreqCounting)
+	}
+	if config.SimilarityStrategy < SimilarityFixed || config.SimilarityStrategy > SimilarityByVariance {
+		return fmt.Errorf("%w: unknown SimilarityStrategy %d", ErrInvalidConfig, config.SimilarityStrategy)
+	}
+	if config.Segmentation < SegmentNone || config.Segmentation > SegmentByField {
+		return fmt.Errorf("%w: unknown Segmentation %d", ErrInvalidConfig, config.Segmentation)
+	}
+	if config.CalendarWords < CalendarWordsAlways || config.CalendarWords > CalendarWordsNever {
+		return fmt.Errorf("%w: unknown CalendarWords %d", ErrInvalidConfig, config.CalendarWords)
+	}
+	if config.Segmentation == SegmentByField && config.SegmentField == "" {
+		return fmt.Errorf("%w: SegmentField is required for SegmentByField", ErrInvalidConfig)
+	}
+	for i, stage := range config.Pipeline {
+		if stage == nil {
+			return fmt.Errorf("%w: Pipeline stage %d is nil", ErrInvalidConfig, i)
+		}
 	}
 
-	// Compile and set HeaderRegex
-	re, err := regexp.Compile(config.HeaderRegex)
+	// Compile everything before changing the parser, so that it is left
+	// unchanged if any regex is invalid
+	headerRegex, err := regexp.Compile(config.HeaderRegex)
 	if err != nil {
-		return fmt.Errorf("invalid HeaderRegex: %v", err)
+		return &RegexError{Field: "HeaderRegex", Pattern: config.HeaderRegex, Err: err}
 	}
-	lp.headerRegex = re
-
-	// Compile and store CustomRegexes
-	lp.customRegexes = make([]*regexp.Regexp, 0, len(config.CustomRegexes))
+	customRegexes := make([]*regexp.Regexp, 0, len(config.CustomRegexes))
 	for _, pattern := range config.CustomRegexes {
 		re, err := regexp.Compile(pattern)
 		if err != nil {
-			return fmt.Errorf("invalid custom regex pattern %s: %v", pattern, err)
+			return &RegexError{Field: "CustomRegexes", Pattern: pattern, Err: err}
 		}
-		lp.customRegexes = append(lp.customRegexes, re)
+		customRegexes = append(customRegexes, re)
+	}
+	brackets, err := compileBrackets(config.Brackets)
+	if err != nil {
+		return err
+	}
+	columns, err := compileColumns(config.ColumnRules)
+	if err != nil {
+		return err
 	}
 
 	// Apply configuration
+	lp.headerRegex = headerRegex
+	lp.customRegexes = customRegexes
+	lp.brackets = brackets
+	lp.columns = columns
+	lp.pathPatterns = pathPatterns(config.PathMinSegments)
 	lp.config = config
 	return nil
 }
@@ -223,94 +423,305 @@ func (lp *AWSOMLP) chooseFreqThreshold(frequency map[string]int, groupSize int)
 	}
 }
 
-// Preprocess performs log event preprocessing
+// Preprocess performs log event preprocessing by running the configured pipeline
+// (header removal, trivial and custom variable masking, tokenization by default).
+// If no stage produced tokens, the final content is split on whitespace.
 func (lp *AWSOMLP) Preprocess(logLine string) *LogEvent {
-	event := &LogEvent{Raw: logLine}
+	event := &LogEvent{Raw: logLine, Content: logLine}
 
-	// Step 1: Header removal
-	content := lp.removeHeader(logLine)
+	for _, stage := range lp.config.Pipeline {
+		stage.Process(lp, event)
+	}
+
+	if event.Tokens == nil {
+		event.Tokens = strings.Fields(event.Content)
+	}
+	event.Segment = lp.segmentOf(event)
 
-	// Step 2: Trivial variable replacement
-	content = lp.replaceTrivialVariables(content)
+	return event
+}
+
+// preprocessLine preprocesses a trimmed input line, truncating it to MaxLineLength first
+// and to MaxTokens after tokenization. The event keeps the complete line as Raw so results
+// stay addressable by the input line.
+func (lp *AWSOMLP) preprocessLine(line string) *LogEvent {
+	event := lp.prepareLine(line)
+	lp.countLimits(event)
+	return event
+}
 
-	event.Content = content
-	event.Tokens = strings.Fields(content)
+// countLimits counts an event cut to MaxLineLength or with more than MaxTokens
+// tokens, reporting the latter to OnOversized
+func (lp *AWSOMLP) countLimits(event *LogEvent) {
+	if lp.config.MaxLineLength > 0 && len(event.Raw) > lp.config.MaxLineLength {
+		lp.truncated++
+	}
+	if event.oversized > 0 {
+		lp.oversized++
+		if lp.config.OnOversized != nil {
+			lp.config.OnOversized(event, event.oversized)
+		}
+	}
+}
 
+// limitTokens truncates an event with more than MaxTokens tokens to its first
+// MaxTokens tokens and a final <*> standing for the rest, unless such lines are
+// rejected, and records its original token count
+func (lp *AWSOMLP) limitTokens(event *LogEvent) *LogEvent {
+	if lp.config.MaxTokens <= 0 || len(event.Tokens) <= lp.config.MaxTokens {
+		return event
+	}
+	event.oversized = len(event.Tokens)
+	if !lp.config.RejectOversized {
+		event.Tokens = append(event.Tokens[:lp.config.MaxTokens:lp.config.MaxTokens], "<*>")
+		event.Content = strings.Join(event.Tokens, " ")
+		event.Truncated = true
+	}
 	return event
 }
 
-// removeHeader removes header from log string
-func (lp *AWSOMLP) removeHeader(logLine string) string {
+// rejected reports whether an event is skipped for having more than MaxTokens tokens
+func (lp *AWSOMLP) rejected(event *LogEvent) bool {
+	return event.oversized > 0 && lp.config.RejectOversized
+}
+
+// prepareLine is preprocessLine without counting truncated lines. It does not
+// modify the parser, so it may run concurrently with learning.
+func (lp *AWSOMLP) prepareLine(line string) *LogEvent {
+	if lp.config.MaxLineLength <= 0 || len(line) <= lp.config.MaxLineLength {
+		return lp.limitTokens(lp.Preprocess(line))
+	}
+
+	// Cut on a rune boundary to avoid producing invalid UTF-8
+	cut := lp.config.MaxLineLength
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+
+	event := lp.Preprocess(line[:cut])
+	event.Raw = line
+	event.Truncated = true
+	return lp.limitTokens(event)
+}
+
+// splitHeader removes header from log string and returns the remaining content
+// together with the header fields captured by named groups. A group named
+// "content" is not reported as a field.
+func (lp *AWSOMLP) splitHeader(logLine string) (string, map[string]string) {
 	if lp.headerRegex == nil {
-		return logLine
+		return logLine, nil
 	}
 
 	matches := lp.headerRegex.FindStringSubmatch(logLine)
-	if len(matches) > 0 {
-		// Assume content is in the last capture group
-		for i := len(matches) - 1; i >= 0; i-- {
-			if matches[i] != "" && matches[i] != logLine {
-				return matches[i]
-			}
+	if len(matches) == 0 {
+		return logLine, nil
+	}
+
+	var fields map[string]string
+	for i, name := range lp.headerRegex.SubexpNames() {
+		if name == "" || name == "content" || matches[i] == "" {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[name] = matches[i]
+	}
+
+	// Assume content is in the last capture group
+	for i := len(matches) - 1; i >= 0; i-- {
+		if matches[i] != "" && matches[i] != logLine {
+			return matches[i], fields
 		}
 	}
-	return logLine
+	return logLine, fields
 }
 
-// replaceTrivialVariables replaces trivial variables with <*>
-func (lp *AWSOMLP) replaceTrivialVariables(content string) string {
-	// Apply global trivial variable patterns
-	for _, re := range trivialVarPatterns {
+// replaceAll replaces matches of every pattern with <*>
+func replaceAll(patterns []*regexp.Regexp, content string) string {
+	for _, re := range patterns {
 		content = re.ReplaceAllString(content, "<*>")
 	}
+	return content
+}
 
-	// Apply custom regexes
-	for _, re := range lp.customRegexes {
+// maskTrivial replaces trivial variables with <*>, masking quoted strings,
+// paths, threads, month and weekday names and bracket contents as configured
+// by MaskQuoted, PathMinSegments, KeepPaths, MaskThreads, CalendarWords and
+// Brackets. Quoted strings and paths are masked first, so that their parts are
+// not masked separately, and bracket contents last.
+// Patterns needing characters the content lacks are skipped; masking only
+// replaces text with <*>, so the features found before the first replacement
+// remain a superset of those of the content.
+func (lp *AWSOMLP) maskTrivial(content string) string {
+	features := scanFeatures(content)
+	if lp.config.MaskQuoted {
+		content = maskQuoted(content)
+	}
+	if !lp.config.KeepPaths {
+		for _, p := range lp.pathPatterns {
+			if features&p.needs == p.needs {
+				content = p.re.ReplaceAllString(content, "<*>")
+			}
+		}
+	}
+	if lp.config.MaskThreads && features&featDigit != 0 {
+		content = maskThreads(content)
+	}
+	for _, p := range trivialVarPatterns {
+		if features&p.needs != p.needs {
+			continue
+		}
+		re := p.re
+		if re == monthNameRegex || re == weekdayNameRegex {
+			switch lp.config.CalendarWords {
+			case CalendarWordsInDates:
+				if re == monthNameRegex {
+					content = calendarDateRegex.ReplaceAllStringFunc(content, maskCalendarNames)
+				}
+				continue
+			case CalendarWordsNever:
+				continue
+			}
+		}
 		content = re.ReplaceAllString(content, "<*>")
 	}
-
+	for _, m := range lp.brackets {
+		content = m.mask(content)
+	}
 	return content
 }
 
-// patternRecognition groups similar log events
-func (lp *AWSOMLP) patternRecognition(events []*LogEvent) {
-	for _, event := range events {
-		matched := false
+// patternRecognition groups similar log events and returns the pattern assigned to each event
+func (lp *AWSOMLP) patternRecognition(events []*LogEvent) []*Pattern {
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
 
-		// Try to find existing pattern
-		for _, pattern := range lp.patterns {
-			if len(pattern.Events) == 0 {
-				continue
+	// In canonical mode events are grouped in a fixed order, so the first event of
+	// each pattern (its representative) no longer depends on the input order
+	if lp.config.Canonical || lp.config.Deterministic {
+		sort.SliceStable(order, func(a, b int) bool {
+			ea, eb := events[order[a]], events[order[b]]
+			if ea.Content != eb.Content {
+				return ea.Content < eb.Content
 			}
+			return ea.Raw < eb.Raw
+		})
+	}
 
-			// Compare with first event in pattern
-			similarity := lp.calculateSimilarity(event, pattern.Events[0])
-
-			// Debug: uncomment for debugging
-			// fmt.Printf("DEBUG: Comparing event '%s' with pattern %d (first event: '%s'), similarity: %.3f, threshold: %.3f\n",
-			//     event.Content, patternIdx, pattern.Events[0].Content, similarity, lp.config.MinSimilarity)
+	progress := lp.startProgress(len(events))
+	assigned := make([]*Pattern, len(events))
+	for _, i := range order {
+		assigned[i] = lp.assignEvent(events[i])
+		progress.step()
+	}
+	progress.end()
 
-			if similarity >= lp.config.MinSimilarity {
-				pattern.Events = append(pattern.Events, event)
-				matched = true
-				// Debug: uncomment for debugging
-				// fmt.Printf("DEBUG: Event matched to pattern %d\n", patternIdx)
-				break
+	// Final pass merging one-off lines into the groups
+	if merged := lp.consolidateSingletons(); merged != nil {
+		for i, pattern := range assigned {
+			if target := merged[pattern]; target != nil {
+				assigned[i] = target
 			}
 		}
+	}
+	return assigned
+}
 
-		// If no suitable pattern found, create new one
-		if !matched {
-			newPattern := &Pattern{
-				ID:        len(lp.patterns),
-				Events:    []*LogEvent{event},
-				Frequency: make(map[string]int),
-			}
-			lp.patterns = append(lp.patterns, newPattern)
-			// Debug: uncomment for debugging
-			// fmt.Printf("DEBUG: Created new pattern %d for event '%s'\n", newPattern.ID, event.Content)
+// assignEvent adds the event to the first similar pattern, creating a new pattern if none matches
+func (lp *AWSOMLP) assignEvent(event *LogEvent) *Pattern {
+	if lp.config.BeforeGroup != nil {
+		lp.config.BeforeGroup(event)
+	}
+
+	pattern, similarity := lp.findPattern(event)
+
+	// If no suitable pattern found, create new one
+	if pattern != nil {
+		lp.recordSimilarity(pattern, similarity)
+	} else {
+		pattern = &Pattern{
+			ID:        lp.nextID,
+			Frequency: make(map[string]int),
+			Segment:   event.Segment,
+		}
+		lp.nextID++
+		lp.patterns = append(lp.patterns, pattern)
+		lp.indexPattern(pattern, len(event.Tokens))
+		lp.indexLSH(pattern, event)
+		// Debug: uncomment for debugging
+		// fmt.Printf("DEBUG: Created new pattern %d for event '%s'\n", pattern.ID, event.Content)
+	}
+
+	lp.addEvent(pattern, event)
+	return pattern
+}
+
+// findPattern returns the first pattern similar enough to the event together with
+// the event's similarity to it, or nil
+func (lp *AWSOMLP) findPattern(event *LogEvent) (*Pattern, float64) {
+	if lp.config.ApproximateGrouping {
+		return lp.findApproximate(event)
+	}
+	if lp.config.BucketByTokenCount {
+		return lp.findBucketed(event)
+	}
+	return lp.findSimilar(lp.patterns, event)
+}
+
+// findSimilar returns the first of the given patterns similar enough to the event
+func (lp *AWSOMLP) findSimilar(patterns []*Pattern, event *LogEvent) (*Pattern, float64) {
+	for _, pattern := range patterns {
+		if len(pattern.Events) == 0 || pattern.Segment != event.Segment {
+			continue
+		}
+
+		// Compare with first event in pattern
+		similarity := lp.calculateSimilarity(event, pattern.Events[0])
+
+		// Debug: uncomment for debugging
+		// fmt.Printf("DEBUG: Comparing event '%s' with pattern %d (first event: '%s'), similarity: %.3f, threshold: %.3f\n",
+		//     event.Content, pattern.ID, pattern.Events[0].Content, similarity, lp.similarityThreshold(pattern))
+
+		if similarity >= lp.similarityThreshold(pattern) {
+			return pattern, similarity
 		}
 	}
+	return nil, 0
+}
+
+// addEvent assigns an event to a pattern and updates the pattern's token frequencies.
+// The event itself is only retained while the pattern holds fewer than MaxEventsPerPattern events.
+func (lp *AWSOMLP) addEvent(pattern *Pattern, event *LogEvent) {
+	event.PatternID = pattern.ID
+	event.seq = lp.lines
+	if lp.config.MaxEventsPerPattern == 0 || len(pattern.Events) < lp.config.MaxEventsPerPattern {
+		pattern.Events = append(pattern.Events, event)
+	}
+	pattern.Count++
+	lp.lines++
+	lp.touch(pattern)
+	lp.sampleExample(pattern, event.Raw)
+	for _, token := range event.Tokens {
+		lp.countToken(pattern, token)
+	}
+	if lp.config.FreqCounting == FreqCountPositional {
+		lp.countPositions(pattern, event.Tokens)
+	}
+}
+
+// sampleExample keeps a uniform sample of the pattern's raw lines using reservoir
+// sampling; pattern.Count must already include the new line
+func (lp *AWSOMLP) sampleExample(pattern *Pattern, raw string) {
+	if len(pattern.Examples) < lp.config.MaxExamplesPerPattern {
+		pattern.Examples = append(pattern.Examples, raw)
+		return
+	}
+	if i := lp.rng.IntN(pattern.Count); i < len(pattern.Examples) {
+		pattern.Examples[i] = raw
+	}
 }
 
 // calculateSimilarity calculates similarity between two log events
@@ -402,7 +813,8 @@ func (lp *AWSOMLP) isAlphabeticalToken(token string) bool {
 }
 
 // sortEventsInPattern sorts events in pattern according to the configured strategy
-func (lp *AWSOMLP) sortEventsInPattern(events []*LogEvent) []*LogEvent {
+func (lp *AWSOMLP) sortEventsInPattern(pattern *Pattern) []*LogEvent {
+	events := pattern.Events
 	switch lp.config.SortingStrategy {
 	case SortByLength:
 		return lp.sortByLength(events)
@@ -410,6 +822,12 @@ func (lp *AWSOMLP) sortEventsInPattern(events []*LogEvent) []*LogEvent {
 		return lp.sortLexically(events)
 	case SortByDynTokens:
 		return lp.sortByDynamicTokenCount(events)
+	case SortByMostTokens:
+		return sortByMostTokens(events)
+	case SortByMedianLength:
+		return sortByMedianLength(events)
+	case SortByStaticRatio:
+		return sortByStaticRatio(pattern)
 	default: // SortNone
 		return events
 	}
@@ -425,8 +843,11 @@ func (lp *AWSOMLP) sortByLength(events []*LogEvent) []*LogEvent {
 		if len(sorted[i].Tokens) != len(sorted[j].Tokens) {
 			return len(sorted[i].Tokens) < len(sorted[j].Tokens)
 		}
-		// Secondary sort by content for determinism
-		return sorted[i].Content < sorted[j].Content
+		// Secondary sort by content and raw string for determinism
+		if sorted[i].Content != sorted[j].Content {
+			return sorted[i].Content < sorted[j].Content
+		}
+		return sorted[i].Raw < sorted[j].Raw
 	})
 
 	return sorted
@@ -472,69 +893,171 @@ func (lp *AWSOMLP) sortByDynamicTokenCount(events []*LogEvent) []*LogEvent {
 		if dynCount1 != dynCount2 {
 			return dynCount1 < dynCount2
 		}
-		// Secondary sort by content for determinism
-		return sorted[i].Content < sorted[j].Content
+		// Secondary sort by content and raw string for determinism
+		if sorted[i].Content != sorted[j].Content {
+			return sorted[i].Content < sorted[j].Content
+		}
+		return sorted[i].Raw < sorted[j].Raw
 	})
 
 	return sorted
 }
 
-// frequencyAnalysis applies frequency analysis to each pattern
-func (lp *AWSOMLP) frequencyAnalysis() {
-	for _, pattern := range lp.patterns {
-		if len(pattern.Events) == 0 {
-			continue
+// sortByMostTokens sorts events by the number of tokens (descending), so the
+// most detailed line is the representative
+func sortByMostTokens(events []*LogEvent) []*LogEvent {
+	sorted := make([]*LogEvent, len(events))
+	copy(sorted, events)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i].Tokens) != len(sorted[j].Tokens) {
+			return len(sorted[i].Tokens) > len(sorted[j].Tokens)
+		}
+		if sorted[i].Content != sorted[j].Content {
+			return sorted[i].Content < sorted[j].Content
+		}
+		return sorted[i].Raw < sorted[j].Raw
+	})
+
+	return sorted
+}
+
+// sortByMedianLength sorts events by the distance of their number of tokens
+// from the median of the pattern, so a typical line is the representative
+// rather than an outlier
+func sortByMedianLength(events []*LogEvent) []*LogEvent {
+	sorted := make([]*LogEvent, len(events))
+	copy(sorted, events)
+	if len(sorted) == 0 {
+		return sorted
+	}
+
+	lengths := make([]int, len(sorted))
+	for i, event := range sorted {
+		lengths[i] = len(event.Tokens)
+	}
+	sort.Ints(lengths)
+	median := lengths[(len(lengths)-1)/2]
+	distance := func(event *LogEvent) int {
+		if len(event.Tokens) < median {
+			return median - len(event.Tokens)
 		}
+		return len(event.Tokens) - median
+	}
 
-		// For small groups: apply frequency analysis based on configuration
-		if len(pattern.Events) < lp.config.MinGroupSize && !lp.config.ApplyFreqAnalysisToSmallGroups {
-			// Sort events in pattern if sorting strategy is enabled
-			if lp.config.SortingStrategy != SortNone {
-				pattern.Events = lp.sortEventsInPattern(pattern.Events)
-			}
+	sort.Slice(sorted, func(i, j int) bool {
+		if d1, d2 := distance(sorted[i]), distance(sorted[j]); d1 != d2 {
+			return d1 < d2
+		}
+		if len(sorted[i].Tokens) != len(sorted[j].Tokens) {
+			return len(sorted[i].Tokens) < len(sorted[j].Tokens)
+		}
+		if sorted[i].Content != sorted[j].Content {
+			return sorted[i].Content < sorted[j].Content
+		}
+		return sorted[i].Raw < sorted[j].Raw
+	})
 
-			// Use preprocessed content of first event as template
-			pattern.Template = pattern.Events[0].Content
+	return sorted
+}
 
-			// Apply template to all events in the group
-			for _, event := range pattern.Events {
-				event.Template = pattern.Template
-			}
+// sortByStaticRatio sorts the events of a pattern by the share of their tokens
+// that are static, occurring as often as the pattern has lines (descending),
+// so the representative carries the fewest variables
+func sortByStaticRatio(pattern *Pattern) []*LogEvent {
+	sorted := make([]*LogEvent, len(pattern.Events))
+	copy(sorted, pattern.Events)
+
+	ratios := make(map[*LogEvent]float64, len(sorted))
+	for _, event := range sorted {
+		if len(event.Tokens) == 0 {
 			continue
 		}
+		static := 0
+		for _, token := range event.Tokens {
+			if token == "<*>" || pattern.tokenFrequency(token) >= pattern.Count {
+				static++
+			}
+		}
+		ratios[event] = float64(static) / float64(len(event.Tokens))
+	}
 
-		// For large groups: apply full frequency analysis
+	sort.Slice(sorted, func(i, j int) bool {
+		if ratios[sorted[i]] != ratios[sorted[j]] {
+			return ratios[sorted[i]] > ratios[sorted[j]]
+		}
+		if sorted[i].Content != sorted[j].Content {
+			return sorted[i].Content < sorted[j].Content
+		}
+		return sorted[i].Raw < sorted[j].Raw
+	})
+
+	return sorted
+}
+
+// frequencyAnalysis applies frequency analysis to each pattern
+func (lp *AWSOMLP) frequencyAnalysis() {
+	for _, pattern := range lp.patterns {
+		lp.analyzePattern(pattern)
+	}
+}
+
+// analyzePattern generates the template of a single pattern from its token frequencies
+func (lp *AWSOMLP) analyzePattern(pattern *Pattern) {
+	if len(pattern.Events) == 0 {
+		return
+	}
+
+	// For small groups: apply frequency analysis based on configuration
+	if pattern.Count < lp.config.MinGroupSize && !lp.config.ApplyFreqAnalysisToSmallGroups {
 		// Sort events in pattern if sorting strategy is enabled
 		if lp.config.SortingStrategy != SortNone {
-			pattern.Events = lp.sortEventsInPattern(pattern.Events)
+			pattern.Events = lp.sortEventsInPattern(pattern)
 		}
 
-		// Count frequency of each token in the group
-		pattern.Frequency = make(map[string]int)
+		// Use preprocessed content of first event as template
+		pattern.Template = pattern.Events[0].Content
+
+		// Apply template to all events in the group
 		for _, event := range pattern.Events {
-			for _, token := range event.Tokens {
-				pattern.Frequency[token]++
-			}
+			event.Template = pattern.Template
 		}
+		return
+	}
+
+	// For large groups: apply full frequency analysis
+	// Sort events in pattern if sorting strategy is enabled
+	if lp.config.SortingStrategy != SortNone {
+		pattern.Events = lp.sortEventsInPattern(pattern)
+	}
 
+	// Token frequencies are counted while grouping (see addEvent)
+	var template string
+	if lp.config.FreqCounting == FreqCountPositional && len(pattern.PositionFrequency) > 0 {
+		template = lp.generatePositionalTemplate(pattern)
+	} else {
 		// Frequency threshold: calculate based on configured strategy
-		freqThreshold := lp.chooseFreqThreshold(pattern.Frequency, len(pattern.Events))
+		frequency := lp.representativeFrequency(pattern)
+		freqThreshold := lp.chooseFreqThreshold(frequency, pattern.Count)
 
 		// Generate template based on frequency using first event (potentially sorted)
-		template := lp.generateTemplate(pattern.Events[0], pattern.Frequency, freqThreshold)
+		template = lp.generateTemplate(pattern.Events[0], frequency, freqThreshold)
+	}
 
-		// Check if template has too many placeholders - if so, use simpler template
-		if lp.hasExcessivePlaceholders(template) {
-			// Fallback to preprocessed content
-			template = pattern.Events[0].Content
-		}
+	// Positions whose tokens vary a lot are variables even if each value is frequent
+	template = lp.maskHighEntropy(pattern, template)
 
-		pattern.Template = template
+	// Check if template has too many placeholders - if so, use simpler template
+	if lp.hasExcessivePlaceholders(template) {
+		// Fallback to preprocessed content
+		template = pattern.Events[0].Content
+	}
 
-		// Apply template to all events in the group
-		for _, event := range pattern.Events {
-			event.Template = pattern.Template
-		}
+	pattern.Template = template
+
+	// Apply template to all events in the group
+	for _, event := range pattern.Events {
+		event.Template = pattern.Template
 	}
 }
 
@@ -578,63 +1101,100 @@ func (lp *AWSOMLP) generateTemplate(event *LogEvent, frequency map[string]int, f
 // replaceRemainingNumericalVariables replaces remaining numerical variables
 func (lp *AWSOMLP) replaceRemainingNumericalVariables() {
 	for _, pattern := range lp.patterns {
-		for _, re := range numericalPatterns {
-			// Replace in template
-			pattern.Template = re.ReplaceAllStringFunc(pattern.Template, func(match string) string {
-				// Preserve spaces/brackets
-				prefix := ""
-				suffix := ""
-				content := match
-
-				if strings.HasPrefix(match, " ") {
-					prefix = " "
-					content = content[1:]
-				}
-				if strings.HasSuffix(match, " ") {
-					suffix = " "
-					content = content[:len(content)-1]
-				}
-				if strings.HasPrefix(content, "(") && strings.HasSuffix(content, ")") {
-					return "(<*>)"
-				}
-				if strings.HasPrefix(content, "[") && strings.HasSuffix(content, "]") {
-					return "[<*>]"
-				}
+		lp.replacePatternNumericalVariables(pattern)
+	}
+}
 
-				return prefix + "<*>" + suffix
-			})
-		}
+// replacePatternNumericalVariables replaces remaining numerical variables in a single pattern
+func (lp *AWSOMLP) replacePatternNumericalVariables(pattern *Pattern) {
+	// Every numerical pattern contains a digit
+	numerical := numericalPatterns
+	if scanFeatures(pattern.Template)&featDigit == 0 {
+		numerical = nil
+	}
+	for _, re := range numerical {
+		// Replace in template
+		pattern.Template = re.ReplaceAllStringFunc(pattern.Template, func(match string) string {
+			// Preserve spaces/brackets
+			prefix := ""
+			suffix := ""
+			content := match
+
+			if strings.HasPrefix(match, " ") {
+				prefix = " "
+				content = content[1:]
+			}
+			if strings.HasSuffix(match, " ") {
+				suffix = " "
+				content = content[:len(content)-1]
+			}
+			if strings.HasPrefix(content, "(") && strings.HasSuffix(content, ")") {
+				return "(<*>)"
+			}
+			if strings.HasPrefix(content, "[") && strings.HasSuffix(content, "]") {
+				return "[<*>]"
+			}
 
-		// Update templates for all events in pattern
-		for _, event := range pattern.Events {
-			event.Template = pattern.Template
-		}
+			return prefix + "<*>" + suffix
+		})
+	}
+
+	if lp.config.AfterTemplate != nil {
+		lp.config.AfterTemplate(pattern)
+	}
+
+	// Update templates for all events in pattern
+	for _, event := range pattern.Events {
+		event.Template = pattern.Template
 	}
 }
 
-// Parse performs complete parsing process
+// Parse performs complete parsing process and maps every distinct line to its
+// template. Duplicate lines share an entry; ParseToResults keeps one per line.
 func (lp *AWSOMLP) Parse(logLines []string) map[string]string {
-	// Input validation
-	if logLines == nil {
-		return make(map[string]string)
+	// Return results - every log must have a result
+	results := make(map[string]string)
+	for _, event := range lp.ParseEvents(logLines) {
+		results[event.Raw] = event.Template
 	}
 
+	return results
+}
+
+// ParseEvents performs complete parsing process and returns the processed events
+// in input order, skipping empty lines and lines rejected by RejectOversized. Each
+// event carries its final template and the ID of the pattern it was assigned to.
+func (lp *AWSOMLP) ParseEvents(logLines []string) []*LogEvent {
+	events, _ := lp.parseEvents(logLines)
+	return events
+}
+
+// ParseToResults performs complete parsing process like ParseEvents and returns
+// one result per parsed line in input order. Unlike Parse, duplicate lines keep
+// a result each, and every result holds the position of its line in logLines,
+// so results can be joined back to the input although empty lines and lines
+// rejected by RejectOversized are skipped.
+func (lp *AWSOMLP) ParseToResults(logLines []string) []ParseResult {
+	_, results := lp.parseEvents(logLines)
+	return results
+}
+
+// parseEvents parses a batch of lines and returns the events with their results
+func (lp *AWSOMLP) parseEvents(logLines []string) ([]*LogEvent, []ParseResult) {
 	// Step 1: Preprocessing
 	events := make([]*LogEvent, 0, len(logLines))
-	for _, line := range logLines {
+	indexes := make([]int, 0, len(logLines))
+	for i, line := range logLines {
 		if line = strings.TrimSpace(line); line != "" {
-			// Limit individual line length to prevent ReDoS attacks
-			const maxLineLength = 10000 // 10KB per line
-			if len(line) > maxLineLength {
-				line = line[:maxLineLength]
+			if event := lp.preprocessLine(line); !lp.rejected(event) {
+				events = append(events, event)
+				indexes = append(indexes, i)
 			}
-			event := lp.Preprocess(line)
-			events = append(events, event)
 		}
 	}
 
 	// Step 2: Pattern recognition
-	lp.patternRecognition(events)
+	assigned := lp.patternRecognition(events)
 
 	// Step 3: Frequency analysis
 	lp.frequencyAnalysis()
@@ -642,21 +1202,65 @@ func (lp *AWSOMLP) Parse(logLines []string) map[string]string {
 	// Step 4: Replace remaining numerical variables
 	lp.replaceRemainingNumericalVariables()
 
-	// Return results - every log must have a result
-	results := make(map[string]string)
-	for _, event := range events {
-		template := strings.TrimSpace(event.Template)
-		if template == "" {
-			// Fallback to preprocessed content if no template was generated
-			template = strings.TrimSpace(event.Content)
-			if template == "" {
-				template = strings.TrimSpace(event.Raw) // Ultimate fallback
-			}
+	results := make([]ParseResult, len(events))
+	for i, event := range events {
+		// Events beyond MaxEventsPerPattern are not retained, so take the template from the pattern
+		results[i] = lp.result(indexes[i], event, assigned[i])
+		event.Template = results[i].Template
+	}
+
+	lp.expire()
+	return events, results
+}
+
+// ParseChunked parses lines read from r in windows of chunkSize lines. After each
+// window is folded into the model, per-event data is discarded and only token
+// frequencies, event counts and one representative event per pattern are kept,
+// so memory stays proportional to the number of templates rather than lines.
+// It returns the number of lines assigned to each final template.
+func (lp *AWSOMLP) ParseChunked(r io.Reader, chunkSize int) (map[string]int, error) {
+	if chunkSize < 1 {
+		return nil, fmt.Errorf("%w: chunk size must be at least 1, got %d", ErrInvalidConfig, chunkSize)
+	}
+
+	// Chunks add their lines to the progress of the whole stream
+	progress := lp.startProgress(0)
+	defer progress.end()
+
+	reader := bufio.NewReader(r)
+	window := make([]string, 0, chunkSize)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			window = append(window, line)
+		}
+		if len(window) == chunkSize || (err != nil && len(window) > 0) {
+			lp.Parse(window)
+			lp.discardEvents()
+			window = window[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
 		}
-		results[event.Raw] = template
 	}
 
-	return results
+	counts := make(map[string]int)
+	for _, tc := range lp.GetTemplatesByFrequency() {
+		counts[tc.Template] = tc.Count
+	}
+	return counts, nil
+}
+
+// discardEvents drops retained events, keeping only the representative event of each pattern
+func (lp *AWSOMLP) discardEvents() {
+	for _, pattern := range lp.patterns {
+		if len(pattern.Events) > 1 {
+			pattern.Events = []*LogEvent{pattern.Events[0]}
+		}
+	}
 }
 
 // GetTemplates returns all unique templates
@@ -699,7 +1303,80 @@ func (lp *AWSOMLP) isValidTemplate(template string) bool {
 	return realTokens >= lp.config.MinTemplateTokens
 }
 
-// GetPatterns returns all patterns with their statistics
+// TruncatedLines returns the number of lines truncated to MaxLineLength so far
+func (lp *AWSOMLP) TruncatedLines() int {
+	return lp.truncated
+}
+
+// OversizedLines returns the number of lines with more than MaxTokens tokens
+// so far, truncated or rejected
+func (lp *AWSOMLP) OversizedLines() int {
+	return lp.oversized
+}
+
+// GetPatterns returns all patterns with their statistics. These are the
+// parser's own patterns, not copies: modifying them corrupts the model, and
+// they must not be read while Feed, Recluster or another locked method runs.
+// Snapshot returns copies that are safe in both respects.
 func (lp *AWSOMLP) GetPatterns() []*Pattern {
 	return lp.patterns
 }
+
+// GetPatternsSorted returns a copy of the patterns slice in the given order.
+// Ties are broken by pattern ID, i.e. by first appearance.
+func (lp *AWSOMLP) GetPatternsSorted(by PatternOrder) []*Pattern {
+	patterns := make([]*Pattern, len(lp.patterns))
+	copy(patterns, lp.patterns)
+
+	var weights map[*Pattern]float64
+	if by == OrderByWeight {
+		weights = make(map[*Pattern]float64, len(patterns))
+		for _, pattern := range patterns {
+			weights[pattern] = lp.PatternWeight(pattern)
+		}
+	}
+
+	sort.SliceStable(patterns, func(i, j int) bool {
+		switch by {
+		case OrderByCount:
+			if patterns[i].Count != patterns[j].Count {
+				return patterns[i].Count > patterns[j].Count
+			}
+		case OrderBySize:
+			if len(patterns[i].Events) != len(patterns[j].Events) {
+				return len(patterns[i].Events) > len(patterns[j].Events)
+			}
+		case OrderByWeight:
+			if weights[patterns[i]] != weights[patterns[j]] {
+				return weights[patterns[i]] > weights[patterns[j]]
+			}
+		}
+		return patterns[i].ID < patterns[j].ID
+	})
+	return patterns
+}
+
+// GetTemplatesByFrequency returns every template with the number of lines it
+// covers, most frequent first and then alphabetically. Patterns sharing a
+// template are counted together.
+func (lp *AWSOMLP) GetTemplatesByFrequency() []TemplateCount {
+	counts := make(map[string]int)
+	for _, pattern := range lp.patterns {
+		if len(pattern.Events) == 0 {
+			continue
+		}
+		counts[lp.result(0, pattern.Events[0], pattern).Template] += pattern.Count
+	}
+
+	templates := make([]TemplateCount, 0, len(counts))
+	for template, count := range counts {
+		templates = append(templates, TemplateCount{Template: template, Count: count})
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Count != templates[j].Count {
+			return templates[i].Count > templates[j].Count
+		}
+		return templates[i].Template < templates[j].Template
+	})
+	return templates
+}
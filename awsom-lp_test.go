@@ -1,10 +1,23 @@
 package awsomlp
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Test data
@@ -64,6 +77,29 @@ func TestNewAWSOMLP(t *testing.T) {
 	}
 }
 
+func TestMaskPatternFeatures(t *testing.T) {
+	lines := []string{
+		"Connection from 192.168.1.10:8080 closed",
+		"Reading /var/log/app/server.log failed",
+		"Copy C:\\Users\\admin\\file.txt to D:\\backup\\data",
+		"Request 550e8400-e29b-41d4-a716-446655440000 done",
+		"Started at 2024-01-15T10:30:15.123Z on Mon",
+		"Jan 15 10:30:15 host sshd: session opened",
+		"Mail to admin@example.com via https://example.com/api",
+		"MAC aa:bb:cc:dd:ee:ff seen, hash deadbeefdeadbeefdeadbeefdeadbeef",
+		"worker (idle) finished at 10:30:15",
+		"no variables here at all",
+	}
+	for _, line := range lines {
+		features := scanFeatures(line)
+		for _, p := range trivialVarPatterns {
+			if features&p.needs != p.needs && p.re.MatchString(line) {
+				t.Errorf("pattern %s matches %q but is skipped by its features", p.re, line)
+			}
+		}
+	}
+}
+
 func TestDefaultConfig(t *testing.T) {
 	config := DefaultConfig()
 
@@ -395,6 +431,9 @@ func TestSortingStrategies(t *testing.T) {
 		{"SortByLength", SortByLength},
 		{"SortLexical", SortLexical},
 		{"SortByDynTokens", SortByDynTokens},
+		{"SortByMostTokens", SortByMostTokens},
+		{"SortByMedianLength", SortByMedianLength},
+		{"SortByStaticRatio", SortByStaticRatio},
 	}
 
 	for _, s := range strategies {
@@ -425,6 +464,148 @@ func TestSortingStrategies(t *testing.T) {
 	}
 }
 
+// TestCrossValidate tests the stability report of independently parsed folds
+func TestCrossValidate(t *testing.T) {
+	var lines []string
+	for i := range 12 {
+		lines = append(lines, fmt.Sprintf("Connection from 10.0.0.%d closed", i), fmt.Sprintf("User %d logged in", 1000+i))
+	}
+
+	parser := NewAWSOMLP()
+	stability, err := parser.CrossValidate(lines, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stability.Folds) != 3 || stability.Folds[0].Lines != 8 || stability.Folds[0].Templates != 2 {
+		t.Errorf("Expected 3 folds of 8 lines and 2 templates, got %+v", stability.Folds)
+	}
+	if stability.MeanJaccard != 1 || stability.MinJaccard != 1 || stability.TemplateVariance != 0 || stability.CountVariation != 0 {
+		t.Errorf("Expected perfectly stable folds, got %+v", stability)
+	}
+	if stability.Shared != 2 || stability.Templates != 2 {
+		t.Errorf("Expected 2 templates shared by all folds, got %d of %d", stability.Shared, stability.Templates)
+	}
+	if len(parser.GetPatterns()) != 0 {
+		t.Error("Expected the model of the parser to be unchanged")
+	}
+
+	// A template of one fold only lowers the similarity of its pairs
+	stability, err = parser.CrossValidate(append(lines[:6:6], "Disk full"), 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stability.Templates != 3 || stability.Shared != 2 || stability.MinJaccard != 2.0/3 || stability.CountVariation == 0 {
+		t.Errorf("Expected an unstable third template, got %+v", stability)
+	}
+
+	if _, err := parser.CrossValidate(lines, 1); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for a single fold, got %v", err)
+	}
+}
+
+// TestRecluster tests moving recent lines of changed wording to their own template
+func TestRecluster(t *testing.T) {
+	parser := NewAWSOMLP()
+	if _, err := parser.Recluster(0); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for a zero window, got %v", err)
+	}
+
+	for i := range 50 {
+		parser.Feed(fmt.Sprintf("User %d logged in from web", i))
+	}
+	for i := range 30 {
+		parser.Feed(fmt.Sprintf("User %d signed in from web", i))
+	}
+	if patterns := parser.GetPatterns(); len(patterns) != 1 {
+		t.Fatalf("Expected the changed wording to be absorbed by similarity, got %d patterns", len(patterns))
+	}
+
+	// The window also holds lines of the old wording, which stay
+	moved, err := parser.Recluster(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 30 {
+		t.Errorf("Expected 30 moved lines, got %d", moved)
+	}
+	counts := make(map[string]int)
+	for _, tc := range parser.GetTemplatesByFrequency() {
+		counts[tc.Template] = tc.Count
+	}
+	expected := map[string]int{"User <*> logged in from web": 50, "User <*> signed in from web": 30}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected templates %v, got %v", expected, counts)
+	}
+	for _, pattern := range parser.GetPatterns() {
+		for _, event := range pattern.Events {
+			if event.PatternID != pattern.ID || event.Template != pattern.Template {
+				t.Fatalf("Event %q not updated: pattern %d %q", event.Raw, event.PatternID, event.Template)
+			}
+		}
+	}
+
+	// New lines of the changed wording join the existing pattern on the next run
+	parser.Feed("User 99 signed in from web")
+	if moved, _ := parser.Recluster(40); moved != 1 {
+		t.Errorf("Expected 1 moved line, got %d", moved)
+	}
+	if moved, _ := parser.Recluster(40); moved != 0 {
+		t.Errorf("Expected a stable model, got %d moved lines", moved)
+	}
+	if len(parser.GetPatterns()) != 2 {
+		t.Errorf("Expected 2 patterns, got %d", len(parser.GetPatterns()))
+	}
+}
+
+// TestRepresentativeSelection tests that the sorting strategies pick the
+// representative the template is generated from
+func TestRepresentativeSelection(t *testing.T) {
+	lines := []string{
+		"session opened for user",
+		"session a1 b2 c3 opened for user",
+		"session q9 opened for user",
+		"session a1 opened for user",
+		"session opened for user",
+	}
+	tests := []struct {
+		strategy SortingStrategy
+		expected string
+	}{
+		{SortNone, "session opened for user"},
+		{SortByMostTokens, "session a1 b2 c3 opened for user"},
+		{SortByMedianLength, "session a1 opened for user"},
+		{SortByStaticRatio, "session opened for user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy.String(), func(t *testing.T) {
+			parser := NewAWSOMLP()
+			if err := parser.WithConfig(Config{SortingStrategy: tt.strategy}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			parser.Parse(lines)
+
+			patterns := parser.GetPatterns()
+			if len(patterns) != 1 {
+				t.Fatalf("Expected 1 pattern, got %d", len(patterns))
+			}
+			if patterns[0].Template != tt.expected {
+				t.Errorf("Expected template %q, got %q", tt.expected, patterns[0].Template)
+			}
+		})
+	}
+
+	// The static ratio also holds for a sketch of the token frequencies
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{SortingStrategy: SortByStaticRatio, FreqSketchThreshold: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	parser.Parse(lines[1:4])
+	if template := parser.GetPatterns()[0].Template; template != "session a1 opened for user" {
+		t.Errorf("Expected template %q with a sketch, got %q", "session a1 opened for user", template)
+	}
+}
+
 func TestEmptyInput(t *testing.T) {
 	parser := NewAWSOMLP()
 
@@ -634,6 +815,12 @@ func (s SortingStrategy) String() string {
 		return "SortLexical"
 	case SortByDynTokens:
 		return "SortByDynTokens"
+	case SortByMostTokens:
+		return "SortByMostTokens"
+	case SortByMedianLength:
+		return "SortByMedianLength"
+	case SortByStaticRatio:
+		return "SortByStaticRatio"
 	default:
 		return "Unknown"
 	}
@@ -1385,3 +1572,3406 @@ func TestNewConfigValidation(t *testing.T) {
 		})
 	}
 }
+
+// TestSentinelErrors verifies that configuration errors can be classified with errors.Is/As
+func TestSentinelErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  Config
+		target  error
+		isRegex bool
+	}{
+		{
+			name:   "Out of range MinSimilarity",
+			config: Config{MinSimilarity: 2},
+			target: ErrInvalidConfig,
+		},
+		{
+			name:   "Out of range FreqPercentile",
+			config: Config{FreqPercentile: -1},
+			target: ErrInvalidConfig,
+		},
+		{
+			name:    "Invalid HeaderRegex",
+			config:  Config{HeaderRegex: "(unclosed"},
+			target:  ErrRegexCompile,
+			isRegex: true,
+		},
+		{
+			name:    "Invalid CustomRegex",
+			config:  Config{CustomRegexes: []string{"[bad"}},
+			target:  ErrRegexCompile,
+			isRegex: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewAWSOMLP().WithConfig(tc.config)
+			if !errors.Is(err, tc.target) {
+				t.Fatalf("Expected error matching %v, got %v", tc.target, err)
+			}
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("Expected every configuration error to match ErrInvalidConfig, got %v", err)
+			}
+
+			var regexErr *RegexError
+			if errors.As(err, &regexErr) != tc.isRegex {
+				t.Errorf("errors.As(*RegexError) = %v, want %v", !tc.isRegex, tc.isRegex)
+			}
+			if tc.isRegex && regexErr.Pattern == "" {
+				t.Error("RegexError should carry the offending pattern")
+			}
+		})
+	}
+}
+
+// TestMaxLineLength tests configurable line truncation and its bookkeeping
+func TestMaxLineLength(t *testing.T) {
+	longLine := "Payload received " + strings.Repeat("x", 200) + " end"
+
+	testCases := []struct {
+		name          string
+		maxLineLength int
+		wantTruncated bool
+	}{
+		{name: "Truncate long line", maxLineLength: 50, wantTruncated: true},
+		{name: "Unlimited", maxLineLength: -1, wantTruncated: false},
+		{name: "Limit above line length", maxLineLength: 1000, wantTruncated: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parser := NewAWSOMLP()
+			config := DefaultConfig()
+			config.MaxLineLength = tc.maxLineLength
+			if err := parser.WithConfig(config); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			results := parser.Parse([]string{longLine})
+			if _, ok := results[longLine]; !ok {
+				t.Fatalf("Result should be keyed by the complete input line, got %v", results)
+			}
+
+			event := parser.GetPatterns()[0].Events[0]
+			if event.Truncated != tc.wantTruncated {
+				t.Errorf("Expected Truncated=%v, got %v", tc.wantTruncated, event.Truncated)
+			}
+			if tc.wantTruncated {
+				if len(event.Content) > tc.maxLineLength {
+					t.Errorf("Content length %d exceeds MaxLineLength %d", len(event.Content), tc.maxLineLength)
+				}
+				if parser.TruncatedLines() != 1 {
+					t.Errorf("Expected 1 truncated line, got %d", parser.TruncatedLines())
+				}
+			} else if !strings.Contains(results[longLine], "end") {
+				t.Errorf("Untruncated template lost the line ending: %s", results[longLine])
+			}
+		})
+	}
+
+	// Zero is replaced by the default like other numeric fields
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaxLineLength: 0}); err != nil || parser.config.MaxLineLength != DefaultConfig().MaxLineLength {
+		t.Errorf("Expected the default MaxLineLength for 0, got %d, %v", parser.config.MaxLineLength, err)
+	}
+	if err := NewAWSOMLP().WithConfig(Config{MaxLineLength: -2}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for MaxLineLength below -1, got %v", err)
+	}
+}
+
+func TestMaxTokens(t *testing.T) {
+	dump := "values " + strings.Repeat("a ", 1000) + "end"
+	lines := []string{dump, "values " + strings.Repeat("b ", 2000) + "end", "Service started"}
+
+	var reported []int
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaxTokens: 5, OnOversized: func(event *LogEvent, tokens int) {
+		reported = append(reported, tokens)
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	events := parser.ParseEvents(lines)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	if want := "values a a a a <*>"; events[0].Content != want || len(events[0].Tokens) != 6 || !events[0].Truncated {
+		t.Errorf("Expected the first 5 tokens and a final placeholder, got %q (%d tokens, truncated %v)", events[0].Content, len(events[0].Tokens), events[0].Truncated)
+	}
+	if events[0].Raw != dump {
+		t.Error("Expected the raw line to be kept")
+	}
+	if events[2].Truncated {
+		t.Error("Expected a short line not to be truncated")
+	}
+	if !reflect.DeepEqual(reported, []int{1002, 2002}) || parser.OversizedLines() != 2 || parser.TruncatedLines() != 0 {
+		t.Errorf("Expected 2 oversized lines of 1002 and 2002 tokens, got %v, %d (%d truncated)", reported, parser.OversizedLines(), parser.TruncatedLines())
+	}
+
+	// Rejected lines are skipped like blank lines
+	parser = NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaxTokens: 5, RejectOversized: true}); err != nil {
+		t.Fatal(err)
+	}
+	if events := parser.ParseEvents(lines); len(events) != 1 || events[0].Raw != "Service started" {
+		t.Errorf("Expected only the short line, got %d events", len(events))
+	}
+	if _, ok := parser.Feed(dump); ok {
+		t.Error("Expected Feed to reject an oversized line")
+	}
+	if _, err := parser.Freeze().MatchLine(dump); !errors.Is(err, ErrUnmatchedLine) || !strings.Contains(err.Error(), "exceeds MaxTokens") {
+		t.Errorf("Expected MatchLine to reject an oversized line for exceeding MaxTokens, got %v", err)
+	}
+	if len(parser.GetPatterns()) != 1 || parser.OversizedLines() != 3 {
+		t.Errorf("Expected 1 pattern and 3 oversized lines, got %d and %d", len(parser.GetPatterns()), parser.OversizedLines())
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{MaxTokens: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative MaxTokens, got %v", err)
+	}
+}
+
+// TestParseChunked verifies that chunked parsing matches full parsing while discarding events
+func TestParseChunked(t *testing.T) {
+	logs := append(append([]string{}, hdfsTestLogs...), paperComplianceTestLogs...)
+
+	full := NewAWSOMLP()
+	full.WithConfig(Config{HeaderRegex: HDFSHeaderRegex})
+	full.Parse(logs)
+
+	chunked := NewAWSOMLP()
+	chunked.WithConfig(Config{HeaderRegex: HDFSHeaderRegex})
+	counts, err := chunked.ParseChunked(strings.NewReader(strings.Join(logs, "\n")), 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(full.GetTemplates(), chunked.GetTemplates()) {
+		t.Errorf("Chunked templates differ from full parse.\nFull: %v\nChunked: %v", full.GetTemplates(), chunked.GetTemplates())
+	}
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if total != len(logs) {
+		t.Errorf("Expected counts to cover %d lines, got %d (%v)", len(logs), total, counts)
+	}
+
+	for _, pattern := range chunked.GetPatterns() {
+		if len(pattern.Events) > 1 {
+			t.Errorf("Pattern %d retained %d events, expected only the representative", pattern.ID, len(pattern.Events))
+		}
+	}
+
+	if _, err := chunked.ParseChunked(strings.NewReader(""), 0); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for zero chunk size, got %v", err)
+	}
+}
+
+// TestMaxEventsPerPattern verifies that capped event retention keeps counts and templates intact
+func TestMaxEventsPerPattern(t *testing.T) {
+	logs := []string{
+		"PacketResponder 1 for block blk_12345 terminating",
+		"PacketResponder 0 for block blk_67890 terminating",
+		"PacketResponder 2 for block blk_11111 terminating",
+		"PacketResponder 3 for block blk_22222 terminating",
+		"PacketResponder 4 for block blk_33333 terminating",
+	}
+
+	unlimited := NewAWSOMLP()
+	expected := unlimited.Parse(logs)
+
+	parser := NewAWSOMLP()
+	config := DefaultConfig()
+	config.MaxEventsPerPattern = 2
+	if err := parser.WithConfig(config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	results := parser.Parse(logs)
+
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Capped retention changed results.\nExpected: %v\nGot: %v", expected, results)
+	}
+
+	patterns := parser.GetPatterns()
+	if len(patterns) != 1 {
+		t.Fatalf("Expected 1 pattern, got %d", len(patterns))
+	}
+	if len(patterns[0].Events) != 2 {
+		t.Errorf("Expected 2 retained events, got %d", len(patterns[0].Events))
+	}
+	if patterns[0].Frequency["PacketResponder"] != len(logs) {
+		t.Errorf("Frequencies should include dropped events, got %v", patterns[0].Frequency)
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{MaxEventsPerPattern: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative MaxEventsPerPattern, got %v", err)
+	}
+}
+
+// TestParseSeq tests the iterator-based streaming API
+func TestParseSeq(t *testing.T) {
+	parser := NewAWSOMLP()
+	lines := append([]string{"", "   "}, paperComplianceTestLogs...)
+
+	var results []ParseResult
+	for raw, result := range parser.ParseSeq(slices.Values(lines)) {
+		if raw != result.Raw {
+			t.Errorf("Yielded key %q differs from result.Raw %q", raw, result.Raw)
+		}
+		results = append(results, result)
+	}
+
+	if len(results) != len(paperComplianceTestLogs) {
+		t.Fatalf("Expected %d results (blank lines skipped), got %d", len(paperComplianceTestLogs), len(results))
+	}
+	if results[0].Index != 2 {
+		t.Errorf("Expected Index to refer to the input position 2, got %d", results[0].Index)
+	}
+
+	// Templates are refined as lines arrive; the last line sees the complete group
+	expected := "PacketResponder <*> for block <*> terminating"
+	if last := results[len(results)-1]; last.Template != expected {
+		t.Errorf("Expected final template %q, got %q", expected, last.Template)
+	}
+	if !reflect.DeepEqual(parser.GetTemplates(), []string{expected}) {
+		t.Errorf("Unexpected templates after streaming: %v", parser.GetTemplates())
+	}
+
+	// Stopping early must not consume the rest of the sequence
+	consumed := 0
+	source := func(yield func(string) bool) {
+		for _, line := range hdfsTestLogs {
+			consumed++
+			if !yield(line) {
+				return
+			}
+		}
+	}
+	for range NewAWSOMLP().ParseSeq(source) {
+		break
+	}
+	if consumed != 1 {
+		t.Errorf("Expected the source to be consumed lazily, consumed %d lines", consumed)
+	}
+}
+
+// TestParseStream tests the channel-based streaming API
+func TestParseStream(t *testing.T) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for _, line := range append([]string{""}, paperComplianceTestLogs...) {
+			lines <- line
+		}
+	}()
+
+	parser := NewAWSOMLP()
+	var results []ParseResult
+	for result := range parser.ParseStream(context.Background(), lines) {
+		results = append(results, result)
+	}
+
+	var expected []ParseResult
+	for _, result := range NewAWSOMLP().ParseSeq(slices.Values(append([]string{""}, paperComplianceTestLogs...))) {
+		expected = append(expected, result)
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected the results of ParseSeq %v, got %v", expected, results)
+	}
+	if !reflect.DeepEqual(parser.GetTemplates(), []string{"PacketResponder <*> for block <*> terminating"}) {
+		t.Errorf("Unexpected templates after streaming: %v", parser.GetTemplates())
+	}
+
+	// Canceling the context closes the results while the input stays open
+	ctx, cancel := context.WithCancel(context.Background())
+	open := make(chan string, 1)
+	open <- hdfsTestLogs[0]
+	results2 := NewAWSOMLP().ParseStream(ctx, open)
+	if result := <-results2; result.Raw != hdfsTestLogs[0] {
+		t.Errorf("Expected the result of %q, got %q", hdfsTestLogs[0], result.Raw)
+	}
+	cancel()
+	select {
+	case _, ok := <-results2:
+		if ok {
+			t.Error("Expected no results after cancellation")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the results to be closed after cancellation")
+	}
+}
+
+// TestParseLine tests learning single lines online
+func TestParseLine(t *testing.T) {
+	parser := NewAWSOMLP()
+	if id, template := parser.ParseLine("  "); id != -1 || template != "" {
+		t.Errorf("Expected -1 and an empty template for a blank line, got %d %q", id, template)
+	}
+
+	id1, _ := parser.ParseLine(paperComplianceTestLogs[0])
+	var id2 int
+	var template string
+	for _, line := range paperComplianceTestLogs[1:] {
+		id2, template = parser.ParseLine(line)
+	}
+	if id1 != id2 {
+		t.Errorf("Expected the lines to join pattern %d, got %d", id1, id2)
+	}
+	if expected := "PacketResponder <*> for block <*> terminating"; template != expected {
+		t.Errorf("Expected template %q, got %q", expected, template)
+	}
+
+	if id, _ := parser.ParseLine("Disk quota exceeded"); id == id1 {
+		t.Error("Expected a new pattern for a dissimilar line")
+	}
+	if len(parser.GetPatterns()) != 2 {
+		t.Errorf("Expected 2 patterns, got %d", len(parser.GetPatterns()))
+	}
+}
+
+// TestFreezeMatch tests classifying lines against a frozen template set
+func TestFreezeMatch(t *testing.T) {
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{HeaderRegex: HDFSHeaderRegex}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.Parse(hdfsTestLogs)
+	matcher := parser.Freeze()
+	if matcher.Len() != len(parser.GetPatterns()) {
+		t.Errorf("Expected %d frozen templates, got %d", len(parser.GetPatterns()), matcher.Len())
+	}
+
+	line := "081112 101010 160 INFO dfs.DataNode$PacketResponder: PacketResponder 7 for block blk_424242 terminating"
+	result, ok := matcher.Match(line)
+	if !ok {
+		t.Fatalf("Expected %q to match", line)
+	}
+	if expected := "PacketResponder <*> for block <*> terminating"; result.Template != expected || result.Raw != line {
+		t.Errorf("Expected template %q for %q, got %+v", expected, line, result)
+	}
+	if result.Fields["level"] != "INFO" {
+		t.Errorf("Expected the header fields of the line, got %v", result.Fields)
+	}
+	// Four static tokens and two placeholders counting half of twelve tokens
+	if math.Abs(result.Similarity-5.0/6) > 1e-9 || result.Margin <= 0 || result.Margin > result.Similarity {
+		t.Errorf("Expected similarity 5/6 with a positive margin, got %v and %v", result.Similarity, result.Margin)
+	}
+
+	// A line of the same length but other static tokens matches nothing
+	if result, ok := matcher.Match("081112 101010 160 INFO dfs.DataNode$PacketResponder: PacketResponder 7 for block blk_424242 restarting"); ok {
+		t.Errorf("Expected no match, got %+v", result)
+	}
+	if _, ok := matcher.Match("   "); ok {
+		t.Error("Expected no match for a blank line")
+	}
+	if _, err := matcher.MatchLine("unknown message"); !errors.Is(err, ErrUnmatchedLine) {
+		t.Errorf("Expected ErrUnmatchedLine for an unknown line, got %v", err)
+	}
+	if result, err := matcher.MatchLine(line); err != nil || result.Template != "PacketResponder <*> for block <*> terminating" {
+		t.Errorf("Expected MatchLine to match %q, got %+v, %v", line, result, err)
+	}
+
+	// A general template fitting the line as well leaves no margin
+	general := NewAWSOMLP()
+	general.Parse([]string{"job 1 done", "job 2 done", "job 1 <*>"})
+	if result, ok := general.Freeze().Match("job 3 done"); !ok || result.Template != "job <*> done" || result.Margin >= 0.5 {
+		t.Errorf("Expected a low-margin match of %q, got %+v", "job <*> done", result)
+	}
+
+	// Matching does not learn, and learning does not change the matcher
+	patterns := len(parser.GetPatterns())
+	parser.Feed("081112 101010 160 INFO dfs.DataNode$PacketResponder: PacketResponder 7 for block blk_424242 restarting")
+	if _, ok := matcher.Match("081112 101010 160 INFO dfs.DataNode$PacketResponder: PacketResponder 7 for block blk_424242 restarting"); ok {
+		t.Error("Expected the matcher to ignore lines learned after Freeze")
+	}
+	if len(parser.GetPatterns()) != patterns+1 {
+		t.Errorf("Expected only Feed to add a pattern, got %d patterns", len(parser.GetPatterns()))
+	}
+}
+
+// TestParseBatches tests the batch callback API
+func TestParseBatches(t *testing.T) {
+	input := strings.Join(paperComplianceTestLogs, "\n\n") + "\n"
+
+	var sizes []int
+	var results []ParseResult
+	err := NewAWSOMLP().ParseBatches(strings.NewReader(input), 2, func(batch []ParseResult) error {
+		sizes = append(sizes, len(batch))
+		results = append(results, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(sizes, []int{2, 1}) {
+		t.Errorf("Expected batch sizes [2 1], got %v", sizes)
+	}
+	for i, result := range results {
+		if result.Raw != paperComplianceTestLogs[i] {
+			t.Errorf("Result %d: expected raw %q, got %q", i, paperComplianceTestLogs[i], result.Raw)
+		}
+		if result.Index != i*2 {
+			t.Errorf("Result %d: expected index %d, got %d", i, i*2, result.Index)
+		}
+	}
+
+	// A callback error stops parsing
+	sinkErr := errors.New("sink unavailable")
+	calls := 0
+	err = NewAWSOMLP().ParseBatches(strings.NewReader(input), 1, func([]ParseResult) error {
+		calls++
+		return sinkErr
+	})
+	if !errors.Is(err, sinkErr) || calls != 1 {
+		t.Errorf("Expected parsing to stop with the sink error after one call, got %v after %d calls", err, calls)
+	}
+
+	if err := NewAWSOMLP().ParseBatches(strings.NewReader(input), 0, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for zero batch size, got %v", err)
+	}
+}
+
+// TestParseEvents tests that ParseEvents returns enriched events in input order
+func TestParseEvents(t *testing.T) {
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{HeaderRegex: HDFSHeaderRegex}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+
+	lines := append([]string{""}, hdfsTestLogs...)
+	events := parser.ParseEvents(lines)
+	if len(events) != len(hdfsTestLogs) {
+		t.Fatalf("Expected %d events, got %d", len(hdfsTestLogs), len(events))
+	}
+
+	patterns := make(map[int]*Pattern)
+	for _, pattern := range parser.GetPatterns() {
+		patterns[pattern.ID] = pattern
+	}
+
+	results := NewAWSOMLP()
+	results.WithConfig(Config{HeaderRegex: HDFSHeaderRegex})
+	expected := results.Parse(hdfsTestLogs)
+
+	for i, event := range events {
+		if event.Raw != hdfsTestLogs[i] {
+			t.Errorf("Event %d: expected raw %q, got %q", i, hdfsTestLogs[i], event.Raw)
+		}
+		if event.Template != expected[event.Raw] {
+			t.Errorf("Event %d: expected template %q, got %q", i, expected[event.Raw], event.Template)
+		}
+		if len(event.Tokens) == 0 || event.Content == "" {
+			t.Errorf("Event %d: expected content and tokens to be populated", i)
+		}
+		if _, ok := patterns[event.PatternID]; !ok {
+			t.Errorf("Event %d: unknown pattern ID %d", i, event.PatternID)
+		}
+		if event.Fields["level"] != "INFO" || event.Fields["timestamp"] == "" || event.Fields["component"] == "" {
+			t.Errorf("Event %d: unexpected header fields %v", i, event.Fields)
+		}
+		if _, ok := event.Fields["content"]; ok {
+			t.Errorf("Event %d: content should not be reported as a header field", i)
+		}
+	}
+
+	// Headers without named groups produce no fields
+	event := NewAWSOMLP().Preprocess("2024-01-01 10:00:00, service started")
+	if event.Fields != nil {
+		t.Errorf("Expected no fields for the default header regex, got %v", event.Fields)
+	}
+}
+
+// TestParseToResults tests per-line results in input order
+func TestParseToResults(t *testing.T) {
+	lines := []string{
+		"User 1 logged in",
+		"",
+		"Disk full",
+		"User 2 logged in",
+		"User 1 logged in",
+	}
+	results := NewAWSOMLP().ParseToResults(lines)
+
+	expected := []struct {
+		index    int
+		template string
+	}{
+		{0, "User <*> logged in"},
+		{2, "Disk full"},
+		{3, "User <*> logged in"},
+		{4, "User <*> logged in"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %+v", len(expected), results)
+	}
+	for i, want := range expected {
+		result := results[i]
+		if result.Index != want.index || result.Raw != lines[want.index] || result.Template != want.template {
+			t.Errorf("Result %d: expected line %d with template %q, got %+v", i, want.index, want.template, result)
+		}
+	}
+	// The duplicate line keeps its own result with the same pattern
+	if results[3].PatternID != results[0].PatternID || results[1].PatternID == results[0].PatternID {
+		t.Errorf("Unexpected pattern IDs: %+v", results)
+	}
+}
+
+// TestPipeline tests reordering, disabling and extending preprocessing stages
+func TestPipeline(t *testing.T) {
+	line := "2024-01-01 10:00:00, user=alice logged in from 192.168.1.1"
+
+	tests := []struct {
+		name     string
+		pipeline []Stage
+		custom   []string
+		expected string
+	}{
+		{
+			name:     "Default pipeline",
+			pipeline: nil,
+			expected: "user=alice logged in from <*>",
+		},
+		{
+			name:     "Trivial masking disabled",
+			pipeline: []Stage{HeaderStage(), CustomStage(), TokenizeStage()},
+			custom:   []string{`alice`},
+			expected: "user=<*> logged in from 192.168.1.1",
+		},
+		{
+			name: "Custom stage before masking",
+			pipeline: []Stage{
+				HeaderStage(),
+				NewStage("drop-user-name", func(lp *AWSOMLP, event *LogEvent) {
+					event.Content = strings.Replace(event.Content, "user=alice", "user", 1)
+				}),
+				TrivialStage(),
+				CustomStage(),
+				TokenizeStage(),
+			},
+			expected: "user logged in from <*>",
+		},
+		{
+			name:     "Empty pipeline",
+			pipeline: []Stage{},
+			expected: line,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewAWSOMLP()
+			if err := parser.WithConfig(Config{Pipeline: tt.pipeline, CustomRegexes: tt.custom}); err != nil {
+				t.Fatalf("Failed to set config: %v", err)
+			}
+
+			event := parser.Preprocess(line)
+			if event.Content != tt.expected {
+				t.Errorf("Expected content %q, got %q", tt.expected, event.Content)
+			}
+			if !reflect.DeepEqual(event.Tokens, strings.Fields(tt.expected)) {
+				t.Errorf("Expected tokens %v, got %v", strings.Fields(tt.expected), event.Tokens)
+			}
+		})
+	}
+
+	names := make([]string, 0)
+	for _, stage := range DefaultPipeline() {
+		names = append(names, stage.Name())
+	}
+	if !reflect.DeepEqual(names, []string{StageHeader, StageTrivial, StageCustom, StageTokenize}) {
+		t.Errorf("Unexpected default pipeline order: %v", names)
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{Pipeline: []Stage{nil}}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for nil stage, got %v", err)
+	}
+}
+
+// TestParseRFC5424 tests parsing of RFC 5424 syslog messages, using the examples of the RFC
+func TestParseRFC5424(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		fields  map[string]string
+		message string
+	}{
+		{
+			name: "No structured data",
+			line: "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \ufeff'su root' failed for lonvick on /dev/pts/8",
+			fields: map[string]string{
+				"priority": "34", "facility": "4", "severity": "2", "level": "crit", "version": "1",
+				"timestamp": "2003-10-11T22:14:15.003Z", "host": "mymachine.example.com", "app": "su", "msgid": "ID47",
+			},
+			message: "'su root' failed for lonvick on /dev/pts/8",
+		},
+		{
+			name: "Structured data and message",
+			line: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"] An application event log entry...`,
+			fields: map[string]string{
+				"priority": "165", "facility": "20", "severity": "5", "level": "notice", "version": "1",
+				"timestamp": "2003-10-11T22:14:15.003Z", "host": "mymachine.example.com", "app": "evntslog", "msgid": "ID47",
+				"exampleSDID@32473.iut": "3", "exampleSDID@32473.eventSource": "Application", "exampleSDID@32473.eventID": "1011",
+			},
+			message: "An application event log entry...",
+		},
+		{
+			name: "Several elements, escapes and no message",
+			line: `<165>1 2003-10-11T22:14:15.003-07:00 - - 8710 - [exampleSDID@32473 iut="3" path="C:\\tmp\]"][examplePriority@32473 class="high" class="urgent"]`,
+			fields: map[string]string{
+				"priority": "165", "facility": "20", "severity": "5", "level": "notice", "version": "1",
+				"timestamp": "2003-10-11T22:14:15.003-07:00", "procid": "8710",
+				"exampleSDID@32473.iut": "3", "exampleSDID@32473.path": `C:\tmp]`, "examplePriority@32473.class": "high,urgent",
+			},
+			message: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseRFC5424(tt.line)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if !reflect.DeepEqual(msg.Fields(), tt.fields) {
+				t.Errorf("Expected fields %v, got %v", tt.fields, msg.Fields())
+			}
+			if msg.Message != tt.message {
+				t.Errorf("Expected message %q, got %q", tt.message, msg.Message)
+			}
+		})
+	}
+
+	for _, line := range []string{
+		"Oct 11 22:14:15 mymachine su: 'su root' failed",            // RFC 3164
+		"<34>Oct 11 22:14:15 mymachine su: 'su root' failed",        // RFC 3164 with PRI
+		"<192>1 2003-10-11T22:14:15Z host app - - - message",        // PRI out of range
+		"<34>1 2003-10-11 22:14:15 host app - - - message",          // Timestamp with a space
+		`<34>1 2003-10-11T22:14:15Z host app - - [id a="1" message`, // Unterminated element
+		`<34>1 2003-10-11T22:14:15Z host app - - [id a="1"]message`, // No space before MSG
+	} {
+		if _, err := ParseRFC5424(line); !errors.Is(err, ErrInvalidSyslog) {
+			t.Errorf("Expected ErrInvalidSyslog for %q, got %v", line, err)
+		}
+	}
+}
+
+// TestRFC5424Stage tests that only MSG of RFC 5424 lines is templated
+func TestRFC5424Stage(t *testing.T) {
+	parser := NewAWSOMLP()
+	pipeline := []Stage{RFC5424Stage(), TrivialStage(), CustomStage(), TokenizeStage()}
+	if err := parser.WithConfig(Config{Pipeline: pipeline, HeaderRegex: SyslogHeaderRegex}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+
+	parser.Parse([]string{
+		`<13>1 2024-01-01T10:00:00Z web1 app 100 - [req@1 id="a1"] session 1001 opened`,
+		`<13>1 2024-01-01T10:00:01Z web2 app 200 - [req@1 id="b2"] session 2002 opened`,
+		`Jan  1 10:00:02 web3 app[300]: session 3003 opened`, // Falls back to HeaderRegex
+	})
+	if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{"session <*> opened"}) {
+		t.Errorf("Expected template [session <*> opened], got %v", got)
+	}
+
+	event := parser.Preprocess(`<13>1 2024-01-01T10:00:00Z web1 app 100 - [req@1 id="a1"] session 1001 opened`)
+	if event.Fields["req@1.id"] != "a1" || event.Fields["host"] != "web1" {
+		t.Errorf("Expected structured data and header fields, got %v", event.Fields)
+	}
+	if event = parser.Preprocess(`Jan  1 10:00:02 web3 app[300]: session 3003 opened`); event.Fields["host"] != "web3" {
+		t.Errorf("Expected fields of the fallback header regex, got %v", event.Fields)
+	}
+}
+
+// TestParseRFC3164 tests strict parsing of BSD syslog messages
+func TestParseRFC3164(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		fields  map[string]string
+		message string
+	}{
+		{
+			name: "PRI and pid",
+			line: "<34>Oct 11 22:14:15 mymachine su[1234]: 'su root' failed for lonvick on /dev/pts/8",
+			fields: map[string]string{
+				"priority": "34", "facility": "4", "severity": "2", "level": "crit",
+				"timestamp": "Oct 11 22:14:15", "host": "mymachine", "app": "su", "procid": "1234",
+			},
+			message: "'su root' failed for lonvick on /dev/pts/8",
+		},
+		{
+			name: "Log file line without PRI",
+			line: "Feb  5 17:32:18 10.0.0.99 CRON: (root) CMD (run-parts /etc/cron.hourly)",
+			fields: map[string]string{
+				"timestamp": "Feb  5 17:32:18", "host": "10.0.0.99", "app": "CRON",
+			},
+			message: "(root) CMD (run-parts /etc/cron.hourly)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseRFC3164(tt.line)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if !reflect.DeepEqual(msg.Fields(), tt.fields) {
+				t.Errorf("Expected fields %v, got %v", tt.fields, msg.Fields())
+			}
+			if msg.Message != tt.message {
+				t.Errorf("Expected message %q, got %q", tt.message, msg.Message)
+			}
+		})
+	}
+
+	for _, line := range []string{
+		"<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - failed", // RFC 5424
+		"Oct 1 22:14:15 mymachine su: failed",                         // Day not padded
+		"Oct 32 22:14:15 mymachine su: failed",                        // Invalid date
+		"<200>Oct 11 22:14:15 mymachine su: failed",                   // PRI out of range
+		"Oct 11 22:14:15 mymachine su failed",                         // No ':' after TAG
+		"Oct 11 22:14:15 mymachine su[12: failed",                     // Unterminated pid
+	} {
+		if _, err := ParseRFC3164(line); !errors.Is(err, ErrInvalidSyslog) {
+			t.Errorf("Expected ErrInvalidSyslog for %q, got %v", line, err)
+		}
+	}
+
+	// Severity fields separate the patterns of a segmented parser
+	parser := NewAWSOMLP()
+	pipeline := []Stage{RFC3164Stage(), TrivialStage(), CustomStage(), TokenizeStage()}
+	if err := parser.WithConfig(Config{Pipeline: pipeline, Segmentation: SegmentByField, SegmentField: "level"}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.Parse([]string{
+		"<11>Oct 11 22:14:15 web1 app[1]: request 1001 done",
+		"<14>Oct 11 22:14:16 web1 app[1]: request 1002 done",
+		"<14>Oct 11 22:14:17 web2 app[2]: request 1003 done",
+	})
+	counts := make(map[string]int)
+	for _, pattern := range parser.GetPatterns() {
+		counts[pattern.Segment] = pattern.Count
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"err": 1, "info": 2}) {
+		t.Errorf("Expected patterns per severity, got %v", counts)
+	}
+}
+
+// TestParseCEF tests parsing of Common Event Format events
+func TestParseCEF(t *testing.T) {
+	line := `Sep 19 08:26:10 host CEF:0|Security|threatmanager|1.0|100|detected a \| in message|10|src=10.0.0.1 act=blocked a \= dst=2.1.2.2 msg=Worm stopped\non host 7`
+	event, err := ParseCEF(line)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if event.Prefix != "Sep 19 08:26:10 host" || event.Version != 0 || event.Name != "detected a | in message" || event.Severity != "10" {
+		t.Errorf("Unexpected header %+v", event)
+	}
+	expected := []CEFField{
+		{Key: "src", Value: "10.0.0.1"},
+		{Key: "act", Value: "blocked a ="},
+		{Key: "dst", Value: "2.1.2.2"},
+		{Key: "msg", Value: "Worm stopped\non host 7"},
+	}
+	if !reflect.DeepEqual(event.Extension, expected) {
+		t.Errorf("Expected extension %v, got %v", expected, event.Extension)
+	}
+	if msg := event.Message(); msg != "detected a | in message src=<*> act=<*> dst=<*> msg=Worm stopped on host 7" {
+		t.Errorf("Unexpected message %q", msg)
+	}
+	fields := event.Fields()
+	if fields["device_vendor"] != "Security" || fields["signature_id"] != "100" || fields["dst"] != "2.1.2.2" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+
+	for _, line := range []string{
+		"LEEF:1.0|Microsoft|MSExchange|4.0 SP1|15345|src=10.50.1.1", // Other format
+		"CEF:0|Security|threatmanager|1.0|100",                      // Truncated header
+		"CEF:x|Security|threatmanager|1.0|100|worm stopped|10|",     // Invalid version
+	} {
+		if _, err := ParseCEF(line); !errors.Is(err, ErrInvalidCEF) {
+			t.Errorf("Expected ErrInvalidCEF for %q, got %v", line, err)
+		}
+	}
+
+	// Masked extension values group events of one signature into a single template
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{Pipeline: []Stage{CEFStage(), TrivialStage(), CustomStage(), TokenizeStage()}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.Parse([]string{
+		"CEF:0|Security|threatmanager|1.0|100|worm stopped|10|src=10.0.0.1 suser=alice msg=Stopped on host 7",
+		"CEF:0|Security|threatmanager|1.0|100|worm stopped|10|src=10.0.0.2 suser=bob msg=Stopped on host 12",
+	})
+	patterns := parser.GetPatterns()
+	if len(patterns) != 1 || patterns[0].Template != "worm stopped src=<*> suser=<*> msg=Stopped on host <*>" {
+		t.Errorf("Expected one masked template, got %v", patterns)
+	}
+}
+
+// TestParseLEEF tests parsing of LEEF 1.0 and 2.0 events
+func TestParseLEEF(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		delimiter  byte
+		attributes []CEFField
+	}{
+		{
+			name:       "LEEF 1.0 with tabs",
+			line:       "LEEF:1.0|Microsoft|MSExchange|4.0 SP1|15345|src=10.50.1.1\tdst=2.10.20.20\tusrName=joe smith",
+			delimiter:  '\t',
+			attributes: []CEFField{{Key: "src", Value: "10.50.1.1"}, {Key: "dst", Value: "2.10.20.20"}, {Key: "usrName", Value: "joe smith"}},
+		},
+		{
+			name:       "LEEF 2.0 with a character delimiter",
+			line:       "Jan 18 11:07:53 host LEEF:2.0|Lancope|StealthWatch|1.0|41|^|src=10.0.1.8^dst=10.0.0.5^sev=5",
+			delimiter:  '^',
+			attributes: []CEFField{{Key: "src", Value: "10.0.1.8"}, {Key: "dst", Value: "10.0.0.5"}, {Key: "sev", Value: "5"}},
+		},
+		{
+			name:       "LEEF 2.0 with a hex delimiter",
+			line:       "LEEF:2.0|Lancope|StealthWatch|1.0|41|0x7C|src=10.0.1.8|dst=10.0.0.5",
+			delimiter:  '|',
+			attributes: []CEFField{{Key: "src", Value: "10.0.1.8"}, {Key: "dst", Value: "10.0.0.5"}},
+		},
+		{
+			name:       "LEEF 2.0 without delimiter and tabs replaced by spaces",
+			line:       "LEEF:2.0|Lancope|StealthWatch|1.0|41|src=10.0.1.8 msg=flow ended early",
+			delimiter:  '\t',
+			attributes: []CEFField{{Key: "src", Value: "10.0.1.8"}, {Key: "msg", Value: "flow ended early"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := ParseLEEF(tt.line)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if event.Delimiter != tt.delimiter {
+				t.Errorf("Expected delimiter %q, got %q", tt.delimiter, event.Delimiter)
+			}
+			if !reflect.DeepEqual(event.Attributes, tt.attributes) {
+				t.Errorf("Expected attributes %v, got %v", tt.attributes, event.Attributes)
+			}
+		})
+	}
+
+	for _, line := range []string{
+		"CEF:0|Security|threatmanager|1.0|100|worm stopped|10|src=10.0.0.1", // Other format
+		"LEEF:1.0|Microsoft|MSExchange|4.0 SP1",                             // Truncated header
+		"LEEF:3.0|Microsoft|MSExchange|4.0 SP1|15345|src=10.50.1.1",         // Unknown version
+		"LEEF:2.0|Lancope|StealthWatch|1.0|41|xZZ|src=10.0.1.8",             // Invalid delimiter
+	} {
+		if _, err := ParseLEEF(line); !errors.Is(err, ErrInvalidLEEF) {
+			t.Errorf("Expected ErrInvalidLEEF for %q, got %v", line, err)
+		}
+	}
+
+	// A mixed CEF/LEEF export is reduced to one template per event type
+	parser := NewAWSOMLP()
+	pipeline := []Stage{LEEFStage(), TrivialStage(), CustomStage(), TokenizeStage()}
+	if err := parser.WithConfig(Config{Pipeline: pipeline, Segmentation: SegmentByField, SegmentField: "event_id"}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.Parse([]string{
+		"LEEF:1.0|Microsoft|MSExchange|4.0 SP1|15345|src=10.50.1.1\tusrName=joe",
+		"LEEF:1.0|Microsoft|MSExchange|4.0 SP1|15345|src=10.50.1.2\tusrName=ann",
+		"LEEF:1.0|Microsoft|MSExchange|4.0 SP1|15346|src=10.50.1.3\tusrName=joe",
+		"LEEF:2.0|Lancope|StealthWatch|1.0|FlowDenied|^|src=10.0.1.8^dst=10.0.0.5",
+		"CEF:0|Security|threatmanager|1.0|100|worm stopped|10|src=10.0.0.1",
+	})
+	templates := make(map[string]int)
+	for _, pattern := range parser.GetPatterns() {
+		templates[pattern.Segment+": "+pattern.Template] = pattern.Count
+	}
+	expected := map[string]int{
+		"15345: MSExchange <*> src=<*> usrName=<*>":           2,
+		"15346: MSExchange <*> src=<*> usrName=<*>":           1,
+		"FlowDenied: StealthWatch FlowDenied src=<*> dst=<*>": 1,
+		": worm stopped src=<*>":                              1,
+	}
+	if !reflect.DeepEqual(templates, expected) {
+		t.Errorf("Expected templates %v, got %v", expected, templates)
+	}
+}
+
+// TestW3CStage tests parsing of W3C extended log files
+func TestW3CStage(t *testing.T) {
+	logs := []string{
+		"#Software: Microsoft Internet Information Services 10.0",
+		"#Fields: date time s-ip cs-method cs-uri-stem cs-uri-query s-port c-ip cs(User-Agent) sc-status time-taken",
+		"2024-01-15 10:30:15 10.0.0.1 GET /default.htm - 80 192.168.1.10 Mozilla/5.0 200 15",
+		"2024-01-15 10:30:16 10.0.0.1 GET /default.htm q=1 80 192.168.1.11 curl/8.0 200 3",
+		"2024-01-15 10:30:17 10.0.0.1 POST /login.aspx - 443 192.168.1.12 Mozilla/5.0 401 7",
+		"#Fields: date time cs-method cs-uri-stem sc-status",
+		"2024-01-16 08:00:00 DELETE /default.htm 304",
+		"another format",
+	}
+
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{Pipeline: []Stage{W3CStage(), TrivialStage(), CustomStage(), TokenizeStage()}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	events := parser.ParseEvents(logs)
+
+	expected := []string{
+		"#Software: <*>",
+		"#Fields: <*>",
+		"GET /default.htm s-port=80 sc-status=200",
+		"GET /default.htm s-port=80 sc-status=200",
+		"POST /login.aspx s-port=443 sc-status=401",
+		"#Fields: <*>",
+		"DELETE /default.htm sc-status=304",
+		"another format",
+	}
+	for i, event := range events {
+		if event.Template != expected[i] {
+			t.Errorf("Line %d: expected template %q, got %q", i, expected[i], event.Template)
+		}
+	}
+	if fields := events[3].Fields; fields["c-ip"] != "192.168.1.11" || fields["cs-uri-query"] != "q=1" || fields["time-taken"] != "3" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+	if _, ok := events[2].Fields["cs-uri-query"]; ok {
+		t.Errorf("Expected the - placeholder to be left out, got %v", events[2].Fields)
+	}
+	if events[0].Fields["w3c_directive"] != "Software" {
+		t.Errorf("Expected directive field, got %v", events[0].Fields)
+	}
+}
+
+// TestHAProxyStage tests the HAProxy HTTP log preset
+func TestHAProxyStage(t *testing.T) {
+	logs := []string{
+		`Feb  6 12:14:14 localhost haproxy[14389]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"`,
+		`Feb  6 12:14:15 localhost haproxy[14389]: 10.0.1.3:33318 [06/Feb/2009:12:14:15.001] http-in static/srv2 3/0/1/12/16 200 812 - - ---- 2/2/2/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"`,
+		`10.0.1.4:40112 [06/Feb/2009:12:14:16.120] http-in api/app3 0/0/-1/-1/3001 503 212 - - sC-- 5/5/0/0/3 0/0 "POST /orders HTTP/1.1"`,
+	}
+
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{Pipeline: []Stage{HAProxyStage(), TrivialStage(), CustomStage(), TokenizeStage()}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	events := parser.ParseEvents(logs)
+
+	expected := []string{
+		"http-in static/<*> status=200 ---- GET /index.html HTTP/1.1",
+		"http-in static/<*> status=200 ---- GET /index.html HTTP/1.1",
+		"http-in api/<*> status=503 sC-- POST /orders HTTP/1.1",
+	}
+	for i, event := range events {
+		if event.Template != expected[i] {
+			t.Errorf("Line %d: expected template %q, got %q", i, expected[i], event.Template)
+		}
+	}
+	fields := events[2].Fields
+	if fields["server"] != "app3" || fields["timers"] != "0/0/-1/-1/3001" || fields["bytes"] != "212" || fields["connections"] != "5/5/0/0/3" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+	if events[0].Fields["host"] != "localhost" || events[0].Fields["request_headers"] != "{1wt.eu}" {
+		t.Errorf("Unexpected syslog fields %v", events[0].Fields)
+	}
+}
+
+// TestPostgreSQL tests folding and parsing of PostgreSQL logs
+func TestPostgreSQL(t *testing.T) {
+	logs := []string{
+		"2024-01-15 10:30:15.123 UTC [4242] LOG:  duration: 0.512 ms  statement: SELECT * FROM users WHERE id = 42 AND name = 'bob'",
+		"2024-01-15 10:30:16.001 UTC [4242] LOG:  duration: 12.034 ms  statement: SELECT * FROM users WHERE id = 7 AND name = 'it''s me'",
+		"2024-01-15 10:30:17.500 UTC [4243] ERROR:  duplicate key value violates unique constraint \"users_pkey\"",
+		"2024-01-15 10:30:17.500 UTC [4243] DETAIL:  Key (id)=(42) already exists.",
+		"2024-01-15 10:30:17.500 UTC [4243] STATEMENT:  INSERT INTO users (id, name)",
+		"\tVALUES (42, 'bob')",
+		"2024-01-15 10:30:18.000 UTC [4244] LOG:  checkpoint starting: time",
+	}
+
+	folded := FoldPostgreSQL(logs)
+	if len(folded) != 4 {
+		t.Fatalf("Expected 4 entries, got %d: %q", len(folded), folded)
+	}
+	expected := logs[2] + " DETAIL: Key (id)=(42) already exists. STATEMENT: INSERT INTO users (id, name) VALUES (42, 'bob')"
+	if folded[2] != expected {
+		t.Errorf("Expected folded entry %q, got %q", expected, folded[2])
+	}
+
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{Pipeline: []Stage{PostgreSQLStage(), TrivialStage(), CustomStage(), TokenizeStage()}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	events := parser.ParseEvents(folded)
+	templates := []string{
+		"duration: <*> ms statement: SELECT * FROM users WHERE id = <*> AND name = <*>",
+		"duration: <*> ms statement: SELECT * FROM users WHERE id = <*> AND name = <*>",
+		`duplicate key value violates unique constraint "users_pkey" DETAIL: Key <*>=(<*>) already exists. STATEMENT: INSERT INTO users (id, name) VALUES (<*>, <*>)`,
+		"checkpoint starting: time",
+	}
+	for i, event := range events {
+		if event.Template != templates[i] {
+			t.Errorf("Entry %d: expected template %q, got %q", i, templates[i], event.Template)
+		}
+	}
+	if fields := events[2].Fields; fields["pid"] != "4243" || fields["level"] != "ERROR" || fields["timestamp"] != "2024-01-15 10:30:17.500 UTC" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+}
+
+// TestMySQLSlowLog tests folding and parsing of MySQL slow query logs
+func TestMySQLSlowLog(t *testing.T) {
+	logs := []string{
+		"/usr/sbin/mysqld, Version: 8.0.36 (MySQL Community Server - GPL). started with:",
+		"Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock",
+		"Time                 Id Command    Argument",
+		"# Time: 2024-01-15T10:30:15.123456Z",
+		"# User@Host: app[app] @ localhost [127.0.0.1]  Id:    42",
+		"# Query_time: 2.000123  Lock_time: 0.000045 Rows_sent: 1  Rows_examined: 100000",
+		"use shop;",
+		"SET timestamp=1705314615;",
+		"SELECT * FROM orders",
+		"WHERE customer_id = 42 AND status = 'open';",
+		"# User@Host: app[app] @  [10.0.0.7]  Id:    43",
+		"# Query_time: 3.5  Lock_time: 0.0 Rows_sent: 0  Rows_examined: 250000",
+		"SET timestamp=1705314616;",
+		"SELECT * FROM orders WHERE customer_id = 7 AND status = 'closed';",
+	}
+
+	folded := FoldMySQLSlowLog(logs)
+	if len(folded) != 2 {
+		t.Fatalf("Expected 2 records, got %d: %q", len(folded), folded)
+	}
+	query, err := ParseMySQLSlowQuery(folded[0])
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	expected := &MySQLSlowQuery{
+		Time: "2024-01-15T10:30:15.123456Z", User: "app", Host: "localhost", IP: "127.0.0.1", ThreadID: "42",
+		QueryTime: 2.000123, LockTime: 0.000045, RowsSent: 1, RowsExamined: 100000,
+		Database: "shop", Timestamp: 1705314615,
+		SQL: "SELECT * FROM orders WHERE customer_id = 42 AND status = 'open'",
+		Attributes: map[string]string{
+			"Time": "2024-01-15T10:30:15.123456Z", "Id": "42", "Query_time": "2.000123",
+			"Lock_time": "0.000045", "Rows_sent": "1", "Rows_examined": "100000",
+		},
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, query)
+	}
+	if _, err := ParseMySQLSlowQuery("SELECT 1"); !errors.Is(err, ErrInvalidSlowQuery) {
+		t.Errorf("Expected ErrInvalidSlowQuery, got %v", err)
+	}
+
+	// Both slow queries have the same shape
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{Pipeline: []Stage{MySQLSlowLogStage(), TrivialStage(), CustomStage(), TokenizeStage()}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	events := parser.ParseEvents(folded)
+	for _, event := range events {
+		if event.Template != "SELECT * FROM orders WHERE customer_id = <*> AND status = <*>" {
+			t.Errorf("Unexpected template %q", event.Template)
+		}
+	}
+	if fields := events[1].Fields; fields["ip"] != "10.0.0.7" || fields["query_time"] != "3.5" || fields["thread_id"] != "43" || fields["host"] != "" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+}
+
+// TestK8sStage tests masking of Kubernetes resource names
+func TestK8sStage(t *testing.T) {
+	tests := []struct {
+		text       string
+		normalized string
+	}{
+		{"Started pod api-7f9c6d5b4-xk2lp on node-1", "Started pod api-<*> on node-1"},
+		{"Job backup-28391220-q8v2z completed", "Job backup-<*> completed"},
+		{"Killing fluentd-x7k2p and kube-proxy-https", "Killing fluentd-<*> and kube-proxy-https"},
+		{"Container containerd://4f2a9c1b7e3d5f60 restarted", "Container containerd://<*> restarted"},
+		{`Created namespace=team-a and "namespace":"prod"`, `Created namespace=<*> and "namespace":"<*>"`},
+		{`namespaces "staging" not found`, `namespaces "<*>" not found`},
+		{`"Pod is ready" pod="kube-system/coredns-558bd4d5db-x7k2p"`, `"Pod is ready" pod="<*>/coredns-<*>"`},
+	}
+	for _, tt := range tests {
+		if normalized := NormalizeK8s(tt.text); normalized != tt.normalized {
+			t.Errorf("NormalizeK8s(%q): expected %q, got %q", tt.text, tt.normalized, normalized)
+		}
+	}
+
+	// Pods of a Deployment share a template
+	logs := []string{
+		"Pulling image for pod api-7f9c6d5b4-xk2lp in namespace=prod",
+		"Pulling image for pod api-7f9c6d5b4-m9q4w in namespace=staging",
+		"Pulling image for pod api-5d8b7c6f9-t2r8n in namespace=prod",
+	}
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{Pipeline: []Stage{HeaderStage(), K8sStage(), TrivialStage(), CustomStage(), TokenizeStage()}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.ParseEvents(logs)
+	if templates := parser.GetTemplates(); !reflect.DeepEqual(templates, []string{"Pulling image for pod api-<*> in namespace=<*>"}) {
+		t.Errorf("Expected a single template, got %v", templates)
+	}
+}
+
+// TestSQLStage tests normalization of SQL statements in log messages
+func TestSQLStage(t *testing.T) {
+	tests := []struct {
+		sql        string
+		normalized string
+	}{
+		{"SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'bob'", "SELECT * FROM t WHERE id IN (<*>) AND name = <*>"},
+		{"select * from t where id in ($1,$2) and x = ?", "select * from t where id in (<*>) and x = ?"},
+		{`UPDATE "t1" SET v = -1.5e3, s = E'it\'s', w = 'a''b' WHERE k2 = 42`, `UPDATE "t1" SET v = -<*>, s = <*>, w = <*> WHERE k2 = <*>`},
+		{"INSERT INTO t (a, b) VALUES (1, 'x')", "INSERT INTO t (a, b) VALUES (<*>, <*>)"},
+	}
+	for _, tt := range tests {
+		if normalized := NormalizeSQL(tt.sql); normalized != tt.normalized {
+			t.Errorf("NormalizeSQL(%q): expected %q, got %q", tt.sql, tt.normalized, normalized)
+		}
+	}
+
+	// ORM statements with lists of different lengths share a template
+	logs := []string{
+		"Hibernate: select u.id from users u where u.id in (1, 2, 3) and u.name = 'bob'",
+		"Hibernate: select u.id from users u where u.id in (4) and u.name = 'alice'",
+		"Started 2 workers in 15 ms",
+	}
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{Pipeline: []Stage{HeaderStage(), SQLStage(), TrivialStage(), CustomStage(), TokenizeStage()}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	events := parser.ParseEvents(logs)
+	expected := []string{
+		"Hibernate: select u.id from users u where u.id in (<*>) and u.name = <*>",
+		"Hibernate: select u.id from users u where u.id in (<*>) and u.name = <*>",
+		"Started <*> workers in <*> ms",
+	}
+	for i, event := range events {
+		if event.Template != expected[i] {
+			t.Errorf("Line %d: expected template %q, got %q", i, expected[i], event.Template)
+		}
+	}
+}
+
+// TestHooks tests the BeforeGroup and AfterTemplate hooks
+func TestHooks(t *testing.T) {
+	logs := []string{
+		"User Alice logged in",
+		"user alice logged in",
+		"USER ALICE logged in",
+	}
+
+	var grouped, generated int
+	parser := NewAWSOMLP()
+	err := parser.WithConfig(Config{
+		BeforeGroup: func(event *LogEvent) {
+			grouped++
+			for i, token := range event.Tokens {
+				event.Tokens[i] = strings.ToLower(token)
+			}
+		},
+		AfterTemplate: func(p *Pattern) {
+			generated++
+			p.Template = "[auth] " + p.Template
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+
+	results := parser.Parse(logs)
+
+	if grouped != len(logs) {
+		t.Errorf("Expected BeforeGroup to be called %d times, got %d", len(logs), grouped)
+	}
+	if generated == 0 {
+		t.Error("Expected AfterTemplate to be called")
+	}
+	if len(parser.GetPatterns()) != 1 {
+		t.Errorf("Expected normalized tokens to form a single pattern, got %d", len(parser.GetPatterns()))
+	}
+	for _, line := range logs {
+		if results[line] != "[auth] user alice logged in" {
+			t.Errorf("Expected rewritten template for %q, got %q", line, results[line])
+		}
+	}
+}
+
+// TestCanonicalMode verifies that canonical mode yields the same templates for any input order
+func TestCanonicalMode(t *testing.T) {
+	logs := append([]string{
+		"Connection from 10.0.0.1 closed by peer",
+		"Connection from host closed by peer after timeout",
+		"Connection closed",
+		"Connection reset by client",
+	}, hdfsTestLogs...)
+
+	parse := func(lines []string) (map[string]string, []string) {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(Config{Canonical: true, MinSimilarity: 0.5, HeaderRegex: HDFSHeaderRegex}); err != nil {
+			t.Fatalf("Failed to set config: %v", err)
+		}
+		return parser.Parse(lines), parser.GetTemplates()
+	}
+
+	expectedResults, expectedTemplates := parse(logs)
+
+	reversed := slices.Clone(logs)
+	slices.Reverse(reversed)
+	orders := [][]string{reversed}
+	for shift := 1; shift < len(logs); shift += 3 {
+		orders = append(orders, append(slices.Clone(logs[shift:]), logs[:shift]...))
+	}
+
+	for i, order := range orders {
+		results, templates := parse(order)
+		if !reflect.DeepEqual(templates, expectedTemplates) {
+			t.Errorf("Order %d: templates differ.\nExpected: %v\nGot: %v", i, expectedTemplates, templates)
+		}
+		if !reflect.DeepEqual(results, expectedResults) {
+			t.Errorf("Order %d: results differ.\nExpected: %v\nGot: %v", i, expectedResults, results)
+		}
+	}
+}
+
+// TestDeterministic tests that shuffled input gives a byte-identical state
+func TestDeterministic(t *testing.T) {
+	logs := append([]string{
+		"Connection from 10.0.0.1 closed by peer",
+		"Connection from host closed by peer after timeout",
+		"Connection closed",
+		"Connection closed",
+		"Connection reset by client",
+	}, hdfsTestLogs...)
+
+	configs := []Config{
+		{Deterministic: true, MinSimilarity: 0.5, HeaderRegex: HDFSHeaderRegex},
+		{Deterministic: true, HeaderRegex: HDFSHeaderRegex, SortingStrategy: SortByLength, FreqCounting: FreqCountPositional, MaxExamplesPerPattern: 1},
+		{Deterministic: true, HeaderRegex: HDFSHeaderRegex, ApproximateGrouping: true, SingletonSimilarity: 0.5, PatternTTLLines: 100},
+	}
+	for i, config := range configs {
+		var expected []byte
+		for seed := range uint64(5) {
+			lines := slices.Clone(logs)
+			rand.New(rand.NewPCG(seed, seed)).Shuffle(len(lines), func(a, b int) { lines[a], lines[b] = lines[b], lines[a] })
+
+			parser := NewAWSOMLP()
+			if err := parser.WithConfig(config); err != nil {
+				t.Fatalf("Failed to set config: %v", err)
+			}
+			parser.Parse(lines)
+			var buf bytes.Buffer
+			if err := parser.ExportState(&buf); err != nil {
+				t.Fatalf("ExportState failed: %v", err)
+			}
+			if expected == nil {
+				expected = buf.Bytes()
+			} else if !bytes.Equal(buf.Bytes(), expected) {
+				t.Errorf("Config %d, seed %d: state differs.\nExpected: %s\nGot: %s", i, seed, expected, buf.Bytes())
+			}
+		}
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{Deterministic: true, DecayHalfLife: time.Minute}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig with DecayHalfLife, got %v", err)
+	}
+}
+
+// TestSimilarityDiagnostics tests SimilarityMatrix and NearestPatterns
+func TestSimilarityDiagnostics(t *testing.T) {
+	parser := NewAWSOMLP()
+	lines := []string{"User alice logged in", "User bob logged in", "Disk full"}
+	matrix := parser.SimilarityMatrix(lines)
+	if len(matrix) != 3 || len(matrix[0]) != 3 {
+		t.Fatalf("Expected a 3x3 matrix, got %v", matrix)
+	}
+	for i := range matrix {
+		for j := range matrix {
+			if matrix[i][j] != matrix[j][i] {
+				t.Errorf("Expected a symmetric matrix, got %v", matrix)
+			}
+		}
+		if matrix[i][i] != 1 {
+			t.Errorf("Expected similarity 1 of line %d with itself, got %f", i, matrix[i][i])
+		}
+	}
+	// The similarity is the ratio of the letters of the lines, 15 and 17
+	if want := 15.0 / 17; math.Abs(matrix[0][1]-want) > 1e-9 {
+		t.Errorf("Expected similarity %f, got %f", want, matrix[0][1])
+	}
+	if len(parser.GetPatterns()) != 0 {
+		t.Error("Expected SimilarityMatrix not to learn patterns")
+	}
+
+	parser.Parse(lines)
+	scores := parser.NearestPatterns("User carol logged in", 2)
+	if len(scores) != 2 {
+		t.Fatalf("Expected 2 scores, got %v", scores)
+	}
+	if scores[0].Similarity < scores[1].Similarity || scores[0].Threshold != 1 {
+		t.Errorf("Expected scores ordered by similarity with threshold 1, got %v", scores)
+	}
+	if scores[0].Template != "User alice logged in" && scores[0].Template != "User bob logged in" {
+		t.Errorf("Expected a user pattern first, got %v", scores[0])
+	}
+	if all := parser.NearestPatterns("User carol logged in", 0); len(all) != len(parser.GetPatterns()) {
+		t.Errorf("Expected a score per pattern, got %v", all)
+	}
+}
+
+// TestSortedAccessors tests GetTemplatesByFrequency and GetPatternsSorted
+func TestSortedAccessors(t *testing.T) {
+	logs := []string{
+		"Service started",
+		"User 1 logged in",
+		"User 2 logged in",
+		"User 2 logged in", // Duplicate lines are counted
+		"Disk 1 full",
+		"Disk 2 full",
+	}
+
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaxEventsPerPattern: 2}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.Parse(logs)
+
+	expected := []TemplateCount{
+		{Template: "User <*> logged in", Count: 3},
+		{Template: "Disk <*> full", Count: 2},
+		{Template: "Service started", Count: 1},
+	}
+	if got := parser.GetTemplatesByFrequency(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	ids := func(patterns []*Pattern) []int {
+		result := make([]int, len(patterns))
+		for i, pattern := range patterns {
+			result[i] = pattern.ID
+		}
+		return result
+	}
+
+	tests := []struct {
+		order    PatternOrder
+		expected []int
+	}{
+		{OrderByFirstSeen, []int{0, 1, 2}},
+		{OrderByCount, []int{1, 2, 0}},
+		{OrderBySize, []int{1, 2, 0}}, // Retained events are capped at 2, ties keep first-seen order
+	}
+	for _, tt := range tests {
+		if got := ids(parser.GetPatternsSorted(tt.order)); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("Order %d: expected pattern IDs %v, got %v", tt.order, tt.expected, got)
+		}
+	}
+
+	// The internal pattern order is left untouched
+	if got := ids(parser.GetPatterns()); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("GetPatternsSorted modified the pattern order: %v", got)
+	}
+}
+
+// TestSnapshot tests that pattern views are copies independent of the parser
+func TestSnapshot(t *testing.T) {
+	parser := NewAWSOMLP()
+	parser.Parse(paperComplianceTestLogs)
+	parser.Feed("Disk quota exceeded")
+
+	views := parser.Snapshot()
+	if len(views) != 2 || views[0].ID != 0 || views[1].ID != 1 {
+		t.Fatalf("Expected 2 views ordered by ID, got %+v", views)
+	}
+	view := views[0]
+	if view.Template != "PacketResponder <*> for block <*> terminating" || view.Count != 3 || view.Retained != 3 ||
+		view.Representative != paperComplianceTestLogs[0] || view.Frequency["PacketResponder"] != 3 || view.Weight != 3 {
+		t.Errorf("Unexpected view %+v", view)
+	}
+
+	// Modifying a view leaves the parser alone, and learning leaves the view alone
+	view.Examples[0] = "changed"
+	view.Frequency["PacketResponder"] = 0
+	pattern := parser.GetPatterns()[0]
+	if pattern.Examples[0] != paperComplianceTestLogs[0] || pattern.Frequency["PacketResponder"] != 3 {
+		t.Error("Expected the parser's pattern to be unchanged")
+	}
+	parser.Feed("PacketResponder 3 for block blk_22222 terminating")
+	if views[0].Count != 3 || parser.Snapshot()[0].Count != 4 {
+		t.Errorf("Expected the old view to keep its count, got %d", views[0].Count)
+	}
+
+	// Snapshots may be taken while lines are fed
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			parser.Feed(fmt.Sprintf("User %d logged in", i))
+		}
+	}()
+	for range 50 {
+		parser.Snapshot()
+	}
+	wg.Wait()
+}
+
+// TestPatternCount tests that Pattern.Count covers duplicates and non-retained events
+func TestPatternCount(t *testing.T) {
+	logs := []string{
+		"User 1 logged in",
+		"User 1 logged in",
+		"User 2 logged in",
+		"User 3 logged in",
+	}
+
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaxEventsPerPattern: 1}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.Parse(logs)
+	parser.Parse(logs[:1])
+
+	patterns := parser.GetPatterns()
+	if len(patterns) != 1 {
+		t.Fatalf("Expected 1 pattern, got %d", len(patterns))
+	}
+	if patterns[0].Count != 5 {
+		t.Errorf("Expected Count 5 across parse calls, got %d", patterns[0].Count)
+	}
+
+	data, err := json.Marshal(patterns[0])
+	if err != nil {
+		t.Fatalf("Failed to marshal pattern: %v", err)
+	}
+	var decoded Pattern
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal pattern: %v", err)
+	}
+	if decoded.Count != 5 {
+		t.Errorf("Expected Count to be serialized, got %d", decoded.Count)
+	}
+}
+
+// TestMaxExamplesPerPattern tests that example lines are sampled with a cap
+func TestMaxExamplesPerPattern(t *testing.T) {
+	logs := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		logs = append(logs, fmt.Sprintf("User %d logged in", i))
+	}
+
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaxEventsPerPattern: 1, MaxExamplesPerPattern: 5}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	parser.Parse(logs)
+
+	pattern := parser.GetPatterns()[0]
+	if len(pattern.Examples) != 5 {
+		t.Fatalf("Expected 5 examples, got %d", len(pattern.Examples))
+	}
+	if len(pattern.Events) != 1 {
+		t.Errorf("Expected event retention to stay capped at 1, got %d", len(pattern.Events))
+	}
+
+	sampledLater := false
+	for _, example := range pattern.Examples {
+		if !slices.Contains(logs, example) {
+			t.Errorf("Example %q is not an input line", example)
+		}
+		if !slices.Contains(logs[:5], example) {
+			sampledLater = true
+		}
+	}
+	if !sampledLater {
+		t.Error("Expected examples to be sampled from the whole input, not only the first lines")
+	}
+
+	// Default keeps a few examples
+	defaults := NewAWSOMLP()
+	defaults.Parse(logs[:2])
+	if got := defaults.GetPatterns()[0].Examples; !reflect.DeepEqual(got, logs[:2]) {
+		t.Errorf("Expected examples %v, got %v", logs[:2], got)
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{MaxExamplesPerPattern: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative MaxExamplesPerPattern, got %v", err)
+	}
+}
+
+// TestPatternExpiration tests time- and volume-based pattern expiration
+func TestPatternExpiration(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var expired []string
+	parser := NewAWSOMLP()
+	parser.now = func() time.Time { return clock }
+	err := parser.WithConfig(Config{
+		PatternTTL: time.Hour,
+		OnExpire: func(p *Pattern) {
+			expired = append(expired, p.Template)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+
+	parser.Parse([]string{"Disk 1 full", "User 1 logged in"})
+	clock = clock.Add(45 * time.Minute)
+	parser.Parse([]string{"User 2 logged in"})
+	clock = clock.Add(30 * time.Minute)
+	parser.Parse([]string{"Service started"})
+
+	if !reflect.DeepEqual(expired, []string{"Disk <*> full"}) {
+		t.Errorf("Expected only the disk pattern to expire, got %v", expired)
+	}
+	if !reflect.DeepEqual(parser.GetTemplates(), []string{"Service started", "User <*> logged in"}) {
+		t.Errorf("Unexpected templates after expiration: %v", parser.GetTemplates())
+	}
+
+	// IDs are not reused after expiration
+	parser.Parse([]string{"Disk 2 full"})
+	patterns := parser.GetPatterns()
+	if id := patterns[len(patterns)-1].ID; id != 3 {
+		t.Errorf("Expected new pattern ID 3, got %d", id)
+	}
+
+	// Volume-based expiration
+	volume := NewAWSOMLP()
+	if err := volume.WithConfig(Config{PatternTTLLines: 3}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	volume.Parse([]string{"Disk 1 full", "User 1 logged in", "User 2 logged in"})
+	if len(volume.GetPatterns()) != 2 {
+		t.Errorf("Expected both patterns to survive, got %d", len(volume.GetPatterns()))
+	}
+	volume.Parse([]string{"User 3 logged in"})
+	if !reflect.DeepEqual(volume.GetTemplates(), []string{"User <*> logged in"}) {
+		t.Errorf("Expected the disk pattern to expire after 3 lines, got %v", volume.GetTemplates())
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{PatternTTL: -time.Second}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative PatternTTL, got %v", err)
+	}
+}
+
+// TestExpireConcurrent tests calling Expire from a timer while lines are fed
+func TestExpireConcurrent(t *testing.T) {
+	parser := NewAWSOMLP()
+	parser.WithConfig(Config{PatternTTLLines: 50})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 2000 {
+			parser.Feed(fmt.Sprintf("job %d finished in stage %d", i, i%7))
+		}
+	}()
+	for range 200 {
+		parser.Expire()
+	}
+	wg.Wait()
+
+	// Feeding stopped, so the next 50 lines expire everything else
+	for range 50 {
+		parser.Feed("service heartbeat")
+	}
+	parser.Expire()
+	if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{"service heartbeat"}) {
+		t.Errorf("Expected only the heartbeat pattern to remain, got %v", got)
+	}
+}
+
+// TestPatternDecay tests the exponential decay of pattern weights
+func TestPatternDecay(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	parser := NewAWSOMLP()
+	parser.now = func() time.Time { return clock }
+	if err := parser.WithConfig(Config{DecayHalfLife: time.Hour}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+
+	parser.Parse([]string{"User 1 logged in", "User 2 logged in", "User 3 logged in", "User 4 logged in"})
+	clock = clock.Add(time.Hour)
+	parser.Parse([]string{"Disk 1 full", "Disk 2 full", "Disk 3 full"})
+
+	users, disks := parser.GetPatterns()[0], parser.GetPatterns()[1]
+	if w := parser.PatternWeight(users); math.Abs(w-2) > 1e-9 {
+		t.Errorf("Expected user weight to halve to 2, got %f", w)
+	}
+	if w := parser.PatternWeight(disks); math.Abs(w-3) > 1e-9 {
+		t.Errorf("Expected disk weight 3, got %f", w)
+	}
+	if users.Count != 4 {
+		t.Errorf("Expected Count to be unaffected by decay, got %d", users.Count)
+	}
+	if sorted := parser.GetPatternsSorted(OrderByWeight); sorted[0] != disks {
+		t.Errorf("Expected the recent disk pattern to rank first by weight")
+	}
+
+	clock = clock.Add(time.Hour)
+	parser.Parse([]string{"User 5 logged in"})
+	if w := parser.PatternWeight(users); math.Abs(w-2) > 1e-9 {
+		t.Errorf("Expected decayed weight 1 plus the new line, got %f", w)
+	}
+}
+
+// TestStateRoundTrip tests that an exported state restores the learned model
+func TestStateRoundTrip(t *testing.T) {
+	original := NewAWSOMLP()
+	original.WithConfig(Config{HeaderRegex: HDFSHeaderRegex})
+	original.Parse(hdfsTestLogs)
+
+	var buf bytes.Buffer
+	if err := original.ExportState(&buf); err != nil {
+		t.Fatalf("Failed to export state: %v", err)
+	}
+
+	restored := NewAWSOMLP()
+	restored.WithConfig(Config{HeaderRegex: HDFSHeaderRegex})
+	if err := restored.ImportState(&buf); err != nil {
+		t.Fatalf("Failed to import state: %v", err)
+	}
+
+	if !reflect.DeepEqual(original.GetTemplatesByFrequency(), restored.GetTemplatesByFrequency()) {
+		t.Errorf("Templates differ after restore.\nOriginal: %v\nRestored: %v",
+			original.GetTemplatesByFrequency(), restored.GetTemplatesByFrequency())
+	}
+
+	// New lines continue to match restored patterns and get fresh IDs otherwise
+	before := len(restored.GetPatterns())
+	result, ok := restored.Feed(hdfsTestLogs[0])
+	if !ok || result.PatternID != original.GetPatterns()[0].ID {
+		t.Errorf("Expected the line to match restored pattern %d, got %+v", original.GetPatterns()[0].ID, result)
+	}
+	result, _ = restored.Feed("Completely new message kind")
+	if result.PatternID != before {
+		t.Errorf("Expected new pattern ID %d, got %d", before, result.PatternID)
+	}
+
+	err := restored.ImportState(strings.NewReader(`{"version": 99, "patterns": []}`))
+	if !errors.Is(err, ErrStateVersion) {
+		t.Errorf("Expected ErrStateVersion, got %v", err)
+	}
+	if len(restored.GetPatterns()) != before+1 {
+		t.Errorf("Expected a failed import to leave the parser unchanged")
+	}
+}
+
+// TestSnapshotManager tests atomic snapshots and restoring them
+func TestSnapshotManager(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.json")
+
+	parser := NewAWSOMLP()
+	manager := NewSnapshotManager(parser, path, 10*time.Millisecond)
+	if restored, err := manager.Restore(); restored || err != nil {
+		t.Fatalf("Expected nothing to restore, got %v, %v", restored, err)
+	}
+	if !manager.LastSaved().IsZero() {
+		t.Errorf("Expected no snapshot time before the first snapshot")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(stopped)
+	}()
+
+	// Feed concurrently with periodic snapshots
+	for i := 0; i < 200; i++ {
+		parser.Feed(fmt.Sprintf("User %d logged in", i))
+	}
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	<-stopped
+
+	before := time.Now()
+	if err := manager.Save(); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	if manager.LastSaved().Before(before) {
+		t.Errorf("Expected the snapshot time to be updated, got %v", manager.LastSaved())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the snapshot file, found %d entries", len(entries))
+	}
+
+	restored := NewAWSOMLP()
+	restoring := NewSnapshotManager(restored, path, 0)
+	if ok, err := restoring.Restore(); !ok || err != nil {
+		t.Fatalf("Failed to restore snapshot: %v, %v", ok, err)
+	}
+	if restoring.LastSaved().IsZero() {
+		t.Errorf("Expected the snapshot time of the restored file")
+	}
+	if count := restored.GetPatterns()[0].Count; count != 200 {
+		t.Errorf("Expected restored count 200, got %d", count)
+	}
+}
+
+// TestStateConfig tests that the configuration is part of the state
+func TestStateConfig(t *testing.T) {
+	original := NewAWSOMLP()
+	original.WithConfig(Config{
+		HeaderRegex:   HDFSHeaderRegex,
+		MinSimilarity: 0.8,
+		MaskQuoted:    true,
+		Brackets:      []BracketRule{},
+		ColumnRules:   []ColumnRule{{Match: `^Served`, Column: -2, Tokens: -1}},
+	})
+	original.Parse(hdfsTestLogs)
+
+	var buf bytes.Buffer
+	if err := original.ExportState(&buf); err != nil {
+		t.Fatalf("Failed to export state: %v", err)
+	}
+
+	// Pipeline and callbacks are kept from the importing parser
+	var grouped int
+	restored := NewAWSOMLP()
+	restored.WithConfig(Config{BeforeGroup: func(*LogEvent) { grouped++ }})
+	if err := restored.ImportState(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to import state: %v", err)
+	}
+	config := restored.config
+	if config.HeaderRegex != HDFSHeaderRegex || config.MinSimilarity != 0.8 || !config.MaskQuoted || config.Brackets == nil || len(config.Brackets) != 0 || len(config.ColumnRules) != 1 {
+		t.Errorf("Expected the exported configuration, got %+v", config)
+	}
+	if result, _ := restored.Feed(hdfsTestLogs[0]); result.Fields["level"] != "INFO" || grouped != 1 {
+		t.Errorf("Expected the restored header regex and the parser's callback to apply, got %+v", result)
+	}
+
+	// The protobuf model carries the same configuration
+	var protoBuf bytes.Buffer
+	original.ExportProto(&protoBuf)
+	fromProto := NewAWSOMLP()
+	if err := fromProto.ImportProto(&protoBuf); err != nil {
+		t.Fatalf("Failed to import protobuf model: %v", err)
+	}
+	if !reflect.DeepEqual(newConfigState(fromProto.config), newConfigState(original.config)) {
+		t.Errorf("Expected the configuration %+v from protobuf, got %+v", newConfigState(original.config), newConfigState(fromProto.config))
+	}
+
+	// States without a configuration keep the parser's, invalid ones are rejected
+	v2 := `{"format":"awsom-lp-state","version":2,"next_id":0,"lines":0,"truncated":0,"patterns":[]}`
+	if err := restored.ImportState(strings.NewReader(v2)); err != nil || restored.config.HeaderRegex != HDFSHeaderRegex {
+		t.Errorf("Expected a version 2 state to keep the configuration, got %v", err)
+	}
+	invalid := strings.Replace(buf.String(), `"min_similarity":0.8`, `"min_similarity":2`, 1)
+	if err := restored.ImportState(strings.NewReader(invalid)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for an invalid configuration, got %v", err)
+	}
+	if restored.config.MinSimilarity != 0.8 {
+		t.Error("Expected a failed import to leave the configuration unchanged")
+	}
+}
+
+// TestStateMigration tests loading states written by older format versions
+func TestStateMigration(t *testing.T) {
+	v1 := `{"version":1,"next_id":1,"lines":2,"truncated":0,"patterns":[{"id":0,
+		"template":"User <*> logged in","frequency":{"User":2,"logged":2,"in":2,"1":1,"2":1},"count":2,
+		"events":[{"raw":"User 1 logged in","content":"User 1 logged in","tokens":["User","1","logged","in"]}]}]}`
+
+	parser := NewAWSOMLP()
+	if err := parser.ImportState(strings.NewReader(v1)); err != nil {
+		t.Fatalf("Failed to import version 1 state: %v", err)
+	}
+	if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{"User <*> logged in"}) {
+		t.Errorf("Unexpected templates after migration: %v", got)
+	}
+
+	var buf bytes.Buffer
+	parser.ExportState(&buf)
+	var exported struct {
+		Format  string `json:"format"`
+		Version int    `json:"version"`
+	}
+	json.Unmarshal(buf.Bytes(), &exported)
+	if exported.Version != StateVersion || exported.Format == "" {
+		t.Errorf("Expected re-export in the current format, got %+v", exported)
+	}
+
+	tests := []struct {
+		name  string
+		state string
+	}{
+		{"Missing version", `{"patterns":[]}`},
+		{"Invalid version", `{"version":"two"}`},
+		{"Newer version", fmt.Sprintf(`{"version":%d}`, StateVersion+1)},
+	}
+	for _, tt := range tests {
+		if err := parser.ImportState(strings.NewReader(tt.state)); !errors.Is(err, ErrStateVersion) {
+			t.Errorf("%s: expected ErrStateVersion, got %v", tt.name, err)
+		}
+	}
+
+	if err := parser.ImportState(strings.NewReader(`{"version":2,"format":"other"}`)); err == nil || errors.Is(err, ErrStateVersion) {
+		t.Errorf("Expected a format error for foreign files, got %v", err)
+	}
+
+	// Version 3 states stored an unlimited MaxLineLength as 0
+	v3 := `{"format":"awsom-lp-state","version":3,"next_id":0,"lines":0,"truncated":0,"patterns":[],
+		"config":{"min_similarity":0.8,"max_line_length":0}}`
+	if err := parser.ImportState(strings.NewReader(v3)); err != nil {
+		t.Fatalf("Failed to import version 3 state: %v", err)
+	}
+	if parser.config.MaxLineLength != -1 {
+		t.Errorf("Expected an unlimited MaxLineLength after migration, got %d", parser.config.MaxLineLength)
+	}
+}
+
+// TestPatternEncoding tests JSON and gob round trips of single patterns
+func TestPatternEncoding(t *testing.T) {
+	parser := NewAWSOMLP()
+	parser.WithConfig(Config{FreqCounting: FreqCountPositional, FreqSketchThreshold: 8, MaxExamplesPerPattern: 2})
+	for i := range 20 {
+		parser.Feed(fmt.Sprintf("User %d logged in", i))
+	}
+	original := parser.GetPatterns()[0]
+
+	data, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("Failed to marshal pattern: %v", err)
+	}
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	if fields["version"] != float64(PatternVersion) || fields["template"] != "User <*> logged in" || fields["count"] != float64(20) {
+		t.Errorf("Unexpected JSON fields: %v", fields)
+	}
+
+	var gobBuf bytes.Buffer
+	if err := gob.NewEncoder(&gobBuf).Encode(original); err != nil {
+		t.Fatalf("Failed to gob-encode pattern: %v", err)
+	}
+
+	var fromJSON, fromGob Pattern
+	if err := json.Unmarshal(data, &fromJSON); err != nil {
+		t.Fatalf("Failed to unmarshal pattern: %v", err)
+	}
+	if err := gob.NewDecoder(&gobBuf).Decode(&fromGob); err != nil {
+		t.Fatalf("Failed to gob-decode pattern: %v", err)
+	}
+	for name, decoded := range map[string]*Pattern{"JSON": &fromJSON, "gob": &fromGob} {
+		if decoded.ID != original.ID || decoded.Template != original.Template || decoded.Count != original.Count ||
+			!decoded.LastSeen.Equal(original.LastSeen) || !reflect.DeepEqual(decoded.Examples, original.Examples) ||
+			!reflect.DeepEqual(decoded.PositionFrequency, original.PositionFrequency) || len(decoded.Events) != len(original.Events) {
+			t.Errorf("%s: pattern differs after round trip: %+v", name, decoded)
+		}
+		// Frequencies beyond FreqSketchThreshold are restored from the sketch
+		if decoded.sketch == nil || decoded.tokenFrequency("logged") != 20 || decoded.tokenFrequency("7") != original.tokenFrequency("7") {
+			t.Errorf("%s: token frequencies differ after round trip", name)
+		}
+		if event := decoded.Events[3]; event.Raw != "User 3 logged in" || event.PatternID != original.ID || event.Template != original.Template {
+			t.Errorf("%s: unexpected event %+v", name, event)
+		}
+	}
+
+	for _, doc := range []string{`{"template":"x"}`, fmt.Sprintf(`{"version":%d}`, PatternVersion+1)} {
+		unchanged := Pattern{Template: "kept"}
+		if err := json.Unmarshal([]byte(doc), &unchanged); !errors.Is(err, ErrStateVersion) || unchanged.Template != "kept" {
+			t.Errorf("%s: expected ErrStateVersion and an unchanged pattern, got %v", doc, err)
+		}
+	}
+}
+
+// TestDrain3Compatibility tests importing and exporting Drain3 snapshots
+func TestDrain3Compatibility(t *testing.T) {
+	snapshot := `{"py/object": "drain3.drain.Drain", "log_cluster_depth": 4, "max_node_depth": 2, "sim_th": 0.4,
+		"max_children": 100, "root_node": {"py/object": "drain3.drain.Node", "key_to_child_node": {"4": {"py/object":
+		"drain3.drain.Node", "key_to_child_node": {"User": {"py/object": "drain3.drain.Node", "key_to_child_node": {},
+		"cluster_ids": [1]}}, "cluster_ids": []}}, "cluster_ids": []},
+		"profiler": {"py/object": "drain3.simple_profiler.NullProfiler"}, "extra_delimiters": [], "max_clusters": null,
+		"param_str": "<*>", "parametrize_numeric_tokens": true, "id_to_cluster": {
+		"json://1": {"py/object": "drain3.drain.LogCluster", "log_template_tokens": {"py/tuple": ["User", "<*>", "logged", "in"]}, "cluster_id": 1, "size": 7},
+		"json://3": {"py/object": "drain3.drain.LogCluster", "log_template_tokens": {"py/tuple": ["Disk", "<*>", "full"]}, "cluster_id": 3, "size": 2}},
+		"clusters_counter": 3}`
+
+	parser := NewAWSOMLP()
+	if err := parser.ImportDrain3(strings.NewReader(snapshot)); err != nil {
+		t.Fatalf("Failed to import Drain3 state: %v", err)
+	}
+
+	expected := []TemplateCount{{Template: "User <*> logged in", Count: 7}, {Template: "Disk <*> full", Count: 2}}
+	if got := parser.GetTemplatesByFrequency(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	// Imported templates keep matching new lines
+	if result, _ := parser.Feed("User 42 logged in"); result.PatternID != 0 || result.Template != "User <*> logged in" {
+		t.Errorf("Expected the line to match the imported cluster, got %+v", result)
+	}
+	if result, _ := parser.Feed("Service started"); result.PatternID != 3 {
+		t.Errorf("Expected new patterns to continue after cluster IDs, got ID %d", result.PatternID)
+	}
+
+	// Export, compressed and plain, and import back
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := parser.ExportDrain3(&buf, compress); err != nil {
+			t.Fatalf("Failed to export Drain3 state: %v", err)
+		}
+		if compress == (buf.Bytes()[0] == '{') {
+			t.Errorf("compress=%v: unexpected encoding %q", compress, buf.String()[:10])
+		}
+
+		roundTrip := NewAWSOMLP()
+		if err := roundTrip.ImportDrain3(&buf); err != nil {
+			t.Fatalf("Failed to re-import exported state: %v", err)
+		}
+		if !reflect.DeepEqual(roundTrip.GetTemplatesByFrequency(), parser.GetTemplatesByFrequency()) {
+			t.Errorf("compress=%v: templates differ after round trip: %v", compress, roundTrip.GetTemplatesByFrequency())
+		}
+	}
+
+	// The prefix tree is keyed by token count, then by leading token
+	var buf bytes.Buffer
+	parser.ExportDrain3(&buf, false)
+	var exported struct {
+		Root struct {
+			Children map[string]struct {
+				Children map[string]struct {
+					ClusterIDs []int `json:"cluster_ids"`
+				} `json:"key_to_child_node"`
+			} `json:"key_to_child_node"`
+		} `json:"root_node"`
+		Counter int `json:"clusters_counter"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("Failed to decode export: %v", err)
+	}
+	if ids := exported.Root.Children["4"].Children["User"].ClusterIDs; !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("Expected cluster 1 under 4/User, got %v", ids)
+	}
+	if exported.Counter != 4 {
+		t.Errorf("Expected clusters_counter 4, got %d", exported.Counter)
+	}
+
+	if err := NewAWSOMLP().ImportDrain3(strings.NewReader(`{"foo": 1}`)); err == nil {
+		t.Error("Expected an error for a document without clusters")
+	}
+}
+
+// TestDrain3ImportExpiration tests that imported clusters survive the next parse with a TTL set
+func TestDrain3ImportExpiration(t *testing.T) {
+	snapshot := `{"id_to_cluster": {
+		"json://1": {"py/object": "drain3.drain.LogCluster", "log_template_tokens": {"py/tuple": ["User", "<*>", "logged", "in"]}, "cluster_id": 1, "size": 7}},
+		"clusters_counter": 1}`
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, config := range map[string]Config{
+		"PatternTTL":      {PatternTTL: time.Hour},
+		"PatternTTLLines": {PatternTTLLines: 3},
+	} {
+		parser := NewAWSOMLP()
+		parser.now = func() time.Time { return clock }
+		if err := parser.WithConfig(config); err != nil {
+			t.Fatalf("Failed to set config: %v", err)
+		}
+		// Lines seen before the import count towards PatternTTLLines
+		parser.Parse([]string{"Disk 1 full", "Disk 2 full", "Disk 3 full"})
+		if err := parser.ImportDrain3(strings.NewReader(snapshot)); err != nil {
+			t.Fatalf("Failed to import Drain3 state: %v", err)
+		}
+
+		clock = clock.Add(30 * time.Minute)
+		parser.Feed("Service started")
+		if n := parser.Expire(); n != 0 {
+			t.Errorf("%s: expected no patterns to expire, got %d", name, n)
+		}
+		if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{"Service started", "User <*> logged in"}) {
+			t.Errorf("%s: expected the imported cluster to survive, got %v", name, got)
+		}
+	}
+}
+
+// TestProtoRoundTrip tests protobuf model serialization
+func TestProtoRoundTrip(t *testing.T) {
+	original := NewAWSOMLP()
+	original.WithConfig(Config{HeaderRegex: HDFSHeaderRegex})
+	original.Parse(hdfsTestLogs)
+
+	var protoBuf, jsonBuf bytes.Buffer
+	if err := original.ExportProto(&protoBuf); err != nil {
+		t.Fatalf("Failed to export protobuf model: %v", err)
+	}
+	original.ExportState(&jsonBuf)
+	if protoBuf.Len() >= jsonBuf.Len() {
+		t.Errorf("Expected protobuf (%d bytes) to be smaller than JSON (%d bytes)", protoBuf.Len(), jsonBuf.Len())
+	}
+
+	restored := NewAWSOMLP()
+	if err := restored.ImportProto(&protoBuf); err != nil {
+		t.Fatalf("Failed to import protobuf model: %v", err)
+	}
+
+	var restoredJSON bytes.Buffer
+	restored.ExportState(&restoredJSON)
+	if restoredJSON.String() != jsonBuf.String() {
+		t.Errorf("State differs after protobuf round trip.\nExpected: %s\nGot: %s", jsonBuf.String(), restoredJSON.String())
+	}
+
+	// Model{version: 2, next_id: 1, patterns: [{id: 0, template: "a <*>", count: 3}]} as written by protoc-generated code
+	wire := []byte{0x08, 0x02, 0x10, 0x01, 0x2a, 0x09, 0x12, 0x05, 'a', ' ', '<', '*', '>', 0x20, 0x03}
+	parser := NewAWSOMLP()
+	if err := parser.ImportProto(bytes.NewReader(wire)); err != nil {
+		t.Fatalf("Failed to import hand-encoded model: %v", err)
+	}
+	if patterns := parser.GetPatterns(); len(patterns) != 1 || patterns[0].Template != "a <*>" || patterns[0].Count != 3 {
+		t.Errorf("Unexpected patterns from hand-encoded model: %+v", patterns)
+	}
+
+	// Model{version: 3, config: {}} stored an unlimited MaxLineLength as 0
+	if err := parser.ImportProto(bytes.NewReader([]byte{0x08, 0x03, 0x32, 0x00})); err != nil || parser.config.MaxLineLength != -1 {
+		t.Errorf("Expected an unlimited MaxLineLength from a version 3 model, got %d, %v", parser.config.MaxLineLength, err)
+	}
+	protoBuf.Reset()
+	parser.ExportProto(&protoBuf)
+	if err := restored.ImportProto(&protoBuf); err != nil || restored.config.MaxLineLength != -1 {
+		t.Errorf("Expected an unlimited MaxLineLength after a round trip, got %d, %v", restored.config.MaxLineLength, err)
+	}
+
+	if err := parser.ImportProto(bytes.NewReader([]byte{0x08, 0x63})); !errors.Is(err, ErrStateVersion) {
+		t.Errorf("Expected ErrStateVersion for version 99, got %v", err)
+	}
+	if err := parser.ImportProto(bytes.NewReader(wire[:8])); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
+
+// TestParserSet tests namespace isolation and parser set snapshots
+func TestParserSet(t *testing.T) {
+	set, err := NewParserSet(Config{MaxEventsPerPattern: 2})
+	if err != nil {
+		t.Fatalf("Failed to create parser set: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, namespace := range []string{"billing", "auth"} {
+		wg.Add(1)
+		go func(namespace string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				set.Feed(namespace, fmt.Sprintf("User %d logged in", i))
+			}
+		}(namespace)
+	}
+	wg.Wait()
+	set.Feed("billing", "Invoice 7 created")
+
+	stats := set.Stats()
+	expected := []NamespaceStats{
+		{Namespace: "auth", Patterns: 1, Lines: 50},
+		{Namespace: "billing", Patterns: 2, Lines: 51},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected stats %v, got %v", expected, stats)
+	}
+	if got := set.Parser("auth").GetTemplates(); !reflect.DeepEqual(got, []string{"User <*> logged in"}) {
+		t.Errorf("Expected auth templates to be isolated from billing, got %v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := set.ExportState(&buf); err != nil {
+		t.Fatalf("Failed to export parser set: %v", err)
+	}
+	restored, _ := NewParserSet(Config{MaxEventsPerPattern: 2})
+	if err := restored.ImportState(&buf); err != nil {
+		t.Fatalf("Failed to import parser set: %v", err)
+	}
+	if !reflect.DeepEqual(restored.Stats(), stats) {
+		t.Errorf("Expected restored stats %v, got %v", stats, restored.Stats())
+	}
+
+	restored.Remove("auth")
+	if got := restored.Namespaces(); !reflect.DeepEqual(got, []string{"billing"}) {
+		t.Errorf("Expected only billing after removal, got %v", got)
+	}
+
+	if _, err := NewParserSet(Config{MinSimilarity: 2}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for invalid shared config, got %v", err)
+	}
+}
+
+func TestShardedParser(t *testing.T) {
+	var lines []string
+	for i := 0; i < 40; i++ {
+		lines = append(lines,
+			fmt.Sprintf("User %d logged in", i),
+			fmt.Sprintf("Invoice %d created for order %d", i, i*7),
+			fmt.Sprintf("Connection to db%d lost", i%3),
+			fmt.Sprintf("Cache ready with %d entries", i*100))
+	}
+
+	single := NewAWSOMLP()
+	for _, line := range lines {
+		single.Feed(line)
+	}
+
+	sharded, err := NewShardedParser(Config{}, 4)
+	if err != nil {
+		t.Fatalf("Failed to create sharded parser: %v", err)
+	}
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < len(lines); i += 4 {
+				if _, ok := sharded.Feed(lines[i]); !ok {
+					t.Errorf("Feed(%q) not ok", lines[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sharded.Lines() != len(lines) {
+		t.Errorf("Expected %d lines, got %d", len(lines), sharded.Lines())
+	}
+	if got, want := sharded.GetTemplates(), single.GetTemplates(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected templates %v, got %v", want, got)
+	}
+	if got, want := sharded.GetTemplatesByFrequency(), single.GetTemplatesByFrequency(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected template counts %v, got %v", want, got)
+	}
+	user, _ := sharded.Feed("User 99 logged in")
+	invoice, _ := sharded.Feed("Invoice 99 created for order 7")
+	if user.PatternID == invoice.PatternID {
+		t.Errorf("Expected distinct pattern IDs across shards, got %d for both", user.PatternID)
+	}
+
+	if _, ok := sharded.Feed("   "); ok {
+		t.Error("Expected blank line to be skipped")
+	}
+	if _, err := NewShardedParser(Config{}, 0); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for zero shards, got %v", err)
+	}
+}
+
+// TestSegmentation tests that lines of different sources are never grouped together
+func TestSegmentation(t *testing.T) {
+	mixed := []string{
+		"2024-01-02 10:00:00, worker 1 started",
+		"worker 2 started",
+		"2024-01-02 10:00:05, worker 3 started",
+		"worker 4 started",
+	}
+
+	tests := []struct {
+		name     string
+		config   Config
+		patterns int
+	}{
+		{"none", Config{}, 1},
+		{"by header", Config{Segmentation: SegmentByHeader}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewAWSOMLP()
+			if err := parser.WithConfig(tt.config); err != nil {
+				t.Fatalf("Failed to configure parser: %v", err)
+			}
+			parser.Parse(mixed)
+			if got := len(parser.GetPatterns()); got != tt.patterns {
+				t.Errorf("Expected %d patterns, got %d", tt.patterns, got)
+			}
+		})
+	}
+
+	parser := NewAWSOMLP()
+	err := parser.WithConfig(Config{
+		HeaderRegex:  `^(?P<app>\w+): (?P<content>.+)$`,
+		Segmentation: SegmentByField,
+		SegmentField: "app",
+	})
+	if err != nil {
+		t.Fatalf("Failed to configure parser: %v", err)
+	}
+	parser.Parse([]string{"nginx: request served", "redis: request served", "nginx: request served"})
+	segments := make(map[string]int)
+	for _, pattern := range parser.GetPatterns() {
+		segments[pattern.Segment] = pattern.Count
+	}
+	if expected := map[string]int{"nginx": 2, "redis": 1}; !reflect.DeepEqual(segments, expected) {
+		t.Errorf("Expected pattern counts per segment %v, got %v", expected, segments)
+	}
+	expectedSegments := []SegmentTemplates{
+		{Segment: "nginx", Count: 2, Templates: []TemplateCount{{"request served", 2}}},
+		{Segment: "redis", Count: 1, Templates: []TemplateCount{{"request served", 1}}},
+	}
+	if got := parser.GetTemplatesBySegment(); !reflect.DeepEqual(got, expectedSegments) {
+		t.Errorf("Expected templates by segment %+v, got %+v", expectedSegments, got)
+	}
+
+	if got := headerSignature("081109 203518 143 INFO dfs.DataNode: ok"); got != "9 9" {
+		t.Errorf("Expected HDFS signature %q, got %q", "9 9", got)
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{Segmentation: SegmentByField}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig without SegmentField, got %v", err)
+	}
+}
+
+// TestLearnHeaderRegex tests header inference from sample lines
+func TestLearnHeaderRegex(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		fields  []string
+		content string // Expected content of the first line
+	}{
+		{
+			name: "hdfs",
+			lines: []string{
+				"081109 203518 143 INFO dfs.DataNode$PacketResponder: PacketResponder 1 for block blk_38865049064139660 terminating",
+				"081109 203519 145 INFO dfs.FSNamesystem: BLOCK* NameSystem.allocateBlock: /mnt/hadoop/mapred/system/job_200811092030_0001/job.jar",
+			},
+			fields:  []string{"timestamp", "pid", "level", "component"},
+			content: "PacketResponder 1 for block blk_38865049064139660 terminating",
+		},
+		{
+			name: "syslog",
+			lines: []string{
+				"Jan  2 10:00:00 myhost sshd[123]: Accepted password for root",
+				"Jan 12 10:00:01 myhost cron[9]: job started",
+			},
+			fields:  []string{"timestamp", "host", "component"},
+			content: "Accepted password for root",
+		},
+		{
+			name: "java",
+			lines: []string{
+				"2024-01-15 10:30:15.123 INFO [main] com.example.App - Application started",
+				"2024-01-15 10:30:16.001 ERROR [pool-1] com.example.Db - Connection failed",
+			},
+			fields:  []string{"timestamp", "level", "thread", "logger"},
+			content: "Application started",
+		},
+		{
+			name: "timestamp only",
+			lines: []string{
+				"2024-01-02 10:00:00, worker 1 started",
+				"2024-01-02 10:00:05, worker 3 stopped",
+			},
+			fields:  []string{"timestamp"},
+			content: "worker 1 started",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guess := LearnHeaderRegex(tt.lines)
+			if !reflect.DeepEqual(guess.Fields, tt.fields) {
+				t.Errorf("Expected fields %v, got %v (regex %s)", tt.fields, guess.Fields, guess.Regex)
+			}
+			if guess.Confidence != 1 {
+				t.Errorf("Expected confidence 1, got %f", guess.Confidence)
+			}
+
+			parser := NewAWSOMLP()
+			if err := parser.WithConfig(Config{HeaderRegex: guess.Regex}); err != nil {
+				t.Fatalf("Failed to use learned regex %s: %v", guess.Regex, err)
+			}
+			if content, _ := parser.splitHeader(tt.lines[0]); content != tt.content {
+				t.Errorf("Expected content %q, got %q", tt.content, content)
+			}
+		})
+	}
+
+	// Lines without the header lower the confidence
+	lines := []string{"Starting up"}
+	for i := 0; i < 9; i++ {
+		lines = append(lines, fmt.Sprintf("2024-01-02 10:00:0%d [WARN] disk %d almost full", i, i))
+	}
+	if guess := LearnHeaderRegex(lines); guess.Confidence != 0.9 {
+		t.Errorf("Expected confidence 0.9, got %f (regex %s)", guess.Confidence, guess.Regex)
+	}
+
+	if guess := LearnHeaderRegex([]string{"hello world", "user logged in"}); guess.Regex != "" || guess.Confidence != 0 {
+		t.Errorf("Expected no header for plain messages, got %+v", guess)
+	}
+}
+
+// TestSimilarityStrategy tests that adaptive thresholds keep a grown group from absorbing unrelated lines
+func TestSimilarityStrategy(t *testing.T) {
+	lines := []string{"user logged in", "user logged out"}
+	for i := 0; i < 8; i++ {
+		lines = append(lines, "user logged in")
+	}
+	unrelated := "disk full" // Similarity 8/12 to the representative
+
+	tests := []struct {
+		name     string
+		strategy SimilarityStrategy
+		patterns int
+	}{
+		{"fixed", SimilarityFixed, 1},
+		{"group size", SimilarityByGroupSize, 2},
+		{"variance", SimilarityByVariance, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewAWSOMLP()
+			if err := parser.WithConfig(Config{MinSimilarity: 0.5, SimilarityStrategy: tt.strategy}); err != nil {
+				t.Fatalf("Failed to configure parser: %v", err)
+			}
+			parser.Parse(lines)
+			if got := len(parser.GetPatterns()); got != 1 {
+				t.Fatalf("Expected the initial lines to form 1 pattern, got %d", got)
+			}
+
+			// The learned statistics survive a state round trip
+			var buf bytes.Buffer
+			parser.ExportState(&buf)
+			restored := NewAWSOMLP()
+			restored.WithConfig(Config{MinSimilarity: 0.5, SimilarityStrategy: tt.strategy})
+			if err := restored.ImportState(&buf); err != nil {
+				t.Fatalf("Failed to import state: %v", err)
+			}
+
+			restored.Feed(unrelated)
+			if got := len(restored.GetPatterns()); got != tt.patterns {
+				t.Errorf("Expected %d patterns after %q, got %d", tt.patterns, unrelated, got)
+			}
+		})
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{SimilarityStrategy: 7}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for unknown strategy, got %v", err)
+	}
+}
+
+// TestEntropyThreshold tests that varying tokens become placeholders despite passing the frequency threshold
+func TestEntropyThreshold(t *testing.T) {
+	var lines []string
+	users := []string{"anna", "bert", "carl", "dave"} // 2 bits of entropy
+	states := []string{"opened", "closed"}            // 1 bit of entropy
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("user %s %s session", users[i%4], states[i/2%2]))
+	}
+
+	tests := []struct {
+		threshold float64
+		expected  string
+	}{
+		{0, "user anna opened session"},
+		{2, "user <*> opened session"},
+		{1, "user <*> <*> session"},
+	}
+	for _, tt := range tests {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(Config{EntropyThreshold: tt.threshold}); err != nil {
+			t.Fatalf("Failed to configure parser: %v", err)
+		}
+		parser.Parse(lines)
+		if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{tt.expected}) {
+			t.Errorf("EntropyThreshold %v: expected templates [%s], got %v", tt.threshold, tt.expected, got)
+		}
+	}
+
+	// Too few events give no reliable estimate
+	parser := NewAWSOMLP()
+	parser.WithConfig(Config{EntropyThreshold: 1})
+	parser.Parse(lines[:4])
+	if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{"user anna opened session"}) {
+		t.Errorf("Expected small groups to be left alone, got %v", got)
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{EntropyThreshold: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative EntropyThreshold, got %v", err)
+	}
+}
+
+// TestPositionalFrequency tests counting token frequencies per position
+func TestPositionalFrequency(t *testing.T) {
+	// "anna" occurs in every line, but never always at the same position
+	lines := []string{"copy anna to bert", "copy bert to anna", "copy anna to carl"}
+
+	tests := []struct {
+		counting FreqCounting
+		expected string
+	}{
+		{FreqCountGlobal, "copy anna to <*>"},
+		{FreqCountPositional, "copy <*> to <*>"},
+	}
+	for _, tt := range tests {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(Config{FreqThresholdStrategy: FreqAll, FreqCounting: tt.counting}); err != nil {
+			t.Fatalf("Failed to configure parser: %v", err)
+		}
+		parser.Parse(lines)
+		if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{tt.expected}) {
+			t.Errorf("FreqCounting %d: expected templates [%s], got %v", tt.counting, tt.expected, got)
+		}
+
+		// Positional counts survive the protobuf round trip
+		var buf bytes.Buffer
+		parser.ExportProto(&buf)
+		restored := NewAWSOMLP()
+		restored.WithConfig(Config{FreqThresholdStrategy: FreqAll, FreqCounting: tt.counting})
+		if err := restored.ImportProto(&buf); err != nil {
+			t.Fatalf("Failed to import model: %v", err)
+		}
+		if !reflect.DeepEqual(restored.GetPatterns()[0].PositionFrequency, parser.GetPatterns()[0].PositionFrequency) {
+			t.Errorf("Expected position frequencies %v, got %v",
+				parser.GetPatterns()[0].PositionFrequency, restored.GetPatterns()[0].PositionFrequency)
+		}
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{FreqCounting: 5}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for unknown FreqCounting, got %v", err)
+	}
+}
+
+// TestBucketByTokenCount tests that only events with patterns of about the same token count are grouped
+func TestBucketByTokenCount(t *testing.T) {
+	// Same number of letters, different structure
+	lines := []string{"user admin logged in", "useradmin logged in", "user root logged in"}
+
+	tests := []struct {
+		name     string
+		config   Config
+		patterns int
+	}{
+		{"disabled", Config{}, 2},
+		{"identical counts", Config{BucketByTokenCount: true}, 3},
+		{"tolerance", Config{BucketByTokenCount: true, TokenCountTolerance: 1}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewAWSOMLP()
+			if err := parser.WithConfig(tt.config); err != nil {
+				t.Fatalf("Failed to configure parser: %v", err)
+			}
+			parser.Parse(lines)
+			if got := len(parser.GetPatterns()); got != tt.patterns {
+				t.Errorf("Expected %d patterns, got %d", tt.patterns, got)
+			}
+		})
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{TokenCountTolerance: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative TokenCountTolerance, got %v", err)
+	}
+}
+
+func BenchmarkBucketByTokenCount(b *testing.B) {
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, strings.Repeat("w", 1+i%300)+strings.Repeat(" x", i%20))
+	}
+
+	for _, bucket := range []bool{false, true} {
+		b.Run(fmt.Sprintf("bucket=%v", bucket), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parser := NewAWSOMLP()
+				parser.WithConfig(Config{BucketByTokenCount: bucket})
+				parser.Parse(lines)
+			}
+		})
+	}
+}
+
+// TestApproximateGrouping tests LSH candidate retrieval against the exact search
+func TestApproximateGrouping(t *testing.T) {
+	exact := NewAWSOMLP()
+	exact.WithConfig(Config{HeaderRegex: HDFSHeaderRegex})
+	approximate := NewAWSOMLP()
+	if err := approximate.WithConfig(Config{HeaderRegex: HDFSHeaderRegex, ApproximateGrouping: true}); err != nil {
+		t.Fatalf("Failed to configure parser: %v", err)
+	}
+	if got, expected := approximate.Parse(hdfsTestLogs), exact.Parse(hdfsTestLogs); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the same templates as the exact search.\nExpected: %v\nGot: %v", expected, got)
+	}
+
+	// Lines with the same letter count but no common words are never compared
+	lines := []string{"disk full", "user gone", "disk full"}
+	exact = NewAWSOMLP()
+	exact.Parse(lines)
+	approximate = NewAWSOMLP()
+	approximate.WithConfig(Config{ApproximateGrouping: true})
+	approximate.Parse(lines)
+	if got := []int{len(exact.GetPatterns()), len(approximate.GetPatterns())}; !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Expected 1 exact and 2 approximate patterns, got %v", got)
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{LSHRows: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative LSHRows, got %v", err)
+	}
+}
+
+func BenchmarkApproximateGrouping(b *testing.B) {
+	words := strings.Fields("alpha bravo charlie delta echo foxtrot golf hotel india juliett kilo lima mike november oscar papa")
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, fmt.Sprintf("%s %s %s value", words[i%16], words[i/16%16], words[i/256%16]))
+	}
+
+	for _, approximate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("approximate=%v", approximate), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parser := NewAWSOMLP()
+				parser.WithConfig(Config{ApproximateGrouping: approximate, StrictAlphabeticalMatching: true})
+				parser.Parse(lines)
+			}
+		})
+	}
+}
+
+// TestFreqSketch tests counting token frequencies of large groups in a count-min sketch
+func TestFreqSketch(t *testing.T) {
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("request u%04d done", i))
+	}
+
+	exact := NewAWSOMLP()
+	exact.WithConfig(Config{FreqThresholdStrategy: FreqAll})
+	sketched := NewAWSOMLP()
+	if err := sketched.WithConfig(Config{FreqThresholdStrategy: FreqAll, FreqSketchThreshold: 100}); err != nil {
+		t.Fatalf("Failed to configure parser: %v", err)
+	}
+	if got, expected := sketched.Parse(lines), exact.Parse(lines); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the same templates as with exact counts.\nExpected: %v\nGot: %v", expected, got)
+	}
+	if got := sketched.GetTemplates(); !reflect.DeepEqual(got, []string{"request <*> done"}) {
+		t.Errorf("Expected template [request <*> done], got %v", got)
+	}
+	if got := len(sketched.GetPatterns()[0].Frequency); got != 0 {
+		t.Errorf("Expected the frequency map to be replaced by the sketch, got %d tokens", got)
+	}
+
+	// The sketch is part of the state
+	var buf bytes.Buffer
+	sketched.ExportState(&buf)
+	restored := NewAWSOMLP()
+	restored.WithConfig(Config{FreqThresholdStrategy: FreqAll, FreqSketchThreshold: 100})
+	if err := restored.ImportState(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to import state: %v", err)
+	}
+	if result, _ := restored.Feed("request u9999 done"); result.Template != "request <*> done" {
+		t.Errorf("Expected template %q after restoring, got %q", "request <*> done", result.Template)
+	}
+
+	corrupt := bytes.Replace(buf.Bytes(), []byte(`"sketch":"`), []byte(`"sketch":"AAAA`), 1)
+	if err := NewAWSOMLP().ImportState(bytes.NewReader(corrupt)); err == nil {
+		t.Error("Expected an error for a sketch of the wrong size")
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{FreqSketchThreshold: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for negative FreqSketchThreshold, got %v", err)
+	}
+}
+
+// TestReparse tests applying a new configuration to parsed data
+func TestReparse(t *testing.T) {
+	lines := []string{"user logged in", "user logged out", "disk full", "user logged in"}
+	parser := NewAWSOMLP()
+	events := parser.ParseEvents(lines)
+	if got := len(parser.GetPatterns()); got != 3 {
+		t.Fatalf("Expected 3 patterns, got %d", got)
+	}
+
+	// Regrouping with a lower threshold merges login and logout
+	if err := parser.Reparse(Config{MinSimilarity: 0.9, FreqThresholdStrategy: FreqAll}); err != nil {
+		t.Fatalf("Failed to reparse: %v", err)
+	}
+	if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{"disk full", "user logged <*>"}) {
+		t.Errorf("Expected merged templates, got %v", got)
+	}
+	if events[1].Template != "user logged <*>" || events[1].PatternID != events[0].PatternID {
+		t.Errorf("Expected returned events to be updated, got %+v", events[1])
+	}
+
+	// Template settings only regenerate templates
+	if err := parser.Reparse(Config{MinSimilarity: 0.9, FreqThresholdStrategy: FreqMin}); err != nil {
+		t.Fatalf("Failed to reparse: %v", err)
+	}
+	if got := parser.GetTemplates(); !reflect.DeepEqual(got, []string{"disk full", "user logged in"}) {
+		t.Errorf("Expected regenerated templates, got %v", got)
+	}
+
+	// New custom regexes preprocess the raw lines again
+	if err := parser.Reparse(Config{CustomRegexes: []string{`\b(in|out)$`}}); err != nil {
+		t.Fatalf("Failed to reparse: %v", err)
+	}
+	if got := parser.GetTemplatesByFrequency(); !reflect.DeepEqual(got, []TemplateCount{{"user logged <*>", 3}, {"disk full", 1}}) {
+		t.Errorf("Expected masked templates, got %v", got)
+	}
+
+	// Regrouping needs all events
+	bounded := NewAWSOMLP()
+	bounded.WithConfig(Config{MaxEventsPerPattern: 1})
+	bounded.Parse(lines)
+	if err := bounded.Reparse(Config{MaxEventsPerPattern: 1, MinSimilarity: 0.5}); !errors.Is(err, ErrEventsDiscarded) {
+		t.Errorf("Expected ErrEventsDiscarded, got %v", err)
+	}
+	if err := bounded.Reparse(Config{MinSimilarity: 2}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+	if got := len(bounded.GetPatterns()); got != 3 {
+		t.Errorf("Expected the patterns to be unchanged, got %d", got)
+	}
+
+	// A configuration failing on a later regex leaves the preprocessing unchanged
+	masking := NewAWSOMLP()
+	masking.WithConfig(Config{CustomRegexes: []string{`\bok$`}})
+	before := masking.Preprocess("login user42 ok").Content
+	invalid := Config{CustomRegexes: []string{`user\w+`, `(`}}
+	if err := masking.Reparse(invalid); err == nil {
+		t.Error("Expected an error for an invalid custom regex")
+	}
+	if err := masking.Reconfigure(invalid); err == nil {
+		t.Error("Expected an error for an invalid custom regex")
+	}
+	if got := masking.Preprocess("login user42 ok").Content; got != before {
+		t.Errorf("Expected %q after the failed reparse, got %q", before, got)
+	}
+}
+
+// TestReconfigure tests reconfiguring parsers that keep learning
+func TestReconfigure(t *testing.T) {
+	lines := []string{"user logged in", "user logged out", "user logged in"}
+	parser := NewAWSOMLP()
+	parser.WithConfig(Config{MaxEventsPerPattern: 1})
+	for _, line := range lines {
+		parser.Feed(line)
+	}
+
+	// Without all lines the patterns keep their grouping
+	if err := parser.Reconfigure(Config{MaxEventsPerPattern: 1, MinSimilarity: 0.9, FreqThresholdStrategy: FreqAll}); err != nil {
+		t.Fatalf("Failed to reconfigure: %v", err)
+	}
+	if got := len(parser.GetPatterns()); got != 2 {
+		t.Errorf("Expected 2 patterns, got %d", got)
+	}
+	if res, _ := parser.Feed("user logged off"); res.Template != "user logged <*>" {
+		t.Errorf("Expected new lines to use the new threshold, got %q", res.Template)
+	}
+
+	set, _ := NewParserSet(Config{})
+	for _, line := range lines {
+		set.Feed("auth", line)
+	}
+	if err := set.Reconfigure(Config{MinSimilarity: 2}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+	if err := set.Reconfigure(Config{MinSimilarity: 0.9, FreqThresholdStrategy: FreqAll}); err != nil {
+		t.Fatalf("Failed to reconfigure: %v", err)
+	}
+	if got := set.Parser("auth").GetTemplates(); !reflect.DeepEqual(got, []string{"user logged <*>"}) {
+		t.Errorf("Expected regrouped templates, got %v", got)
+	}
+	if res, _ := set.Feed("billing", "user logged off"); res.Template != "user logged off" {
+		t.Errorf("Expected new namespace to use the new configuration, got %q", res.Template)
+	}
+}
+
+// TestCalendarWords tests the masking modes of month and weekday names
+func TestCalendarWords(t *testing.T) {
+	lines := []string{
+		"Deploying service May to Sun cluster",
+		"Report for Mon Jan 15 ready",
+		"Backup of 5 May finished on Sunday",
+		"Release planned for June, 2024",
+	}
+	tests := []struct {
+		mode CalendarWordMasking
+		want []string
+	}{
+		{CalendarWordsAlways, []string{
+			"Deploying service <*> to <*> cluster",
+			"Report for <*> <*> 15 ready",
+			"Backup of 5 <*> finished on <*>",
+			"Release planned for <*>, 2024",
+		}},
+		{CalendarWordsInDates, []string{
+			"Deploying service May to Sun cluster",
+			"Report for <*> <*> 15 ready",
+			"Backup of 5 <*> finished on Sunday",
+			"Release planned for <*>, 2024",
+		}},
+		{CalendarWordsNever, []string{
+			"Deploying service May to Sun cluster",
+			"Report for Mon Jan 15 ready",
+			"Backup of 5 May finished on Sunday",
+			"Release planned for June, 2024",
+		}},
+	}
+	for _, tt := range tests {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(Config{CalendarWords: tt.mode}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i, line := range lines {
+			if got := parser.Preprocess(line).Content; got != tt.want[i] {
+				t.Errorf("Mode %d: expected %q, got %q", tt.mode, tt.want[i], got)
+			}
+		}
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{CalendarWords: CalendarWordsNever + 1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+// TestNumericalUnits tests the replacement of numbers with units, ranges and ratios
+func TestNumericalUnits(t *testing.T) {
+	tests := []struct {
+		line, template string
+	}{
+		{"Disk usage at 85% of quota", "Disk usage at <*> of quota"},
+		{"Heap grew to 1.5GiB from 512MiB", "Heap grew to <*> from <*>"},
+		{"Transfer ran at 20MB/s for 3s", "Transfer ran at <*> for <*>"},
+		{"Retry in 10-20ms after (5-10%) loss", "Retry in <*> after (<*>) loss"},
+		{"Replicas ready 3/4 in zone", "Replicas ready <*> in zone"},
+	}
+	for _, tt := range tests {
+		parser := NewAWSOMLP()
+		parser.ParseEvents([]string{tt.line})
+		if templates := parser.GetTemplates(); len(templates) != 1 || templates[0] != tt.template {
+			t.Errorf("Expected template %q for %q, got %v", tt.template, tt.line, templates)
+		}
+	}
+}
+
+// TestMaskThreads tests masking of thread names and IDs
+func TestMaskThreads(t *testing.T) {
+	tests := []struct {
+		line, masked string
+	}{
+		{"[pool-2-thread-17] Task done", "[pool-<*>-thread-<*>] Task done"},
+		{"Exception in Thread-42 ignored", "Exception in Thread-<*> ignored"},
+		{"Request on http-nio-8080-exec-10 served", "Request on http-nio-<*>-exec-<*> served"},
+		{"ForkJoinPool.commonPool-worker-5 idle", "ForkJoinPool.commonPool-worker-<*> idle"},
+		{"goroutine 1234 [running]:", "goroutine <*> [running]:"},
+		{"Lock held by tid=4711", "Lock held by tid=<*>"},
+		{"Worker pool started", "Worker pool started"},
+	}
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaskThreads: true}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, tt := range tests {
+		if got := parser.Preprocess(tt.line).Content; got != tt.masked {
+			t.Errorf("Expected %q, got %q", tt.masked, got)
+		}
+	}
+
+	// Off by default
+	if got := NewAWSOMLP().Preprocess("Exception in Thread-42 ignored").Content; got != "Exception in Thread-42 ignored" {
+		t.Errorf("Expected thread names to be kept by default, got %q", got)
+	}
+}
+
+// TestMaskQuoted tests masking of quoted strings
+func TestMaskQuoted(t *testing.T) {
+	tests := []struct {
+		line, masked string
+	}{
+		{`Cannot open 'report 2024.pdf' for "bob"`, `Cannot open '<*>' for "<*>"`},
+		{`Don't retry the users' jobs`, `Don't retry the users' jobs`},
+		{`Value "say \"hi\"" rejected`, `Value "<*>" rejected`},
+		{`Payload {"user": "alice", "note": ""}`, `Payload {"user": "<*>", "note": "<*>"}`},
+		{`Unterminated "quote here`, `Unterminated "quote here`},
+	}
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{MaskQuoted: true}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, tt := range tests {
+		if got := parser.Preprocess(tt.line).Content; got != tt.masked {
+			t.Errorf("Expected %q, got %q", tt.masked, got)
+		}
+	}
+
+	// Off by default
+	if got := NewAWSOMLP().Preprocess(`Cannot open 'a.pdf'`).Content; got != `Cannot open 'a.pdf'` {
+		t.Errorf("Expected quoted strings to be kept by default, got %q", got)
+	}
+}
+
+// TestBrackets tests the bracket masking rules
+func TestBrackets(t *testing.T) {
+	line := "Call (AuthController) from [worker] with {alpha beta} as <admin> ok (42)"
+	tests := []struct {
+		name     string
+		brackets []BracketRule
+		want     string
+	}{
+		{"default", nil, "Call <*> from [worker] with {alpha beta} as <admin> ok (42)"},
+		{"none", []BracketRule{}, line},
+		{"kept brackets", []BracketRule{
+			{Brackets: "[]", KeepBrackets: true},
+			{Brackets: "<>", KeepBrackets: true},
+			{Brackets: "{}", Content: `[a-z ]+`, KeepBrackets: true},
+		}, "Call (AuthController) from [<*>] with {<*>} as <<*>> ok (42)"},
+		{"charset and length", []BracketRule{
+			{Brackets: "()", Content: `[0-9]+`},
+			{Brackets: "[]", MaxLength: 4},
+		}, "Call (AuthController) from [worker] with {alpha beta} as <admin> ok <*>"},
+	}
+	for _, tt := range tests {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(Config{Brackets: tt.brackets}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if got := parser.Preprocess(line).Content; got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	for _, invalid := range [][]BracketRule{
+		{{Brackets: "||"}},
+		{{Brackets: "[]", MinLength: 5, MaxLength: 2}},
+	} {
+		if err := NewAWSOMLP().WithConfig(Config{Brackets: invalid}); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Expected ErrInvalidConfig for %v, got %v", invalid, err)
+		}
+	}
+	var regexErr *RegexError
+	if err := NewAWSOMLP().WithConfig(Config{Brackets: []BracketRule{{Brackets: "()", Content: "[a-"}}}); !errors.As(err, &regexErr) {
+		t.Errorf("Expected a RegexError, got %v", err)
+	}
+}
+
+func TestColumnRules(t *testing.T) {
+	line := "audit: user alice comment fixed the login bug"
+	tests := []struct {
+		name  string
+		rules []ColumnRule
+		want  string
+	}{
+		{"none", nil, line},
+		{"single token", []ColumnRule{{Column: 3}}, "audit: user <*> comment fixed the login bug"},
+		{"rest of line", []ColumnRule{{Match: `^audit:`, Column: 5, Tokens: -1}}, "audit: user alice comment <*>"},
+		{"from the end", []ColumnRule{{Column: -2, Tokens: 2}}, "audit: user alice comment fixed the <*>"},
+		{"in order", []ColumnRule{{Column: 5, Tokens: -1}, {Column: 3}}, "audit: user <*> comment <*>"},
+		{"not matching", []ColumnRule{{Match: `^access:`, Column: 1}}, line},
+		{"out of range", []ColumnRule{{Column: 20}, {Column: -20}}, line},
+	}
+	for _, tt := range tests {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(Config{ColumnRules: tt.rules}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		event := parser.Preprocess(line)
+		if event.Content != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, event.Content)
+		}
+		if !slices.Equal(event.Tokens, strings.Fields(tt.want)) {
+			t.Errorf("%s: expected the tokens of %q, got %q", tt.name, tt.want, event.Tokens)
+		}
+	}
+
+	// Free-text comments of any length share a template
+	parser := NewAWSOMLP()
+	parser.WithConfig(Config{ColumnRules: []ColumnRule{{Match: `^audit:`, Column: 5, Tokens: -1}, {Match: `^audit:`, Column: 3}}})
+	parser.Parse([]string{line, "audit: user bob comment rolled back", "audit: user carol comment ok"})
+	if templates := parser.GetTemplatesByFrequency(); len(templates) != 1 || templates[0].Template != "audit: user <*> comment <*>" {
+		t.Errorf("Expected one template for the free-text comments, got %v", templates)
+	}
+
+	for _, invalid := range [][]ColumnRule{
+		{{Column: 0}},
+		{{Column: 1, Tokens: -2}},
+	} {
+		if err := NewAWSOMLP().WithConfig(Config{ColumnRules: invalid}); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Expected ErrInvalidConfig for %v, got %v", invalid, err)
+		}
+	}
+	var regexErr *RegexError
+	if err := NewAWSOMLP().WithConfig(Config{ColumnRules: []ColumnRule{{Match: "[a-", Column: 1}}}); !errors.As(err, &regexErr) {
+		t.Errorf("Expected a RegexError, got %v", err)
+	}
+}
+
+// TestPathMasking tests the masking of Unix, Windows and UNC paths
+func TestPathMasking(t *testing.T) {
+	lines := []string{
+		`Reading /etc/app/config.yaml done`,
+		`Reading /etc/hosts done`,
+		`Opened C:\Windows failed`,
+		`Loaded C:\Program Files\App\app.exe with flags`,
+		`Mounted \\fileserver\share\reports\q1.xlsx read-only`,
+		`Saved D:backup\db.bak today`,
+		`Copied D:/data/in.csv to out`,
+		`Parsed {"file": "C:\\app\\conf.json"} ok`,
+	}
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"default", Config{}, []string{
+			`Reading <*> done`,
+			`Reading /etc/hosts done`,
+			`Opened <*> failed`,
+			`Loaded <*> with flags`,
+			`Mounted <*> read-only`,
+			`Saved <*> today`,
+			`Copied <*> to out`,
+			`Parsed {"file": "<*>"} ok`,
+		}},
+		{"two segments", Config{PathMinSegments: 2}, []string{
+			`Reading <*> done`,
+			`Reading <*> done`,
+			`Opened <*> failed`,
+			`Loaded <*> with flags`,
+			`Mounted <*> read-only`,
+			`Saved <*> today`,
+			`Copied <*> to out`,
+			`Parsed {"file": "<*>"} ok`,
+		}},
+		{"keep", Config{KeepPaths: true}, lines},
+	}
+	for _, tt := range tests {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(tt.config); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i, line := range lines {
+			if got := parser.Preprocess(line).Content; got != tt.want[i] {
+				t.Errorf("%s: expected %q, got %q", tt.name, tt.want[i], got)
+			}
+		}
+	}
+
+	if err := NewAWSOMLP().WithConfig(Config{PathMinSegments: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	content := "User alice logged in\r\n\nUser bob logged in\nUser carol logged in"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := MapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if file.Len() != len(content) {
+		t.Errorf("Len() = %d, want %d", file.Len(), len(content))
+	}
+	var lines []string
+	for line := range file.Lines() {
+		lines = append(lines, line)
+	}
+	want := []string{"User alice logged in", "", "User bob logged in", "User carol logged in"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Lines() = %q, want %q", lines, want)
+	}
+
+	parser := NewAWSOMLP()
+	events := parser.ParseMapped(file)
+	if len(events) != 3 {
+		t.Fatalf("ParseMapped() returned %d events, want 3", len(events))
+	}
+	if events[2].Raw != "User carol logged in" {
+		t.Errorf("events[2].Raw = %q", events[2].Raw)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.log")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile, err := MapFile(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line := range emptyFile.Lines() {
+		t.Errorf("empty file yielded %q", line)
+	}
+	if err := emptyFile.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	tests := []struct {
+		template string
+		params   []string
+		want     string
+	}{
+		{"User <*> logged in from <*>", []string{"alice", "10.0.0.1"}, "User alice logged in from 10.0.0.1"},
+		{"Disk usage [<*>] at <*>%", []string{"sda1", "93"}, "Disk usage [sda1] at 93%"},
+		{"<*>", []string{"<*>"}, "<*>"},
+		{"Service started", nil, "Service started"},
+	}
+	for _, tt := range tests {
+		got, err := Reconstruct(tt.template, tt.params)
+		if err != nil {
+			t.Errorf("Reconstruct(%q, %q) failed: %v", tt.template, tt.params, err)
+		} else if got != tt.want {
+			t.Errorf("Reconstruct(%q, %q) = %q, want %q", tt.template, tt.params, got, tt.want)
+		}
+	}
+
+	if _, err := Reconstruct("User <*> logged in", []string{"a", "b"}); !errors.Is(err, ErrParamCount) {
+		t.Errorf("Expected ErrParamCount for extra parameters, got %v", err)
+	}
+	if _, err := Reconstruct("User <*> logged in from <*>", []string{"a"}); !errors.Is(err, ErrParamCount) {
+		t.Errorf("Expected ErrParamCount for missing parameters, got %v", err)
+	}
+}
+
+// TestExtractParams tests recovering the values behind the placeholders of a line
+func TestExtractParams(t *testing.T) {
+	template := "PacketResponder <*> for block <*> terminating"
+	raw := "081109 203615 148 INFO dfs.DataNode$PacketResponder: PacketResponder 1 for block blk_38865049064139660 terminating"
+	if got, want := ExtractParams(template, raw), []string{"1", "blk_38865049064139660"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractParams = %q, want %q", got, want)
+	}
+	if got := ExtractParams(template, "Disk quota exceeded"); got != nil {
+		t.Errorf("Expected nil for a line not matching the template, got %q", got)
+	}
+	if got := ExtractParams("Service started", "Service started"); got == nil || len(got) != 0 {
+		t.Errorf("Expected no parameters for a static template, got %#v", got)
+	}
+
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{HeaderRegex: HDFSHeaderRegex}); err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		raw,
+		"081109 203807 222 INFO dfs.DataNode$PacketResponder: PacketResponder 0 for block blk_-6952295868487656571 terminating",
+		"081109 204005 35 INFO dfs.DataNode$PacketResponder: PacketResponder 2 for block blk_7128370237687728475 terminating",
+	}
+	for _, event := range parser.ParseEvents(lines) {
+		if event.Template != template {
+			t.Fatalf("Expected template %q, got %q", template, event.Template)
+		}
+		params := event.Params()
+		if reconstructed, err := Reconstruct(template, params); err != nil || !strings.HasSuffix(event.Raw, reconstructed) {
+			t.Errorf("Params %q of %q do not reconstruct the message: %q, %v", params, event.Raw, reconstructed, err)
+		}
+	}
+
+	result, _ := parser.Feed(lines[0])
+	if got, want := result.Params(), []string{"1", "blk_38865049064139660"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseResult.Params = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{FreqThresholdStrategy: FreqAll}); err != nil {
+		t.Fatal(err)
+	}
+	events := parser.ParseEvents([]string{
+		"Disk sda1 uses IEEE 754 floats at 10.0.0.1",
+		"Disk sdb2 uses IEEE 754 floats at 10.0.0.2",
+		"User alice logged in",
+	})
+	events = append(events, &LogEvent{Raw: "Cache rebuilt", Template: "Cache <*> cleared"})
+
+	issues := parser.VerifyRoundTrip(events)
+	if len(issues) != 2 {
+		t.Fatalf("Expected 2 issues, got %+v", issues)
+	}
+	constant := issues[0]
+	if constant.Kind != RoundTripConstant || constant.Value != "754" || constant.Lines != 2 || constant.Index != 0 {
+		t.Errorf("Expected constant placeholder 754 over 2 lines, got %+v", constant)
+	}
+	lossy := issues[1]
+	if lossy.Kind != RoundTripLossy || lossy.Index != 3 || lossy.Raw != "Cache rebuilt" {
+		t.Errorf("Expected lossy line 3, got %+v", lossy)
+	}
+	if lossy.Kind.String() != "lossy" || constant.Kind.String() != "constant" {
+		t.Errorf("Unexpected kind names %q and %q", lossy.Kind, constant.Kind)
+	}
+}
+
+func TestTemplateTree(t *testing.T) {
+	parser := NewAWSOMLP()
+	for i, tc := range []TemplateCount{
+		{"User <*> logged in", 5},
+		{"User admin logged in", 3},
+		{"User <*> logged in from <*>", 4},
+		{"User <*> logged in from 10.0.0.<*>", 2},
+		{"User root logged in from 10.0.0.<*>", 1},
+		{"Disk <*> full", 6},
+	} {
+		parser.patterns = append(parser.patterns, &Pattern{
+			ID: i, Template: tc.Template, Count: tc.Count,
+			Events: []*LogEvent{{Raw: tc.Template}},
+		})
+	}
+
+	tree := parser.TemplateTree()
+	var lines []string
+	tree.Walk(func(node *TemplateNode, depth int) bool {
+		lines = append(lines, fmt.Sprintf("%s%s %d/%d", strings.Repeat("  ", depth), node.Template, node.Count, node.Total))
+		return true
+	})
+	expected := []string{
+		"User <*> logged in 5/8",
+		"  User admin logged in 3/3",
+		"User <*> logged in from <*> 4/7",
+		"  User <*> logged in from 10.0.0.<*> 2/3",
+		"    User root logged in from 10.0.0.<*> 1/1",
+		"Disk <*> full 6/6",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected tree\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	node := tree.Find("User <*> logged in from <*>")
+	if node == nil || node.Descendants() != 2 || node.Parent != nil {
+		t.Fatalf("Expected root with 2 descendants, got %+v", node)
+	}
+	if leaf := tree.Find("User root logged in from 10.0.0.<*>"); leaf == nil || leaf.Parent.Template != "User <*> logged in from 10.0.0.<*>" {
+		t.Errorf("Expected leaf under the 10.0.0.<*> template, got %+v", leaf)
+	}
+	if tree.Find("missing") != nil {
+		t.Error("Expected nil for an unknown template")
+	}
+
+	if got := tree.AtDepth(0); !reflect.DeepEqual(got, []TemplateCount{{"User <*> logged in", 8}, {"User <*> logged in from <*>", 7}, {"Disk <*> full", 6}}) {
+		t.Errorf("Unexpected aggregation at depth 0: %v", got)
+	}
+	expected1 := []TemplateCount{
+		{"Disk <*> full", 6}, {"User <*> logged in", 5}, {"User <*> logged in from <*>", 4},
+		{"User <*> logged in from 10.0.0.<*>", 3}, {"User admin logged in", 3},
+	}
+	if got := tree.AtDepth(1); !reflect.DeepEqual(got, expected1) {
+		t.Errorf("Expected aggregation at depth 1 %v, got %v", expected1, got)
+	}
+}
+
+func TestTemplateIndex(t *testing.T) {
+	ix := NewTemplateIndex([]TemplateCount{
+		{"BLOCK* NameSystem.addStoredBlock: blockMap updated: <*> is added to <*> size <*>", 40},
+		{"BLOCK* NameSystem.addStoredBlock: Redundant addStoredBlock request received for <*> on <*> size <*>", 3},
+		{"BLOCK* NameSystem.allocateBlock: <*> <*>", 20},
+		{"BLOCK* NameSystem.addStoredBlock:", 1},
+		{"Receiving block <*> src: <*> dest: <*>", 60},
+	})
+	if ix.Len() != 5 {
+		t.Errorf("Expected 5 templates, got %d", ix.Len())
+	}
+
+	got := ix.WithPrefix("BLOCK*   NameSystem.addStoredBlock:")
+	expected := []TemplateCount{
+		{"BLOCK* NameSystem.addStoredBlock: blockMap updated: <*> is added to <*> size <*>", 40},
+		{"BLOCK* NameSystem.addStoredBlock: Redundant addStoredBlock request received for <*> on <*> size <*>", 3},
+		{"BLOCK* NameSystem.addStoredBlock:", 1},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if got := ix.WithPrefix("BLOCK*"); len(got) != 4 {
+		t.Errorf("Expected 4 BLOCK* templates, got %v", got)
+	}
+	if got := ix.WithPrefix("Receiving block <*>"); len(got) != 1 || got[0].Count != 60 {
+		t.Errorf("Expected the Receiving template, got %v", got)
+	}
+	if got := ix.WithPrefix("BLOCK* NameSystem.add"); got != nil {
+		t.Errorf("Expected no match for a partial token, got %v", got)
+	}
+	if got := ix.WithPrefix(""); len(got) != 5 || got[0].Count != 60 {
+		t.Errorf("Expected all templates for an empty prefix, got %v", got)
+	}
+}
+
+func TestAlign(t *testing.T) {
+	parse := func(lines ...string) *AWSOMLP {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(Config{FreqThresholdStrategy: FreqAll}); err != nil {
+			t.Fatal(err)
+		}
+		parser.Parse(lines)
+		return parser
+	}
+	previous := parse(
+		"Service started on port 8080",                                         // 0
+		"User alice logged in",                                                 // 1
+		"Connection to db1 closed by peer", "Connection to db2 closed by peer", // 2
+		"Cache flushed", // 3
+	)
+	current := parse(
+		"Backup completed",
+		"Connection to db1 closed by remote peer", "Connection to db2 closed by remote peer",
+		"Service started on port 8080",
+		"User alice logged in", "User brian logged in",
+	)
+
+	got := current.Align(previous, 0)
+	expected := []struct {
+		template string
+		eventID  int
+		method   AlignMethod
+	}{
+		{"Backup completed", 4, AlignNone},
+		{"Connection to <*> closed by remote peer", 2, AlignSimilarity},
+		{"Service started on port <*>", 0, AlignExact},
+		{"User <*> logged in", 1, AlignSubsumption},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d alignments, got %+v", len(expected), got)
+	}
+	for i, e := range expected {
+		a := got[i]
+		if a.PatternID != i || a.Template != e.template || a.EventID != e.eventID || a.Method != e.method {
+			t.Errorf("Alignment %d: expected %q -> %d by %s, got %+v", i, e.template, e.eventID, e.method, a)
+		}
+	}
+	if got[1].Score < DefaultAlignSimilarity || got[1].Score >= 1 {
+		t.Errorf("Expected similarity score below 1, got %v", got[1].Score)
+	}
+
+	// A stricter threshold leaves the shifted template unaligned, with the
+	// next new event ID
+	if a := current.Align(previous, 0.95)[1]; a.Method != AlignNone || a.EventID != 5 {
+		t.Errorf("Expected new event ID 5 with threshold 0.95, got %+v", a)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	// Grouping a line takes 1/256s on the parser's clock
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var reports []Progress
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{
+		ProgressInterval: time.Second,
+		OnProgress:       func(p Progress) { reports = append(reports, p) },
+		BeforeGroup:      func(*LogEvent) { clock = clock.Add(time.Second / 256) },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	parser.now = func() time.Time { return clock }
+
+	lines := make([]string, 4*progressCheckInterval)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("Request %d served", i)
+	}
+	parser.Parse(lines)
+
+	// A report every 256 lines, then the final one
+	if len(reports) != 5 {
+		t.Fatalf("Expected 5 reports, got %+v", reports)
+	}
+	p := reports[0]
+	if p.Lines != 256 || p.Total != 1024 || p.Patterns != 1 || p.Done || p.Elapsed != time.Second {
+		t.Errorf("Unexpected progress report %+v", p)
+	}
+	if p.Rate != 256 || p.ETA != 3*time.Second {
+		t.Errorf("Expected rate 256 lines/s and ETA 3s, got %v and %v", p.Rate, p.ETA)
+	}
+	if last := reports[4]; !last.Done || last.Lines != 1024 || last.ETA != 0 || last.Elapsed != 4*time.Second {
+		t.Errorf("Expected final report of 1024 lines, got %+v", last)
+	}
+
+	// ParseChunked reports the lines of all chunks with an unknown total
+	reports = nil
+	if _, err := parser.ParseChunked(strings.NewReader(strings.Join(lines, "\n")), 100); err != nil {
+		t.Fatal(err)
+	}
+	last := reports[len(reports)-1]
+	if !last.Done || last.Lines != 1024 || last.Total != 0 || last.ETA != 0 {
+		t.Errorf("Expected final chunked report of 1024 lines, got %+v", last)
+	}
+	for _, p := range reports[:len(reports)-1] {
+		if p.Done {
+			t.Errorf("Expected a single final report, got %+v", reports)
+		}
+	}
+
+	if err := parser.WithConfig(Config{ProgressInterval: -time.Second}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for a negative interval, got %v", err)
+	}
+}
+
+func TestConsolidateSingletons(t *testing.T) {
+	lines := []string{
+		"User alice logged in",
+		"User brian logged in",
+		"User bob logged in",
+		"Connection closed",
+		"Connection to server lost",
+	}
+	parser := NewAWSOMLP()
+	if err := parser.WithConfig(Config{FreqThresholdStrategy: FreqAll}); err != nil {
+		t.Fatal(err)
+	}
+	parser.Parse(lines)
+	if n := len(parser.GetPatterns()); n != 4 {
+		t.Fatalf("Expected 4 patterns without consolidation, got %d", n)
+	}
+
+	parser = NewAWSOMLP()
+	if err := parser.WithConfig(Config{FreqThresholdStrategy: FreqAll, SingletonSimilarity: 0.75}); err != nil {
+		t.Fatal(err)
+	}
+	events := parser.ParseEvents(lines)
+	patterns := parser.GetPatterns()
+	if len(patterns) != 3 {
+		t.Fatalf("Expected 3 patterns after consolidation, got %d", len(patterns))
+	}
+	if patterns[0].Count != 3 || patterns[0].Template != "User <*> logged in" || len(patterns[0].Events) != 3 {
+		t.Errorf("Expected the singleton merged into the user pattern, got %+v", patterns[0])
+	}
+	if events[2].PatternID != patterns[0].ID || events[2].Template != "User <*> logged in" {
+		t.Errorf("Expected the merged event to report the user pattern, got %d %q", events[2].PatternID, events[2].Template)
+	}
+	// Singletons do not merge with each other
+	if events[3].Template != "Connection closed" || events[4].Template != "Connection to server lost" {
+		t.Errorf("Expected the connection lines to stay apart, got %q and %q", events[3].Template, events[4].Template)
+	}
+
+	if err := parser.WithConfig(Config{SingletonSimilarity: 1.5}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestSlotNames(t *testing.T) {
+	tests := []struct {
+		template string
+		expected []string
+	}{
+		{"Receiving block <*> src: <*> dest: <*>", []string{"block", "source", "destination"}},
+		{"Connection from <*> to <*> closed", []string{"source", "destination"}},
+		{"<*> <*> user=<*> path:<*>", []string{"p1", "p2", "user", "path"}},
+		{"Deleting blk_<*> file <*>", []string{"blk", "file"}},
+		{"Wrote <*> bytes in <*> ms, size <*> size <*>", []string{"wrote", "p2", "size", "size_2"}},
+		{"size <*> size <*> size_2 <*>", []string{"size", "size_2", "size_2_2"}},
+		{"size_2 <*> size <*> size <*>", []string{"size_2", "size", "size_3"}},
+		{"Host 10.0.0.<*> reached the <*>", []string{"p1", "p2"}},
+		{"Service started", nil},
+	}
+	for _, tt := range tests {
+		if got := SlotNames(tt.template); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("SlotNames(%q) = %v, expected %v", tt.template, got, tt.expected)
+		}
+	}
+
+	re := ToRegex("Receiving block <*> src: <*> dest: <*>")
+	match := re.FindStringSubmatch("081109 203518 INFO dfs.DataNode: Receiving block blk_1 src: /10.0.0.1:5 dest: /10.0.0.2:6")
+	if match == nil {
+		t.Fatalf("Expected %s to match", re)
+	}
+	if got := match[re.SubexpIndex("source")]; got != "/10.0.0.1:5" {
+		t.Errorf("Expected source /10.0.0.1:5, got %q", got)
+	}
+
+	named := NamedParams("Connection from <*> to <*> closed", []string{"a", "b"})
+	if expected := map[string]string{"source": "a", "destination": "b"}; !reflect.DeepEqual(named, expected) {
+		t.Errorf("Expected %v, got %v", expected, named)
+	}
+	if NamedParams("Connection from <*> to <*> closed", []string{"a"}) != nil {
+		t.Error("Expected nil for a parameter count mismatch")
+	}
+}
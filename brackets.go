@@ -0,0 +1,79 @@
+package awsomlp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// BracketRule defines which contents of one kind of bracket are masked as
+// trivial variables
+type BracketRule struct {
+	Brackets     string `json:"brackets"`                // Opening and closing bracket: "()", "[]", "{}" or "<>"
+	Content      string `json:"content,omitempty"`       // Regex the whole contents must match, e.g. a charset like `[a-z0-9]+` (default: any characters but spaces and the brackets)
+	MinLength    int    `json:"min_length,omitempty"`    // Minimum length of the contents in bytes (default 1)
+	MaxLength    int    `json:"max_length,omitempty"`    // Maximum length of the contents in bytes (default 0 = unlimited)
+	KeepBrackets bool   `json:"keep_brackets,omitempty"` // Replace only the contents with <*>, "(<*>)", instead of the brackets with them, "<*>"
+}
+
+// DefaultBrackets returns the default bracket rules: words in parentheses,
+// like controller names or user roles
+func DefaultBrackets() []BracketRule {
+	return []BracketRule{{Brackets: "()", Content: `[a-zA-Z][a-zA-Z0-9_-]*`}}
+}
+
+// defaultBracketMasks are the compiled DefaultBrackets
+var defaultBracketMasks, _ = compileBrackets(DefaultBrackets())
+
+// bracketMask is a compiled BracketRule
+type bracketMask struct {
+	rule BracketRule
+	re   *regexp.Regexp
+}
+
+// compileBrackets validates and compiles bracket rules
+func compileBrackets(rules []BracketRule) ([]bracketMask, error) {
+	masks := make([]bracketMask, 0, len(rules))
+	for _, rule := range rules {
+		switch rule.Brackets {
+		case "()", "[]", "{}", "<>":
+		default:
+			return nil, fmt.Errorf("%w: unknown Brackets %q, want (), [], {} or <>", ErrInvalidConfig, rule.Brackets)
+		}
+		if rule.MinLength < 0 || rule.MaxLength < 0 || (rule.MaxLength > 0 && rule.MaxLength < rule.MinLength) {
+			return nil, fmt.Errorf("%w: invalid lengths %d-%d for %s", ErrInvalidConfig, rule.MinLength, rule.MaxLength, rule.Brackets)
+		}
+		if rule.MinLength == 0 {
+			rule.MinLength = 1
+		}
+		content := rule.Content
+		if content == "" {
+			content = `[^\s` + regexp.QuoteMeta(rule.Brackets) + `]+`
+		}
+		pattern := regexp.QuoteMeta(rule.Brackets[:1]) + `(?:` + content + `)` + regexp.QuoteMeta(rule.Brackets[1:])
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, &RegexError{Field: "Brackets", Pattern: rule.Content, Err: err}
+		}
+		masks = append(masks, bracketMask{rule: rule, re: re})
+	}
+	return masks, nil
+}
+
+// mask replaces the brackets in content whose contents match the rule, or
+// only their contents, with <*>
+func (m bracketMask) mask(content string) string {
+	if !strings.Contains(content, m.rule.Brackets[:1]) {
+		return content
+	}
+	return m.re.ReplaceAllStringFunc(content, func(match string) string {
+		inner := match[1 : len(match)-1]
+		if inner == "*" || len(inner) < m.rule.MinLength || (m.rule.MaxLength > 0 && len(inner) > m.rule.MaxLength) {
+			return match // A placeholder or contents of another length
+		}
+		if !m.rule.KeepBrackets {
+			return "<*>"
+		}
+		return match[:1] + "<*>" + match[len(match)-1:]
+	})
+}
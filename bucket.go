@@ -0,0 +1,40 @@
+package awsomlp
+
+// findBucketed looks for a similar pattern only among the patterns whose
+// representative has about as many tokens as the event. Of several matches in
+// different buckets the oldest pattern wins, as without bucketing.
+func (lp *AWSOMLP) findBucketed(event *LogEvent) (*Pattern, float64) {
+	if lp.buckets == nil {
+		lp.buckets = make(map[int][]*Pattern)
+		for _, pattern := range lp.patterns {
+			if len(pattern.Events) > 0 {
+				lp.indexPattern(pattern, len(pattern.Events[0].Tokens))
+			}
+		}
+	}
+
+	var best *Pattern
+	var bestSimilarity float64
+	tokens := len(event.Tokens)
+	for count := tokens - lp.config.TokenCountTolerance; count <= tokens+lp.config.TokenCountTolerance; count++ {
+		pattern, similarity := lp.findSimilar(lp.buckets[count], event)
+		if pattern != nil && (best == nil || pattern.ID < best.ID) {
+			best, bestSimilarity = pattern, similarity
+		}
+	}
+	return best, bestSimilarity
+}
+
+// resetIndexes drops the pattern indexes after patterns were removed or replaced;
+// they are rebuilt on the next lookup
+func (lp *AWSOMLP) resetIndexes() {
+	lp.buckets = nil
+	lp.lsh = nil
+}
+
+// indexPattern adds a pattern with the given token count to the buckets if they are built
+func (lp *AWSOMLP) indexPattern(pattern *Pattern, tokens int) {
+	if lp.buckets != nil {
+		lp.buckets[tokens] = append(lp.buckets[tokens], pattern)
+	}
+}
@@ -0,0 +1,206 @@
+package awsomlp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StageCEF is the name of the CEF header and extension stage
+const StageCEF = "cef"
+
+// cefTextKeys are the extension keys holding free text, which is template-mined
+// instead of masked
+var cefTextKeys = map[string]bool{"msg": true}
+
+// cefHeaderFields names the header fields after the version, in order
+var cefHeaderFields = []string{"device_vendor", "device_product", "device_version", "signature_id", "name", "severity"}
+
+// CEFEvent is a parsed ArcSight Common Event Format event with unescaped values:
+//
+//	CEF:Version|Device Vendor|Device Product|Device Version|Signature ID|Name|Severity|Extension
+type CEFEvent struct {
+	Prefix        string     // Text before "CEF:", usually a syslog header
+	Version       int        // CEF format version
+	DeviceVendor  string     // Vendor of the sending device
+	DeviceProduct string     // Product of the sending device
+	DeviceVersion string     // Version of the sending product
+	SignatureID   string     // Device Event Class ID
+	Name          string     // Human-readable description of the event
+	Severity      string     // 0-10, or Low, Medium, High, Very-High
+	Extension     []CEFField // key=value pairs in order
+}
+
+// CEFField is a key=value pair of a CEF extension
+type CEFField struct {
+	Key   string
+	Value string
+}
+
+// ParseCEF parses a CEF event, optionally preceded by a prefix such as a syslog
+// header. The error wraps ErrInvalidCEF if the line is not a CEF event.
+func ParseCEF(line string) (*CEFEvent, error) {
+	start := strings.Index(line, "CEF:")
+	if start < 0 {
+		return nil, fmt.Errorf("%w: no CEF: marker", ErrInvalidCEF)
+	}
+	event := &CEFEvent{Prefix: strings.TrimSpace(line[:start])}
+
+	// Seven header fields separated by unescaped pipes, then the extension
+	rest := line[start+len("CEF:"):]
+	header := make([]string, 0, 7)
+	var field strings.Builder
+	for i := 0; i < len(rest) && len(header) < 7; i++ {
+		switch c := rest[i]; {
+		case c == '\\' && i+1 < len(rest) && (rest[i+1] == '|' || rest[i+1] == '\\'):
+			field.WriteByte(rest[i+1])
+			i++
+		case c == '|':
+			header = append(header, field.String())
+			field.Reset()
+			if len(header) == 7 {
+				rest = rest[i+1:]
+			}
+		default:
+			field.WriteByte(c)
+		}
+	}
+	if len(header) < 7 {
+		return nil, fmt.Errorf("%w: %d of 7 header fields", ErrInvalidCEF, len(header))
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(header[0]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid version %q", ErrInvalidCEF, header[0])
+	}
+	event.Version = version
+	event.DeviceVendor, event.DeviceProduct, event.DeviceVersion = header[1], header[2], header[3]
+	event.SignatureID, event.Name, event.Severity = header[4], header[5], header[6]
+	event.Extension = parseCEFExtension(rest)
+	return event, nil
+}
+
+// parseCEFExtension splits an extension into its pairs. A key is a word
+// directly followed by an unescaped '=' at the start or after a space; values
+// run up to the space before the next key, so they may contain spaces.
+func parseCEFExtension(ext string) []CEFField {
+	type keyPos struct{ start, eq int }
+	var keys []keyPos
+	for i := 0; i < len(ext); i++ {
+		if ext[i] == '\\' {
+			i++ // Escaped character, e.g. \=
+			continue
+		}
+		if ext[i] != '=' {
+			continue
+		}
+		k := i
+		for k > 0 && isCEFKeyChar(ext[k-1]) {
+			k--
+		}
+		if k < i && (k == 0 || ext[k-1] == ' ') {
+			keys = append(keys, keyPos{k, i})
+		}
+	}
+
+	fields := make([]CEFField, 0, len(keys))
+	for j, key := range keys {
+		end := len(ext)
+		if j+1 < len(keys) {
+			end = keys[j+1].start
+		}
+		fields = append(fields, CEFField{
+			Key:   ext[key.start:key.eq],
+			Value: unescapeCEFValue(strings.TrimRight(ext[key.eq+1:end], " ")),
+		})
+	}
+	return fields
+}
+
+// isCEFKeyChar reports whether c may appear in an extension key
+func isCEFKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-' || c == '[' || c == ']'
+}
+
+// unescapeCEFValue decodes the \= \\ \n and \r escapes of an extension value
+func unescapeCEFValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			switch value[i+1] {
+			case '=', '\\':
+				sb.WriteByte(value[i+1])
+				i++
+				continue
+			case 'n', 'r':
+				sb.WriteByte('\n')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
+
+// Message returns the text to template: the Name followed by the extension with
+// every value masked as <*>, except free-text values such as msg, which are kept
+// so their variables are found by mining
+func (e *CEFEvent) Message() string {
+	var sb strings.Builder
+	sb.WriteString(e.Name)
+	writeMaskedExtension(&sb, e.Extension)
+	return sb.String()
+}
+
+// writeMaskedExtension writes " key=<*>" for every pair, keeping the
+// whitespace-normalized value of free-text keys
+func writeMaskedExtension(sb *strings.Builder, extension []CEFField) {
+	for _, field := range extension {
+		sb.WriteByte(' ')
+		sb.WriteString(field.Key)
+		sb.WriteByte('=')
+		if cefTextKeys[field.Key] {
+			sb.WriteString(strings.Join(strings.Fields(field.Value), " "))
+		} else {
+			sb.WriteString("<*>")
+		}
+	}
+}
+
+// Fields returns the header as the fields cef_version, device_vendor,
+// device_product, device_version, signature_id, name and severity, plus every
+// extension pair under its key. Empty values are left out.
+func (e *CEFEvent) Fields() map[string]string {
+	fields := map[string]string{"cef_version": strconv.Itoa(e.Version)}
+	values := []string{e.DeviceVendor, e.DeviceProduct, e.DeviceVersion, e.SignatureID, e.Name, e.Severity}
+	for i, name := range cefHeaderFields {
+		if values[i] != "" {
+			fields[name] = values[i]
+		}
+	}
+	for _, field := range e.Extension {
+		if field.Value != "" {
+			fields[field.Key] = field.Value
+		}
+	}
+	return fields
+}
+
+// CEFStage replaces a CEF event by its Message, so that templates are mined
+// from the Name and the free-text extension fields while other extension values
+// are masked, and captures the header and extension as fields (see
+// CEFEvent.Fields). Lines that are not CEF events fall back to HeaderRegex. Use
+// it in place of HeaderStage.
+func CEFStage() Stage {
+	return NewStage(StageCEF, func(lp *AWSOMLP, event *LogEvent) {
+		cef, err := ParseCEF(event.Content)
+		if err != nil {
+			event.Content, event.Fields = lp.splitHeader(event.Content)
+			return
+		}
+		event.Content, event.Fields = cef.Message(), cef.Fields()
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// alignEventIDs maps the pattern IDs of the parser onto the event IDs of the
+// model saved in a state file, so that -align keeps event IDs stable across runs
+func alignEventIDs(parser *awsomlp.AWSOMLP, path string) ([]awsomlp.Alignment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	previous := awsomlp.NewAWSOMLP()
+	if err := previous.ImportState(file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return parser.Align(previous, 0), nil
+}
+
+// reportAlignment writes a summary of the alignment methods used
+func reportAlignment(w io.Writer, alignments []awsomlp.Alignment) {
+	methods := make(map[awsomlp.AlignMethod]int)
+	for _, alignment := range alignments {
+		methods[alignment.Method]++
+	}
+	fmt.Fprintf(w, "Aligned %d templates: %d exact, %d by subsumption, %d by similarity, %d new\n",
+		len(alignments), methods[awsomlp.AlignExact], methods[awsomlp.AlignSubsumption],
+		methods[awsomlp.AlignSimilarity], methods[awsomlp.AlignNone])
+}
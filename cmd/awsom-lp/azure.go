@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// azureTokenResource is the resource of Log Analytics access tokens
+const azureTokenResource = "https://api.loganalytics.io"
+
+// azureQueryEndpoint is the query API URL of a workspace, a variable so that
+// tests can point it at a local server
+var azureQueryEndpoint = "https://api.loganalytics.azure.com/v1/workspaces/%s/query"
+
+// azureOptions selects the Log Analytics rows to read
+type azureOptions struct {
+	query    string // KQL query
+	timespan string // ISO 8601 duration or interval, or a Go duration before now
+}
+
+// isAzure reports whether an input is an azure://WORKSPACE_ID Log Analytics source
+func isAzure(input string) bool {
+	return strings.HasPrefix(input, "azure://")
+}
+
+// azureResult is a response of the query API
+type azureResult struct {
+	Tables []struct {
+		Columns []struct {
+			Name string `json:"name"`
+		} `json:"columns"`
+		Rows [][]json.RawMessage `json:"rows"`
+	} `json:"tables"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// openAzure runs a KQL query against a Log Analytics workspace and returns the
+// messages of the result rows, one per line. The message is assembled from the
+// result columns like from CSV columns (-column, -column-template).
+func openAzure(input string, opts inputOptions) (io.ReadCloser, error) {
+	workspace := strings.Trim(strings.TrimPrefix(input, "azure://"), "/")
+	if workspace == "" {
+		return nil, fmt.Errorf("invalid Log Analytics input %s: no workspace ID", input)
+	}
+	if opts.azure.query == "" {
+		return nil, fmt.Errorf("-kql query is required for %s", input)
+	}
+
+	request := map[string]string{"query": opts.azure.query}
+	if timespan := opts.azure.timespan; timespan != "" {
+		if d, err := time.ParseDuration(timespan); err == nil {
+			timespan = fmt.Sprintf("PT%dS", int64(d.Seconds()))
+		}
+		request["timespan"] = timespan
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := azureAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(azureQueryEndpoint, workspace), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("Log Analytics: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result azureResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Log Analytics: %w", err)
+	}
+	if result.Error != nil {
+		// Rows returned with an error, e.g. a truncated result, are still parsed
+		fmt.Fprintf(os.Stderr, "Warning: Log Analytics: %s\n", result.Error.Message)
+	}
+	if len(result.Tables) == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	table := result.Tables[0]
+	header := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		header[i] = column.Name
+	}
+	builder, err := newMessageBuilder(header, len(header), opts.csv)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	record := make([]string, len(header))
+	for _, row := range table.Rows {
+		for i := range record {
+			record[i] = ""
+			if i < len(row) {
+				record[i] = azureValue(row[i])
+			}
+		}
+		if message := builder.message(record); message != "" {
+			buf.WriteString(newlineReplacer.Replace(message))
+			buf.WriteByte('\n')
+		}
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// azureValue converts a result cell to text: strings unquoted, null as empty, other values as JSON
+func azureValue(cell json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(cell, &s); err == nil {
+		return s
+	}
+	if string(cell) == "null" {
+		return ""
+	}
+	return string(cell)
+}
+
+// azureAccessToken returns an access token from AZURE_ACCESS_TOKEN or the Azure CLI
+func azureAccessToken() (string, error) {
+	if token := os.Getenv("AZURE_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	out, err := exec.Command("az", "account", "get-access-token",
+		"--resource", azureTokenResource, "--query", "accessToken", "--output", "tsv").Output()
+	if err != nil {
+		return "", fmt.Errorf("getting an access token with az (or set AZURE_ACCESS_TOKEN): %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
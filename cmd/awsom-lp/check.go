@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// runCheck runs the check command: the templates of the input are compared
+// with a golden file, and any difference is printed and fails with exit code 1
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	parserOptions := registerParserFlags(fs)
+	var (
+		inputFile    = fs.String("input", "", "Input log file(s), comma-separated, glob patterns allowed (required)")
+		goldenPath   = fs.String("golden", "", "Golden file with the expected templates, one per line (required)")
+		update       = fs.Bool("update", false, "Write the templates of the input to the golden file instead of comparing them")
+		inputFormat  = fs.String("format", "auto", "Input format: auto (by extension), text, csv, tsv, parquet")
+		csvColumn    = fs.String("column", "message", "CSV column name(s) for log messages, comma-separated columns are joined with spaces")
+		maxLineBytes = fs.Int("max-line-bytes", defaultMaxLineBytes, "Maximum line length in bytes (-1 = unlimited)")
+	)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check -input <file> -golden <file> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Parses the input and compares its templates with a golden file, one template\n")
+		fmt.Fprintf(os.Stderr, "per line in ascending order. Templates missing from the output are printed with\n")
+		fmt.Fprintf(os.Stderr, "\"-\", new ones with \"+\", and the command exits with status 1 if there are any.\n")
+		fmt.Fprintf(os.Stderr, "With -update the golden file is written instead.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  %s check -input testdata/hdfs.log -header hdfs -golden testdata/hdfs.golden -update\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s check -input testdata/hdfs.log -header hdfs -golden testdata/hdfs.golden\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	if *inputFile == "" || *goldenPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if parserOptions.autoHeader() {
+		log.Fatal("-header auto is not supported by check, pin the header regex instead")
+	}
+
+	limit, err := newLineLimit(*maxLineBytes, policyTruncate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parser, err := parserOptions.newParser()
+	if err != nil {
+		log.Fatal(err)
+	}
+	inputs, err := expandInputs(*inputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := inputOptions{csv: csvOptions{columns: *csvColumn}}
+	var lines []string
+	for _, path := range inputs {
+		input, err := readLogFile(path, *inputFormat, limit, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lines = append(lines, parserOptions.fold(input)...)
+	}
+	parser.Parse(lines)
+	templates := parser.GetTemplates()
+	for i := range templates {
+		templates[i] = strings.TrimSpace(templates[i])
+	}
+	slices.Sort(templates)
+	templates = slices.Compact(templates)
+
+	if *update {
+		if err := writeGolden(*goldenPath, templates); err != nil {
+			log.Fatalf("Error writing golden file: %v", err)
+		}
+		return
+	}
+
+	file, err := os.Open(*goldenPath)
+	if err != nil {
+		log.Fatalf("Error reading golden file: %v", err)
+	}
+	golden, err := readGolden(file)
+	file.Close()
+	if err != nil {
+		log.Fatalf("Error reading golden file %s: %v", *goldenPath, err)
+	}
+
+	if missing, added := diffTemplates(os.Stdout, golden, templates, *goldenPath, *inputFile); missing+added > 0 {
+		fmt.Printf("%d templates differ from %s (%d missing, %d new)\n", missing+added, *goldenPath, missing, added)
+		os.Exit(1)
+	}
+}
+
+// readGolden reads the templates of a golden file, ignoring blank lines
+func readGolden(r io.Reader) ([]string, error) {
+	var templates []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if template := strings.TrimSpace(scanner.Text()); template != "" {
+			templates = append(templates, template)
+		}
+	}
+	slices.Sort(templates)
+	return slices.Compact(templates), scanner.Err()
+}
+
+// writeGolden writes templates to a golden file, one per line
+func writeGolden(path string, templates []string) error {
+	var sb strings.Builder
+	for _, template := range templates {
+		sb.WriteString(template)
+		sb.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0o644)
+}
+
+// diffTemplates writes the differences between two sorted template lists in
+// the style of a unified diff and returns the number of missing and added ones
+func diffTemplates(w io.Writer, want, got []string, wantName, gotName string) (missing, added int) {
+	header := func() {
+		if missing+added == 0 {
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", wantName, gotName)
+		}
+	}
+	i, j := 0, 0
+	for i < len(want) || j < len(got) {
+		switch {
+		case j == len(got) || (i < len(want) && want[i] < got[j]):
+			header()
+			fmt.Fprintf(w, "-%s\n", want[i])
+			missing++
+			i++
+		case i == len(want) || got[j] < want[i]:
+			header()
+			fmt.Fprintf(w, "+%s\n", got[j])
+			added++
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return missing, added
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// Header learning for -header auto
+const (
+	headerSampleLines   = 500 // Number of leading input lines to learn the header from
+	minHeaderConfidence = 0.5 // Minimum share of sample lines the learned header must match
+)
+
+// parserFlags holds the flags configuring the parser, shared by all commands
+type parserFlags struct {
+	headerRegex         *string
+	similarity          *float64
+	similarityMode      *string
+	sortStrategy        *string
+	customRegex         *string
+	minGroupSize        *int
+	maxPlaceholderRatio *float64
+	minTemplateTokens   *int
+	entropyThreshold    *float64
+	positional          *bool
+	bucket              *bool
+	bucketTolerance     *int
+	approximate         *bool
+	sketch              *int
+	maxEvents           *int
+	maxTokens           *int
+	skipOversized       *bool
+	canonical           *bool
+	deterministic       *bool
+	segment             *string
+	sql                 *bool
+	k8s                 *bool
+	calendarWords       *string
+	pathSegments        *int
+	threads             *bool
+	quoted              *bool
+	brackets            *string
+	columns             *string
+	singletons          *float64
+
+	// Set by -progress of the default command, not flags
+	onProgress       func(awsomlp.Progress)
+	progressInterval time.Duration
+}
+
+// registerParserFlags defines the parser flags on fs
+func registerParserFlags(fs *flag.FlagSet) *parserFlags {
+	return &parserFlags{
+		headerRegex:         fs.String("header", "", "Header regex pattern (default, hdfs, syslog, rfc3164, rfc5424, cef, leef (CEF or LEEF), w3c (IIS), haproxy, postgresql, mysql-slow, java, auto to learn it from the input, or custom regex)"),
+		similarity:          fs.Float64("similarity", 1.0, "Minimum similarity threshold (0.0-1.0)"),
+		similarityMode:      fs.String("similarity-mode", "fixed", "Similarity threshold adaptation per pattern: fixed, size (tightens as groups grow), variance"),
+		sortStrategy:        fs.String("sort", "none", "Sorting strategy: none, length, lexical, dyntokens, mosttokens, median, static"),
+		customRegex:         fs.String("regex", "", "Custom regex patterns for variables (comma-separated)"),
+		minGroupSize:        fs.Int("min-group", 3, "Minimum group size to generate template"),
+		maxPlaceholderRatio: fs.Float64("max-placeholders", 0.8, "Maximum ratio of placeholders in template (0.0-1.0)"),
+		minTemplateTokens:   fs.Int("min-tokens", 1, "Minimum number of non-placeholder tokens in template"),
+		bucket:              fs.Bool("bucket", false, "Only group lines with the same number of tokens"),
+		bucketTolerance:     fs.Int("bucket-tolerance", 0, "Allowed token count difference with -bucket"),
+		approximate:         fs.Bool("approximate", false, "Compare lines only with likely patterns found by MinHash LSH (for huge corpora)"),
+		sketch:              fs.Int("sketch", 0, "Count frequencies of patterns with more distinct tokens than this in a count-min sketch (0 = never)"),
+		positional:          fs.Bool("positional", false, "Count token frequencies per position instead of per group"),
+		entropyThreshold:    fs.Float64("entropy", 0, "Per-position token entropy in bits from which tokens become placeholders (0 = disabled)"),
+		maxEvents:           fs.Int("max-events", 0, "Maximum number of events retained per pattern (0 = all)"),
+		maxTokens:           fs.Int("max-tokens", 0, "Maximum number of tokens per line; longer lines keep their first tokens and a final <*> (0 = unlimited)"),
+		skipOversized:       fs.Bool("skip-oversized", false, "Skip lines with more than -max-tokens tokens instead of truncating them"),
+		canonical:           fs.Bool("canonical", false, "Produce the same templates regardless of line order"),
+		deterministic:       fs.Bool("deterministic", false, "Like -canonical, and leave pattern timestamps out so -save-state writes byte-identical files for the same lines"),
+		segment:             fs.String("segment", "none", "Separate patterns of mixed sources: none, header, or field:<name> (header regex field)"),
+		sql:                 fs.Bool("sql", false, "Mask literals and IN lists of SQL statements in messages"),
+		k8s:                 fs.Bool("k8s", false, "Mask Kubernetes pod name suffixes, container IDs and namespaces in messages"),
+		singletons:          fs.Float64("merge-singletons", 0, "Merge single-line patterns into the larger pattern sharing the most tokens, if at least this share (0.0-1.0, 0 = never)"),
+		pathSegments:        fs.Int("path-segments", 3, "Minimum number of segments of Unix paths to mask; Windows and UNC paths are masked from one (0 = no path masking)"),
+		threads:             fs.Bool("threads", false, "Mask the numbers of thread names and thread and goroutine IDs (pool-<*>-thread-<*>, goroutine <*>)"),
+		quoted:              fs.Bool("quoted", false, "Mask the contents of single- and double-quoted strings, keeping the quotes"),
+		brackets:            fs.String("brackets", "()", "Brackets whose contents are masked, comma-separated, each optionally with a maximum length: (), [], {}, <>, e.g. \"(),[]:16\" (none = no bracket masking)"),
+		columns:             fs.String("mask-columns", "", "Token positions masked on lines matching a regex, for free-text fields, comma-separated: [regex@]column[:tokens], column 1 = first token, -1 = last, tokens * = up to the end of the line, e.g. \"^audit:@4:*\""),
+		calendarWords:       fs.String("calendar-words", "always", "Masking of month and weekday names: always, dates (only next to a day number or year), never"),
+	}
+}
+
+// config builds the parser configuration from the flags
+func (f *parserFlags) config() (awsomlp.Config, error) {
+	config := awsomlp.Config{
+		MinSimilarity:       *f.similarity,
+		MinGroupSize:        *f.minGroupSize,
+		MaxPlaceholderRatio: *f.maxPlaceholderRatio,
+		MinTemplateTokens:   *f.minTemplateTokens,
+		EntropyThreshold:    *f.entropyThreshold,
+		MaskThreads:         *f.threads,
+		MaskQuoted:          *f.quoted,
+		BucketByTokenCount:  *f.bucket,
+		TokenCountTolerance: *f.bucketTolerance,
+		ApproximateGrouping: *f.approximate,
+		FreqSketchThreshold: *f.sketch,
+		MaxLineLength:       -1, // Line length is already enforced while reading
+		MaxEventsPerPattern: *f.maxEvents,
+		MaxTokens:           *f.maxTokens,
+		RejectOversized:     *f.skipOversized,
+		Canonical:           *f.canonical,
+		Deterministic:       *f.deterministic,
+		SingletonSimilarity: *f.singletons,
+		OnProgress:          f.onProgress,
+		ProgressInterval:    f.progressInterval,
+	}
+
+	// Set header regex
+	switch *f.headerRegex {
+	case "default", "", "auto":
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex // Replaced by learnHeader for auto
+	case "hdfs":
+		config.HeaderRegex = awsomlp.HDFSHeaderRegex
+	case "syslog":
+		config.HeaderRegex = awsomlp.SyslogHeaderRegex
+	case "rfc3164":
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.RFC3164Stage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "rfc5424":
+		// Structured syslog is parsed properly, BSD syslog lines fall back to the regex
+		config.HeaderRegex = awsomlp.SyslogHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.RFC5424Stage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "cef":
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.CEFStage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "leef":
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.LEEFStage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "w3c":
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.W3CStage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "haproxy":
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.HAProxyStage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "postgresql":
+		// Multi-line entries are joined by fold before parsing
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.PostgreSQLStage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "mysql-slow":
+		config.HeaderRegex = awsomlp.DefaultHeaderRegex
+		config.Pipeline = []awsomlp.Stage{awsomlp.MySQLSlowLogStage(), awsomlp.TrivialStage(), awsomlp.CustomStage(), awsomlp.TokenizeStage()}
+	case "java":
+		config.HeaderRegex = awsomlp.JavaAppHeaderRegex
+	default:
+		// Treat as custom regex
+		config.HeaderRegex = *f.headerRegex
+	}
+
+	// SQL normalization and Kubernetes name masking run right after header removal
+	if *f.sql {
+		if config.Pipeline == nil {
+			config.Pipeline = awsomlp.DefaultPipeline()
+		}
+		config.Pipeline = slices.Insert(config.Pipeline, 1, awsomlp.SQLStage())
+	}
+	if *f.k8s {
+		if config.Pipeline == nil {
+			config.Pipeline = awsomlp.DefaultPipeline()
+		}
+		config.Pipeline = slices.Insert(config.Pipeline, 1, awsomlp.K8sStage())
+	}
+
+	// Set sorting strategy
+	switch *f.sortStrategy {
+	case "none":
+		config.SortingStrategy = awsomlp.SortNone
+	case "length":
+		config.SortingStrategy = awsomlp.SortByLength
+	case "lexical":
+		config.SortingStrategy = awsomlp.SortLexical
+	case "dyntokens":
+		config.SortingStrategy = awsomlp.SortByDynTokens
+	case "mosttokens":
+		config.SortingStrategy = awsomlp.SortByMostTokens
+	case "median":
+		config.SortingStrategy = awsomlp.SortByMedianLength
+	case "static":
+		config.SortingStrategy = awsomlp.SortByStaticRatio
+	default:
+		return config, fmt.Errorf("invalid sorting strategy: %s", *f.sortStrategy)
+	}
+
+	if *f.positional {
+		config.FreqCounting = awsomlp.FreqCountPositional
+	}
+
+	// Set similarity strategy
+	switch *f.similarityMode {
+	case "fixed":
+		config.SimilarityStrategy = awsomlp.SimilarityFixed
+	case "size":
+		config.SimilarityStrategy = awsomlp.SimilarityByGroupSize
+	case "variance":
+		config.SimilarityStrategy = awsomlp.SimilarityByVariance
+	default:
+		return config, fmt.Errorf("invalid similarity mode: %s", *f.similarityMode)
+	}
+
+	// Set source segmentation
+	switch name, field, _ := strings.Cut(*f.segment, ":"); name {
+	case "none":
+		config.Segmentation = awsomlp.SegmentNone
+	case "header":
+		config.Segmentation = awsomlp.SegmentByHeader
+	case "field":
+		config.Segmentation = awsomlp.SegmentByField
+		config.SegmentField = field
+	default:
+		return config, fmt.Errorf("invalid segmentation: %s", *f.segment)
+	}
+
+	// Set month and weekday name masking
+	switch *f.calendarWords {
+	case "always":
+		config.CalendarWords = awsomlp.CalendarWordsAlways
+	case "dates":
+		config.CalendarWords = awsomlp.CalendarWordsInDates
+	case "never":
+		config.CalendarWords = awsomlp.CalendarWordsNever
+	default:
+		return config, fmt.Errorf("invalid calendar word masking: %s", *f.calendarWords)
+	}
+
+	// Set path masking
+	switch {
+	case *f.pathSegments == 0:
+		config.KeepPaths = true
+	case *f.pathSegments > 0:
+		config.PathMinSegments = *f.pathSegments
+	default:
+		return config, fmt.Errorf("invalid path segments: %d", *f.pathSegments)
+	}
+
+	// Set bracket masking
+	brackets, err := parseBrackets(*f.brackets)
+	if err != nil {
+		return config, err
+	}
+	config.Brackets = brackets
+
+	// Set column masking
+	if config.ColumnRules, err = parseColumns(*f.columns); err != nil {
+		return config, err
+	}
+
+	// Add custom regex patterns
+	if *f.customRegex != "" {
+		config.CustomRegexes = strings.Split(*f.customRegex, ",")
+		for i := range config.CustomRegexes {
+			config.CustomRegexes[i] = strings.TrimSpace(config.CustomRegexes[i])
+		}
+	}
+
+	return config, nil
+}
+
+// parseBrackets parses the bracket rules of -brackets. Words in parentheses
+// are masked with their parentheses as by default; the contents of other
+// brackets are masked up to any non-space characters, keeping the brackets.
+func parseBrackets(spec string) ([]awsomlp.BracketRule, error) {
+	rules := []awsomlp.BracketRule{}
+	if spec == "none" {
+		return rules, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		brackets, maxLength, hasMax := strings.Cut(strings.TrimSpace(item), ":")
+		rule := awsomlp.BracketRule{Brackets: brackets, KeepBrackets: true}
+		if brackets == "()" {
+			rule = awsomlp.DefaultBrackets()[0]
+		}
+		if hasMax {
+			n, err := strconv.Atoi(maxLength)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid bracket length: %s", item)
+			}
+			rule.MaxLength = n
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseColumns parses the column rules of -mask-columns. The regex is
+// everything before the last @, as the column spec never contains one.
+func parseColumns(spec string) ([]awsomlp.ColumnRule, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var rules []awsomlp.ColumnRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		var rule awsomlp.ColumnRule
+		position := item
+		if i := strings.LastIndex(item, "@"); i >= 0 {
+			rule.Match, position = item[:i], item[i+1:]
+		}
+		column, tokens, hasTokens := strings.Cut(position, ":")
+		n, err := strconv.Atoi(column)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid column: %s", item)
+		}
+		rule.Column = n
+		switch {
+		case !hasTokens:
+		case tokens == "*":
+			rule.Tokens = -1
+		default:
+			if rule.Tokens, err = strconv.Atoi(tokens); err != nil || rule.Tokens < 1 {
+				return nil, fmt.Errorf("invalid column token count: %s", item)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// autoHeader reports whether the header regex is to be learned from the input
+func (f *parserFlags) autoHeader() bool {
+	return *f.headerRegex == "auto"
+}
+
+// multiLine reports whether the header format has entries spanning several
+// lines, which fold joins
+func (f *parserFlags) multiLine() bool {
+	return *f.headerRegex == "postgresql" || *f.headerRegex == "mysql-slow"
+}
+
+// fold joins the lines of multi-line entries of one input
+func (f *parserFlags) fold(lines []string) []string {
+	switch *f.headerRegex {
+	case "postgresql":
+		return awsomlp.FoldPostgreSQL(lines)
+	case "mysql-slow":
+		return awsomlp.FoldMySQLSlowLog(lines)
+	default:
+		return lines
+	}
+}
+
+// learnHeader configures the parser with a header regex learned from the first
+// lines of the input. The default header regex is kept if the learned one matches
+// less than half of the sample.
+func (f *parserFlags) learnHeader(parser *awsomlp.AWSOMLP, lines []string, verbose bool) error {
+	sample := lines[:min(len(lines), headerSampleLines)]
+	guess := awsomlp.LearnHeaderRegex(sample)
+	if guess.Regex == "" || guess.Confidence < minHeaderConfidence {
+		if verbose {
+			fmt.Printf("No common header found (confidence %.2f), using the default header regex\n", guess.Confidence)
+		}
+		return nil
+	}
+	if verbose {
+		fmt.Printf("Learned header regex (confidence %.2f, fields %s): %s\n",
+			guess.Confidence, strings.Join(guess.Fields, ", "), guess.Regex)
+	}
+
+	config, err := f.config()
+	if err != nil {
+		return err
+	}
+	config.HeaderRegex = guess.Regex
+	if err := parser.WithConfig(config); err != nil {
+		return fmt.Errorf("configuring parser: %w", err)
+	}
+	return nil
+}
+
+// newParser creates a parser configured from the flags
+func (f *parserFlags) newParser() (*awsomlp.AWSOMLP, error) {
+	config, err := f.config()
+	if err != nil {
+		return nil, err
+	}
+
+	parser := awsomlp.NewAWSOMLP()
+	if err := parser.WithConfig(config); err != nil {
+		return nil, fmt.Errorf("configuring parser: %w", err)
+	}
+	return parser, nil
+}
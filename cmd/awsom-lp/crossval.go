@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// writeStability writes the -cross-validate report
+func writeStability(w io.Writer, stability awsomlp.Stability) {
+	fmt.Fprintf(w, "Cross-validation over %d folds:\n", len(stability.Folds))
+	for i, fold := range stability.Folds {
+		fmt.Fprintf(w, "  Fold %d: %d lines, %d templates\n", i+1, fold.Lines, fold.Templates)
+	}
+	fmt.Fprintf(w, "Templates per fold: mean %.1f, variance %.2f\n", stability.TemplateMean, stability.TemplateVariance)
+	fmt.Fprintf(w, "Template set Jaccard similarity: mean %.3f, min %.3f\n", stability.MeanJaccard, stability.MinJaccard)
+	fmt.Fprintf(w, "Templates found in every fold: %d of %d\n", stability.Shared, stability.Templates)
+	fmt.Fprintf(w, "Count variation: %.3f\n", stability.CountVariation)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// csvChunkSize is the amount of CSV data a worker decodes at a time
+const csvChunkSize = 1 << 20
+
+// recordSplitter finds the ends of CSV or TSV records without decoding their
+// fields. It follows the quoting and escaping rules of the record readers, so
+// the input can be cut into chunks of whole records that are decoded
+// independently. Only single-byte delimiter, quote and escape characters are
+// supported, as the bytes of multi-byte runes are never ASCII.
+type recordSplitter struct {
+	comma, quote, escape byte
+	lazy                 bool // encoding/csv rules: leading spaces are skipped, and a quote only closes a field before a delimiter or line end
+
+	fieldStart    bool // At the start of a field
+	inQuotes      bool // Inside a quoted field
+	quotePending  bool // A quote inside a quoted field, the next byte decides its meaning
+	crPending     bool // A quote followed by \r inside a quoted field
+	escapePending bool // The next byte is escaped
+}
+
+// newRecordSplitter creates a splitter for the dialect of opts; ok is false
+// if the dialect has multi-byte characters
+func newRecordSplitter(opts csvOptions) (splitter *recordSplitter, ok bool) {
+	for _, r := range []rune{opts.comma, opts.quote, opts.escape} {
+		if r >= utf8.RuneSelf {
+			return nil, false
+		}
+	}
+	return &recordSplitter{
+		comma:      byte(opts.comma),
+		quote:      byte(opts.quote),
+		escape:     byte(opts.escape),
+		lazy:       opts.quote == '"' && opts.escape == 0, // Read by encoding/csv, see newRecordReader
+		fieldStart: true,
+	}, true
+}
+
+// step advances the splitter by one byte and reports whether it ends a record
+func (s *recordSplitter) step(c byte) bool {
+	switch {
+	case s.escapePending:
+		s.escapePending = false
+		return false
+
+	case s.crPending:
+		s.crPending = false
+		if c == '\n' {
+			s.inQuotes, s.fieldStart = false, true
+			return true
+		}
+		return s.step(c) // The quote was literal, still inside quotes
+
+	case s.quotePending:
+		s.quotePending = false
+		if c == s.quote {
+			return false // Doubled quote
+		}
+		if !s.lazy {
+			s.inQuotes = false
+			return s.step(c)
+		}
+		switch c {
+		case s.comma:
+			s.inQuotes, s.fieldStart = false, true
+			return false
+		case '\n':
+			s.inQuotes, s.fieldStart = false, true
+			return true
+		case '\r':
+			s.crPending = true
+			return false
+		}
+		return s.step(c) // A lazy quote is kept literally
+
+	case s.inQuotes:
+		switch {
+		case s.escape != 0 && c == s.escape:
+			s.escapePending = true
+		case c == s.quote && s.escape == 0:
+			s.quotePending = true
+		case c == s.quote:
+			s.inQuotes = false
+		}
+		return false
+	}
+
+	switch {
+	case s.escape != 0 && c == s.escape:
+		s.escapePending, s.fieldStart = true, false
+	case c == s.comma:
+		s.fieldStart = true
+	case c == '\n':
+		s.fieldStart = true
+		return true
+	case s.fieldStart && s.quote != 0 && c == s.quote:
+		s.inQuotes, s.fieldStart = true, false
+	case s.fieldStart && s.lazy && (c == ' ' || c == '\t'):
+		// Leading space trimmed by encoding/csv
+	default:
+		s.fieldStart = false
+	}
+	return false
+}
+
+// split reads r from a record boundary and calls emit with chunks of whole
+// records of at least csvChunkSize bytes, the last one holding the remainder
+func (s *recordSplitter) split(r io.Reader, emit func([]byte)) error {
+	chunk := make([]byte, 0, csvChunkSize+64*1024)
+	scanned, boundary := 0, 0
+	block := make([]byte, 64*1024)
+	for {
+		for ; scanned < len(chunk); scanned++ {
+			if s.step(chunk[scanned]) {
+				boundary = scanned + 1
+			}
+		}
+		if boundary >= csvChunkSize {
+			emit(chunk[:boundary])
+			chunk = append(make([]byte, 0, csvChunkSize+64*1024), chunk[boundary:]...)
+			scanned -= boundary
+			boundary = 0
+		}
+
+		n, err := r.Read(block)
+		chunk = append(chunk, block[:n]...)
+		if err == io.EOF {
+			if len(chunk) > 0 {
+				emit(chunk)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCSVLogsParallel reads log lines from a CSV or TSV file like readCSVLogs,
+// decoding chunks of records and assembling their messages on several workers.
+// The messages are collected in input order.
+func readCSVLogsParallel(file io.Reader, opts csvOptions, limit *lineLimit, splitter *recordSplitter, workers int) ([]string, error) {
+	reader := bufio.NewReaderSize(file, 64*1024)
+
+	// Read header (or the first record of a headerless file)
+	var data []byte
+	for {
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, c)
+		if splitter.step(c) {
+			break
+		}
+	}
+	if len(data) == 0 && opts.noHeader {
+		return nil, nil
+	}
+	first, err := newRecordReader(bytes.NewReader(data), opts).Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+
+	header := first
+	if opts.noHeader {
+		header = nil
+	}
+	builder, err := newMessageBuilder(header, len(first), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	type job struct {
+		data   []byte
+		result chan csvChunk
+	}
+	jobs := make(chan job)
+	pending := make(chan chan csvChunk, workers) // Results in input order
+	for range workers {
+		go func() {
+			for j := range jobs {
+				j.result <- decodeCSVChunk(j.data, opts, len(first), builder)
+			}
+		}()
+	}
+	var readErr error
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		readErr = splitter.split(reader, func(chunk []byte) {
+			result := make(chan csvChunk, 1)
+			pending <- result
+			jobs <- job{data: chunk, result: result}
+		})
+	}()
+
+	var (
+		lines     []string
+		rowNo     int
+		malformed int
+		limitErr  error
+	)
+	add := func(message string) {
+		rowNo++
+		if message == "" || limitErr != nil {
+			return
+		}
+		line, ok, err := limit.apply(message, rowNo)
+		if err != nil {
+			limitErr = fmt.Errorf("CSV row %d: %v", rowNo, err)
+		} else if ok {
+			lines = append(lines, line)
+		}
+	}
+	if opts.noHeader {
+		add(builder.message(first))
+	}
+	// Results are drained after an error so that the workers finish
+	for result := range pending {
+		chunk := <-result
+		for _, message := range chunk.messages {
+			add(message)
+		}
+		malformed += chunk.malformed
+		if chunk.err != nil && limitErr == nil {
+			limitErr = fmt.Errorf("CSV row %d: %w", rowNo+1, chunk.err)
+		}
+	}
+	if limitErr != nil {
+		return nil, limitErr
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	reportMalformedRows(malformed)
+	return lines, nil
+}
+
+// csvChunk is the result of decoding a chunk of records
+type csvChunk struct {
+	messages  []string // Message of every record up to err
+	malformed int      // Records with a wrong number of fields, whose message is empty
+	err       error    // Error decoding the record after the messages
+}
+
+// decodeCSVChunk decodes a chunk of whole records and returns the message of
+// every record. Records with a wrong number of fields yield an empty message
+// so that rows keep their numbers; other errors end the chunk. fields is the
+// number of fields encoding/csv expects per record.
+func decodeCSVChunk(data []byte, opts csvOptions, fields int, builder *messageBuilder) csvChunk {
+	reader := newRecordReader(bytes.NewReader(data), opts)
+	if r, ok := reader.(*csv.Reader); ok {
+		r.FieldsPerRecord = fields
+	}
+
+	var chunk csvChunk
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return chunk
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			chunk.messages = append(chunk.messages, "")
+			chunk.malformed++
+			continue
+		}
+		if err != nil {
+			// The position of a parse error is relative to the chunk
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				err = parseErr.Err
+			}
+			chunk.err = err
+			return chunk
+		}
+		chunk.messages = append(chunk.messages, builder.message(record))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// delimitedReader reads delimiter-separated records with a configurable quote
+// and escape character. It is used for TSV files and for CSV dialects that
+// encoding/csv cannot express (custom quotes, backslash escapes).
+//
+// Quotes are only recognized at the start of a field; quotes inside unquoted
+// fields are kept literally. Inside quotes a doubled quote stands for a single
+// quote unless an escape character is configured. The escape character makes
+// the next character literal, except for \n, \t and \r which are decoded.
+type delimitedReader struct {
+	reader *bufio.Reader
+	comma  rune // Field delimiter
+	quote  rune // Quote character (0 = no quoting)
+	escape rune // Escape character (0 = no escaping)
+}
+
+// newDelimitedReader creates a reader for the given dialect
+func newDelimitedReader(r io.Reader, comma, quote, escape rune) *delimitedReader {
+	return &delimitedReader{
+		reader: bufio.NewReader(r),
+		comma:  comma,
+		quote:  quote,
+		escape: escape,
+	}
+}
+
+// Read reads one record. It returns io.EOF when no more records are available.
+func (d *delimitedReader) Read() ([]string, error) {
+	var (
+		record   []string
+		field    strings.Builder
+		inQuotes bool
+		started  bool // Whether anything was read for this record
+		quoted   bool // Whether the current field started with a quote
+	)
+
+	endField := func() {
+		value := field.String()
+		if !quoted {
+			value = strings.TrimSuffix(value, "\r")
+		}
+		record = append(record, value)
+		field.Reset()
+		quoted = false
+	}
+
+	for {
+		r, _, err := d.reader.ReadRune()
+		if err == io.EOF {
+			if !started {
+				return nil, io.EOF
+			}
+			endField()
+			return record, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		started = true
+
+		switch {
+		case d.escape != 0 && r == d.escape:
+			next, _, err := d.reader.ReadRune()
+			if err != nil {
+				field.WriteRune(r)
+				continue
+			}
+			switch next {
+			case 'n':
+				field.WriteRune('\n')
+			case 't':
+				field.WriteRune('\t')
+			case 'r':
+				field.WriteRune('\r')
+			default:
+				field.WriteRune(next)
+			}
+
+		case inQuotes:
+			if r != d.quote {
+				field.WriteRune(r)
+				continue
+			}
+			if d.escape == 0 {
+				if next, _, err := d.reader.ReadRune(); err == nil {
+					if next == d.quote {
+						field.WriteRune(r)
+						continue
+					}
+					_ = d.reader.UnreadRune()
+				}
+			}
+			inQuotes = false
+
+		case d.quote != 0 && r == d.quote && field.Len() == 0 && !quoted:
+			inQuotes = true
+			quoted = true
+
+		case r == d.comma:
+			endField()
+
+		case r == '\n':
+			endField()
+			return record, nil
+
+		default:
+			field.WriteRune(r)
+		}
+	}
+}
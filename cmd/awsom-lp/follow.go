@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// follower reads a growing log file like tail -F: at the end of the file it waits
+// for new data, and it reopens the file when it is rotated (replaced by a new
+// file) or truncated. Read returns io.EOF only when the context is cancelled.
+type follower struct {
+	ctx     context.Context
+	path    string
+	poll    time.Duration // Interval between checks for new data
+	rotated bool          // On truncation, read the missed tail of the rotated copy (path.1 or path.1.gz)
+
+	file    *os.File
+	info    fs.FileInfo
+	offset  int64     // Bytes read from file
+	pending io.Reader // Data to read before file: the rest of a rotated file or a rotated copy's tail
+}
+
+// newFollower opens path for following, starting at its end unless fromStart is set
+func newFollower(ctx context.Context, path string, fromStart, rotated bool, poll time.Duration) (*follower, error) {
+	if poll <= 0 {
+		return nil, fmt.Errorf("poll interval must be positive, got %s", poll)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &follower{ctx: ctx, path: path, poll: poll, rotated: rotated, file: file, info: info}
+	if !fromStart {
+		if f.offset, err = file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Read reads from the followed file, waiting for data at its end
+func (f *follower) Read(p []byte) (int, error) {
+	for {
+		if f.pending != nil {
+			n, err := f.pending.Read(p)
+			if n > 0 {
+				return n, nil
+			}
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			if closer, ok := f.pending.(io.Closer); ok {
+				closer.Close()
+			}
+			f.pending = nil
+			continue
+		}
+
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		// At the end of the file: continue at once if it was rotated or truncated
+		reopened, err := f.checkRotation()
+		if err != nil {
+			return 0, err
+		}
+		if reopened {
+			continue
+		}
+
+		select {
+		case <-f.ctx.Done():
+			return 0, io.EOF
+		case <-time.After(f.poll):
+		}
+	}
+}
+
+// checkRotation detects a rotated or truncated file and prepares reading its successor
+func (f *follower) checkRotation() (bool, error) {
+	info, err := os.Stat(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil // Moved away, the new file is not created yet
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Rotated: finish the old file, which may still be written to, then read the new one
+	if !os.SameFile(info, f.info) {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return false, err
+		}
+		f.pending = f.file
+		f.file, f.info, f.offset = file, info, 0
+		return true, nil
+	}
+
+	// Truncated in place (copytruncate): restart at the beginning
+	if info.Size() < f.offset {
+		if f.rotated {
+			f.pending = openRotatedTail(f.path, f.offset)
+		}
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		f.offset = 0
+		return true, nil
+	}
+	return false, nil
+}
+
+// openRotatedTail opens the rotated copy of a truncated file, plain or gzipped,
+// positioned at offset, or returns nil if there is none
+func openRotatedTail(path string, offset int64) io.Reader {
+	if file, err := os.Open(path + ".1"); err == nil {
+		if _, err := file.Seek(offset, io.SeekStart); err == nil {
+			return file
+		}
+		file.Close()
+		return nil
+	}
+
+	file, err := os.Open(path + ".1.gz")
+	if err != nil {
+		return nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil
+	}
+	if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+		file.Close()
+		return nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, file}
+}
+
+// Close closes the followed file
+func (f *follower) Close() error {
+	if closer, ok := f.pending.(io.Closer); ok {
+		closer.Close()
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Fluentd forward protocol parameters
+const (
+	msgpackMaxBytes = 64 << 20 // Larger strings and chunks are rejected instead of allocated
+	msgpackMaxItems = 1 << 24  // Larger arrays and maps are rejected instead of allocated
+	msgpackMaxDepth = 64       // Deeper nesting is rejected
+)
+
+// forwardOptions configures the forward protocol server
+type forwardOptions struct {
+	addr    string         // Listen address, e.g. :24224
+	keys    []string       // Record keys holding the log line, the first one present is used
+	clients *clientLimiter // Limits of every client (connections of one IP address share them)
+}
+
+// msgpackExt is a msgpack extension value, e.g. the EventTime of a forward entry
+type msgpackExt struct {
+	kind int8
+	data []byte
+}
+
+// msgpackDecoder decodes msgpack values from a stream
+type msgpackDecoder struct {
+	r *bufio.Reader
+}
+
+// decode reads the next value as nil, bool, int64, uint64, float64, string,
+// []byte, []any, map[string]any or msgpackExt. Map keys other than strings are
+// converted with fmt.Sprint.
+func (d *msgpackDecoder) decode() (any, error) {
+	return d.value(0)
+}
+
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, fmt.Errorf("msgpack value nested deeper than %d levels", msgpackMaxDepth)
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.mapValue(int(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return d.array(int(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		return d.str(int(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(b - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return d.raw(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(b - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(n)
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce:
+		v, err := d.uint(1 << (b - 0xcc))
+		return int64(v), err
+	case 0xcf:
+		v, err := d.uint(8)
+		if v <= math.MaxInt64 {
+			return int64(v), err
+		}
+		return v, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		v, err := d.uint(size)
+		shift := 64 - 8*size
+		return int64(v<<shift) >> shift, err // Sign extension
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(b - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(b - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(b - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(n, depth)
+	default:
+		return nil, fmt.Errorf("invalid msgpack type 0x%02x", b)
+	}
+}
+
+// uint reads a big-endian unsigned integer of size bytes
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// length reads a length of 1, 2 or 4 bytes for class 0, 1 or 2
+func (d *msgpackDecoder) length(class byte) (int, error) {
+	v, err := d.uint(1 << class)
+	if err != nil {
+		return 0, err
+	}
+	if v > msgpackMaxBytes {
+		return 0, fmt.Errorf("msgpack value of %d bytes exceeds %d", v, msgpackMaxBytes)
+	}
+	return int(v), nil
+}
+
+// raw reads n bytes. The declared length is not trusted for an allocation:
+// the data is buffered as it arrives, so a truncated value costs no more
+// memory than was sent.
+func (d *msgpackDecoder) raw(n int) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(d.r, int64(n))); err != nil {
+		return nil, err
+	}
+	if buf.Len() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	data, err := d.raw(n)
+	return string(data), err
+}
+
+func (d *msgpackDecoder) ext(n int) (msgpackExt, error) {
+	kind, err := d.r.ReadByte()
+	if err != nil {
+		return msgpackExt{}, err
+	}
+	data, err := d.raw(n)
+	return msgpackExt{kind: int8(kind), data: data}, err
+}
+
+func (d *msgpackDecoder) array(n, depth int) ([]any, error) {
+	if n > msgpackMaxItems {
+		return nil, fmt.Errorf("msgpack array of %d items exceeds %d", n, msgpackMaxItems)
+	}
+	items := make([]any, 0, min(n, 1024))
+	for range n {
+		item, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) mapValue(n, depth int) (map[string]any, error) {
+	if n > msgpackMaxItems {
+		return nil, fmt.Errorf("msgpack map of %d items exceeds %d", n, msgpackMaxItems)
+	}
+	m := make(map[string]any, min(n, 1024))
+	for range n {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case string:
+			m[k] = value
+		case []byte:
+			m[string(k)] = value
+		default:
+			m[fmt.Sprint(k)] = value
+		}
+	}
+	return m, nil
+}
+
+// appendMsgpackString appends a msgpack string
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// serveForward accepts Fluentd and Fluent Bit forward protocol connections and
+// pushes the log line of every record into the queue until the context is
+// cancelled. A chunk that asks for an acknowledgment is acknowledged once all
+// its lines are parsed, so the agent resends chunks that were not.
+func serveForward(ctx context.Context, opts forwardOptions, queue *lineQueue, limit *lineLimit) error {
+	defer queue.close()
+
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", opts.addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	// Connections share the line limit, whose counters are not synchronized
+	var limitMu sync.Mutex
+	apply := func(line string, lineNo int) (string, bool, error) {
+		limitMu.Lock()
+		defer limitMu.Unlock()
+		return limit.apply(line, lineNo)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	failed := make(chan error, 1)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			select {
+			case err := <-failed:
+				return err
+			default:
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := handleForward(ctx, conn, opts, queue, apply)
+			var limitErr *forwardLimitError
+			switch {
+			case errors.As(err, &limitErr):
+				// The long line policy aborts reading like for any other input
+				select {
+				case failed <- limitErr.err:
+				default:
+				}
+				listener.Close()
+			case err != nil && err != io.EOF && ctx.Err() == nil:
+				log.Printf("Forward connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// forwardLimitError is a line that exceeds the limit with the error policy
+type forwardLimitError struct {
+	err error
+}
+
+func (e *forwardLimitError) Error() string { return e.err.Error() }
+
+// handleForward reads forward protocol messages from a connection until it is closed
+func handleForward(ctx context.Context, conn net.Conn, opts forwardOptions, queue *lineQueue,
+	apply func(line string, lineNo int) (string, bool, error)) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var writeMu sync.Mutex
+	decoder := &msgpackDecoder{r: bufio.NewReaderSize(conn, 64*1024)}
+	for lineNo := 1; ; {
+		message, err := decoder.decode()
+		if err != nil {
+			return err
+		}
+		records, chunk, err := forwardRecords(message)
+		if err != nil {
+			return err
+		}
+		lines := make([]string, 0, len(records))
+		for _, record := range records {
+			if line := newlineReplacer.Replace(strings.TrimSpace(forwardLine(record, opts.keys))); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if _, err := opts.clients.allow(clientAddress(conn.RemoteAddr().String()), len(lines)); err != nil {
+			continue // Not acknowledged, so the agent sends the chunk again
+		}
+
+		// The acknowledgment is sent when the last line of the chunk is parsed;
+		// the extra count keeps it from being sent while lines are still pushed
+		var pending atomic.Int64
+		pending.Store(1)
+		ack := func() {
+			if pending.Add(-1) != 0 || chunk == "" {
+				return
+			}
+			response := appendMsgpackString([]byte{0x81}, "ack")
+			response = appendMsgpackString(response, chunk)
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			conn.Write(response)
+		}
+
+		for _, line := range lines {
+			text, ok, limitErr := apply(line, lineNo)
+			lineNo++
+			if limitErr != nil {
+				return &forwardLimitError{limitErr}
+			}
+			if !ok {
+				continue
+			}
+			pending.Add(1)
+			queue.pushAcked(text, ack)
+		}
+		ack()
+	}
+}
+
+// forwardRecords extracts the records and the chunk ID to acknowledge from a
+// message in Message, Forward, PackedForward or CompressedPackedForward mode
+func forwardRecords(message any) (records []map[string]any, chunk string, err error) {
+	array, _ := message.([]any)
+	if len(array) < 2 {
+		return nil, "", fmt.Errorf("malformed forward message")
+	}
+	if _, ok := array[0].(string); !ok {
+		return nil, "", fmt.Errorf("malformed forward message: tag is not a string")
+	}
+
+	var option map[string]any
+	switch entries := array[1].(type) {
+	case []any:
+		// Forward mode: [tag, [[time, record], ...], option]
+		for _, entry := range entries {
+			if record, ok := forwardEntryRecord(entry); ok {
+				records = append(records, record)
+			}
+		}
+		if len(array) > 2 {
+			option, _ = array[2].(map[string]any)
+		}
+	case string, []byte:
+		// PackedForward mode: [tag, msgpack stream of entries, option], optionally gzipped
+		if len(array) > 2 {
+			option, _ = array[2].(map[string]any)
+		}
+		var data io.Reader
+		if s, ok := entries.(string); ok {
+			data = strings.NewReader(s)
+		} else {
+			data = bytes.NewReader(entries.([]byte))
+		}
+		if compressed, _ := option["compressed"].(string); compressed == "gzip" {
+			gz, err := gzip.NewReader(data)
+			if err != nil {
+				return nil, "", err
+			}
+			data = io.LimitReader(gz, msgpackMaxBytes)
+		}
+		packed := &msgpackDecoder{r: bufio.NewReader(data)}
+		for {
+			entry, err := packed.decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("malformed packed forward entries: %w", err)
+			}
+			if record, ok := forwardEntryRecord(entry); ok {
+				records = append(records, record)
+			}
+		}
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(array) < 3 {
+			return nil, "", fmt.Errorf("malformed forward message")
+		}
+		if record, ok := array[2].(map[string]any); ok {
+			records = append(records, record)
+		}
+		if len(array) > 3 {
+			option, _ = array[3].(map[string]any)
+		}
+	}
+
+	chunk, _ = option["chunk"].(string)
+	return records, chunk, nil
+}
+
+// forwardEntryRecord returns the record of a [time, record] entry
+func forwardEntryRecord(entry any) (map[string]any, bool) {
+	pair, _ := entry.([]any)
+	if len(pair) < 2 {
+		return nil, false
+	}
+	record, ok := pair[1].(map[string]any)
+	return record, ok
+}
+
+// forwardLine returns the first of the keys present in a record as text
+func forwardLine(record map[string]any, keys []string) string {
+	for _, key := range keys {
+		switch value := record[key].(type) {
+		case string:
+			return value
+		case []byte:
+			return string(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Google Cloud Logging API parameters
+const (
+	gcpPageSize   = 1000 // Maximum entries per request allowed by the API
+	gcpMaxRetries = 5    // Retries of a request rejected by the read quota
+)
+
+// gcpLoggingEndpoint is the entries:list API URL, a variable so that tests can
+// point it at a local server
+var gcpLoggingEndpoint = "https://logging.googleapis.com/v2/entries:list"
+
+// newlineReplacer joins the lines of a multi-line message
+var newlineReplacer = strings.NewReplacer("\r\n", " ", "\n", " ")
+
+// gcpOptions selects the Cloud Logging entries to read
+type gcpOptions struct {
+	filter string // Logging query language expression
+	from   string // Start of the time range: RFC 3339 time or duration before now
+	to     string // End of the time range: RFC 3339 time or duration before now
+}
+
+// isGCP reports whether an input is a gcp://PROJECT_ID Cloud Logging source
+func isGCP(input string) bool {
+	return strings.HasPrefix(input, "gcp://")
+}
+
+// gcpReader streams the messages of Cloud Logging entries, one per line, fetching
+// pages in timestamp order as they are read
+type gcpReader struct {
+	project   string
+	filter    string // Complete filter including the time range
+	token     string // OAuth access token
+	pageToken string
+	buf       bytes.Buffer
+	done      bool // The last page was fetched
+}
+
+// gcpEntry holds the fields of a log entry that can carry the message
+type gcpEntry struct {
+	TextPayload string         `json:"textPayload"`
+	JSONPayload map[string]any `json:"jsonPayload"`
+}
+
+// gcpPage is a response of entries:list
+type gcpPage struct {
+	Entries       []gcpEntry `json:"entries"`
+	NextPageToken string     `json:"nextPageToken"`
+}
+
+// openGCP prepares reading the entries of a project matching the options
+func openGCP(input string, opts gcpOptions) (*gcpReader, error) {
+	project := strings.Trim(strings.TrimPrefix(input, "gcp://"), "/")
+	if project == "" {
+		return nil, fmt.Errorf("invalid Cloud Logging input %s: no project ID", input)
+	}
+
+	now := time.Now()
+	var terms []string
+	if opts.filter != "" {
+		terms = append(terms, "("+opts.filter+")")
+	}
+	for _, bound := range []struct{ value, op string }{{opts.from, ">="}, {opts.to, "<"}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := parseTimeBound(bound.value, now)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, fmt.Sprintf(`timestamp%s"%s"`, bound.op, t.UTC().Format(time.RFC3339Nano)))
+	}
+
+	token, err := gcpAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	return &gcpReader{project: project, filter: strings.Join(terms, " AND "), token: token}, nil
+}
+
+// parseTimeBound parses an RFC 3339 time or a duration before now such as 24h
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s (want RFC 3339 time or duration like 24h)", value)
+	}
+	return t, nil
+}
+
+// gcpAccessToken returns an OAuth access token from CLOUDSDK_AUTH_ACCESS_TOKEN or gcloud
+func gcpAccessToken() (string, error) {
+	if token := os.Getenv("CLOUDSDK_AUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	out, err := exec.Command("gcloud", "auth", "print-access-token").Output()
+	if err != nil {
+		return "", fmt.Errorf("getting an access token with gcloud (or set CLOUDSDK_AUTH_ACCESS_TOKEN): %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Read implements io.Reader
+func (r *gcpReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// fetch requests the next page of entries and appends their messages to the buffer
+func (r *gcpReader) fetch() error {
+	body, err := json.Marshal(map[string]any{
+		"resourceNames": []string{"projects/" + r.project},
+		"filter":        r.filter,
+		"orderBy":       "timestamp asc",
+		"pageSize":      gcpPageSize,
+		"pageToken":     r.pageToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	var page gcpPage
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, gcpLoggingEndpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+r.token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < gcpMaxRetries {
+			resp.Body.Close()
+			time.Sleep(retryDelay(resp, attempt))
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			return fmt.Errorf("Cloud Logging: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Cloud Logging: %w", err)
+		}
+		break
+	}
+
+	for _, entry := range page.Entries {
+		message := entry.message()
+		if message == "" {
+			continue
+		}
+		// A multi-line entry, such as a stack trace, is parsed as one line
+		r.buf.WriteString(newlineReplacer.Replace(strings.TrimRight(message, "\r\n")))
+		r.buf.WriteByte('\n')
+	}
+	r.pageToken = page.NextPageToken
+	r.done = page.NextPageToken == ""
+	return nil
+}
+
+// message returns textPayload or the message field of jsonPayload
+func (e gcpEntry) message() string {
+	if e.TextPayload != "" {
+		return e.TextPayload
+	}
+	message, _ := e.JSONPayload["message"].(string)
+	return message
+}
+
+// retryDelay returns the wait before retrying a rejected request: Retry-After
+// if given, else an exponential backoff starting at one second
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Second << attempt
+}
+
+// Close implements io.Closer
+func (r *gcpReader) Close() error {
+	return nil
+}
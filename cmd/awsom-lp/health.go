@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// serveHealth tracks the state of serve mode reported by /healthz and /readyz
+type serveHealth struct {
+	started   time.Time
+	queue     *lineQueue
+	snapshots *awsomlp.SnapshotManager // nil without -state
+	interval  time.Duration            // Snapshot interval
+	exporter  *otlpExporter            // nil without -otlp
+	clients   *clientLimiter
+
+	inputDone      atomic.Bool // The input has ended
+	stopping       atomic.Bool // Shutdown has begun
+	inputErrors    atomic.Int64
+	snapshotErrors atomic.Int64
+	configErrors   atomic.Int64
+}
+
+// healthReport is the JSON body of /healthz and /readyz
+type healthReport struct {
+	Status        string       `json:"status"`
+	Reasons       []string     `json:"reasons,omitempty"` // Why the service is not ready
+	Uptime        float64      `json:"uptime_seconds"`
+	LinesReceived int          `json:"lines_received"`
+	LinesDropped  int          `json:"lines_dropped"`
+	QueueDepth    int          `json:"queue_depth"`
+	QueueCapacity int          `json:"queue_capacity"`
+	SnapshotAge   *float64     `json:"snapshot_age_seconds,omitempty"` // Absent without -state or before the first snapshot
+	Errors        healthErrors `json:"errors"`
+	Ingest        ingestStats  `json:"ingest"`
+}
+
+// ingestStats counts the batches of -ingest requests and -forward chunks
+type ingestStats struct {
+	Accepted    int64 `json:"accepted"`
+	RateLimited int64 `json:"rate_limited"`
+	TooLarge    int64 `json:"too_large"`
+}
+
+// healthErrors counts the errors since startup
+type healthErrors struct {
+	Input    int64 `json:"input"`
+	Snapshot int64 `json:"snapshot"`
+	Config   int64 `json:"config"`
+	Export   int64 `json:"export"`
+}
+
+// report returns the current state; the service is ready unless it is
+// shutting down, its input has ended, its queue is full or its snapshot is
+// more than two intervals old
+func (h *serveHealth) report() healthReport {
+	received, dropped, queued := h.queue.stats()
+	report := healthReport{
+		Status:        "ok",
+		Uptime:        time.Since(h.started).Seconds(),
+		LinesReceived: received,
+		LinesDropped:  dropped,
+		QueueDepth:    queued,
+		QueueCapacity: len(h.queue.lines),
+		Errors: healthErrors{
+			Input:    h.inputErrors.Load(),
+			Snapshot: h.snapshotErrors.Load(),
+			Config:   h.configErrors.Load(),
+		},
+		Ingest: ingestStats{
+			Accepted:    h.clients.accepted.Load(),
+			RateLimited: h.clients.rateLimited.Load(),
+			TooLarge:    h.clients.tooLarge.Load(),
+		},
+	}
+	if h.exporter != nil {
+		report.Errors.Export = h.exporter.failed.Load()
+	}
+
+	if h.stopping.Load() {
+		report.Reasons = append(report.Reasons, "shutting down")
+	}
+	if h.inputDone.Load() {
+		report.Reasons = append(report.Reasons, "input ended")
+	}
+	if queued == report.QueueCapacity {
+		report.Reasons = append(report.Reasons, "queue full")
+	}
+	if h.snapshots != nil {
+		if saved := h.snapshots.LastSaved(); !saved.IsZero() {
+			age := time.Since(saved).Seconds()
+			report.SnapshotAge = &age
+			if h.interval > 0 && time.Since(saved) > 2*h.interval {
+				report.Reasons = append(report.Reasons, "snapshot outdated")
+			}
+		}
+	}
+	if len(report.Reasons) > 0 {
+		report.Status = "not ready"
+	}
+	return report
+}
+
+// serveHealthz reports liveness: the service answers as long as it runs
+func (h *serveHealth) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	report := h.report()
+	report.Status, report.Reasons = "ok", nil
+	writeHealth(w, http.StatusOK, report)
+}
+
+// serveReadyz reports readiness, failing with 503 while the service cannot
+// take more input
+func (h *serveHealth) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	report := h.report()
+	status := http.StatusOK
+	if len(report.Reasons) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, report)
+}
+
+// writeHealth writes a health report as JSON
+func writeHealth(w http.ResponseWriter, status int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
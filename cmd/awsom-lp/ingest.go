@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxClientBuckets is the number of clients tracked before idle ones are forgotten
+const maxClientBuckets = 10000
+
+// maxIngestBytes limits the body of an /ingest request, also when -max-batch
+// does not limit its lines
+const maxIngestBytes = 64 << 20
+
+// Reasons for rejecting a batch of lines from a client
+var (
+	errRateLimited   = errors.New("client rate limit exceeded")
+	errBatchTooLarge = errors.New("batch too large")
+)
+
+// clientLimiter enforces per-client rate limits and a maximum batch size on
+// the ingest endpoints. Every client, identified by its IP address, has a
+// token bucket refilled at rate lines per second up to burst lines. A batch is
+// accepted when the bucket holds as many tokens as the batch has lines, or is
+// full for batches larger than burst; the tokens of an accepted batch are
+// taken even if the bucket goes negative, so a large batch delays the next one.
+type clientLimiter struct {
+	rate     float64 // Lines per second per client (0 = unlimited)
+	burst    float64 // Bucket size in lines
+	maxBatch int     // Maximum number of lines per batch (0 = unlimited)
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time // Clock of the buckets, replaced in tests
+
+	accepted    atomic.Int64 // Batches accepted
+	rateLimited atomic.Int64 // Batches rejected by the rate limit
+	tooLarge    atomic.Int64 // Batches rejected by the batch size
+}
+
+// tokenBucket holds the tokens of a client
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newClientLimiter creates a limiter; a burst of 0 allows one second of lines
+func newClientLimiter(rate float64, burst, maxBatch int) (*clientLimiter, error) {
+	if rate < 0 {
+		return nil, fmt.Errorf("client rate must be non-negative, got %g", rate)
+	}
+	if burst < 0 {
+		return nil, fmt.Errorf("client burst must be non-negative, got %d", burst)
+	}
+	if maxBatch < 0 {
+		return nil, fmt.Errorf("maximum batch size must be non-negative, got %d", maxBatch)
+	}
+	l := &clientLimiter{
+		rate:     rate,
+		burst:    float64(burst),
+		maxBatch: maxBatch,
+		buckets:  make(map[string]*tokenBucket),
+		now:      time.Now,
+	}
+	if l.burst == 0 {
+		l.burst = max(math.Ceil(rate), 1)
+	}
+	return l, nil
+}
+
+// allow reports whether a client may send a batch of n lines. On rejection it
+// returns errBatchTooLarge or errRateLimited, the latter with the time after
+// which the batch would be accepted.
+func (l *clientLimiter) allow(client string, n int) (retryAfter time.Duration, err error) {
+	if l.maxBatch > 0 && n > l.maxBatch {
+		l.tooLarge.Add(1)
+		return 0, errBatchTooLarge
+	}
+	if l.rate == 0 {
+		l.accepted.Add(1)
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxClientBuckets {
+			l.forgetIdle(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = min(bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate, l.burst)
+	bucket.updated = now
+
+	if needed := min(float64(n), l.burst); bucket.tokens < needed {
+		l.rateLimited.Add(1)
+		return time.Duration((needed - bucket.tokens) / l.rate * float64(time.Second)), errRateLimited
+	}
+	bucket.tokens -= float64(n)
+	l.accepted.Add(1)
+	return 0, nil
+}
+
+// forgetIdle removes the buckets of clients that would be full by now
+func (l *clientLimiter) forgetIdle(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// clientAddress returns the IP address of a network address, or the address itself
+func clientAddress(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ingestHandler accepts log lines POSTed to /ingest, one per line
+type ingestHandler struct {
+	queue   *lineQueue
+	clients *clientLimiter
+	mu      sync.Mutex // Guards limit, whose counters are not synchronized
+	limit   *lineLimit
+	lineNo  int
+
+	maxBytes int64 // Maximum size of a request body (0 = maxIngestBytes)
+}
+
+// ServeHTTP reads the lines of a request and queues them if the client is
+// within its limits: 413 rejects a batch or body larger than the maximum, 429
+// with Retry-After a batch over the client's rate, and 202 accepts it
+func (h *ingestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxBytes := h.maxBytes
+	if maxBytes == 0 {
+		maxBytes = maxIngestBytes
+	}
+	var lines []string
+	reader := bufio.NewReaderSize(http.MaxBytesReader(w, r.Body, maxBytes), 64*1024)
+	for {
+		line, err := readLine(reader, h.limit.maxBytes)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.clients.tooLarge.Add(1)
+			http.Error(w, fmt.Sprintf("%v: more than %d bytes", errBatchTooLarge, tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if line != "" {
+			lines = append(lines, line)
+			if h.clients.maxBatch > 0 && len(lines) > h.clients.maxBatch {
+				break // Rejected without reading the rest
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	retryAfter, err := h.clients.allow(clientAddress(r.RemoteAddr), len(lines))
+	switch {
+	case errors.Is(err, errBatchTooLarge):
+		http.Error(w, fmt.Sprintf("%v: more than %d lines", err, h.clients.maxBatch), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errRateLimited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	h.mu.Lock()
+	texts := make([]string, 0, len(lines))
+	for _, line := range lines {
+		h.lineNo++
+		text, ok, err := h.limit.apply(line, h.lineNo)
+		if err != nil {
+			h.mu.Unlock()
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if ok {
+			texts = append(texts, text)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, text := range texts {
+		h.queue.push(text)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
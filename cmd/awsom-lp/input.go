@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// Long line policies for -long-lines
+const (
+	policyTruncate = "truncate" // Keep the first max-line-bytes bytes
+	policySkip     = "skip"     // Drop the line
+	policyError    = "error"    // Abort reading
+)
+
+// defaultMaxLineBytes is the line size limit used for -max-line-bytes 0
+const defaultMaxLineBytes = 10000
+
+// lineLimit enforces the maximum line size and counts affected lines
+type lineLimit struct {
+	maxBytes  int    // Maximum line size in bytes (-1 = unlimited)
+	policy    string // One of policyTruncate, policySkip, policyError
+	truncated int    // Number of truncated lines
+	skipped   int    // Number of skipped lines
+}
+
+// newLineLimit validates the policy and creates a line limit. Like the
+// library's MaxLineLength, a maxBytes of 0 selects the default and -1 disables
+// the limit.
+func newLineLimit(maxBytes int, policy string) (*lineLimit, error) {
+	switch policy {
+	case policyTruncate, policySkip, policyError:
+	default:
+		return nil, fmt.Errorf("invalid long line policy: %s (want truncate, skip or error)", policy)
+	}
+	if maxBytes < -1 {
+		return nil, fmt.Errorf("max line bytes must be positive, or -1 for unlimited, got %d", maxBytes)
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultMaxLineBytes
+	}
+	return &lineLimit{maxBytes: maxBytes, policy: policy}, nil
+}
+
+// apply applies the policy to a line; ok is false if the line must be dropped
+func (l *lineLimit) apply(line string, lineNo int) (result string, ok bool, err error) {
+	if l.maxBytes < 0 || len(line) <= l.maxBytes {
+		return line, true, nil
+	}
+
+	switch l.policy {
+	case policySkip:
+		l.skipped++
+		return "", false, nil
+	case policyError:
+		return "", false, fmt.Errorf("line %d exceeds %d bytes", lineNo, l.maxBytes)
+	default:
+		// Cut on a rune boundary to avoid producing invalid UTF-8
+		cut := l.maxBytes
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		l.truncated++
+		return line[:cut], true, nil
+	}
+}
+
+// readTextLogs reads log lines from a text file
+func readTextLogs(file io.Reader, limit *lineLimit) ([]string, error) {
+	var lines []string
+	reader := bufio.NewReaderSize(file, 64*1024)
+
+	for lineNo := 1; ; lineNo++ {
+		line, err := readLine(reader, limit.maxBytes)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if line != "" {
+			text, ok, limitErr := limit.apply(line, lineNo)
+			if limitErr != nil {
+				return nil, limitErr
+			}
+			if ok {
+				lines = append(lines, text)
+			}
+		}
+
+		if err == io.EOF {
+			return lines, nil
+		}
+	}
+}
+
+// readMappedLogs reads log lines from a memory-mapped text file. The lines are
+// slices of the mapping, which stays mapped until the program exits because
+// the parser keeps referring to them.
+func readMappedLogs(path string, limit *lineLimit) ([]string, error) {
+	file, err := awsomlp.MapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	lineNo := 0
+	for line := range file.Lines() {
+		lineNo++
+		if line == "" {
+			continue
+		}
+		text, ok, err := limit.apply(line, lineNo)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lines = append(lines, text)
+		}
+	}
+	return lines, nil
+}
+
+// lineLimitReader streams a text file applying a line limit, yielding only the
+// accepted lines. It is used where the parser consumes an io.Reader directly.
+type lineLimitReader struct {
+	reader   *bufio.Reader
+	limit    *lineLimit
+	maxLines int    // Maximum number of lines to yield (0 = all)
+	lines    int    // Number of lines yielded so far
+	lineNo   int    // Number of input lines read so far
+	buf      []byte // Pending output
+	err      error  // Sticky read error
+}
+
+// newLineLimitReader creates a filtering reader
+func newLineLimitReader(file io.Reader, limit *lineLimit, maxLines int) *lineLimitReader {
+	return &lineLimitReader{
+		reader:   bufio.NewReaderSize(file, 64*1024),
+		limit:    limit,
+		maxLines: maxLines,
+	}
+}
+
+// Read implements io.Reader
+func (r *lineLimitReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.maxLines > 0 && r.lines >= r.maxLines {
+			r.err = io.EOF
+			continue
+		}
+
+		line, err := readLine(r.reader, r.limit.maxBytes)
+		r.lineNo++
+		if err != nil {
+			r.err = err
+		}
+		if line == "" {
+			continue
+		}
+		text, ok, limitErr := r.limit.apply(line, r.lineNo)
+		if limitErr != nil {
+			r.err = limitErr
+			return 0, limitErr
+		}
+		if ok {
+			r.buf = append([]byte(text), '\n')
+			r.lines++
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// readLine reads a single line without its line terminator. Lines longer than
+// maxBytes are not buffered completely: only maxBytes+1 bytes are kept, which
+// is enough for the caller to detect the overflow. A negative maxBytes reads
+// lines of any length.
+func readLine(reader *bufio.Reader, maxBytes int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		chunk = bytes.TrimSuffix(chunk, []byte("\n"))
+
+		if maxBytes < 0 || len(line) <= maxBytes {
+			if room := maxBytes + 1 - len(line); maxBytes >= 0 && len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			line = append(line, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(bytes.TrimSuffix(line, []byte("\r"))), err
+	}
+}
+
+// Input formats for -format
+const (
+	formatAuto    = "auto"    // Detect by file extension
+	formatText    = "text"    // One log line per line
+	formatCSV     = "csv"     // Comma-separated values
+	formatTSV     = "tsv"     // Tab-separated values
+	formatParquet = "parquet" // Apache Parquet (string column)
+)
+
+// formatNames are the human-readable format names used in messages
+var formatNames = map[string]string{
+	formatText:    "text",
+	formatCSV:     "CSV",
+	formatTSV:     "TSV",
+	formatParquet: "Parquet",
+}
+
+// inputOptions holds the format-specific reader flags
+type inputOptions struct {
+	csv       csvOptions   // Column selection for CSV, TSV and Parquet
+	delimiter string       // -delimiter flag
+	quote     string       // -quote flag
+	escape    string       // -escape flag
+	headers   httpHeaders  // -http-header flags for URL inputs
+	gcp       gcpOptions   // Entry selection for Cloud Logging inputs
+	azure     azureOptions // Query for Log Analytics inputs
+	mmap      bool         // Map local text files into memory instead of reading them
+}
+
+// readLogs reads all log lines from file in the given format
+func readLogs(file io.Reader, format string, limit *lineLimit, opts inputOptions) ([]string, error) {
+	switch format {
+	case formatCSV, formatTSV:
+		if err := opts.csv.setDialect(format, opts.delimiter, opts.quote, opts.escape); err != nil {
+			return nil, err
+		}
+		return readCSVLogs(file, opts.csv, limit)
+	case formatParquet:
+		// Parquet needs random access: a remote file is buffered in memory
+		if f, ok := file.(*os.File); ok {
+			info, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			return readParquetLogs(f, info.Size(), opts.csv.columns, limit)
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		return readParquetLogs(bytes.NewReader(data), int64(len(data)), opts.csv.columns, limit)
+	case formatText:
+		return readTextLogs(file, limit)
+	default:
+		return nil, fmt.Errorf("invalid input format: %s", format)
+	}
+}
+
+// readLogFile opens a file or URL and reads all its log lines, detecting the
+// format from the extension if format is auto
+func readLogFile(path, format string, limit *lineLimit, opts inputOptions) ([]string, error) {
+	if format == formatAuto {
+		format = detectFormat(inputPath(path))
+	}
+	if opts.mmap && format == formatText && !isRemote(path) {
+		lines, err := readMappedLogs(path, limit)
+		if err != nil {
+			return nil, fmt.Errorf("error reading text file %s: %w", path, err)
+		}
+		return lines, nil
+	}
+
+	file, err := openInput(path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	lines, err := readLogs(file, format, limit, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s file %s: %w", formatNames[format], path, err)
+	}
+	return lines, nil
+}
+
+// detectFormat selects the input format from the file extension
+func detectFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return formatCSV
+	case ".tsv", ".tab":
+		return formatTSV
+	case ".parquet", ".parq":
+		return formatParquet
+	default:
+		return formatText
+	}
+}
+
+// csvOptions controls how log messages are extracted from CSV/TSV files
+type csvOptions struct {
+	columns  string // Comma-separated list of columns forming the message
+	template string // Optional message template referencing columns as {name}
+	comma    rune   // Field delimiter
+	quote    rune   // Quote character (0 = no quoting)
+	escape   rune   // Escape character (0 = quotes are escaped by doubling)
+	noHeader bool   // The file has no header row; columns are selected by number
+	workers  int    // Number of decoding goroutines (0 = GOMAXPROCS, 1 = sequential)
+}
+
+// setDialect resolves the delimiter, quote and escape flags for a format.
+// Empty flag values select the format default; "none" disables quoting or escaping.
+// CSV defaults to comma and double quotes, TSV to tab, no quoting and backslash escapes.
+func (o *csvOptions) setDialect(format, delimiter, quote, escape string) error {
+	o.comma, o.quote, o.escape = ',', '"', 0
+	if format == formatTSV {
+		o.comma, o.quote, o.escape = '\t', 0, '\\'
+	}
+
+	var err error
+	if o.comma, err = parseRuneFlag("delimiter", delimiter, o.comma, false); err != nil {
+		return err
+	}
+	if o.quote, err = parseRuneFlag("quote", quote, o.quote, true); err != nil {
+		return err
+	}
+	if o.escape, err = parseRuneFlag("escape", escape, o.escape, true); err != nil {
+		return err
+	}
+	if o.comma == o.quote || (o.escape != 0 && o.escape == o.comma) {
+		return fmt.Errorf("delimiter, quote and escape characters must differ")
+	}
+	return nil
+}
+
+// parseRuneFlag parses a single-character flag value; \t is accepted for tab
+func parseRuneFlag(name, value string, def rune, allowNone bool) (rune, error) {
+	switch {
+	case value == "":
+		return def, nil
+	case value == "none" && allowNone:
+		return 0, nil
+	case value == `\t`:
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(value) != 1 {
+		return 0, fmt.Errorf("-%s must be a single character, got %q", name, value)
+	}
+	r, _ := utf8.DecodeRuneInString(value)
+	return r, nil
+}
+
+// recordReader is implemented by csv.Reader and delimitedReader
+type recordReader interface {
+	Read() ([]string, error)
+}
+
+// newRecordReader returns encoding/csv for standard CSV and delimitedReader otherwise
+func newRecordReader(file io.Reader, opts csvOptions) recordReader {
+	if opts.quote == '"' && opts.escape == 0 {
+		reader := csv.NewReader(file)
+		reader.Comma = opts.comma
+		reader.LazyQuotes = true
+		reader.TrimLeadingSpace = true
+		return reader
+	}
+	return newDelimitedReader(file, opts.comma, opts.quote, opts.escape)
+}
+
+// templatePlaceholder matches {column} references in a message template
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// messageSegment is a piece of an assembled message: literal text or a column value
+type messageSegment struct {
+	text   string
+	column int // Column index, or -1 for literal text
+}
+
+// messageBuilder assembles the text to parse from one or more CSV columns
+type messageBuilder struct {
+	segments []messageSegment
+	joined   []int // Columns joined with spaces when no template is given
+}
+
+// newMessageBuilder resolves the configured columns against the CSV header.
+// For headerless files header is nil and columns can only be selected by number.
+func newMessageBuilder(header []string, width int, opts csvOptions) (*messageBuilder, error) {
+	builder := &messageBuilder{}
+
+	if opts.template != "" {
+		last := 0
+		for _, match := range templatePlaceholder.FindAllStringSubmatchIndex(opts.template, -1) {
+			index, err := findColumn(header, width, opts.template[match[2]:match[3]])
+			if err != nil {
+				return nil, err
+			}
+			builder.segments = append(builder.segments,
+				messageSegment{text: opts.template[last:match[0]], column: -1},
+				messageSegment{column: index})
+			last = match[1]
+		}
+		builder.segments = append(builder.segments, messageSegment{text: opts.template[last:], column: -1})
+		return builder, nil
+	}
+
+	names := strings.Split(opts.columns, ",")
+	for _, name := range names {
+		index, err := findColumn(header, width, strings.TrimSpace(name))
+		if err != nil {
+			// If a single message column is not found, try to use the last column
+			if len(names) == 1 && strings.EqualFold(strings.TrimSpace(name), "message") && width > 0 {
+				index = width - 1
+				fmt.Fprintf(os.Stderr, "Warning: Column '%s' not found, using column %d\n", name, index+1)
+			} else {
+				return nil, err
+			}
+		}
+		builder.joined = append(builder.joined, index)
+	}
+	return builder, nil
+}
+
+// findColumn returns the index of a column selected by name (case-insensitive)
+// or by its 1-based number. Names take precedence over numbers.
+func findColumn(header []string, width int, name string) (int, error) {
+	for i, col := range header {
+		if strings.EqualFold(strings.TrimSpace(col), name) {
+			return i, nil
+		}
+	}
+	if number, err := strconv.Atoi(name); err == nil && number >= 1 && number <= width {
+		return number - 1, nil
+	}
+	if header == nil {
+		return -1, fmt.Errorf("column '%s' must be a column number between 1 and %d for files without a header", name, width)
+	}
+	return -1, fmt.Errorf("column '%s' not found in CSV header. Available columns: %v", name, header)
+}
+
+// message assembles the message for a record; missing fields are treated as empty
+func (b *messageBuilder) message(record []string) string {
+	field := func(index int) string {
+		if index < len(record) {
+			return strings.TrimSpace(record[index])
+		}
+		return ""
+	}
+
+	if b.segments == nil {
+		parts := make([]string, 0, len(b.joined))
+		for _, index := range b.joined {
+			if value := field(index); value != "" {
+				parts = append(parts, value)
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+
+	var sb strings.Builder
+	for _, segment := range b.segments {
+		if segment.column < 0 {
+			sb.WriteString(segment.text)
+		} else {
+			sb.WriteString(field(segment.column))
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// readCSVLogs reads log lines from a CSV or TSV file, decoding records in
+// parallel unless a single worker is requested
+func readCSVLogs(file io.Reader, opts csvOptions, limit *lineLimit) ([]string, error) {
+	workers := opts.workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if splitter, ok := newRecordSplitter(opts); ok && workers > 1 {
+		return readCSVLogsParallel(file, opts, limit, splitter, workers)
+	}
+
+	var lines []string
+
+	reader := newRecordReader(file, opts)
+
+	// Read header (or the first record of a headerless file)
+	first, err := reader.Read()
+	if err == io.EOF && opts.noHeader {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+
+	header := first
+	if opts.noHeader {
+		header = nil
+	}
+	builder, err := newMessageBuilder(header, len(first), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read data rows
+	malformed := 0
+	for rowNo := 1; ; rowNo++ {
+		var record []string
+		if opts.noHeader && rowNo == 1 {
+			record = first
+		} else if record, err = reader.Read(); err == io.EOF {
+			break
+		} else if errors.Is(err, csv.ErrFieldCount) {
+			malformed++
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("CSV row %d: %w", rowNo, err)
+		}
+
+		line := builder.message(record)
+		if line == "" {
+			continue
+		}
+		line, ok, err := limit.apply(line, rowNo)
+		if err != nil {
+			return nil, fmt.Errorf("CSV row %d: %v", rowNo, err)
+		}
+		if ok {
+			lines = append(lines, line)
+		}
+	}
+	reportMalformedRows(malformed)
+
+	return lines, nil
+}
+
+// reportMalformedRows reports the number of CSV rows skipped for having
+// another number of fields than the header
+func reportMalformedRows(n int) {
+	if n > 0 {
+		log.Printf("Skipped %d CSV rows with a wrong number of fields", n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// levelField is the header field holding the log level of a line
+const levelField = "level"
+
+// levelNone labels the lines of a template without a level field
+const levelNone = "none"
+
+// levelCount is the number of lines of a template at one log level
+type levelCount struct {
+	level string
+	count int
+}
+
+// levelDistribution counts the lines of every template by their log level,
+// upper-cased so that "err" and "ERR" are counted together. Levels are ordered
+// by the number of lines, most frequent first. It returns nil if no line has
+// a level, as the header regex captures none.
+func levelDistribution(events []*awsomlp.LogEvent) map[string][]levelCount {
+	counts := make(map[string]map[string]int)
+	found := false
+	for _, event := range events {
+		level := strings.ToUpper(event.Fields[levelField])
+		if level == "" {
+			level = levelNone
+		} else {
+			found = true
+		}
+		if counts[event.Template] == nil {
+			counts[event.Template] = make(map[string]int)
+		}
+		counts[event.Template][level]++
+	}
+	if !found {
+		return nil
+	}
+
+	levels := make(map[string][]levelCount, len(counts))
+	for template, byLevel := range counts {
+		for level, count := range byLevel {
+			levels[template] = append(levels[template], levelCount{level: level, count: count})
+		}
+		sort.Slice(levels[template], func(i, j int) bool {
+			a, b := levels[template][i], levels[template][j]
+			if a.count != b.count {
+				return a.count > b.count
+			}
+			return a.level < b.level
+		})
+	}
+	return levels
+}
+
+// formatLevels formats the levels of a template with their share of its lines,
+// e.g. "INFO 90%, ERROR 10%"
+func formatLevels(levels []levelCount) string {
+	total := 0
+	for _, level := range levels {
+		total += level.count
+	}
+	parts := make([]string, 0, len(levels))
+	for _, level := range levels {
+		parts = append(parts, level.level+" "+formatShare(level.count, total))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// levelCounts returns the number of lines of a template per level, the levels
+// column of ndjson and csv output; it is empty for templates without levels
+func levelCounts(levels []levelCount) map[string]int {
+	counts := make(map[string]int, len(levels))
+	for _, level := range levels {
+		counts[level.level] = level.count
+	}
+	return counts
+}
+
+// formatShare formats count as a whole percentage of total, showing shares
+// that round to zero as "<1%" so that rare levels stay visible
+func formatShare(count, total int) string {
+	share := 100 * float64(count) / float64(total)
+	if share < 0.5 {
+		return "<1%"
+	}
+	return fmt.Sprintf("%.0f%%", share)
+}
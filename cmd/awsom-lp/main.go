@@ -1,46 +1,86 @@
 package main
 
 import (
-	"bufio"
-	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"sort"
+	"slices"
 	"strings"
+	"time"
 
 	awsomlp "github.com/n0madic/awsom-lp"
 )
 
-// TemplateStats holds template and its frequency
-type TemplateStats struct {
-	Template string
-	Count    int
-}
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		runCheck(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		runStats(os.Args[2:])
+		return
+	}
+
 	// Define command-line flags
+	parserOptions := registerParserFlags(flag.CommandLine)
+	otlpOptions := registerOTLPFlags(flag.CommandLine)
 	var (
-		inputFile           = flag.String("input", "", "Input log file (required)")
-		csvColumn           = flag.String("column", "message", "CSV column name for log messages (default: message)")
-		csvDelimiter        = flag.String("delimiter", ",", "CSV delimiter (default: comma)")
-		headerRegex         = flag.String("header", "", "Header regex pattern (default, hdfs, syslog, java, or custom regex)")
-		similarity          = flag.Float64("similarity", 1.0, "Minimum similarity threshold (0.0-1.0)")
-		sortStrategy        = flag.String("sort", "none", "Sorting strategy: none, length, lexical, dyntokens")
-		customRegex         = flag.String("regex", "", "Custom regex patterns for variables (comma-separated)")
-		minGroupSize        = flag.Int("min-group", 3, "Minimum group size to generate template")
-		maxPlaceholderRatio = flag.Float64("max-placeholders", 0.8, "Maximum ratio of placeholders in template (0.0-1.0)")
-		minTemplateTokens   = flag.Int("min-tokens", 1, "Minimum number of non-placeholder tokens in template")
-		showTemplates       = flag.Bool("templates", false, "Show only templates without counts")
-		verbose             = flag.Bool("verbose", false, "Verbose output")
-		maxLines            = flag.Int("max", 0, "Maximum number of lines to process (0 = all)")
+		inputFile     = flag.String("input", "", "Input log file(s), HTTP(S) URL(s), ssh://[user@]host/path, gcp://PROJECT_ID or azure://WORKSPACE_ID, comma-separated, glob patterns allowed (required)")
+		csvColumn     = flag.String("column", "message", "CSV column name(s) for log messages, comma-separated columns are joined with spaces")
+		csvTemplate   = flag.String("column-template", "", "Template assembling the message from CSV columns, e.g. \"{level} [{component}] {message}\"")
+		inputFormat   = flag.String("format", "auto", "Input format: auto (by extension), text, csv, tsv, parquet")
+		csvDelimiter  = flag.String("delimiter", "", "CSV/TSV delimiter (default: comma for csv, tab for tsv)")
+		csvQuote      = flag.String("quote", "", "CSV/TSV quote character, or none (default: \" for csv, none for tsv)")
+		csvEscape     = flag.String("escape", "", "CSV/TSV escape character, or none (default: none for csv, \\ for tsv)")
+		csvNoHeader   = flag.Bool("no-header", false, "CSV file has no header row (select columns by 1-based number)")
+		csvWorkers    = flag.Int("workers", 0, "Number of goroutines decoding CSV/TSV records (0 = number of CPUs, 1 = sequential)")
+		showTemplates = flag.Bool("templates", false, "Show only templates without counts")
+		prefix        = flag.String("prefix", "", "Show only templates starting with these tokens, e.g. \"BLOCK* NameSystem.addStoredBlock:\"")
+		bySegment     = flag.Bool("by-segment", false, "Group the templates by segment, e.g. by component with -segment field:component")
+		showTree      = flag.Bool("tree", false, "Show templates as a tree, more specific variants indented below the general template subsuming them")
+		pretty        = flag.Bool("pretty", false, "Show templates for the terminal: placeholders in color, right-aligned counts with their percentage of all lines, long templates cut (colors only on a terminal, set NO_COLOR to disable them)")
+		expand        = flag.Bool("expand", false, "Show long templates in full with -pretty")
+		showLevels    = flag.Bool("levels", false, "Show the share of each log level among the lines of every template, from the level field of the header regex; ndjson/csv events get a levels column")
+		outputMode    = flag.String("output", outputText, "Output format: text (templates with counts), ndjson (every input line as JSON with event_id, template and params) or csv (every input line as a row)")
+		outputFields  = flag.String("fields", "", "Columns of ndjson/csv output in order, comma-separated: lineno, eventId, template, count, params, message, levels (with -levels) or a header field")
+		verbose       = flag.Bool("verbose", false, "Verbose output")
+		maxLines      = flag.Int("max", 0, "Maximum number of lines to process (0 = all)")
+		maxLineBytes  = flag.Int("max-line-bytes", defaultMaxLineBytes, "Maximum line length in bytes (-1 = unlimited)")
+		useMmap       = flag.Bool("mmap", false, "Map local text files into memory and slice lines from the mapping instead of copying them")
+		chunkSize     = flag.Int("chunk", 0, "Parse text input in chunks of N lines with bounded memory (0 = load all)")
+		longLines     = flag.String("long-lines", "truncate", "Policy for lines longer than -max-line-bytes: truncate, skip, error")
+		mergeByTime   = flag.Bool("merge-time", false, "Merge the lines of several input files in timestamp order instead of concatenating them")
+		gcpFilter     = flag.String("gcp-filter", "", "Cloud Logging filter expression for gcp:// inputs, e.g. 'resource.type=\"k8s_container\" AND severity>=WARNING'")
+		gcpFrom       = flag.String("gcp-from", "", "Start of the time range for gcp:// inputs: RFC 3339 time or duration before now (e.g. 24h)")
+		gcpTo         = flag.String("gcp-to", "", "End of the time range for gcp:// inputs: RFC 3339 time or duration before now")
+		kqlQuery      = flag.String("kql", "", "KQL query for azure:// inputs; the message is taken from -column of the result")
+		azureTimespan = flag.String("azure-timespan", "", "Time range for azure:// inputs: ISO 8601 duration or interval, or duration before now (e.g. 24h)")
+		verify        = flag.Bool("verify", false, "Reconstruct every line from its template and parameters, report lossy lines and constant placeholders, and exit with status 1 if there are any")
+		saveState     = flag.String("save-state", "", "Write the learned model to a state file, e.g. as baseline for -align")
+		simMatrix     = flag.String("similarity-matrix", "", "Write the pairwise similarities of a sample of the lines with their nearest patterns of other events to this CSV file, to see why a threshold merges lines")
+		simSample     = flag.Int("similarity-sample", 50, "Number of evenly spaced lines sampled for -similarity-matrix")
+		crossValidate = flag.Int("cross-validate", 0, "Split the input into N folds, parse each independently and report how consistent their templates are instead of the templates (0 = off)")
+		alignPath     = flag.String("align", "", "State file of a baseline model (see -save-state); event IDs of ndjson/csv output, -otlp and -rules are mapped onto its event IDs")
+		progress      = flag.String("progress", progressNone, "Report parsing progress with rate and ETA on stderr: none, text or json (one JSON object per line)")
+		progressEvery = flag.Duration("progress-interval", time.Second, "Interval between -progress reports")
+		rulesPath     = flag.String("rules", "", "YAML file of alert rules evaluated on the parsed lines in the order of their timestamps")
 	)
 
+	var headers httpHeaders
+	flag.Var(&headers, "http-header", "HTTP header sent with URL inputs, e.g. \"Authorization: Bearer <token>\" (repeatable)")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "AWSOM-LP Log Parser CLI\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s -input <file> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -input <file> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s serve [options]    (run '%s serve -h' for details)\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check [options]    (run '%s check -h' for details)\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s stats [options]    (run '%s stats -h' for details)\n\n", os.Args[0], os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -48,12 +88,40 @@ func main() {
 		fmt.Fprintf(os.Stderr, "    %s -input app.log\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  Parse CSV file with specific column:\n")
 		fmt.Fprintf(os.Stderr, "    %s -input logs.csv -column log_message\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse tab-separated export:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input export.txt -format tsv -column message\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse headerless CSV file using the third column:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input logs.csv -no-header -column 3\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse CSV file assembling the message from several columns:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input logs.csv -column-template \"{level} {component}: {message}\"\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  Parse HDFS logs with specific header pattern:\n")
 		fmt.Fprintf(os.Stderr, "    %s -input hdfs.log -header hdfs\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  Parse with custom similarity and sorting:\n")
 		fmt.Fprintf(os.Stderr, "    %s -input app.log -similarity 0.8 -sort length\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  Filter low-quality templates:\n")
-		fmt.Fprintf(os.Stderr, "    %s -input app.log -min-group 5 -max-placeholders 0.6 -min-tokens 2\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s -input app.log -min-group 5 -max-placeholders 0.6 -min-tokens 2\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Keep lines up to 1MB and drop longer ones:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input app.log -max-line-bytes 1048576 -long-lines skip\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse a huge log file with bounded memory:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input huge.log -chunk 100000\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Merge the logs of several hosts chronologically:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input 'hosts/*/app.log' -merge-time\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Re-emit every line as an enriched JSON event:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input app.log -header hdfs -output ndjson > events.ndjson\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Write the template of every line as CSV:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input app.log -output csv -fields lineno,eventId,template,count > events.csv\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Replay a log file through alert rules:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input hdfs.log -header hdfs -rules alerts.yaml\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Export every parsed line to an OpenTelemetry Collector:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input app.log -header hdfs -otlp http://collector:4318\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse a log file served over HTTPS:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input https://logs.example.com/app.log -http-header \"Authorization: Bearer $TOKEN\"\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse a log file on a remote host over SSH:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input ssh://ops@web1:/var/log/app.log\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse the last day of warnings from Google Cloud Logging:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input gcp://my-project -gcp-filter 'severity>=WARNING' -gcp-from 24h\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Parse the result of a Log Analytics query:\n")
+		fmt.Fprintf(os.Stderr, "    %s -input azure://<workspace-id> -kql 'AppTraces | project Message' -column Message -azure-timespan 24h\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -64,223 +132,340 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Open input file
-	file, err := os.Open(*inputFile)
+	limit, err := newLineLimit(*maxLineBytes, *longLines)
 	if err != nil {
-		log.Fatalf("Error opening file: %v", err)
+		log.Fatal(err)
 	}
-	defer file.Close()
-
-	// Read log lines based on file type
-	var logLines []string
-	if strings.HasSuffix(strings.ToLower(*inputFile), ".csv") {
-		logLines, err = readCSVLogs(file, *csvColumn, *csvDelimiter)
-		if err != nil {
-			log.Fatalf("Error reading CSV file: %v", err)
-		}
-	} else {
-		logLines, err = readTextLogs(file)
-		if err != nil {
-			log.Fatalf("Error reading text file: %v", err)
-		}
+	if *csvWorkers < 0 {
+		log.Fatalf("-workers must be non-negative, got %d", *csvWorkers)
 	}
-
-	// Apply max lines limit if specified
-	if *maxLines > 0 && len(logLines) > *maxLines {
-		logLines = logLines[:*maxLines]
+	mode, err := checkOutput(*outputMode)
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	if *verbose {
-		fmt.Printf("Loaded %d log lines\n", len(logLines))
+	fields, err := parseFields(*outputFields)
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	// Create parser
-	parser := awsomlp.NewAWSOMLP()
-
-	// Configure parser
-	config := awsomlp.Config{
-		MinSimilarity:       *similarity,
-		MinGroupSize:        *minGroupSize,
-		MaxPlaceholderRatio: *maxPlaceholderRatio,
-		MinTemplateTokens:   *minTemplateTokens,
+	if *prefix != "" && *showTree {
+		log.Fatal("-prefix is not supported with -tree")
 	}
-
-	// Set header regex
-	switch *headerRegex {
-	case "default", "":
-		config.HeaderRegex = awsomlp.DefaultHeaderRegex
-	case "hdfs":
-		config.HeaderRegex = awsomlp.HDFSHeaderRegex
-	case "syslog":
-		config.HeaderRegex = awsomlp.SyslogHeaderRegex
-	case "java":
-		config.HeaderRegex = awsomlp.JavaAppHeaderRegex
-	default:
-		// Treat as custom regex
-		config.HeaderRegex = *headerRegex
+	if *bySegment && *showTree {
+		log.Fatal("-by-segment is not supported with -tree")
 	}
-
-	// Set sorting strategy
-	switch *sortStrategy {
-	case "none":
-		config.SortingStrategy = awsomlp.SortNone
-	case "length":
-		config.SortingStrategy = awsomlp.SortByLength
-	case "lexical":
-		config.SortingStrategy = awsomlp.SortLexical
-	case "dyntokens":
-		config.SortingStrategy = awsomlp.SortByDynTokens
-	default:
-		log.Fatalf("Invalid sorting strategy: %s", *sortStrategy)
+	if *pretty && (*showTree || *bySegment || mode != outputText) {
+		log.Fatal("-pretty is not supported with -tree, -by-segment and -output ndjson or csv")
 	}
-
-	// Add custom regex patterns
-	if *customRegex != "" {
-		config.CustomRegexes = strings.Split(*customRegex, ",")
-		for i := range config.CustomRegexes {
-			config.CustomRegexes[i] = strings.TrimSpace(config.CustomRegexes[i])
+	if *expand && !*pretty {
+		log.Fatal("-expand requires -pretty")
+	}
+	if *showLevels && (*showTemplates || *showTree || *bySegment) {
+		log.Fatal("-levels is not supported with -templates, -tree and -by-segment")
+	}
+	if slices.Contains(fields, fieldLevels) && !*showLevels {
+		log.Fatalf("-fields %s requires -levels", fieldLevels)
+	}
+	if *crossValidate < 0 || *crossValidate == 1 {
+		log.Fatalf("-cross-validate must be at least 2, got %d", *crossValidate)
+	}
+	if *simMatrix != "" && *simSample < 1 {
+		log.Fatalf("-similarity-sample must be positive, got %d", *simSample)
+	}
+	if fields != nil && mode == outputText {
+		log.Fatal("-fields requires -output ndjson or csv")
+	}
+	var exporter *otlpExporter
+	if otlpOptions.endpoint != "" {
+		if exporter, err = newOTLPExporter(*otlpOptions); err != nil {
+			log.Fatal(err)
 		}
 	}
-
-	// Apply configuration
-	if err := parser.WithConfig(config); err != nil {
-		log.Fatalf("Error configuring parser: %v", err)
+	var rules *ruleEngine
+	if *rulesPath != "" {
+		if rules, err = loadRules(*rulesPath); err != nil {
+			log.Fatalf("Error loading rules: %v", err)
+		}
 	}
 
-	// Parse logs
-	if *verbose {
-		fmt.Println("Parsing logs...")
+	reporter, err := newProgressReporter(os.Stderr, *progress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *progressEvery <= 0 {
+		log.Fatalf("-progress-interval must be positive, got %s", *progressEvery)
+	}
+	if reporter != nil {
+		parserOptions.onProgress = reporter.report
+		parserOptions.progressInterval = *progressEvery
 	}
-	results := parser.Parse(logLines)
 
-	// Count template frequencies
-	templateCount := make(map[string]int)
-	for _, template := range results {
-		templateCount[template]++
+	// Create parser
+	parser, err := parserOptions.newParser()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Sort templates by frequency
-	stats := make([]TemplateStats, 0, len(templateCount))
-	for template, count := range templateCount {
-		stats = append(stats, TemplateStats{
-			Template: template,
-			Count:    count,
-		})
+	inputs, err := expandInputs(*inputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := inputOptions{
+		csv: csvOptions{
+			columns:  *csvColumn,
+			template: *csvTemplate,
+			noHeader: *csvNoHeader,
+			workers:  *csvWorkers,
+		},
+		delimiter: *csvDelimiter,
+		quote:     *csvQuote,
+		escape:    *csvEscape,
+		headers:   headers,
+		gcp: gcpOptions{
+			filter: *gcpFilter,
+			from:   *gcpFrom,
+			to:     *gcpTo,
+		},
+		azure: azureOptions{
+			query:    *kqlQuery,
+			timespan: *azureTimespan,
+		},
+		mmap: *useMmap,
 	}
 
-	// Sort by count (descending) and then by template (ascending)
-	sort.Slice(stats, func(i, j int) bool {
-		if stats[i].Count != stats[j].Count {
-			return stats[i].Count > stats[j].Count
+	// Chunked mode streams text input through the parser in windows of lines
+	var totalLines int
+	var levels map[string][]levelCount // Log levels per template, set by -levels
+	if *chunkSize > 0 {
+		if mode != outputText {
+			log.Fatalf("-output %s is not supported with -chunk", mode)
+		}
+		if exporter != nil {
+			log.Fatal("-otlp is not supported with -chunk")
+		}
+		if rules != nil {
+			log.Fatal("-rules is not supported with -chunk")
+		}
+		if *verify {
+			log.Fatal("-verify is not supported with -chunk")
+		}
+		if *alignPath != "" {
+			log.Fatal("-align is not supported with -chunk")
+		}
+		if *simMatrix != "" {
+			log.Fatal("-similarity-matrix is not supported with -chunk")
+		}
+		if *crossValidate > 0 {
+			log.Fatal("-cross-validate is not supported with -chunk")
+		}
+		if *mergeByTime {
+			log.Fatal("-merge-time is not supported with -chunk")
+		}
+		if *showLevels {
+			log.Fatal("-levels is not supported with -chunk")
+		}
+		if parserOptions.autoHeader() {
+			log.Fatal("-header auto is not supported with -chunk")
+		}
+		if parserOptions.multiLine() {
+			log.Fatalf("-header %s is not supported with -chunk", *parserOptions.headerRegex)
+		}
+		readers := make([]io.Reader, 0, len(inputs))
+		for _, path := range inputs {
+			format := *inputFormat
+			if format == formatAuto {
+				format = detectFormat(inputPath(path))
+			}
+			if format != formatText {
+				log.Fatalf("-chunk is only supported for text input, got %s", format)
+			}
+			file, err := openInput(path, opts)
+			if err != nil {
+				log.Fatalf("Error opening file: %v", err)
+			}
+			defer file.Close()
+			readers = append(readers, file)
+		}
+		if *verbose {
+			fmt.Printf("Parsing logs in chunks of %d lines...\n", *chunkSize)
+		}
+		var input io.Reader = io.MultiReader(readers...)
+		if reporter != nil {
+			input = reporter.countBytes(input, inputs)
+		}
+		reader := newLineLimitReader(input, limit, *maxLines)
+		if reporter != nil {
+			reporter.linesRead = func() int { return reader.lines }
+		}
+		if _, err := parser.ParseChunked(reader, *chunkSize); err != nil {
+			log.Fatalf("Error reading text file: %v", err)
+		}
+		totalLines = reader.lines
+		if *saveState != "" {
+			if err := awsomlp.NewSnapshotManager(parser, *saveState, 0).Save(); err != nil {
+				log.Fatalf("Error saving state: %v", err)
+			}
+		}
+	} else {
+		// Read log lines of every input based on its file type
+		perInput := make([][]string, 0, len(inputs))
+		for _, path := range inputs {
+			lines, err := readLogFile(path, *inputFormat, limit, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			perInput = append(perInput, parserOptions.fold(lines))
 		}
-		return stats[i].Template < stats[j].Template
-	})
-
-	// Output results
-	if *verbose {
-		fmt.Printf("\nFound %d unique templates\n", len(stats))
-		fmt.Println(strings.Repeat("=", 80))
-	}
 
-	for _, stat := range stats {
-		if *showTemplates {
-			fmt.Println(stat.Template)
+		var logLines []string
+		if *mergeByTime {
+			var untimed int
+			logLines, untimed = mergeByTimestamp(perInput)
+			if *verbose {
+				fmt.Printf("Merged %d files by timestamp (%d lines without a timestamp)\n", len(inputs), untimed)
+			}
 		} else {
-			fmt.Printf("[%d] %s\n", stat.Count, stat.Template)
+			for _, lines := range perInput {
+				logLines = append(logLines, lines...)
+			}
 		}
-	}
 
-	if *verbose {
-		// Print summary statistics
-		fmt.Println(strings.Repeat("=", 80))
-		fmt.Printf("Total logs processed: %d\n", len(logLines))
-		fmt.Printf("Unique templates: %d\n", len(stats))
-
-		patterns := parser.GetPatterns()
-		fmt.Printf("Pattern groups: %d\n", len(patterns))
-	}
-}
+		// Apply max lines limit if specified
+		if *maxLines > 0 && len(logLines) > *maxLines {
+			logLines = logLines[:*maxLines]
+		}
+		totalLines = len(logLines)
 
-// readTextLogs reads log lines from a text file
-func readTextLogs(file io.Reader) ([]string, error) {
-	var lines []string
-	scanner := bufio.NewScanner(file)
+		if *verbose {
+			fmt.Printf("Loaded %d log lines\n", len(logLines))
+			fmt.Println("Parsing logs...")
+		}
 
-	// Increase buffer size for long lines
-	const maxScanTokenSize = 1024 * 1024 // 1MB
-	buf := make([]byte, maxScanTokenSize)
-	scanner.Buffer(buf, maxScanTokenSize)
+		if parserOptions.autoHeader() {
+			if err := parserOptions.learnHeader(parser, logLines, *verbose); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *crossValidate > 0 {
+			stability, err := parser.CrossValidate(logLines, *crossValidate)
+			if err != nil {
+				log.Fatal(err)
+			}
+			writeStability(os.Stdout, stability)
+			return
+		}
+		events := parser.ParseEvents(logLines)
+		if *showLevels {
+			if levels = levelDistribution(events); levels == nil {
+				log.Printf("No line has a %s field; set -header to a regex capturing it", levelField)
+			}
+		}
+		if *saveState != "" {
+			if err := awsomlp.NewSnapshotManager(parser, *saveState, 0).Save(); err != nil {
+				log.Fatalf("Error saving state: %v", err)
+			}
+		}
+		eventIDs := make(map[int]int) // Pattern ID to event ID, set by -align
+		for _, pattern := range parser.GetPatterns() {
+			eventIDs[pattern.ID] = pattern.ID
+		}
+		if *alignPath != "" {
+			alignments, err := alignEventIDs(parser, *alignPath)
+			if err != nil {
+				log.Fatalf("Error aligning event IDs: %v", err)
+			}
+			for _, alignment := range alignments {
+				eventIDs[alignment.PatternID] = alignment.EventID
+			}
+			for _, event := range events {
+				event.PatternID = eventIDs[event.PatternID]
+			}
+			if *verbose {
+				reportAlignment(os.Stdout, alignments)
+			}
+		}
+		if *simMatrix != "" {
+			if err := writeSimilarityMatrix(*simMatrix, parser, events, eventIDs, *simSample); err != nil {
+				log.Fatalf("Error writing similarity matrix: %v", err)
+			}
+		}
+		if exporter != nil {
+			exportEvents(exporter, events)
+		}
+		if rules != nil {
+			replayEvents(rules, events)
+		}
+		if *verify {
+			defer func() {
+				if reportRoundTrip(os.Stderr, parser.VerifyRoundTrip(events)) > 0 {
+					os.Exit(1)
+				}
+			}()
+		}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line != "" {
-			lines = append(lines, line)
+		// Every line is written as an event instead of the template list
+		if mode != outputText {
+			counts := make(map[int]int)
+			for _, pattern := range parser.GetPatterns() {
+				counts[eventIDs[pattern.ID]] = pattern.Count
+			}
+			if err := writeEvents(os.Stdout, events, mode, fields, counts, levels); err != nil {
+				log.Fatalf("Error writing events: %v", err)
+			}
+			return
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	// Templates ordered by the number of lines they cover
+	stats := parser.GetTemplatesByFrequency()
+	assigned := 0
+	for _, stat := range stats {
+		assigned += stat.Count
 	}
-
-	return lines, nil
-}
-
-// readCSVLogs reads log lines from a CSV file
-func readCSVLogs(file io.Reader, columnName string, delimiter string) ([]string, error) {
-	var lines []string
-
-	reader := csv.NewReader(file)
-	if len(delimiter) > 0 {
-		reader.Comma = rune(delimiter[0])
+	if *prefix != "" {
+		stats = awsomlp.NewTemplateIndex(stats).WithPrefix(*prefix)
 	}
-	reader.LazyQuotes = true
-	reader.TrimLeadingSpace = true
 
-	// Read header
-	header, err := reader.Read()
-	if err != nil {
-		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	// Output results
+	if *verbose {
+		fmt.Printf("\nFound %d unique templates\n", len(stats))
+		fmt.Println(strings.Repeat("=", 80))
 	}
 
-	// Find column index
-	columnIndex := -1
-	for i, col := range header {
-		if strings.EqualFold(strings.TrimSpace(col), columnName) {
-			columnIndex = i
-			break
+	switch {
+	case *showTree:
+		writeTree(os.Stdout, parser.TemplateTree(), *showTemplates)
+	case *bySegment:
+		writeSegments(os.Stdout, parser.GetTemplatesBySegment(), *prefix, *showTemplates)
+	case *pretty:
+		newPrettyWriter(os.Stdout, *expand, *showTemplates, levels).write(os.Stdout, stats, assigned)
+	default:
+		for _, stat := range stats {
+			if *showTemplates {
+				fmt.Println(stat.Template)
+			} else if levels[stat.Template] != nil {
+				fmt.Printf("[%d] %s (%s)\n", stat.Count, stat.Template, formatLevels(levels[stat.Template]))
+			} else {
+				fmt.Printf("[%d] %s\n", stat.Count, stat.Template)
+			}
 		}
 	}
 
-	if columnIndex == -1 {
-		// If column not found, try to use the last column
-		if strings.ToLower(columnName) == "message" {
-			columnIndex = len(header) - 1
-			fmt.Fprintf(os.Stderr, "Warning: Column '%s' not found, using column '%s' (index %d)\n",
-				columnName, header[columnIndex], columnIndex)
-		} else {
-			return nil, fmt.Errorf("column '%s' not found in CSV header. Available columns: %v",
-				columnName, header)
+	if *verbose {
+		// Print summary statistics
+		fmt.Println(strings.Repeat("=", 80))
+		fmt.Printf("Total logs processed: %d\n", totalLines)
+		fmt.Printf("Unique templates: %d\n", len(stats))
+		if limit.truncated > 0 {
+			fmt.Printf("Truncated lines: %d\n", limit.truncated)
 		}
-	}
-
-	// Read data rows
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
+		if limit.skipped > 0 {
+			fmt.Printf("Skipped long lines: %d\n", limit.skipped)
 		}
-		if err != nil {
-			// Skip malformed rows
-			continue
+		if oversized := parser.OversizedLines(); oversized > 0 {
+			fmt.Printf("Oversized lines (more than %d tokens): %d\n", *parserOptions.maxTokens, oversized)
 		}
 
-		if len(record) > columnIndex {
-			line := strings.TrimSpace(record[columnIndex])
-			if line != "" {
-				lines = append(lines, line)
-			}
-		}
+		patterns := parser.GetPatterns()
+		fmt.Printf("Pattern groups: %d\n", len(patterns))
 	}
-
-	return lines, nil
 }
@@ -0,0 +1,2376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// TestLiveConfigRejected tests that a rejected reload leaves the model unchanged
+func TestLiveConfigRejected(t *testing.T) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	options := registerParserFlags(fs)
+	if err := fs.Parse([]string{"-regex", `\bok$`}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := options.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := awsomlp.NewAWSOMLP()
+	if err := parser.WithConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	applied := 0
+	live := newLiveConfig(fs, func(config awsomlp.Config) error {
+		applied++
+		return parser.Reconfigure(config)
+	})
+
+	before := parser.Preprocess("login user42 ok").Content
+	for _, overrides := range []string{"regex user\\w+,(", "header [", "mask-columns ^audit:(@2", "similarity 2"} {
+		if err := live.set(overrides); err == nil {
+			t.Errorf("%q: expected an error", overrides)
+		}
+	}
+	if applied != 0 {
+		t.Errorf("Expected no rejected configuration to be applied, got %d", applied)
+	}
+	if got := parser.Preprocess("login user42 ok").Content; got != before {
+		t.Errorf("Expected %q after the rejected reloads, got %q", before, got)
+	}
+
+	if err := live.set("regex user\\w+"); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if got := parser.Preprocess("login user42 ok").Content; got != "login <*> ok" {
+		t.Errorf("Expected the reloaded regex to apply, got %q", got)
+	}
+}
+
+// TestLevels tests the level distribution of -levels in text, ndjson and csv output
+func TestLevels(t *testing.T) {
+	parser := awsomlp.NewAWSOMLP()
+	if err := parser.WithConfig(awsomlp.Config{HeaderRegex: `^(?P<level>[a-zA-Z]+) (?P<content>.+)$`}); err != nil {
+		t.Fatal(err)
+	}
+	events := parser.ParseEvents([]string{
+		"info served block 1", "INFO served block 2", "info served block 3", "error served block 4",
+		"- disk slow",
+	})
+	levels := levelDistribution(events)
+	template := strings.TrimSpace(events[0].Template)
+	if got := formatLevels(levels[events[0].Template]); got != "INFO 75%, ERROR 25%" {
+		t.Errorf("Expected INFO 75%%, ERROR 25%% for %q, got %q", template, got)
+	}
+	if got := formatLevels(levels[events[4].Template]); got != "none 100%" {
+		t.Errorf("Expected none 100%% for a line without level, got %q", got)
+	}
+	if levelDistribution(awsomlp.NewAWSOMLP().ParseEvents([]string{"disk slow"})) != nil {
+		t.Error("Expected no distribution without a level field")
+	}
+
+	counts := map[int]int{events[0].PatternID: 4, events[4].PatternID: 1}
+	var out bytes.Buffer
+	if err := writeEvents(&out, events, outputNDJSON, nil, counts, levels); err != nil {
+		t.Fatal(err)
+	}
+	var first struct {
+		Level  string         `json:"level"`
+		Levels map[string]int `json:"levels"`
+	}
+	if err := json.Unmarshal(bytes.SplitN(out.Bytes(), []byte("\n"), 2)[0], &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Level != "info" || !reflect.DeepEqual(first.Levels, map[string]int{"INFO": 3, "ERROR": 1}) {
+		t.Errorf("Expected the line's level and its template's levels, got %+v", first)
+	}
+
+	out.Reset()
+	if err := writeEvents(&out, events, outputCSV, nil, counts, levels); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := rows[0]; header[len(header)-1] != fieldLevels {
+		t.Errorf("Expected a trailing levels column, got %v", header)
+	}
+	if got := rows[4][len(rows[4])-1]; got != `{"ERROR":1,"INFO":3}` {
+		t.Errorf("Expected the levels of %q as a JSON object, got %s", template, got)
+	}
+	if got := rows[5][len(rows[5])-1]; got != `{"none":1}` {
+		t.Errorf("Expected none for a line without level, got %s", got)
+	}
+
+	out.Reset()
+	if err := writeEvents(&out, events, outputCSV, nil, counts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if header, _ := csv.NewReader(&out).Read(); slices.Contains(header, fieldLevels) {
+		t.Errorf("Expected no levels column without -levels, got %v", header)
+	}
+}
+
+// TestWriteSegments tests that segment headings count the templates written
+func TestWriteSegments(t *testing.T) {
+	segments := []awsomlp.SegmentTemplates{
+		{Segment: "sshd", Count: 5, Templates: []awsomlp.TemplateCount{{Template: "Accepted <*>", Count: 3}, {Template: "Failed <*>", Count: 2}}},
+		{Segment: "", Count: 1, Templates: []awsomlp.TemplateCount{{Template: "Disk full", Count: 1}}},
+	}
+	var out bytes.Buffer
+	writeSegments(&out, segments, "", false)
+	expected := "== sshd: 5 lines, 2 templates ==\n[3] Accepted <*>\n[2] Failed <*>\n\n== (none): 1 lines, 1 templates ==\n[1] Disk full\n"
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	writeSegments(&out, segments, "Failed", true)
+	if expected := "== sshd: 5 lines, 1 templates ==\nFailed <*>\n"; out.String() != expected {
+		t.Errorf("Expected only the templates with the prefix:\n%s\nGot:\n%s", expected, out.String())
+	}
+}
+
+// TestLineLimit tests that -max-line-bytes 0 selects the default limit and -1
+// reads lines of any length
+func TestLineLimit(t *testing.T) {
+	long := strings.Repeat("x", 2*defaultMaxLineBytes)
+	for maxBytes, want := range map[int]int{0: defaultMaxLineBytes, -1: len(long), 5: 5} {
+		limit, err := newLineLimit(maxBytes, policyTruncate)
+		if err != nil {
+			t.Fatalf("max bytes %d: %v", maxBytes, err)
+		}
+		lines, err := readTextLogs(strings.NewReader(long+"\nshort\n"), limit)
+		if err != nil || len(lines) != 2 || len(lines[0]) != want {
+			t.Errorf("max bytes %d: expected a first line of %d bytes, got %d lines, %v", maxBytes, want, len(lines), err)
+		}
+	}
+
+	if _, err := newLineLimit(-2, policyTruncate); err == nil {
+		t.Error("Expected an error for a max line bytes below -1")
+	}
+}
+
+// TestCSVErrors tests that CSV rows with a wrong number of fields are skipped
+// and reported, and other errors are returned
+func TestCSVErrors(t *testing.T) {
+	limit, _ := newLineLimit(10000, policyTruncate)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	opts := csvOptions{columns: "message", comma: ',', quote: '"', workers: 1}
+	lines, err := readCSVLogs(strings.NewReader("time,message\n1,disk full\n2,too,many\n3,disk ok\n"), opts, limit)
+	if err != nil || !slices.Equal(lines, []string{"disk full", "disk ok"}) {
+		t.Errorf("Expected the rows with two fields, got %q, %v", lines, err)
+	}
+	if !strings.Contains(logged.String(), "Skipped 1 CSV rows") {
+		t.Errorf("Expected the skipped row to be reported, got %q", logged.String())
+	}
+
+	failing := io.MultiReader(strings.NewReader("time,message\n1,disk full\n"), iotest.ErrReader(errors.New("read failed")))
+	if _, err := readCSVLogs(failing, opts, limit); err == nil || !strings.Contains(err.Error(), "read failed") {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+}
+
+// TestCSVParallel tests that the parallel CSV reader returns the messages of
+// the sequential reader in input order, across several chunks with quoted line
+// breaks, and skips and reports the same malformed rows
+func TestCSVParallel(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("time,message\n")
+	for i := range 100000 {
+		switch {
+		case i%1000 == 999:
+			fmt.Fprintf(&input, "%d,too,many\n", i)
+		case i%7 == 0:
+			fmt.Fprintf(&input, "%d,\"request %d\nfailed, \"\"retrying\"\"\"\n", i, i)
+		default:
+			fmt.Fprintf(&input, "%d,request %d served\n", i, i)
+		}
+	}
+	if input.Len() < 2*csvChunkSize {
+		t.Fatalf("Expected the input to span several chunks, got %d bytes", input.Len())
+	}
+
+	limit, _ := newLineLimit(10000, policyTruncate)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	read := func(workers int) ([]string, string) {
+		logged.Reset()
+		opts := csvOptions{columns: "message", comma: ',', quote: '"', workers: workers}
+		lines, err := readCSVLogs(strings.NewReader(input.String()), opts, limit)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		return lines, logged.String()
+	}
+	sequential, sequentialLog := read(1)
+	parallel, parallelLog := read(4)
+	if len(sequential) != 100000-100 || sequential[1] != "request 1 served" || sequential[7] != "request 7\nfailed, \"retrying\"" {
+		t.Fatalf("Unexpected sequential result: %d lines starting with %q", len(sequential), sequential[:8])
+	}
+	if !slices.Equal(parallel, sequential) {
+		t.Errorf("Expected the parallel reader to return the %d sequential lines in order, got %d lines", len(sequential), len(parallel))
+	}
+	if !strings.Contains(sequentialLog, "Skipped 100 CSV rows") || !strings.Contains(parallelLog, "Skipped 100 CSV rows") {
+		t.Errorf("Expected both readers to report 100 skipped rows, got %q and %q", sequentialLog, parallelLog)
+	}
+
+	opts := csvOptions{columns: "message", comma: ',', quote: '"', workers: 4}
+	failing := io.MultiReader(strings.NewReader("time,message\n1,disk full\n"), iotest.ErrReader(errors.New("read failed")))
+	if _, err := readCSVLogs(failing, opts, limit); err == nil || !strings.Contains(err.Error(), "read failed") {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+}
+
+// updateFixtures regenerates the Parquet fixtures in testdata
+var updateFixtures = flag.Bool("update", false, "Regenerate the files in testdata")
+
+// Thrift compact encoding of the Parquet metadata written by the test fixtures.
+// Every field is written in the long form with an explicit field ID.
+
+func thriftInt(v int64) []byte {
+	return binary.AppendUvarint(nil, uint64(v<<1^v>>63))
+}
+
+func thriftBinary(v []byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(v))), v...)
+}
+
+func thriftField(typ byte, id int16, value []byte) []byte {
+	return append(append([]byte{typ}, thriftInt(int64(id))...), value...)
+}
+
+func thriftStructOf(fields ...[]byte) []byte {
+	return append(bytes.Join(fields, nil), 0)
+}
+
+func thriftListOf(elemType byte, elems ...[]byte) []byte {
+	return append([]byte{byte(len(elems))<<4 | elemType}, bytes.Join(elems, nil)...)
+}
+
+// parquetPlain encodes values as PLAIN BYTE_ARRAYs
+func parquetPlain(values ...string) []byte {
+	var out []byte
+	for _, value := range values {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(value)))
+		out = append(out, value...)
+	}
+	return out
+}
+
+// parquetBitPacked encodes values of a bit width as a single bit-packed run
+func parquetBitPacked(bitWidth int, values ...uint64) []byte {
+	groups := (len(values) + 7) / 8
+	packed := make([]byte, groups*bitWidth)
+	for i, value := range values {
+		for b := 0; b < bitWidth; b++ {
+			if value&(1<<b) != 0 {
+				bit := i*bitWidth + b
+				packed[bit/8] |= 1 << (bit % 8)
+			}
+		}
+	}
+	return append(binary.AppendUvarint(nil, uint64(groups<<1|1)), packed...)
+}
+
+// snappyEncode compresses data into a raw Snappy block of literals and
+// copies with 2-byte offsets
+func snappyEncode(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	literal := func(lit []byte) {
+		for len(lit) > 0 {
+			n := len(lit)
+			if n > 60 {
+				n = 60
+			}
+			out = append(out, byte(n-1)<<2)
+			out = append(out, lit[:n]...)
+			lit = lit[n:]
+		}
+	}
+	start := 0
+	for i := 0; i < len(data); {
+		best, offset := 0, 0
+		from := i - 65535
+		if from < 0 {
+			from = 0
+		}
+		for j := from; j < i; j++ {
+			n := 0
+			for i+n < len(data) && n < 64 && data[j+n] == data[i+n] {
+				n++
+			}
+			if n > best {
+				best, offset = n, i-j
+			}
+		}
+		if best < 4 {
+			i++
+			continue
+		}
+		literal(data[start:i])
+		out = append(out, byte(best-1)<<2|2, byte(offset), byte(offset>>8))
+		i += best
+		start = i
+	}
+	literal(data[start:])
+	return out
+}
+
+// parquetPageSpec describes a data page of a test fixture
+type parquetPageSpec struct {
+	v2        bool
+	encoding  int64
+	numValues int
+	defLevels []byte // RLE/bit-packed definition levels of an optional column
+	values    []byte // Encoded values
+}
+
+// parquetSpec describes a test fixture: a file with a single string column
+// "message" in one row group
+type parquetSpec struct {
+	codec      int64
+	optional   bool
+	dictionary []string
+	pages      []parquetPageSpec
+	corrupt    map[string]int64 // Metadata values replacing the correct ones
+}
+
+// value returns the corrupt replacement of a metadata value if there is one
+func (s parquetSpec) value(name string, actual int64) int64 {
+	if v, ok := s.corrupt[name]; ok {
+		return v
+	}
+	return actual
+}
+
+// compress compresses a page body with the codec of the fixture
+func (s parquetSpec) compress(t *testing.T, body []byte) []byte {
+	switch s.codec {
+	case parquetCodecSnappy:
+		return snappyEncode(body)
+	case parquetCodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	return body
+}
+
+// buildParquet writes the Parquet file described by spec
+func buildParquet(t *testing.T, spec parquetSpec) []byte {
+	file := []byte(parquetMagic)
+	chunkStart := int64(len(file))
+	var dictOffset int64
+	numValues := 0
+
+	if spec.dictionary != nil {
+		dictOffset = chunkStart
+		body := parquetPlain(spec.dictionary...)
+		compressed := spec.compress(t, body)
+		file = append(file, thriftStructOf(
+			thriftField(thriftTypeI32, 1, thriftInt(parquetPageDictionary)),
+			thriftField(thriftTypeI32, 2, thriftInt(spec.value("uncompressed_size", int64(len(body))))),
+			thriftField(thriftTypeI32, 3, thriftInt(int64(len(compressed)))),
+			thriftField(thriftTypeStruct, 7, thriftStructOf(
+				thriftField(thriftTypeI32, 1, thriftInt(spec.value("dictionary_count", int64(len(spec.dictionary))))),
+				thriftField(thriftTypeI32, 2, thriftInt(parquetEncodingPlain)),
+			)),
+		)...)
+		file = append(file, compressed...)
+	}
+
+	dataOffset := int64(len(file))
+	for _, page := range spec.pages {
+		numValues += page.numValues
+		pageValues := spec.value("num_values", int64(page.numValues))
+		var header, body []byte
+		if page.v2 {
+			compressed := spec.compress(t, page.values)
+			body = append(append([]byte(nil), page.defLevels...), compressed...)
+			header = thriftStructOf(
+				thriftField(thriftTypeI32, 1, thriftInt(parquetPageDataV2)),
+				thriftField(thriftTypeI32, 2, thriftInt(spec.value("uncompressed_size", int64(len(page.defLevels)+len(page.values))))),
+				thriftField(thriftTypeI32, 3, thriftInt(spec.value("compressed_size", int64(len(body))))),
+				thriftField(thriftTypeStruct, 8, thriftStructOf(
+					thriftField(thriftTypeI32, 1, thriftInt(pageValues)),
+					thriftField(thriftTypeI32, 4, thriftInt(page.encoding)),
+					thriftField(thriftTypeI32, 5, thriftInt(spec.value("def_length", int64(len(page.defLevels))))),
+					thriftField(thriftTypeI32, 6, thriftInt(spec.value("rep_length", 0))),
+					thriftField(thriftTypeTrue, 7, nil),
+				)),
+			)
+		} else {
+			var plain []byte
+			if spec.optional {
+				plain = binary.LittleEndian.AppendUint32(nil, uint32(spec.value("def_length", int64(len(page.defLevels)))))
+				plain = append(plain, page.defLevels...)
+			}
+			plain = append(plain, page.values...)
+			body = spec.compress(t, plain)
+			header = thriftStructOf(
+				thriftField(thriftTypeI32, 1, thriftInt(parquetPageData)),
+				thriftField(thriftTypeI32, 2, thriftInt(spec.value("uncompressed_size", int64(len(plain))))),
+				thriftField(thriftTypeI32, 3, thriftInt(spec.value("compressed_size", int64(len(body))))),
+				thriftField(thriftTypeStruct, 5, thriftStructOf(
+					thriftField(thriftTypeI32, 1, thriftInt(pageValues)),
+					thriftField(thriftTypeI32, 2, thriftInt(page.encoding)),
+				)),
+			)
+		}
+		file = append(file, header...)
+		file = append(file, body...)
+	}
+	chunkSize := spec.value("chunk_size", int64(len(file))-chunkStart)
+
+	repetition := int64(parquetRepetitionRequired)
+	if spec.optional {
+		repetition = 1
+	}
+	footer := thriftStructOf(
+		thriftField(thriftTypeI32, 1, thriftInt(1)),
+		thriftField(thriftTypeList, 2, thriftListOf(thriftTypeStruct,
+			thriftStructOf(thriftField(thriftTypeBinary, 4, thriftBinary([]byte("schema")))),
+			thriftStructOf(
+				thriftField(thriftTypeI32, 1, thriftInt(parquetTypeByteArray)),
+				thriftField(thriftTypeI32, 3, thriftInt(repetition)),
+				thriftField(thriftTypeBinary, 4, thriftBinary([]byte("message"))),
+			),
+		)),
+		thriftField(thriftTypeI64, 3, thriftInt(int64(numValues))),
+		thriftField(thriftTypeList, 4, thriftListOf(thriftTypeStruct,
+			thriftStructOf(
+				thriftField(thriftTypeList, 1, thriftListOf(thriftTypeStruct,
+					thriftStructOf(thriftField(thriftTypeStruct, 3, thriftStructOf(
+						thriftField(thriftTypeI32, 1, thriftInt(parquetTypeByteArray)),
+						thriftField(thriftTypeI32, 4, thriftInt(spec.codec)),
+						thriftField(thriftTypeI64, 5, thriftInt(int64(numValues))),
+						thriftField(thriftTypeI64, 7, thriftInt(chunkSize)),
+						thriftField(thriftTypeI64, 9, thriftInt(spec.value("data_offset", dataOffset))),
+						thriftField(thriftTypeI64, 11, thriftInt(dictOffset)),
+					))),
+				)),
+				thriftField(thriftTypeI64, 3, thriftInt(int64(numValues))),
+			),
+		)),
+	)
+	file = append(file, footer...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(footer)))
+	return append(file, parquetMagic...)
+}
+
+// parquetFixtures are the fixtures in testdata with the lines they hold
+var parquetFixtures = []struct {
+	name  string
+	spec  parquetSpec
+	lines []string
+}{
+	{
+		// PLAIN values of a v1 page, uncompressed, with a null
+		name: "plain_v1.parquet",
+		spec: parquetSpec{
+			codec:    parquetCodecUncompressed,
+			optional: true,
+			pages: []parquetPageSpec{{
+				encoding:  parquetEncodingPlain,
+				numValues: 4,
+				defLevels: parquetBitPacked(1, 1, 0, 1, 1),
+				values:    parquetPlain("user 1 logged in", "user 2 logged in", "disk full"),
+			}},
+		},
+		lines: []string{"user 1 logged in", "user 2 logged in", "disk full"},
+	},
+	{
+		// Dictionary page and RLE_DICTIONARY indices of a v1 page, gzip
+		name: "dictionary_gzip.parquet",
+		spec: parquetSpec{
+			codec:      parquetCodecGzip,
+			dictionary: []string{"service started", "service stopped"},
+			pages: []parquetPageSpec{{
+				encoding:  parquetEncodingRLEDict,
+				numValues: 5,
+				values:    append([]byte{1}, parquetBitPacked(1, 0, 1, 0, 0, 1)...),
+			}},
+		},
+		lines: []string{"service started", "service stopped", "service started", "service started", "service stopped"},
+	},
+	{
+		// PLAIN values of two v2 pages with uncompressed levels, snappy
+		name: "v2_snappy.parquet",
+		spec: parquetSpec{
+			codec:    parquetCodecSnappy,
+			optional: true,
+			pages: []parquetPageSpec{
+				{
+					v2:        true,
+					encoding:  parquetEncodingPlain,
+					numValues: 3,
+					defLevels: parquetBitPacked(1, 1, 1, 0),
+					values:    parquetPlain("connection from 10.0.0.1 closed", "connection from 10.0.0.2 closed"),
+				},
+				{
+					v2:        true,
+					encoding:  parquetEncodingPlain,
+					numValues: 1,
+					defLevels: parquetBitPacked(1, 1),
+					values:    parquetPlain("connection from 10.0.0.3 closed"),
+				},
+			},
+		},
+		lines: []string{"connection from 10.0.0.1 closed", "connection from 10.0.0.2 closed", "connection from 10.0.0.3 closed"},
+	},
+}
+
+// TestParquetFixtures tests reading the Parquet fixtures
+func TestParquetFixtures(t *testing.T) {
+	limit, _ := newLineLimit(10000, policyTruncate)
+	for _, fixture := range parquetFixtures {
+		path := filepath.Join("testdata", fixture.name)
+		if *updateFixtures {
+			if err := os.WriteFile(path, buildParquet(t, fixture.spec), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines, err := readParquetLogs(bytes.NewReader(data), int64(len(data)), "message", limit)
+		if err != nil {
+			t.Errorf("%s: %v", fixture.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, fixture.lines) {
+			t.Errorf("%s: expected %q, got %q", fixture.name, fixture.lines, lines)
+		}
+	}
+}
+
+// TestParquetCorrupt tests that invalid sizes and counts in the metadata of a
+// Parquet file are reported as errors
+func TestParquetCorrupt(t *testing.T) {
+	limit, _ := newLineLimit(10000, policyTruncate)
+	tests := []struct {
+		fixture int
+		field   string
+		value   int64
+	}{
+		{0, "chunk_size", -5},
+		{0, "chunk_size", 1 << 40},
+		{0, "data_offset", -1},
+		{0, "compressed_size", -1},
+		{0, "compressed_size", 1 << 30},
+		{0, "def_length", 1 << 20},
+		{0, "num_values", -1},
+		{0, "num_values", 1 << 40},
+		{1, "dictionary_count", -1},
+		{1, "dictionary_count", 1 << 30},
+		{1, "uncompressed_size", -1},
+		{1, "uncompressed_size", 1 << 40},
+		{2, "def_length", -2},
+		{2, "rep_length", -1},
+		{2, "def_length", 1 << 30},
+		{2, "uncompressed_size", 1},
+		{2, "uncompressed_size", 1 << 30},
+	}
+	for _, tt := range tests {
+		spec := parquetFixtures[tt.fixture].spec
+		spec.corrupt = map[string]int64{tt.field: tt.value}
+		data := buildParquet(t, spec)
+		if _, err := readParquetLogs(bytes.NewReader(data), int64(len(data)), "message", limit); err == nil {
+			t.Errorf("%s: %s %d: expected an error", parquetFixtures[tt.fixture].name, tt.field, tt.value)
+		}
+	}
+
+	if _, err := decodeSnappy([]byte{0xff, 0xff, 0xff, 0x07, 0}); err == nil {
+		t.Error("Expected an error for a snappy length the input cannot hold")
+	}
+}
+
+// mqttCodec returns an mqttReader used only to read and write packets on conn
+func mqttCodec(conn net.Conn) *mqttReader {
+	return &mqttReader{ctx: context.Background(), conn: conn, reader: bufio.NewReader(conn), qos2: make(map[uint16]bool)}
+}
+
+// TestMQTTPackets tests encoding and decoding MQTT control packets
+func TestMQTTPackets(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	r := mqttCodec(client)
+
+	// Remaining lengths of one to four bytes
+	for _, length := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		body := bytes.Repeat([]byte{'x'}, length)
+		errc := make(chan error, 1)
+		go func() { errc <- mqttCodec(server).write(server, mqttPublish<<4, body) }()
+		kind, got, err := r.readPacket()
+		if err != nil || kind != mqttPublish<<4 || !bytes.Equal(got, body) {
+			t.Errorf("%d bytes: expected the written packet, got type %d, %d bytes, %v", length, kind>>4, len(got), err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		kind   byte
+		body   []byte
+		err    string
+	}{
+		{"CONNACK", []byte{0x20, 2, 0, 0}, mqttConnack << 4, []byte{0, 0}, ""},
+		{"SUBACK", []byte{0x90, 3, 0, 1, 1}, mqttSuback << 4, []byte{0, 1, 1}, ""},
+		{"PUBLISH", []byte{0x32, 8, 0, 1, 'a', 0, 7, 'h', 'i', '!'}, mqttPublish<<4 | 0x02, []byte{0, 1, 'a', 0, 7, 'h', 'i', '!'}, ""},
+		{"PINGRESP", []byte{0xd0, 0}, mqttPingresp << 4, []byte{}, ""},
+		{"truncated body", []byte{0x30, 10, 0, 1, 'a'}, 0, nil, "unexpected EOF"},
+		{"truncated length", []byte{0x30, 0x80}, 0, nil, "EOF"},
+		{"oversized length", []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, 0, nil, "exceeds"},
+		{"five-byte length", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, 0, nil, "malformed remaining length"},
+	}
+	for _, tt := range tests {
+		r.reader = bufio.NewReader(bytes.NewReader(tt.packet))
+		kind, body, err := r.readPacket()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || kind != tt.kind || !bytes.Equal(body, tt.body) {
+			t.Errorf("%s: expected type %d with %v, got type %d with %v, %v", tt.name, tt.kind>>4, tt.body, kind>>4, body, err)
+		}
+	}
+}
+
+// serveOnce serves one connection on a local port with handle and returns the
+// address of the server
+func serveOnce(t *testing.T, handle func(conn net.Conn) error) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := handle(conn); err != nil {
+			t.Errorf("Server: %v", err)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// mqttBroker serves one MQTT connection with script and returns the broker URL
+func mqttBroker(t *testing.T, script func(broker *mqttReader) error) string {
+	t.Helper()
+	return "mqtt://user:secret@" + serveOnce(t, func(conn net.Conn) error {
+		return script(mqttCodec(conn))
+	})
+}
+
+// expectMQTT reads a packet and checks its type and body
+func expectMQTT(broker *mqttReader, kind byte, body []byte) error {
+	got, gotBody, err := broker.readPacket()
+	if err != nil {
+		return err
+	}
+	if got != kind || (body != nil && !bytes.Equal(gotBody, body)) {
+		return fmt.Errorf("expected packet 0x%02x %v, got 0x%02x %v", kind, body, got, gotBody)
+	}
+	return nil
+}
+
+// TestMQTTSession tests the session of mqttReader with a broker: CONNECT and
+// SUBSCRIBE, and delivery of PUBLISH messages of every QoS
+func TestMQTTSession(t *testing.T) {
+	publish := func(flags byte, id uint16, payload string) (byte, []byte) {
+		body := appendMQTTString(nil, "logs")
+		if flags&0x06 != 0 {
+			body = binary.BigEndian.AppendUint16(body, id)
+		}
+		return mqttPublish<<4 | flags, append(body, payload...)
+	}
+	url := mqttBroker(t, func(broker *mqttReader) error {
+		connect := append(appendMQTTString(nil, "MQTT"), 4, 0xc2, 0, 30)
+		connect = appendMQTTString(appendMQTTString(appendMQTTString(connect, "test"), "user"), "secret")
+		if err := expectMQTT(broker, mqttConnect<<4, connect); err != nil {
+			return err
+		}
+		if err := broker.write(broker.conn, mqttConnack<<4, []byte{0, 0}); err != nil {
+			return err
+		}
+		if err := expectMQTT(broker, mqttSubscribe<<4|0x02, append(appendMQTTString([]byte{0, 1}, "logs/#"), 2)); err != nil {
+			return err
+		}
+		if err := broker.write(broker.conn, mqttSuback<<4, []byte{0, 1, 2}); err != nil {
+			return err
+		}
+
+		steps := []struct {
+			flags   byte
+			id      uint16
+			payload string
+			reply   byte // Expected acknowledgement, 0 for none
+		}{
+			{0, 0, "one", 0},
+			{0x02, 7, "two", mqttPuback << 4},
+			{0x04, 9, "three", mqttPubrec << 4},
+			{0x0c, 9, "three", mqttPubrec << 4}, // Redelivered before the PUBREL
+		}
+		for _, step := range steps {
+			kind, body := publish(step.flags, step.id, step.payload)
+			if err := broker.write(broker.conn, kind, body); err != nil {
+				return err
+			}
+			if step.reply != 0 {
+				if err := expectMQTT(broker, step.reply, binary.BigEndian.AppendUint16(nil, step.id)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := broker.write(broker.conn, mqttPubrel<<4|0x02, []byte{0, 9}); err != nil {
+			return err
+		}
+		if err := expectMQTT(broker, mqttPubcomp<<4, []byte{0, 9}); err != nil {
+			return err
+		}
+		kind, body := publish(0, 0, "four")
+		if err := broker.write(broker.conn, kind, body); err != nil {
+			return err
+		}
+		return expectMQTT(broker, mqttDisconnect<<4, []byte{})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := newMQTTReader(ctx, mqttOptions{broker: url, topic: "logs/#", qos: 2, clientID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(r)
+	var lines []string
+	for len(lines) < 4 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if expected := []string{"one", "two", "three", "four"}; !slices.Equal(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+	cancel()
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF after cancellation, got %d, %v", n, err)
+	}
+}
+
+// TestMQTTRefused tests that a refused connection or subscription fails
+func TestMQTTRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(broker *mqttReader) error
+		err    string
+	}{
+		{"CONNACK", func(broker *mqttReader) error {
+			if err := expectMQTT(broker, mqttConnect<<4, nil); err != nil {
+				return err
+			}
+			return broker.write(broker.conn, mqttConnack<<4, []byte{0, 5})
+		}, "return code 5"},
+		{"unexpected packet", func(broker *mqttReader) error {
+			if err := expectMQTT(broker, mqttConnect<<4, nil); err != nil {
+				return err
+			}
+			return broker.write(broker.conn, mqttSuback<<4, []byte{0, 1, 0})
+		}, "instead of CONNACK"},
+		{"SUBACK", func(broker *mqttReader) error {
+			if err := expectMQTT(broker, mqttConnect<<4, nil); err != nil {
+				return err
+			}
+			if err := broker.write(broker.conn, mqttConnack<<4, []byte{0, 0}); err != nil {
+				return err
+			}
+			if err := expectMQTT(broker, mqttSubscribe<<4|0x02, nil); err != nil {
+				return err
+			}
+			return broker.write(broker.conn, mqttSuback<<4, []byte{0, 1, 0x80})
+		}, "refused"},
+	}
+	for _, tt := range tests {
+		url := mqttBroker(t, tt.script)
+		_, err := newMQTTReader(context.Background(), mqttOptions{broker: url, topic: "logs", clientID: "test"})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+// TestRedisReplies tests reading canned RESP replies
+func TestRedisReplies(t *testing.T) {
+	tests := []struct {
+		reply    string
+		expected any
+		err      string
+	}{
+		{"+OK\r\n", "OK", ""},
+		{"-BUSYGROUP Consumer Group name already exists\r\n", redisError("BUSYGROUP Consumer Group name already exists"), ""},
+		{":42\r\n", int64(42), ""},
+		{"$5\r\nhello\r\n", "hello", ""},
+		{"$0\r\n\r\n", "", ""},
+		{"$-1\r\n", nil, ""},
+		{"*-1\r\n", nil, ""},
+		{"*0\r\n", []any{}, ""},
+		{"*2\r\n$3\r\nfoo\r\n*2\r\n:1\r\n-ERR nested\r\n", []any{"foo", []any{int64(1), redisError("ERR nested")}}, ""},
+		{"+OK\n", nil, "malformed Redis reply"},
+		{"+OK", nil, "EOF"},
+		{"\r\n", nil, "malformed Redis reply"},
+		{"?1\r\n", nil, "unknown Redis reply type"},
+		{":x\r\n", nil, "invalid syntax"},
+		{"$abc\r\n", nil, "malformed Redis bulk length"},
+		{"$-2\r\n", nil, "malformed Redis bulk length"},
+		{"$999999999999\r\n", nil, "malformed Redis bulk length"},
+		{"$5\r\nhel", nil, "unexpected EOF"},
+		{"$3\r\nhello\r\n", nil, "malformed Redis bulk string"},
+		{"*x\r\n", nil, "malformed Redis array length"},
+		{"*-2\r\n", nil, "malformed Redis array length"},
+		{"*999999999999\r\n:1\r\n", nil, "EOF"},
+	}
+	for _, tt := range tests {
+		c := &redisConn{reader: bufio.NewReader(strings.NewReader(tt.reply))}
+		reply, err := c.readReply()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: expected an error containing %q, got %v, %v", tt.reply, tt.err, reply, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(reply, tt.expected) {
+			t.Errorf("%q: expected %#v, got %#v, %v", tt.reply, tt.expected, reply, err)
+		}
+	}
+}
+
+// TestRedisStreamEntries tests extracting the entries of an XREADGROUP reply
+func TestRedisStreamEntries(t *testing.T) {
+	c := &redisConn{reader: bufio.NewReader(strings.NewReader("*1\r\n*2\r\n$4\r\nlogs\r\n*2\r\n" +
+		"*2\r\n$3\r\n1-0\r\n*4\r\n$4\r\nline\r\n$7\r\ndisk ok\r\n$4\r\nhost\r\n$1\r\na\r\n" +
+		"*2\r\n$3\r\n2-0\r\n*-1\r\n"))}
+	reply, err := c.readReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseStreamEntries(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []redisEntry{
+		{id: "1-0", fields: map[string]string{"line": "disk ok", "host": "a"}},
+		{id: "2-0", fields: map[string]string{}}, // Deleted while pending
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, entries)
+	}
+
+	if entries, err := parseStreamEntries(nil); entries != nil || err != nil {
+		t.Errorf("Expected no entries for a timed out read, got %v, %v", entries, err)
+	}
+	for _, reply := range []any{
+		[]any{[]any{"logs"}},
+		[]any{[]any{"logs", []any{[]any{"1-0"}}}},
+	} {
+		if _, err := parseStreamEntries(reply); err == nil {
+			t.Errorf("%v: expected an error", reply)
+		}
+	}
+}
+
+// TestRedisCommands tests the commands sent on connecting and error replies
+func TestRedisCommands(t *testing.T) {
+	addr := serveOnce(t, func(conn net.Conn) error {
+		reader := bufio.NewReader(conn)
+		for _, step := range []struct{ command, reply string }{
+			{"*3\r\n$4\r\nAUTH\r\n$4\r\nuser\r\n$6\r\nsecret\r\n", "+OK\r\n"},
+			{"*2\r\n$6\r\nSELECT\r\n$1\r\n2\r\n", "-ERR DB index is out of range\r\n"},
+		} {
+			got := make([]byte, len(step.command))
+			if _, err := io.ReadFull(reader, got); err != nil {
+				return err
+			}
+			if string(got) != step.command {
+				return fmt.Errorf("expected command %q, got %q", step.command, got)
+			}
+			if _, err := io.WriteString(conn, step.reply); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	addr = "redis://user:secret@" + addr + "/2"
+	_, err := dialRedis(context.Background(), addr)
+	var replyErr redisError
+	if !errors.As(err, &replyErr) || string(replyErr) != "ERR DB index is out of range" {
+		t.Errorf("Expected the error reply of SELECT, got %v", err)
+	}
+}
+
+// TestNATSMessages tests reading canned NATS protocol operations
+func TestNATSMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected natsMsg
+		err      string
+	}{
+		{"MSG", "MSG logs 1 5\r\nhello\r\n", natsMsg{subject: "logs", data: []byte("hello")}, ""},
+		{"MSG with reply", "+OK\r\nMSG _INBOX.x.pull 1 $JS.ACK.logs.1 4\r\ndisk\r\n", natsMsg{subject: "_INBOX.x.pull", reply: "$JS.ACK.logs.1", data: []byte("disk")}, ""},
+		{"HMSG", "HMSG logs 1 r 18 22\r\nNATS/1.0\r\nA: b\r\n\r\nline\r\n", natsMsg{subject: "logs", reply: "r", data: []byte("line")}, ""},
+		{"status", "HMSG _INBOX.x.pull 1 32 32\r\nNATS/1.0 408 Request Timeout\r\n\r\n\r\n", natsMsg{subject: "_INBOX.x.pull", status: "408", data: []byte{}}, ""},
+		{"error", "-ERR 'Permissions Violation for Subscription'\r\n", natsMsg{}, "NATS: 'Permissions Violation for Subscription'"},
+		{"missing size", "MSG logs 1\r\n", natsMsg{}, "malformed NATS message header"},
+		{"too many fields", "MSG logs 1 r x 5\r\n", natsMsg{}, "malformed NATS message header"},
+		{"invalid size", "MSG logs 1 abc\r\n", natsMsg{}, "malformed NATS message size"},
+		{"negative size", "MSG logs 1 -1\r\n", natsMsg{}, "malformed NATS message size"},
+		{"oversized", "MSG logs 1 999999999999\r\n", natsMsg{}, "malformed NATS message size"},
+		{"header larger than message", "HMSG logs 1 30 20\r\n", natsMsg{}, "malformed NATS header size"},
+		{"negative header size", "HMSG logs 1 -1 20\r\n", natsMsg{}, "malformed NATS header size"},
+		{"truncated payload", "MSG logs 1 10\r\nhel", natsMsg{}, "unexpected EOF"},
+		{"end of stream", "+OK\r\n", natsMsg{}, "EOF"},
+	}
+	for _, tt := range tests {
+		c := &natsConn{reader: bufio.NewReader(strings.NewReader(tt.input))}
+		msg, err := c.next()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected an error containing %q, got %+v, %v", tt.name, tt.err, msg, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(msg, tt.expected) {
+			t.Errorf("%s: expected %+v, got %+v, %v", tt.name, tt.expected, msg, err)
+		}
+	}
+
+	// A PING is answered before the next message
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.WriteString(server, "PING\r\nMSG logs 1 2\r\nok\r\n")
+	c := &natsConn{conn: client, reader: bufio.NewReader(client)}
+	msgs := make(chan natsMsg, 1)
+	go func() {
+		msg, _ := c.next()
+		msgs <- msg
+	}()
+	pong := make([]byte, 6)
+	if _, err := io.ReadFull(server, pong); err != nil || string(pong) != "PONG\r\n" {
+		t.Errorf("Expected PONG, got %q, %v", pong, err)
+	}
+	if msg := <-msgs; string(msg.data) != "ok" {
+		t.Errorf("Expected the message after the PING, got %+v", msg)
+	}
+}
+
+// TestNATSConnect tests the greeting and authentication of dialNATS
+func TestNATSConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies string // Sent after the CONNECT, SUB and PING
+		info    string
+		err     string
+	}{
+		{"connected", "+OK\r\nPONG\r\n", `{"headers":true}`, ""},
+		{"authorization", "-ERR 'Authorization Violation'\r\n", `{"headers":true}`, "NATS: 'Authorization Violation'"},
+		{"no headers", "", `{"headers":false}`, "does not support headers"},
+	}
+	for _, tt := range tests {
+		addr := serveOnce(t, func(conn net.Conn) error {
+			if _, err := io.WriteString(conn, "INFO "+tt.info+"\r\n"); err != nil {
+				return err
+			}
+			if tt.replies == "" {
+				return nil
+			}
+			reader := bufio.NewReader(conn)
+			connect, err := reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			var options map[string]any
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(connect, "CONNECT ")), &options); err != nil {
+				return err
+			}
+			if options["user"] != "user" || options["pass"] != "secret" || options["headers"] != true {
+				return fmt.Errorf("unexpected CONNECT options %v", options)
+			}
+			for _, prefix := range []string{"SUB _INBOX.", "PING"} {
+				if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, prefix) {
+					return fmt.Errorf("expected %s, got %q, %v", prefix, line, err)
+				}
+			}
+			_, err = io.WriteString(conn, tt.replies)
+			return err
+		})
+		conn, err := dialNATS(context.Background(), natsOptions{server: "nats://user:secret@" + addr})
+		if conn != nil {
+			conn.conn.Close()
+		}
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+// protoField is a field of a protobuf message: a varint, fixed64 or length-delimited value
+type protoField struct {
+	varint uint64
+	data   []byte
+}
+
+// decodeProto decodes the fields of a protobuf message by field number,
+// failing on a truncated varint, length or value
+func decodeProto(data []byte) (map[int][]protoField, error) {
+	fields := make(map[int][]protoField)
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("truncated varint")
+		}
+		data = data[n:]
+		var field protoField
+		switch tag & 7 {
+		case 0:
+			if field.varint, n = binary.Uvarint(data); n <= 0 {
+				return nil, fmt.Errorf("truncated varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated fixed64")
+			}
+			field.varint, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("truncated varint")
+			}
+			if data = data[n:]; length > uint64(len(data)) {
+				return nil, fmt.Errorf("truncated length")
+			}
+			field.data, data = data[:length], data[length:]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", tag&7)
+		}
+		fields[int(tag>>3)] = append(fields[int(tag>>3)], field)
+	}
+	return fields, nil
+}
+
+// decodeLogsRequest decodes the log records of an ExportLogsServiceRequest
+// with one resource and scope, returning the service name
+func decodeLogsRequest(data []byte) (service string, records []map[int][]protoField, err error) {
+	message := func(data []byte, path ...int) (map[int][]protoField, error) {
+		fields, err := decodeProto(data)
+		for _, field := range path {
+			if err != nil {
+				return nil, err
+			}
+			if len(fields[field]) != 1 {
+				return nil, fmt.Errorf("expected one field %d, got %d", field, len(fields[field]))
+			}
+			fields, err = decodeProto(fields[field][0].data)
+		}
+		return fields, err
+	}
+	attribute, err := message(data, 1, 1, 1) // ResourceLogs, Resource, KeyValue
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := message(attribute[2][0].data)
+	if err != nil {
+		return "", nil, err
+	}
+	scopeLogs, err := message(data, 1, 2)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, field := range scopeLogs[2] {
+		record, err := decodeProto(field.data)
+		if err != nil {
+			return "", nil, err
+		}
+		records = append(records, record)
+	}
+	return string(value[1][0].data), records, nil
+}
+
+// TestOTLPEncoding tests the ExportLogsServiceRequest of a parsed line
+func TestOTLPEncoding(t *testing.T) {
+	observed := time.Unix(1700000000, 0)
+	record := otlpRecord{
+		raw:       "2024-01-02T03:04:05Z disk full",
+		fields:    map[string]string{"level": "error", "host": "a"},
+		namespace: "ns",
+		eventID:   3,
+		template:  "disk <*>",
+		params:    []string{"full"},
+		observed:  observed,
+	}
+	request := encodeLogsRequest([]otlpRecord{record}, "svc")
+	service, records, err := decodeLogsRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service != "svc" || len(records) != 1 {
+		t.Fatalf("Expected one record of service svc, got %d of %q", len(records), service)
+	}
+	logRecord := records[0]
+	if got := logRecord[1][0].varint; got != uint64(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano()) {
+		t.Errorf("Expected the timestamp of the line, got %d", got)
+	}
+	if logRecord[2][0].varint != 17 || string(logRecord[3][0].data) != "error" {
+		t.Errorf("Expected severity 17 (error), got %d (%s)", logRecord[2][0].varint, logRecord[3][0].data)
+	}
+	if body, _ := decodeProto(logRecord[5][0].data); string(body[1][0].data) != record.raw {
+		t.Errorf("Expected the line as body, got %v", body)
+	}
+	if logRecord[11][0].varint != uint64(observed.UnixNano()) {
+		t.Errorf("Expected the observed time, got %d", logRecord[11][0].varint)
+	}
+
+	var attributes []string
+	for _, field := range logRecord[6] {
+		attribute, err := decodeProto(field.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := decodeProto(attribute[2][0].data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var text string
+		switch {
+		case value[1] != nil:
+			text = string(value[1][0].data)
+		case value[3] != nil:
+			text = fmt.Sprint(value[3][0].varint)
+		case value[5] != nil:
+			array, _ := decodeProto(value[5][0].data)
+			for _, item := range array[1] {
+				item, _ := decodeProto(item.data)
+				text += "[" + string(item[1][0].data) + "]"
+			}
+		}
+		attributes = append(attributes, string(attribute[1][0].data)+"="+text)
+	}
+	expected := []string{"host=a", "level=error", "awsomlp.namespace=ns", "awsomlp.event_id=3", "awsomlp.template=disk <*>", "awsomlp.params=[full]"}
+	if !slices.Equal(attributes, expected) {
+		t.Errorf("Expected attributes %q, got %q", expected, attributes)
+	}
+
+	// Every length prefix covers exactly its value, so no truncation decodes
+	for n := range len(request) {
+		if _, _, err := decodeLogsRequest(request[:n]); err == nil {
+			t.Errorf("Expected an error for the request truncated to %d of %d bytes", n, len(request))
+		}
+	}
+	if _, err := decodeProto([]byte{0x0a, 0x80}); err == nil || err.Error() != "truncated varint" {
+		t.Errorf("Expected a truncated varint, got %v", err)
+	}
+	if _, err := decodeProto([]byte{0x0a, 0x05, 0x01}); err == nil || err.Error() != "truncated length" {
+		t.Errorf("Expected a truncated length, got %v", err)
+	}
+}
+
+// TestOTLPExport tests exporting a record to a collector over HTTP
+func TestOTLPExport(t *testing.T) {
+	type request struct {
+		path, contentType, auth string
+		body                    []byte
+	}
+	requests := make(chan request, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), body}
+	}))
+	defer collector.Close()
+
+	exporter, err := newOTLPExporter(otlpOptions{
+		endpoint: collector.URL,
+		protocol: otlpHTTP,
+		headers:  httpHeaders{"Authorization: Bearer token"},
+		service:  "svc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := otlpRecord{raw: "disk full", eventID: 1, template: "disk <*>", params: []string{"full"}, observed: time.Unix(1700000000, 0)}
+	exporter.export(record)
+	exporter.Close()
+
+	got := <-requests
+	if got.path != "/v1/logs" || got.contentType != "application/x-protobuf" || got.auth != "Bearer token" {
+		t.Errorf("Expected a protobuf POST to /v1/logs with the header, got %+v", got)
+	}
+	if expected := encodeLogsRequest([]otlpRecord{record}, "svc"); !bytes.Equal(got.body, expected) {
+		t.Errorf("Expected the encoded request, got % x", got.body)
+	}
+	if exporter.failed.Load() != 0 {
+		t.Errorf("Expected no failed batch, got %d", exporter.failed.Load())
+	}
+}
+
+// Msgpack encoding of the forward protocol messages of the tests
+
+func msgpackArray(items ...[]byte) []byte {
+	return append([]byte{0x90 | byte(len(items))}, bytes.Join(items, nil)...)
+}
+
+func msgpackMap(pairs ...[]byte) []byte {
+	return append([]byte{0x80 | byte(len(pairs)/2)}, bytes.Join(pairs, nil)...)
+}
+
+func msgpackString(s string) []byte {
+	return appendMsgpackString(nil, s)
+}
+
+func msgpackBin(data []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{0xc6}, uint32(len(data))), data...)
+}
+
+// msgpackEventTime is an EventTime extension of 1700000000.5
+var msgpackEventTime = []byte{0xd7, 0x00, 0x65, 0x53, 0xf1, 0x00, 0x1d, 0xcd, 0x65, 0x00}
+
+// forwardEntry is a [time, {"log": line}] entry
+func forwardEntry(line string) []byte {
+	return msgpackArray(msgpackEventTime, msgpackMap(msgpackString("log"), msgpackString(line)))
+}
+
+// TestMsgpackDecoder tests decoding msgpack values
+func TestMsgpackDecoder(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected any
+		err      string
+	}{
+		{[]byte{0x05}, int64(5), ""},
+		{[]byte{0xff}, int64(-1), ""},
+		{[]byte{0xc0}, nil, ""},
+		{[]byte{0xc3}, true, ""},
+		{[]byte{0xcd, 0x01, 0x00}, int64(256), ""},
+		{[]byte{0xd1, 0xff, 0x00}, int64(-256), ""},
+		{[]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint64), ""},
+		{[]byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5, ""},
+		{msgpackString("hello"), "hello", ""},
+		{[]byte{0xd9, 3, 'a', 'b', 'c'}, "abc", ""},
+		{[]byte{0xc4, 2, 1, 2}, []byte{1, 2}, ""},
+		{msgpackEventTime, msgpackExt{kind: 0, data: msgpackEventTime[2:]}, ""},
+		{msgpackArray([]byte{1}, msgpackString("a")), []any{int64(1), "a"}, ""},
+		{msgpackMap([]byte{1}, []byte{0xc2}), map[string]any{"1": false}, ""},
+		{[]byte{0xc1}, nil, "invalid msgpack type"},
+		{[]byte{0xa5, 'h', 'i'}, nil, "unexpected EOF"},
+		{[]byte{0xdb, 0x03, 0xff, 0xff, 0xff, 'x'}, nil, "unexpected EOF"},
+		{[]byte{0xdb, 0x7f, 0xff, 0xff, 0xff}, nil, "exceeds"},
+		{[]byte{0xc6, 0x04, 0x00, 0x00, 0x00}, nil, "unexpected EOF"},
+		{[]byte{0xdd, 0x7f, 0xff, 0xff, 0xff}, nil, "exceeds"},
+		{[]byte{0xdf, 0x00, 0x00, 0x00, 0x02, 0x01}, nil, "EOF"},
+		{bytes.Repeat([]byte{0x91}, msgpackMaxDepth+2), nil, "nested deeper"},
+	}
+	for _, tt := range tests {
+		decoder := &msgpackDecoder{r: bufio.NewReader(bytes.NewReader(tt.data))}
+		value, err := decoder.decode()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("% x: expected an error containing %q, got %v, %v", tt.data, tt.err, value, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(value, tt.expected) {
+			t.Errorf("% x: expected %#v, got %#v, %v", tt.data, tt.expected, value, err)
+		}
+	}
+}
+
+// TestForwardRecords tests extracting records from messages of every mode of
+// the forward protocol
+func TestForwardRecords(t *testing.T) {
+	packed := append(forwardEntry("three"), forwardEntry("four")...)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(append(forwardEntry("five"), forwardEntry("six")...))
+	gz.Close()
+
+	tests := []struct {
+		name    string
+		message []byte
+		lines   []string
+		chunk   string
+		err     string
+	}{
+		{"Message", msgpackArray(msgpackString("app"), []byte{0xce, 0x65, 0x53, 0xf1, 0x00},
+			msgpackMap(msgpackString("log"), msgpackString("one")), msgpackMap(msgpackString("chunk"), msgpackString("c1"))),
+			[]string{"one"}, "c1", ""},
+		{"Forward", msgpackArray(msgpackString("app"), msgpackArray(forwardEntry("two"), forwardEntry("two again")),
+			msgpackMap(msgpackString("chunk"), msgpackString("c2"))),
+			[]string{"two", "two again"}, "c2", ""},
+		{"PackedForward", msgpackArray(msgpackString("app"), msgpackBin(packed)),
+			[]string{"three", "four"}, "", ""},
+		{"CompressedPackedForward", msgpackArray(msgpackString("app"), msgpackBin(gzipped.Bytes()),
+			msgpackMap(msgpackString("compressed"), msgpackString("gzip"), msgpackString("chunk"), msgpackString("c4"))),
+			[]string{"five", "six"}, "c4", ""},
+		{"no entries", msgpackArray(msgpackString("app")), nil, "", "malformed forward message"},
+		{"tag", msgpackArray([]byte{1}, msgpackArray()), nil, "", "tag is not a string"},
+		{"Message without record", msgpackArray(msgpackString("app"), []byte{1}), nil, "", "malformed forward message"},
+		{"truncated packed entries", msgpackArray(msgpackString("app"), msgpackBin(packed[:len(packed)-2])), nil, "", "malformed packed forward entries"},
+		{"invalid gzip", msgpackArray(msgpackString("app"), msgpackBin(packed),
+			msgpackMap(msgpackString("compressed"), msgpackString("gzip"))), nil, "", "gzip"},
+	}
+	for _, tt := range tests {
+		message, err := (&msgpackDecoder{r: bufio.NewReader(bytes.NewReader(tt.message))}).decode()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		records, chunk, err := forwardRecords(message)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		var lines []string
+		for _, record := range records {
+			lines = append(lines, forwardLine(record, []string{"message", "log"}))
+		}
+		if err != nil || !slices.Equal(lines, tt.lines) || chunk != tt.chunk {
+			t.Errorf("%s: expected %q with chunk %q, got %q with chunk %q, %v", tt.name, tt.lines, tt.chunk, lines, chunk, err)
+		}
+	}
+}
+
+// TestForwardAck tests that a chunk is acknowledged once its lines are parsed
+func TestForwardAck(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	queue, err := newLineQueue(10, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := newClientLimiter(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit, _ := newLineLimit(10000, policyTruncate)
+	done := make(chan error, 1)
+	go func() {
+		done <- handleForward(context.Background(), server, forwardOptions{keys: []string{"log"}, clients: clients}, queue, limit.apply)
+	}()
+
+	go client.Write(msgpackArray(msgpackString("app"), msgpackArray(forwardEntry("one"), forwardEntry("two")),
+		msgpackMap(msgpackString("chunk"), msgpackString("YzE="))))
+	for _, expected := range []string{"one", "two"} {
+		line, _ := queue.pop()
+		if line.text != expected {
+			t.Errorf("Expected %q, got %q", expected, line.text)
+		}
+		if expected == "two" {
+			go line.ack() // Writing the acknowledgment blocks until it is read
+		} else {
+			line.ack()
+		}
+	}
+	reply, err := (&msgpackDecoder{r: bufio.NewReader(client)}).decode()
+	if expected := map[string]any{"ack": "YzE="}; err != nil || !reflect.DeepEqual(reply, expected) {
+		t.Errorf("Expected %v, got %v, %v", expected, reply, err)
+	}
+	client.Close()
+	if err := <-done; err != io.EOF && !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Expected the connection to end, got %v", err)
+	}
+}
+
+// TestRuleYAML tests parsing rule files
+func TestRuleYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []map[string]string
+		err      string
+	}{
+		{"top-level list", "- name: a\n  when: count < 1\n- name: b\n", []map[string]string{{"name": "a", "when": "count < 1"}, {"name": "b"}}, ""},
+		{"rules key", "---\n# Alerts\nrules:\n  - name: a # comment\n    window: 5m\n", []map[string]string{{"name": "a", "window": "5m"}}, ""},
+		{"item on its own line", "-\n  name: a\n", []map[string]string{{"name": "a"}}, ""},
+		{"quoted values", "- template: \"disk #<*> \\\"full\\\"\" # comment\n  command: 'it''s # here'\n  url: ''\n",
+			[]map[string]string{{"template": `disk #<*> "full"`, "command": "it's # here", "url": ""}}, ""},
+		{"empty", "# no rules\n", nil, ""},
+		{"tab indentation", "- name: a\n\twhen: count < 1\n", nil, "line 2: tabs are not allowed"},
+		{"dedented key", "- name: a\nwhen: count < 1\n", nil, "line 2: expected a list item"},
+		{"key at item indentation", "  - name: a\n  when: count < 1\n", nil, "line 2: expected a list item"},
+		{"key before items", "name: a\n", nil, "line 1: expected a list item"},
+		{"missing colon", "- name a\n", nil, "line 1: expected key: value"},
+		{"key with space", "- rule name: a\n", nil, "line 1: expected key: value"},
+		{"duplicate key", "- name: a\n  name: b\n", nil, "line 2: duplicate key name"},
+		{"unterminated double quote", "- name: \"a\n", nil, "invalid double-quoted value"},
+		{"text after double quote", "- name: \"a\" b\n", nil, "invalid double-quoted value"},
+		{"text after single quote", "- name: 'a' b\n", nil, "invalid single-quoted value"},
+	}
+	for _, tt := range tests {
+		items, err := parseRuleYAML(strings.NewReader(tt.input))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected an error containing %q, got %v, %v", tt.name, tt.err, items, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(items, tt.expected) {
+			t.Errorf("%s: expected %v, got %v, %v", tt.name, tt.expected, items, err)
+		}
+	}
+}
+
+// TestAlertRules tests validating rules and evaluating their conditions
+func TestAlertRules(t *testing.T) {
+	invalid := []struct {
+		item map[string]string
+		err  string
+	}{
+		{map[string]string{"name": "a", "when": "count < 1", "severity": "high"}, "unknown field: severity"},
+		{map[string]string{"when": "count < 1"}, "missing name"},
+		{map[string]string{"name": "a", "when": "count < 1", "event_id": "-1"}, "invalid event_id"},
+		{map[string]string{"name": "a"}, "invalid condition"},
+		{map[string]string{"name": "a", "when": "sum > 1"}, "invalid condition"},
+		{map[string]string{"name": "a", "when": "count >"}, "invalid condition"},
+		{map[string]string{"name": "a", "when": "count => 1"}, "invalid operator"},
+		{map[string]string{"name": "a", "when": "rate > many"}, "invalid threshold"},
+		{map[string]string{"name": "a", "when": "count < 1", "window": "soon"}, "invalid window"},
+		{map[string]string{"name": "a", "when": "count < 1", "window": "500ms"}, "window must be between"},
+		{map[string]string{"name": "a", "when": "count < 1", "window": "48h"}, "window must be between"},
+		{map[string]string{"name": "a", "when": "count < 1", "action": "webhook", "url": "ftp://host"}, "http(s) url"},
+		{map[string]string{"name": "a", "when": "count < 1", "action": "exec"}, "needs a command"},
+		{map[string]string{"name": "a", "when": "count < 1", "action": "mail"}, "invalid action: mail"},
+	}
+	for _, tt := range invalid {
+		if _, err := newAlertRule(tt.item); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: expected an error containing %q, got %v", tt.item, tt.err, err)
+		}
+	}
+
+	// Every condition at, below and above its threshold of 2
+	conditions := []struct {
+		when                string
+		below, equal, above bool
+	}{
+		{"count < 2", true, false, false},
+		{"count <= 2", true, true, false},
+		{"count > 2", false, false, true},
+		{"count >= 2", false, true, true},
+		{"rate == 2", false, true, false},
+		{"rate != 2", true, false, true},
+	}
+	for _, tt := range conditions {
+		rule, err := newAlertRule(map[string]string{"name": "a", "when": tt.when})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := [3]bool{rule.holds(1), rule.holds(2), rule.holds(3)}; got != [3]bool{tt.below, tt.equal, tt.above} {
+			t.Errorf("%s: expected %v for 1, 2 and 3, got %v", tt.when, [3]bool{tt.below, tt.equal, tt.above}, got)
+		}
+	}
+
+	// Selectors
+	rule, err := newAlertRule(map[string]string{"name": "a", "when": "count > 0", "template_prefix": "disk ", "event_id": "3", "namespace": "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		namespace string
+		eventID   int
+		template  string
+		matches   bool
+	}{
+		{"db", 3, "disk <*> full", true},
+		{"web", 3, "disk <*> full", false},
+		{"db", 4, "disk <*> full", false},
+		{"db", 3, "network down", false},
+	} {
+		if rule.matches(tt.namespace, tt.eventID, tt.template) != tt.matches {
+			t.Errorf("%+v: expected matches to be %v", tt, tt.matches)
+		}
+	}
+
+	// A count and a rate over a window of two seconds
+	count, err := newAlertRule(map[string]string{"name": "errors", "when": "count >= 3", "window": "2s", "template": "disk <*> full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, err := newAlertRule(map[string]string{"name": "rate", "when": "rate > 1", "window": "2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := &ruleEngine{rules: []*alertRule{count, rate}, span: 2}
+	log.SetOutput(io.Discard) // Alerts of the log action
+	defer log.SetOutput(os.Stderr)
+	start := time.Unix(1700000000, 0)
+	engine.observe("", 1, "disk <*> full", start)
+	engine.observe("", 1, "disk <*> full", start)
+	engine.observe("", 2, "network down", start)
+	engine.observe("", 1, "disk <*> full", start.Add(time.Second))
+	engine.evaluate(start.Add(2 * time.Second))
+	if !count.firing || !rate.firing {
+		t.Errorf("Expected both rules to fire with 3 matching of 4 lines in 2s, got %v and %v", count.firing, rate.firing)
+	}
+	engine.observe("", 1, "disk <*> full", start.Add(2*time.Second))
+	engine.evaluate(start.Add(4 * time.Second))
+	if count.firing || rate.firing {
+		t.Errorf("Expected both rules to resolve with 1 line in 2s, got %v and %v", count.firing, rate.firing)
+	}
+	if got := rate.value(start.Add(3 * time.Second).Unix()); got != 0.5 {
+		t.Errorf("Expected a rate of 0.5 lines per second, got %g", got)
+	}
+}
+
+// TestLoadRules tests reading a rule file
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(path, []byte("rules:\n  - name: quiet\n    when: count < 1\n    window: 10s\n  - name: loud\n    when: rate > 1\n    action: page\n"), 0o644)
+	if _, err := loadRules(path); err == nil || !strings.Contains(err.Error(), "rule 2: invalid action: page") {
+		t.Errorf("Expected the invalid action of rule 2, got %v", err)
+	}
+
+	os.WriteFile(path, []byte("rules:\n  - name: quiet\n    when: count < 1\n    window: 10s\n  - name: loud\n    when: rate > 1\n"), 0o644)
+	engine, err := loadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(engine.rules) != 2 || engine.span != 60 {
+		t.Errorf("Expected 2 rules spanning the default window of 60s, got %d spanning %ds", len(engine.rules), engine.span)
+	}
+}
+
+// TestIngestBodyLimit tests that /ingest rejects a body over the maximum size
+// with 413 even without -max-batch, and accepts a smaller one
+func TestIngestBodyLimit(t *testing.T) {
+	queue, _ := newLineQueue(10, overflowDrop)
+	clients, _ := newClientLimiter(0, 0, 0)
+	limit, _ := newLineLimit(10000, policyTruncate)
+	handler := &ingestHandler{queue: queue, clients: clients, limit: limit, maxBytes: 32}
+
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{"disk full\ndisk ok\n", http.StatusAccepted},
+		{strings.Repeat("disk full\n", 4), http.StatusRequestEntityTooLarge},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(test.body)))
+		if recorder.Code != test.status {
+			t.Errorf("Expected status %d for a body of %d bytes, got %d: %s", test.status, len(test.body), recorder.Code, recorder.Body)
+		}
+	}
+	if queue.size != 2 {
+		t.Errorf("Expected only the lines of the accepted body to be queued, got %d", queue.size)
+	}
+	if clients.tooLarge.Load() != 1 {
+		t.Errorf("Expected the rejected body to be counted as too large, got %d", clients.tooLarge.Load())
+	}
+}
+
+// TestAzureQuery tests running a Log Analytics query against a local server:
+// the request, the assembly of messages from the result columns, and errors
+func TestAzureQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/workspaces/denied/query":
+			http.Error(w, "forbidden workspace", http.StatusForbidden)
+			return
+		case "/v1/workspaces/broken/query":
+			io.WriteString(w, `{"tables": [`)
+			return
+		}
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		if r.URL.Path != "/v1/workspaces/ws1/query" || r.Header.Get("Authorization") != "Bearer token" ||
+			request["query"] != "AppTraces" || request["timespan"] != "PT3600S" {
+			http.Error(w, fmt.Sprintf("unexpected request %s %v", r.URL.Path, request), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"tables": [{"columns": [{"name": "TimeGenerated"}, {"name": "Level"}, {"name": "Message"}],
+			"rows": [["2024-01-01", "Error", "disk\nfull"], ["2024-01-02", null, 42], ["2024-01-03", null, null], ["2024-01-04"]]}],
+			"error": {"message": "partial result"}}`)
+	}))
+	defer server.Close()
+	defer func(endpoint string) { azureQueryEndpoint = endpoint }(azureQueryEndpoint)
+	azureQueryEndpoint = server.URL + "/v1/workspaces/%s/query"
+	t.Setenv("AZURE_ACCESS_TOKEN", "token")
+
+	opts := inputOptions{
+		azure: azureOptions{query: "AppTraces", timespan: "1h"},
+		csv:   csvOptions{columns: "Level,Message"},
+	}
+	reader, err := openAzure("azure://ws1", opts)
+	if err != nil {
+		t.Fatalf("Failed to run the query: %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	if string(data) != "Error disk full\n42\n" {
+		t.Errorf("Expected the messages of the non-empty rows, got %q", data)
+	}
+
+	for input, want := range map[string]string{
+		"azure://denied": "403 Forbidden: forbidden workspace",
+		"azure://broken": "Log Analytics: unexpected EOF",
+		"azure://":       "no workspace ID",
+	} {
+		if _, err := openAzure(input, opts); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", input, want, err)
+		}
+	}
+	opts.azure.query = ""
+	if _, err := openAzure("azure://ws1", opts); err == nil || !strings.Contains(err.Error(), "-kql") {
+		t.Errorf("Expected an error for a missing query, got %v", err)
+	}
+}
+
+// TestClientLimiter tests the token buckets of the ingest clients: bursts,
+// refill, batches larger than the burst and the maximum batch size
+func TestClientLimiter(t *testing.T) {
+	clients, err := newClientLimiter(10, 20, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Unix(1700000000, 0)
+	clients.now = func() time.Time { return clock }
+
+	for i, step := range []struct {
+		client     string
+		lines      int
+		advance    time.Duration // Time passed before the batch
+		err        error
+		retryAfter time.Duration
+	}{
+		// The full burst
+		{"a", 20, 0, nil, 0},
+		// Empty bucket
+		{"a", 1, 0, errRateLimited, 100 * time.Millisecond},
+		// Buckets are per client
+		{"b", 5, 0, nil, 0},
+		// Refilled 10 tokens
+		{"a", 15, time.Second, errRateLimited, 500 * time.Millisecond},
+		// Refilled 15 tokens
+		{"a", 15, 500 * time.Millisecond, nil, 0},
+		// Over the burst with a full bucket, leaving -10
+		{"a", 30, 5 * time.Second, nil, 0},
+		// Refilled back to 0
+		{"a", 1, time.Second, errRateLimited, 100 * time.Millisecond},
+		// Over the maximum batch
+		{"a", 51, time.Hour, errBatchTooLarge, 0},
+	} {
+		clock = clock.Add(step.advance)
+		retryAfter, err := clients.allow(step.client, step.lines)
+		if err != step.err || retryAfter != step.retryAfter {
+			t.Errorf("Step %d: expected %v with retry after %v, got %v with %v", i, step.err, step.retryAfter, err, retryAfter)
+		}
+	}
+	if clients.accepted.Load() != 4 || clients.rateLimited.Load() != 3 || clients.tooLarge.Load() != 1 {
+		t.Errorf("Expected 4 accepted, 3 rate limited and 1 too large batch, got %d, %d and %d",
+			clients.accepted.Load(), clients.rateLimited.Load(), clients.tooLarge.Load())
+	}
+
+	// A new client beyond maxClientBuckets forgets the clients with full buckets
+	clients.buckets = map[string]*tokenBucket{"busy": {tokens: 0, updated: clock}}
+	for i := len(clients.buckets); i < maxClientBuckets; i++ {
+		clients.buckets[fmt.Sprint("idle", i)] = &tokenBucket{tokens: 0, updated: clock.Add(-2 * time.Second)}
+	}
+	if _, err := clients.allow("new", 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients.buckets) != 2 || clients.buckets["busy"] == nil || clients.buckets["new"] == nil {
+		t.Errorf("Expected only the busy and the new client to be kept, got %d buckets", len(clients.buckets))
+	}
+}
+
+// TestIngestLimits tests the statuses of /ingest for batches over the maximum
+// size and over the client's rate
+func TestIngestLimits(t *testing.T) {
+	queue, _ := newLineQueue(10, overflowDrop)
+	clients, _ := newClientLimiter(1, 2, 3)
+	clock := time.Unix(1700000000, 0)
+	clients.now = func() time.Time { return clock }
+	limit, _ := newLineLimit(10000, policyTruncate)
+	handler := &ingestHandler{queue: queue, clients: clients, limit: limit}
+
+	for _, test := range []struct {
+		body       string
+		status     int
+		retryAfter string
+	}{
+		{"disk full\ndisk ok\n", http.StatusAccepted, ""},
+		{"a\nb\nc\nd\n", http.StatusRequestEntityTooLarge, ""},
+		{"disk full\n", http.StatusTooManyRequests, "1"},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(test.body)))
+		if recorder.Code != test.status || recorder.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("Expected status %d with Retry-After %q for %q, got %d with %q: %s", test.status, test.retryAfter,
+				test.body, recorder.Code, recorder.Header().Get("Retry-After"), recorder.Body)
+		}
+	}
+	if queue.size != 2 {
+		t.Errorf("Expected only the lines of the accepted batch to be queued, got %d", queue.size)
+	}
+}
+
+// TestLineQueue tests the overflow policies of the line queue, its stats and
+// draining the queued lines after close
+func TestLineQueue(t *testing.T) {
+	popAll := func(q *lineQueue) []string {
+		var lines []string
+		for {
+			line, ok := q.pop()
+			if !ok {
+				return lines
+			}
+			lines = append(lines, line.text)
+		}
+	}
+
+	for policy, expected := range map[string][]string{
+		overflowDrop:   {"a", "b"},
+		overflowOldest: {"b", "c"},
+	} {
+		q, err := newLineQueue(2, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"a", "b", "c"} {
+			q.push(line)
+		}
+		if received, dropped, queued := q.stats(); received != 3 || dropped != 1 || queued != 2 {
+			t.Errorf("%s: expected 3 received, 1 dropped and 2 queued lines, got %d, %d and %d", policy, received, dropped, queued)
+		}
+		q.close()
+		if lines := popAll(q); !slices.Equal(lines, expected) {
+			t.Errorf("%s: expected %v after close, got %v", policy, expected, lines)
+		}
+	}
+
+	// A full blocking queue holds the push until a line is popped
+	q, _ := newLineQueue(1, overflowBlock)
+	q.push("a")
+	pushed := make(chan struct{})
+	go func() {
+		q.push("b")
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Expected the push to a full queue to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if line, _ := q.pop(); line.text != "a" {
+		t.Errorf("Expected the first line, got %q", line.text)
+	}
+	<-pushed
+	q.close()
+	if lines := popAll(q); !slices.Equal(lines, []string{"b"}) {
+		t.Errorf("Expected the blocked line after close, got %v", lines)
+	}
+	if received, dropped, queued := q.stats(); received != 2 || dropped != 0 || queued != 0 {
+		t.Errorf("Expected 2 received lines and none dropped or queued, got %d, %d and %d", received, dropped, queued)
+	}
+
+	if _, err := newLineQueue(0, overflowBlock); err == nil {
+		t.Error("Expected an error for a queue size of 0")
+	}
+	if _, err := newLineQueue(1, "newest"); err == nil {
+		t.Error("Expected an error for an unknown overflow policy")
+	}
+}
+
+// TestRateLimiter tests that the rate limiter spaces calls evenly
+func TestRateLimiter(t *testing.T) {
+	limiter, err := newRateLimiter(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for range 5 {
+		limiter.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected 5 calls at 100/s to take at least 40ms, took %v", elapsed)
+	}
+
+	if unlimited, _ := newRateLimiter(0); unlimited.interval != 0 {
+		t.Errorf("Expected no interval for a rate of 0, got %v", unlimited.interval)
+	}
+	if _, err := newRateLimiter(-1); err == nil {
+		t.Error("Expected an error for a negative rate")
+	}
+}
+
+// TestFollowRotation tests that a followed file is read across a rotation and
+// a truncation, including the missed tail of a plain or gzipped rotated copy
+func TestFollowRotation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	follow := func(path string, fromStart, rotated bool) *follower {
+		f, err := newFollower(ctx, path, fromStart, rotated, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	expectRead := func(f *follower, expected string) {
+		t.Helper()
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(f, buf); err != nil || string(buf) != expected {
+			t.Errorf("Expected to read %q, got %q, %v", expected, buf, err)
+		}
+	}
+	appendFile := func(path, data string) {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(data)
+		file.Close()
+	}
+
+	// Rotation: the rest of the moved file is read before the new file
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(path, "a\n")
+	f := follow(path, true, false)
+	expectRead(f, "a\n")
+	appendFile(path, "b\n")
+	os.Rename(path, path+".1")
+	appendFile(path+".1", "c\n")
+	appendFile(path, "d\n")
+	expectRead(f, "b\nc\nd\n")
+
+	// copytruncate: lines written after the last read end up in the copy
+	for _, rotatedCopy := range []string{"", ".1", ".1.gz"} {
+		path := filepath.Join(t.TempDir(), "app.log")
+		appendFile(path, "line1\nline2\n")
+		f := follow(path, false, rotatedCopy != "")
+
+		copied := "line1\nline2\nline3\n"
+		switch rotatedCopy {
+		case ".1":
+			os.WriteFile(path+".1", []byte(copied), 0o644)
+		case ".1.gz":
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write([]byte(copied))
+			zw.Close()
+			os.WriteFile(path+".1.gz", buf.Bytes(), 0o644)
+		}
+		os.WriteFile(path, []byte("line4\n"), 0o644)
+
+		expected := "line4\n"
+		if rotatedCopy != "" {
+			expected = "line3\nline4\n"
+		}
+		expectRead(f, expected)
+	}
+}
+
+// TestMergeByTimestamp tests merging two files by timestamp: lines without a
+// timestamp stay after their predecessor and equal timestamps keep input order
+func TestMergeByTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "app1.log"), []byte("2024-01-02T10:00:00Z a1\n"+
+		"2024-01-02T10:00:02Z a2 failed\nCaused by: timeout\n2024-01-02T10:00:04Z a3\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "app2.log"), []byte("2024-01-02 11:00:01 +0100 b1\n"+
+		"2024-01-02 11:00:02 +0100 b2\n2024-01-02 11:00:05 +0100 b3\n"), 0o644)
+
+	paths, err := expandInputs(filepath.Join(dir, "app*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit, _ := newLineLimit(10000, policyTruncate)
+	var perInput [][]string
+	for _, path := range paths {
+		lines, err := readLogFile(path, formatText, limit, inputOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		perInput = append(perInput, lines)
+	}
+
+	merged, untimed := mergeByTimestamp(perInput)
+	expected := []string{
+		"2024-01-02T10:00:00Z a1",
+		"2024-01-02 11:00:01 +0100 b1",
+		"2024-01-02T10:00:02Z a2 failed",
+		"Caused by: timeout",
+		"2024-01-02 11:00:02 +0100 b2",
+		"2024-01-02T10:00:04Z a3",
+		"2024-01-02 11:00:05 +0100 b3",
+	}
+	if !slices.Equal(merged, expected) || untimed != 1 {
+		t.Errorf("Expected the interleaved lines with 1 untimed line, got %d:\n%s", untimed, strings.Join(merged, "\n"))
+	}
+
+	if _, err := expandInputs(filepath.Join(dir, "missing*.log")); err == nil {
+		t.Error("Expected an error for a pattern matching no files")
+	}
+}
+
+// TestCSVMessageAssembly tests assembling the message from several CSV columns,
+// joined or with a template
+func TestCSVMessageAssembly(t *testing.T) {
+	const input = "time,level,component,message\n1,ERROR,db,connection lost\n2,INFO,,started\n3,,,\n"
+	limit, _ := newLineLimit(10000, policyTruncate)
+	for _, test := range []struct {
+		columns, template string
+		expected          []string
+	}{
+		{"level,component,message", "", []string{"ERROR db connection lost", "INFO started"}},
+		{" LEVEL , Message", "", []string{"ERROR connection lost", "INFO started"}},
+		{"", "[{level}] {component}: {message}", []string{"[ERROR] db: connection lost", "[INFO] : started", "[] :"}},
+	} {
+		opts := inputOptions{csv: csvOptions{columns: test.columns, template: test.template}}
+		lines, err := readLogs(strings.NewReader(input), formatCSV, limit, opts)
+		if err != nil || !slices.Equal(lines, test.expected) {
+			t.Errorf("%q%q: expected %q, got %q, %v", test.columns, test.template, test.expected, lines, err)
+		}
+	}
+
+	for _, opts := range []csvOptions{{columns: "host,message"}, {template: "{host} {message}"}} {
+		if _, err := readLogs(strings.NewReader(input), formatCSV, limit, inputOptions{csv: opts}); err == nil ||
+			!strings.Contains(err.Error(), "'host' not found") {
+			t.Errorf("%+v: expected an error for the unknown column, got %v", opts, err)
+		}
+	}
+}
+
+// TestCSVNoHeader tests headerless CSV files and selecting columns by number
+func TestCSVNoHeader(t *testing.T) {
+	limit, _ := newLineLimit(10000, policyTruncate)
+	for _, test := range []struct {
+		input    string
+		opts     csvOptions
+		expected []string
+	}{
+		{"1,ERROR,disk full\n2,INFO,disk ok\n", csvOptions{columns: "3", noHeader: true}, []string{"disk full", "disk ok"}},
+		{"1,ERROR,disk full\n2,INFO,disk ok\n", csvOptions{columns: "2,3", noHeader: true}, []string{"ERROR disk full", "INFO disk ok"}},
+		{"1,ERROR,disk full\n", csvOptions{template: "{2}: {3}", noHeader: true}, []string{"ERROR: disk full"}},
+		{"time,message\n1,disk full\n", csvOptions{columns: "2"}, []string{"disk full"}},
+		{"", csvOptions{columns: "1", noHeader: true}, nil},
+	} {
+		lines, err := readLogs(strings.NewReader(test.input), formatCSV, limit, inputOptions{csv: test.opts})
+		if err != nil || !slices.Equal(lines, test.expected) {
+			t.Errorf("%+v: expected %q, got %q, %v", test.opts, test.expected, lines, err)
+		}
+	}
+
+	for _, column := range []string{"0", "4", "level"} {
+		opts := inputOptions{csv: csvOptions{columns: column + ",3", noHeader: true}}
+		if _, err := readLogs(strings.NewReader("1,ERROR,disk full\n"), formatCSV, limit, opts); err == nil ||
+			!strings.Contains(err.Error(), "between 1 and 3") {
+			t.Errorf("Column %s: expected an error for a column outside the file, got %v", column, err)
+		}
+	}
+}
+
+// TestDelimitedDialects tests TSV input and the quote and escape options
+func TestDelimitedDialects(t *testing.T) {
+	limit, _ := newLineLimit(10000, policyTruncate)
+	for _, test := range []struct {
+		format, input         string
+		delimiter, quote, esc string
+		expected              []string
+	}{
+		// TSV keeps quotes literally and decodes backslash escapes
+		{formatTSV, "time\tmessage\n1\tuser \"bob\" logged in\n2\tpath C:\\\\tmp\n3\tline\\nbreak\n", "", "", "",
+			[]string{`user "bob" logged in`, `path C:\tmp`, "line\nbreak"}},
+		{formatTSV, "time\tmessage\n1\t'a\tb'\n", "", "'", "", []string{"a\tb"}},
+		{formatCSV, "time,message\n1,'disk, full'\n2,'it''s ok'\n", "", "'", "", []string{"disk, full", "it's ok"}},
+		{formatCSV, "time,message\n1,\"say \\\"hi\\\"\"\n", "", "", "\\", []string{`say "hi"`}},
+		{formatCSV, "time,message\n1,\"quoted\"\n", "", "none", "", []string{`"quoted"`}},
+		{formatCSV, "time;message\n1;disk full\n", ";", "", "", []string{"disk full"}},
+	} {
+		opts := inputOptions{csv: csvOptions{columns: "message"}, delimiter: test.delimiter, quote: test.quote, escape: test.esc}
+		lines, err := readLogs(strings.NewReader(test.input), test.format, limit, opts)
+		if err != nil || !slices.Equal(lines, test.expected) {
+			t.Errorf("%s %q: expected %q, got %q, %v", test.format, test.input, test.expected, lines, err)
+		}
+	}
+
+	var opts csvOptions
+	for _, flags := range [][3]string{{"ab", "", ""}, {",", ",", ""}, {"", "", ","}} {
+		if err := opts.setDialect(formatCSV, flags[0], flags[1], flags[2]); err == nil {
+			t.Errorf("Expected an error for delimiter %q, quote %q and escape %q", flags[0], flags[1], flags[2])
+		}
+	}
+}
+
+// TestURLInput tests reading inputs over HTTP: request headers, gzip content
+// encoding, format detection from the URL path and error statuses
+func TestURLInput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/export.csv":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, "time,message\n1,disk full\n2,disk ok\n")
+			zw.Close()
+		case "/app.log":
+			io.WriteString(w, "disk full\ndisk ok\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	var headers httpHeaders
+	if err := headers.Set("Authorization: Bearer token"); err != nil {
+		t.Fatal(err)
+	}
+	opts := inputOptions{headers: headers, csv: csvOptions{columns: "message"}}
+	limit, _ := newLineLimit(10000, policyTruncate)
+	for _, path := range []string{"/export.csv?sig=abc", "/app.log"} {
+		lines, err := readLogFile(server.URL+path, formatAuto, limit, opts)
+		if err != nil || !slices.Equal(lines, []string{"disk full", "disk ok"}) {
+			t.Errorf("%s: expected the two messages, got %q, %v", path, lines, err)
+		}
+	}
+
+	if _, err := readLogFile(server.URL+"/missing.log", formatAuto, limit, opts); err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("Expected an error for a missing file, got %v", err)
+	}
+	if _, err := readLogFile(server.URL+"/app.log", formatAuto, limit, inputOptions{}); err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("Expected an error without the header, got %v", err)
+	}
+	if err := headers.Set("no colon"); err == nil {
+		t.Error("Expected an error for a header without a name")
+	}
+}
+
+// TestGCPEntries tests reading Cloud Logging entries from a local server
+// across pages, and error responses
+func TestGCPEntries(t *testing.T) {
+	pages := map[string]string{
+		"": `{"entries": [{"textPayload": "disk full\n"}, {"jsonPayload": {"message": "request failed\n  at handler"}}],
+			"nextPageToken": "p2"}`,
+		"p2": `{"entries": [{"jsonPayload": {"status": 500}}, {"textPayload": "disk ok"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ResourceNames []string `json:"resourceNames"`
+			Filter        string   `json:"filter"`
+			PageToken     string   `json:"pageToken"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		if r.Header.Get("Authorization") != "Bearer token" || request.ResourceNames[0] == "projects/denied" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		if request.Filter != `(severity>=ERROR) AND timestamp>="2024-01-01T00:00:00Z"` {
+			http.Error(w, "unexpected filter "+request.Filter, http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, pages[request.PageToken])
+	}))
+	defer server.Close()
+	defer func(endpoint string) { gcpLoggingEndpoint = endpoint }(gcpLoggingEndpoint)
+	gcpLoggingEndpoint = server.URL
+	t.Setenv("CLOUDSDK_AUTH_ACCESS_TOKEN", "token")
+
+	opts := gcpOptions{filter: "severity>=ERROR", from: "2024-01-01T00:00:00Z"}
+	reader, err := openGCP("gcp://project", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if expected := "disk full\nrequest failed   at handler\ndisk ok\n"; err != nil || string(data) != expected {
+		t.Errorf("Expected the messages of both pages %q, got %q, %v", expected, data, err)
+	}
+
+	reader, _ = openGCP("gcp://denied", opts)
+	if _, err := io.ReadAll(reader); err == nil || !strings.Contains(err.Error(), "403 Forbidden: permission denied") {
+		t.Errorf("Expected the error response, got %v", err)
+	}
+	if _, err := openGCP("gcp://project", gcpOptions{from: "yesterday"}); err == nil {
+		t.Error("Expected an error for an invalid time")
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": {"3"}}}
+	if delay := retryDelay(resp, 0); delay != 3*time.Second {
+		t.Errorf("Expected the Retry-After delay, got %v", delay)
+	}
+	if delay := retryDelay(&http.Response{}, 2); delay != 4*time.Second {
+		t.Errorf("Expected an exponential backoff of 4s, got %v", delay)
+	}
+}
+
+// TestHealthEndpoints tests that /readyz follows the state of serve mode while
+// /healthz keeps reporting the service as alive
+func TestHealthEndpoints(t *testing.T) {
+	queue, _ := newLineQueue(2, overflowBlock)
+	clients, _ := newClientLimiter(0, 0, 0)
+	health := &serveHealth{started: time.Now(), queue: queue, clients: clients}
+	get := func(handler http.HandlerFunc) (int, healthReport) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		var report healthReport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to decode the report: %v", err)
+		}
+		return recorder.Code, report
+	}
+	expectReady := func(step string, reasons ...string) {
+		t.Helper()
+		status := http.StatusOK
+		if len(reasons) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		if code, report := get(health.serveReadyz); code != status || !slices.Equal(report.Reasons, reasons) {
+			t.Errorf("%s: expected /readyz %d with reasons %v, got %d with %v", step, status, reasons, code, report.Reasons)
+		}
+		if code, report := get(health.serveHealthz); code != http.StatusOK || report.Status != "ok" || report.Reasons != nil {
+			t.Errorf("%s: expected /healthz to report ok, got %d with %+v", step, code, report)
+		}
+	}
+
+	expectReady("start")
+	queue.push("disk full")
+	queue.push("disk ok")
+	expectReady("full queue", "queue full")
+	if _, report := get(health.serveHealthz); report.LinesReceived != 2 || report.QueueDepth != 2 || report.QueueCapacity != 2 {
+		t.Errorf("Expected 2 received and queued lines of 2, got %+v", report)
+	}
+	queue.pop()
+	expectReady("drained")
+
+	parser := awsomlp.NewAWSOMLP()
+	health.snapshots = awsomlp.NewSnapshotManager(parser, filepath.Join(t.TempDir(), "state.json"), 0)
+	health.interval = time.Hour
+	if err := health.snapshots.Save(); err != nil {
+		t.Fatal(err)
+	}
+	expectReady("snapshot saved")
+	health.interval = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	expectReady("snapshot outdated", "snapshot outdated")
+
+	health.interval = time.Hour
+	health.inputDone.Store(true)
+	health.stopping.Store(true)
+	expectReady("stopping", "shutting down", "input ended")
+}
+
+// TestMain runs the CLI instead of the tests in the child processes of runCommand
+func TestMain(m *testing.M) {
+	if args := os.Getenv("AWSOM_LP_TEST_ARGS"); args != "" {
+		os.Args = append([]string{"awsom-lp"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs the CLI with args in a child process and returns its
+// standard output and exit code
+func runCommand(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "AWSOM_LP_TEST_ARGS="+strings.Join(args, "\n"))
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), 0
+}
+
+// TestCheckCommand tests writing a golden file and comparing the templates of
+// the input with it
+func TestCheckCommand(t *testing.T) {
+	dir := t.TempDir()
+	input, golden := filepath.Join(dir, "app.log"), filepath.Join(dir, "app.golden")
+	os.WriteFile(input, []byte("User 1 logged in\nUser 2 logged in\nDisk 1 full\nDisk 2 full\n"), 0o644)
+
+	if out, code := runCommand(t, "check", "-input", input, "-golden", golden, "-update"); code != 0 {
+		t.Fatalf("Expected -update to succeed, got exit code %d: %s", code, out)
+	}
+	if data, _ := os.ReadFile(golden); string(data) != "Disk <*> full\nUser <*> logged in\n" {
+		t.Errorf("Expected the sorted templates in the golden file, got %q", data)
+	}
+	if out, code := runCommand(t, "check", "-input", input, "-golden", golden); code != 0 || out != "" {
+		t.Errorf("Expected a match to pass silently, got exit code %d: %s", code, out)
+	}
+
+	os.WriteFile(golden, []byte("Disk <*> full\n\nService <*> started\n"), 0o644)
+	out, code := runCommand(t, "check", "-input", input, "-golden", golden)
+	expected := "--- " + golden + "\n+++ " + input + "\n-Service <*> started\n+User <*> logged in\n" +
+		"2 templates differ from " + golden + " (1 missing, 1 new)\n"
+	if code != 1 || out != expected {
+		t.Errorf("Expected exit code 1 with the diff:\n%s\nGot exit code %d:\n%s", expected, code, out)
+	}
+}
+
+// TestStatsCommand tests the summary of a saved model
+func TestStatsCommand(t *testing.T) {
+	var lines []string
+	for i := range 6 {
+		lines = append(lines, fmt.Sprintf("User %d logged in", i))
+	}
+	for i := range 3 {
+		lines = append(lines, fmt.Sprintf("Disk %d full", i))
+	}
+	lines = append(lines, "Service started")
+	parser := awsomlp.NewAWSOMLP()
+	parser.Parse(lines)
+
+	var state bytes.Buffer
+	if err := parser.ExportState(&state); err != nil {
+		t.Fatal(err)
+	}
+	model := filepath.Join(t.TempDir(), "model.json")
+	os.WriteFile(model, state.Bytes(), 0o644)
+
+	out, code := runCommand(t, "stats", "-model", model, "-top", "2")
+	expected := `Templates: 3
+Lines: 10
+Singletons: 1 (33.3%)
+
+Lines per template:
+  min 1  p50 3  p90 6  p99 6  max 6  mean 3.3
+
+Placeholders per token:
+  0%            1 templates          1 lines
+  1-25%         1 templates          6 lines
+  26-50%        1 templates          3 lines
+  51-75%        0 templates          0 lines
+  76-100%       0 templates          0 lines
+
+Templates covering a share of lines:
+   50%      1 templates
+   80%      2 templates
+   90%      2 templates
+   95%      3 templates
+   99%      3 templates
+  100%      3 templates
+
+Largest templates:
+  [6] User <*> logged in
+  [3] Disk <*> full
+
+Most wildcarded templates:
+  [33%, 3] Disk <*> full
+  [25%, 6] User <*> logged in
+`
+	if code != 0 || out != expected {
+		t.Errorf("Expected the summary:\n%s\nGot exit code %d:\n%s", expected, code, out)
+	}
+
+	state.Reset()
+	awsomlp.NewAWSOMLP().ExportState(&state)
+	os.WriteFile(model, state.Bytes(), 0o644)
+	if out, code := runCommand(t, "stats", "-model", model); code != 0 || out != "The model has no templates\n" {
+		t.Errorf("Expected an empty model to be reported, got exit code %d: %s", code, out)
+	}
+	if _, code := runCommand(t, "stats", "-model", filepath.Join(t.TempDir(), "missing.json")); code != 1 {
+		t.Errorf("Expected exit code 1 for a missing model, got %d", code)
+	}
+}
+
+// TestPrettyOutput tests the highlighted placeholders, aligned counts and cut
+// templates of -pretty, and that colors are left out when the output is not a
+// terminal or NO_COLOR is set
+func TestPrettyOutput(t *testing.T) {
+	stats := []awsomlp.TemplateCount{{Template: "User <*> logged in", Count: 30}, {Template: "Service started", Count: 5}}
+	var out bytes.Buffer
+	prettyWriter{color: true}.write(&out, stats, 40)
+	expected := "\x1b[1m30\x1b[0m  \x1b[2m 75.0%\x1b[0m  User \x1b[36m<*>\x1b[0m logged in\n" +
+		"\x1b[1m 5\x1b[0m  \x1b[2m 12.5%\x1b[0m  Service started\n"
+	if out.String() != expected {
+		t.Errorf("Expected highlighted output %q, got %q", expected, out.String())
+	}
+
+	out.Reset()
+	prettyWriter{}.write(&out, stats, 40)
+	if expected := "30   75.0%  User <*> logged in\n 5   12.5%  Service started\n"; out.String() != expected {
+		t.Errorf("Expected plain output %q, got %q", expected, out.String())
+	}
+
+	long := strings.Repeat("a", prettyWidth+10)
+	if cut := (prettyWriter{}).template(long); cut != long[:prettyWidth-1]+"…" {
+		t.Errorf("Expected the template to be cut to %d characters, got %q", prettyWidth, cut)
+	}
+	if full := (prettyWriter{expand: true}).template(long); full != long {
+		t.Errorf("Expected the expanded template in full, got %q", full)
+	}
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if newPrettyWriter(file, false, false, nil).color {
+		t.Error("Expected no colors for output to a file")
+	}
+	input := filepath.Join(t.TempDir(), "app.log")
+	os.WriteFile(input, []byte("User 1 logged in\nUser 2 logged in\n"), 0o644)
+	if output, code := runCommand(t, "-input", input, "-pretty"); code != 0 || strings.Contains(output, "\x1b") ||
+		!strings.Contains(output, "User <*> logged in") {
+		t.Errorf("Expected plain -pretty output through a pipe, got exit code %d: %q", code, output)
+	}
+
+	t.Setenv("NO_COLOR", "1")
+	if newPrettyWriter(os.Stdout, false, false, nil).color {
+		t.Error("Expected no colors with NO_COLOR")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampSearchBytes limits the timestamp search to the beginning of a line,
+// so that times quoted in the message are not mistaken for the line's timestamp
+const timestampSearchBytes = 64
+
+// timestampFormat recognizes one common log timestamp notation
+type timestampFormat struct {
+	re    *regexp.Regexp
+	parse func(match []string) (time.Time, error)
+}
+
+// timestampFormats are tried in order on the beginning of every line
+var timestampFormats = []timestampFormat{
+	{ // ISO 8601: 2024-01-02T15:04:05.123Z, 2024-01-02 15:04:05,123 +0100
+		regexp.MustCompile(`(\d{4}-\d{2}-\d{2})[T ](\d{2}:\d{2}:\d{2})(?:[.,](\d{1,9}))?\s?(Z|[+-]\d{2}:?\d{2})?`),
+		func(m []string) (time.Time, error) {
+			t, err := time.Parse("2006-01-02 15:04:05", m[1]+" "+m[2])
+			if err != nil {
+				return t, err
+			}
+			if m[3] != "" {
+				nanos, _ := strconv.Atoi((m[3] + "000000000")[:9])
+				t = t.Add(time.Duration(nanos))
+			}
+			if zone := strings.ReplaceAll(m[4], ":", ""); zone != "" && zone != "Z" {
+				offset, err := time.Parse("-0700", zone)
+				if err != nil {
+					return t, err
+				}
+				_, seconds := offset.Zone()
+				t = t.Add(-time.Duration(seconds) * time.Second)
+			}
+			return t, nil
+		},
+	},
+	{ // Apache/NCSA: 02/Jan/2006:15:04:05 -0700
+		regexp.MustCompile(`\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`),
+		func(m []string) (time.Time, error) {
+			return time.Parse("02/Jan/2006:15:04:05 -0700", m[0])
+		},
+	},
+	{ // Syslog without a year: Jan  2 15:04:05
+		regexp.MustCompile(`^[A-Z][a-z]{2} {1,2}\d{1,2} \d{2}:\d{2}:\d{2}`),
+		func(m []string) (time.Time, error) {
+			return time.Parse("Jan _2 15:04:05", m[0])
+		},
+	},
+	{ // Compact date and time as in HDFS logs: 081109 203615
+		regexp.MustCompile(`^\d{6} \d{6}\b`),
+		func(m []string) (time.Time, error) {
+			return time.Parse("060102 150405", m[0])
+		},
+	},
+	{ // Unix epoch seconds: 1704207845.123
+		regexp.MustCompile(`^1\d{9}(?:\.(\d{1,9}))?\b`),
+		func(m []string) (time.Time, error) {
+			seconds, _ := strconv.ParseInt(m[0][:10], 10, 64)
+			var nanos int
+			if m[1] != "" {
+				nanos, _ = strconv.Atoi((m[1] + "000000000")[:9])
+			}
+			return time.Unix(seconds, int64(nanos)).UTC(), nil
+		},
+	},
+}
+
+// parseTimestamp extracts the timestamp at the beginning of a log line.
+// Timestamps without a time zone are taken as UTC, so all merged files must
+// log in the same zone.
+func parseTimestamp(line string) (time.Time, bool) {
+	if len(line) > timestampSearchBytes {
+		line = line[:timestampSearchBytes]
+	}
+	for _, format := range timestampFormats {
+		match := format.re.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if t, err := format.parse(match); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// timedLines are the lines of one input with the timestamp of every line
+type timedLines struct {
+	input int // Position of the input in the merged list
+	lines []string
+	times []time.Time
+	next  int // Index of the next line to merge
+}
+
+// newTimedLines timestamps the lines of one input. Lines without a timestamp,
+// such as stack trace continuations, take the timestamp of the line before them;
+// the number of lines without a timestamp of their own is returned.
+func newTimedLines(input int, lines []string) (*timedLines, int) {
+	timed := &timedLines{input: input, lines: lines, times: make([]time.Time, len(lines))}
+	var last time.Time
+	var untimed int
+	for i, line := range lines {
+		if t, ok := parseTimestamp(line); ok {
+			last = t
+		} else {
+			untimed++
+		}
+		timed.times[i] = last
+	}
+	return timed, untimed
+}
+
+// mergeHeap orders inputs by the timestamp of their next line, then by input order
+type mergeHeap []*timedLines
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	ti, tj := h[i].times[h[i].next], h[j].times[h[j].next]
+	if ti.Equal(tj) {
+		return h[i].input < h[j].input
+	}
+	return ti.Before(tj)
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*timedLines)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeByTimestamp merges the lines of several inputs into one chronological
+// stream. Every input is expected to be in chronological order already: its
+// lines are never reordered, only interleaved with the lines of the others.
+func mergeByTimestamp(inputs [][]string) (merged []string, untimed int) {
+	h := make(mergeHeap, 0, len(inputs))
+	total := 0
+	for i, lines := range inputs {
+		timed, n := newTimedLines(i, lines)
+		untimed += n
+		total += len(lines)
+		if len(lines) > 0 {
+			h = append(h, timed)
+		}
+	}
+	heap.Init(&h)
+
+	merged = make([]string, 0, total)
+	for h.Len() > 0 {
+		timed := h[0]
+		merged = append(merged, timed.lines[timed.next])
+		timed.next++
+		if timed.next == len(timed.lines) {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return merged, untimed
+}
+
+// expandInputs splits a comma-separated list of input files and remote sources
+// and expands glob patterns in local file paths
+func expandInputs(list string) ([]string, error) {
+	var paths []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if isRemote(item) || !strings.ContainsAny(item, "*?[") {
+			paths = append(paths, item)
+			continue
+		}
+		matches, err := filepath.Glob(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %s: %w", item, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no input files match %s", item)
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no input files")
+	}
+	return paths, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// MQTT session parameters
+const (
+	mqttKeepAlive     = 30 * time.Second
+	mqttMaxBackoff    = 30 * time.Second
+	mqttMaxPacketSize = 16 << 20 // Larger packets are rejected instead of allocated
+)
+
+// mqttOptions configures the MQTT subscriber
+type mqttOptions struct {
+	broker   string // mqtt://[user[:password]@]host[:port] or mqtts:// for TLS
+	topic    string // Topic filter, may contain + and # wildcards
+	qos      int    // Requested QoS: 0, 1 or 2
+	clientID string // Empty for a random client ID
+}
+
+// mqttReader subscribes to a topic filter and yields the payload of every
+// received message as a line. Lost connections are re-established with backoff.
+// Cancelling the context ends the session, and Read then returns io.EOF.
+type mqttReader struct {
+	ctx  context.Context
+	opts mqttOptions
+	addr *url.URL
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex      // Serializes writes of the reader, the keep-alive pinger and the cancellation
+	stop    func()          // Stops the pinger and the cancellation hook of the current connection
+	qos2    map[uint16]bool // QoS 2 packet IDs delivered but not yet released
+	buf     []byte          // Pending output
+}
+
+// newMQTTReader validates the options and connects to the broker
+func newMQTTReader(ctx context.Context, opts mqttOptions) (*mqttReader, error) {
+	addr, err := url.Parse(opts.broker)
+	if err != nil || (addr.Scheme != "mqtt" && addr.Scheme != "mqtts") || addr.Hostname() == "" {
+		return nil, fmt.Errorf("invalid MQTT broker %s (want mqtt://host[:port] or mqtts://host[:port])", opts.broker)
+	}
+	if opts.topic == "" {
+		return nil, fmt.Errorf("MQTT topic filter is required")
+	}
+	if opts.qos < 0 || opts.qos > 2 {
+		return nil, fmt.Errorf("MQTT QoS must be 0, 1 or 2, got %d", opts.qos)
+	}
+	if opts.clientID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		opts.clientID = "awsom-lp-" + hex.EncodeToString(id)
+	}
+
+	r := &mqttReader{ctx: ctx, opts: opts, addr: addr}
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Read implements io.Reader
+func (r *mqttReader) Read(p []byte) (int, error) {
+	for backoff := time.Second; len(r.buf) == 0; {
+		if r.ctx.Err() != nil {
+			return 0, io.EOF
+		}
+		if r.conn == nil {
+			if err := r.connect(); err != nil {
+				log.Printf("Error connecting to MQTT broker: %v (retrying in %s)", err, backoff)
+				if !r.sleep(backoff) {
+					return 0, io.EOF
+				}
+				backoff = min(2*backoff, mqttMaxBackoff)
+				continue
+			}
+			backoff = time.Second
+		}
+		if err := r.receive(); err != nil {
+			if r.ctx.Err() != nil {
+				return 0, io.EOF
+			}
+			log.Printf("MQTT connection lost: %v", err)
+			r.disconnect()
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// sleep waits for d unless the context is cancelled first
+func (r *mqttReader) sleep(d time.Duration) bool {
+	select {
+	case <-r.ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// connect opens a clean session and subscribes to the topic filter
+func (r *mqttReader) connect() error {
+	host := r.addr.Host
+	if r.addr.Port() == "" {
+		port := "1883"
+		if r.addr.Scheme == "mqtts" {
+			port = "8883"
+		}
+		host = net.JoinHostPort(r.addr.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if r.addr.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: r.addr.Hostname()})
+	} else {
+		conn, err = dialer.DialContext(r.ctx, "tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn, r.reader, r.qos2 = conn, bufio.NewReader(conn), make(map[uint16]bool)
+
+	// CONNECT with a clean session
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	flags := byte(0x02)
+	if user := r.addr.User; user != nil {
+		flags |= 0x80
+		if _, ok := user.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = appendMQTTString(body, r.opts.clientID)
+	if user := r.addr.User; user != nil {
+		body = appendMQTTString(body, user.Username())
+		if password, ok := user.Password(); ok {
+			body = appendMQTTString(body, password)
+		}
+	}
+	if err := r.write(conn, mqttConnect<<4, body); err != nil {
+		r.disconnect()
+		return err
+	}
+	kind, body, err := r.readPacket()
+	if err == nil && (kind>>4 != mqttConnack || len(body) < 2) {
+		err = fmt.Errorf("unexpected packet type %d instead of CONNACK", kind>>4)
+	} else if err == nil && body[1] != 0 {
+		err = fmt.Errorf("connection refused with return code %d", body[1])
+	}
+	if err != nil {
+		r.disconnect()
+		return err
+	}
+
+	// SUBSCRIBE, waiting for the SUBACK
+	body = binary.BigEndian.AppendUint16(nil, 1)
+	body = appendMQTTString(body, r.opts.topic)
+	body = append(body, byte(r.opts.qos))
+	if err := r.write(conn, mqttSubscribe<<4|0x02, body); err != nil {
+		r.disconnect()
+		return err
+	}
+	for {
+		if err := r.receivePacket(func(kind byte, body []byte) error {
+			if kind>>4 != mqttSuback {
+				return nil
+			}
+			if len(body) < 3 || body[2] == 0x80 {
+				return fmt.Errorf("subscription to %s refused", r.opts.topic)
+			}
+			return errSubscribed
+		}); err != nil {
+			if errors.Is(err, errSubscribed) {
+				break
+			}
+			r.disconnect()
+			return err
+		}
+	}
+
+	// Keep the session alive, and end it when the context is cancelled
+	done := make(chan struct{})
+	go r.ping(conn, done)
+	stopHook := context.AfterFunc(r.ctx, func() {
+		r.write(conn, mqttDisconnect<<4, nil)
+		conn.Close()
+	})
+	r.stop = func() {
+		close(done)
+		stopHook()
+	}
+	return nil
+}
+
+// errSubscribed ends the wait for the SUBACK
+var errSubscribed = errors.New("subscribed")
+
+// ping sends a PINGREQ every keep-alive interval until done is closed
+func (r *mqttReader) ping(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(mqttKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.write(conn, mqttPingreq<<4, nil)
+		}
+	}
+}
+
+// receive handles one packet, buffering the payload of a PUBLISH
+func (r *mqttReader) receive() error {
+	return r.receivePacket(func(byte, []byte) error { return nil })
+}
+
+// receivePacket reads a packet and acknowledges messages; other packets are passed to handle
+func (r *mqttReader) receivePacket(handle func(kind byte, body []byte) error) error {
+	kind, body, err := r.readPacket()
+	if err != nil {
+		return err
+	}
+	switch kind >> 4 {
+	case mqttPublish:
+		return r.publish(kind, body)
+	case mqttPubrel:
+		if len(body) < 2 {
+			return fmt.Errorf("malformed PUBREL")
+		}
+		delete(r.qos2, binary.BigEndian.Uint16(body))
+		return r.write(r.conn, mqttPubcomp<<4, body[:2])
+	case mqttPingresp:
+		return nil
+	default:
+		return handle(kind, body)
+	}
+}
+
+// publish buffers a message and acknowledges it according to its QoS
+func (r *mqttReader) publish(kind byte, body []byte) error {
+	if len(body) < 2 {
+		return fmt.Errorf("malformed PUBLISH")
+	}
+	offset := 2 + int(binary.BigEndian.Uint16(body))
+	qos := (kind >> 1) & 0x03
+	if qos > 0 {
+		offset += 2
+	}
+	if offset > len(body) {
+		return fmt.Errorf("malformed PUBLISH")
+	}
+	payload := body[offset:]
+
+	deliver := true
+	switch qos {
+	case 1:
+		if err := r.write(r.conn, mqttPuback<<4, body[offset-2:offset]); err != nil {
+			return err
+		}
+	case 2:
+		id := binary.BigEndian.Uint16(body[offset-2:])
+		deliver = !r.qos2[id] // Redelivered before our PUBREC arrived
+		r.qos2[id] = true
+		if err := r.write(r.conn, mqttPubrec<<4, body[offset-2:offset]); err != nil {
+			return err
+		}
+	}
+	if deliver && len(payload) > 0 {
+		r.buf = append(append(r.buf, payload...), '\n')
+	}
+	return nil
+}
+
+// readPacket reads a control packet, failing if the broker is silent past the keep-alive
+func (r *mqttReader) readPacket() (kind byte, body []byte, err error) {
+	r.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+	if kind, err = r.reader.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	var length int
+	for shift := 0; ; shift += 7 {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if shift > 21 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacketSize {
+		return 0, nil, fmt.Errorf("packet of %d bytes exceeds %d", length, mqttMaxPacketSize)
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return kind, body, nil
+}
+
+// write sends a control packet
+func (r *mqttReader) write(conn net.Conn, kind byte, body []byte) error {
+	packet := []byte{kind}
+	for length := len(body); ; {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(mqttKeepAlive))
+	_, err := conn.Write(packet)
+	return err
+}
+
+// disconnect closes the current connection
+func (r *mqttReader) disconnect() {
+	if r.stop != nil {
+		r.stop()
+		r.stop = nil
+	}
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// appendMQTTString appends a length-prefixed UTF-8 string
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
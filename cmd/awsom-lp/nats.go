@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATS JetStream consumer parameters
+const (
+	natsPullBatch  = 100              // Messages per pull request
+	natsPullExpiry = 5 * time.Second  // Lifetime of a pull request, bounds the reaction to cancellation
+	natsAckWait    = 5 * time.Minute  // Redelivery delay of unacknowledged messages, covers the line queue
+	natsTimeout    = 10 * time.Second // Dial and API request timeout
+	natsMaxPayload = 64 << 20         // Larger messages are rejected instead of allocated
+)
+
+// natsOptions configures the JetStream consumer
+type natsOptions struct {
+	server   string // nats://[user:password@|token@]host[:port] or tls:// for TLS
+	stream   string // JetStream stream name
+	durable  string // Durable consumer name, created if missing
+	subject  string // Optional filter subject within the stream
+	clientID string // Connection name
+}
+
+// natsMsg is a message delivered to the consumer inbox
+type natsMsg struct {
+	subject string
+	reply   string
+	status  string // Status code of a header-only status message, e.g. 408 when a pull request expired
+	data    []byte
+}
+
+// natsConn is a minimal NATS client connection with a single inbox subscription
+type natsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	inbox   string // Reply subject prefix, subscribed with a wildcard
+}
+
+// dialNATS connects, authenticates from the URL and subscribes to a private inbox
+func dialNATS(ctx context.Context, opts natsOptions) (*natsConn, error) {
+	addr, err := url.Parse(opts.server)
+	if err != nil || (addr.Scheme != "nats" && addr.Scheme != "tls") || addr.Hostname() == "" {
+		return nil, fmt.Errorf("invalid NATS server %s (want nats://host[:port] or tls://host[:port])", opts.server)
+	}
+	host := addr.Host
+	if addr.Port() == "" {
+		host = net.JoinHostPort(addr.Hostname(), "4222")
+	}
+	dialer := &net.Dialer{Timeout: natsTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	// The server greets with INFO; TLS starts after it
+	conn.SetReadDeadline(time.Now().Add(natsTimeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting %q: %v", strings.TrimSpace(line), err)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+	}
+	json.Unmarshal([]byte(line[5:]), &info)
+	if !info.Headers {
+		conn.Close()
+		return nil, fmt.Errorf("NATS server does not support headers, JetStream needs version 2.2 or later")
+	}
+	if addr.Scheme == "tls" || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: addr.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+	c.conn.SetReadDeadline(time.Time{})
+
+	connect := map[string]any{
+		"verbose": false, "pedantic": false, "headers": true, "no_responders": true,
+		"lang": "go", "version": "awsom-lp", "protocol": 1, "name": opts.clientID,
+	}
+	if user := addr.User; user != nil {
+		if password, ok := user.Password(); ok {
+			connect["user"], connect["pass"] = user.Username(), password
+		} else {
+			connect["auth_token"] = user.Username()
+		}
+	}
+	body, _ := json.Marshal(connect)
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	c.inbox = "_INBOX." + hex.EncodeToString(id)
+	if err := c.write("CONNECT "+string(body)+"\r\nSUB "+c.inbox+".* 1\r\nPING\r\n", nil); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	// PONG confirms the connection; authentication errors arrive as -ERR first
+	c.conn.SetReadDeadline(time.Now().Add(natsTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return c, nil
+		case strings.HasPrefix(line, "-ERR"):
+			c.conn.Close()
+			return nil, fmt.Errorf("NATS: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// write sends a protocol line followed by an optional payload
+func (c *natsConn) write(line string, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	if _, err := io.WriteString(c.conn, line); err != nil {
+		return err
+	}
+	if payload == nil {
+		return nil
+	}
+	_, err := c.conn.Write(append(payload, '\r', '\n'))
+	return err
+}
+
+// publish sends a message with an optional reply subject
+func (c *natsConn) publish(subject, reply string, data []byte) error {
+	line := "PUB " + subject
+	if reply != "" {
+		line += " " + reply
+	}
+	return c.write(line+" "+strconv.Itoa(len(data))+"\r\n", data)
+}
+
+// next reads protocol operations until a message arrives, answering pings
+func (c *natsConn) next() (natsMsg, error) {
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return natsMsg{}, err
+		}
+		line = strings.TrimSpace(line)
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "PING":
+			if err := c.write("PONG\r\n", nil); err != nil {
+				return natsMsg{}, err
+			}
+		case "-ERR":
+			return natsMsg{}, fmt.Errorf("NATS: %s", strings.TrimSpace(args))
+		case "MSG", "HMSG":
+			return c.readMsg(strings.ToUpper(op) == "HMSG", strings.Fields(args))
+		}
+	}
+}
+
+// readMsg reads the payload of a MSG (subject sid [reply] size) or an
+// HMSG (subject sid [reply] header-size total-size)
+func (c *natsConn) readMsg(headers bool, fields []string) (natsMsg, error) {
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(fields) < 2+sizes || len(fields) > 3+sizes {
+		return natsMsg{}, fmt.Errorf("malformed NATS message header %v", fields)
+	}
+	msg := natsMsg{subject: fields[0]}
+	if len(fields) == 3+sizes {
+		msg.reply = fields[2]
+	}
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || total < 0 || total > natsMaxPayload {
+		return natsMsg{}, fmt.Errorf("malformed NATS message size %v", fields)
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize < 0 || headerSize > total {
+			return natsMsg{}, fmt.Errorf("malformed NATS header size %v", fields)
+		}
+	}
+
+	data := make([]byte, total+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return natsMsg{}, err
+	}
+	if headers {
+		// A status message has no payload and a status line like "NATS/1.0 408 Request Timeout"
+		status, _, _ := strings.Cut(string(data[:headerSize]), "\r\n")
+		if parts := strings.Fields(status); len(parts) > 1 && headerSize == total {
+			msg.status = parts[1]
+		}
+	}
+	msg.data = data[headerSize:total]
+	return msg, nil
+}
+
+// request publishes a JetStream API request and waits for its reply
+func (c *natsConn) request(subject string, body []byte) ([]byte, error) {
+	reply := c.inbox + ".api"
+	if err := c.publish(subject, reply, body); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(natsTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		msg, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if msg.subject != reply {
+			continue
+		}
+		if msg.status == "503" {
+			return nil, fmt.Errorf("JetStream is not enabled on the NATS server")
+		}
+		return msg.data, nil
+	}
+}
+
+// readNATS consumes a JetStream stream through a durable pull consumer into the
+// queue, acknowledging every message once its line is parsed, until the context
+// is cancelled
+func readNATS(ctx context.Context, opts natsOptions, queue *lineQueue, limit *lineLimit) error {
+	defer queue.close()
+
+	if opts.stream == "" {
+		return fmt.Errorf("-nats-stream is required")
+	}
+	conn, err := dialNATS(ctx, opts)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.conn.Close() })
+	defer stop()
+	defer conn.conn.Close()
+
+	// Create the durable consumer, or reuse it with its delivery state
+	config := map[string]any{
+		"durable_name": opts.durable,
+		"ack_policy":   "explicit",
+		"ack_wait":     natsAckWait.Nanoseconds(),
+	}
+	if opts.subject != "" {
+		config["filter_subject"] = opts.subject
+	}
+	body, _ := json.Marshal(map[string]any{"stream_name": opts.stream, "config": config})
+	reply, err := conn.request("$JS.API.CONSUMER.DURABLE.CREATE."+opts.stream+"."+opts.durable, body)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &created); err != nil {
+		return fmt.Errorf("JetStream: %w", err)
+	}
+	if created.Error != nil {
+		return fmt.Errorf("JetStream: creating consumer %s: %s", opts.durable, created.Error.Description)
+	}
+
+	pull, _ := json.Marshal(map[string]any{"batch": natsPullBatch, "expires": natsPullExpiry.Nanoseconds()})
+	pullSubject := "$JS.API.CONSUMER.MSG.NEXT." + opts.stream + "." + opts.durable
+	pullReply := conn.inbox + ".pull"
+	for lineNo := 1; ctx.Err() == nil; {
+		if err := conn.publish(pullSubject, pullReply, pull); err != nil {
+			return err
+		}
+		// Read until the batch is complete or the pull request ends with a status
+		for received := 0; received < natsPullBatch; {
+			msg, err := conn.next()
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if msg.subject != pullReply {
+				continue
+			}
+			if msg.status != "" {
+				break
+			}
+			received++
+
+			ack := func() { conn.publish(msg.reply, "", []byte("+ACK")) }
+			line := newlineReplacer.Replace(strings.TrimSpace(string(msg.data)))
+			if line == "" {
+				ack()
+				continue
+			}
+			text, ok, limitErr := limit.apply(line, lineNo)
+			lineNo++
+			if limitErr != nil {
+				return limitErr
+			}
+			if !ok {
+				ack()
+				continue
+			}
+			queue.pushAcked(text, ack)
+		}
+	}
+	return nil
+}
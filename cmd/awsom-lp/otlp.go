@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// OTLP protocols for -otlp-protocol
+const (
+	otlpHTTP = "http/protobuf" // POST of the protobuf request to <endpoint>/v1/logs
+	otlpGRPC = "grpc"          // LogsService/Export over HTTP/2, cleartext for http:// endpoints
+)
+
+// OTLP exporter parameters
+const (
+	otlpBatchSize     = 512               // Records per export request
+	otlpBatchInterval = time.Second       // Maximum delay of a record
+	otlpQueueSize     = 4 * otlpBatchSize // Records waiting for export before parsing waits
+	otlpMaxRetries    = 5                 // Attempts after the first for a retryable failure
+	otlpTimeout       = 10 * time.Second  // Timeout of one export request
+	otlpGRPCMethod    = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+// otlpOptions configures the OTLP exporter
+type otlpOptions struct {
+	endpoint string      // Collector URL, e.g. http://localhost:4318 (http/protobuf) or http://localhost:4317 (grpc)
+	protocol string      // otlpHTTP or otlpGRPC
+	headers  httpHeaders // Extra request headers, e.g. for authentication
+	service  string      // service.name resource attribute
+}
+
+// registerOTLPFlags defines the OTLP exporter flags on fs
+func registerOTLPFlags(fs *flag.FlagSet) *otlpOptions {
+	opts := &otlpOptions{}
+	fs.StringVar(&opts.endpoint, "otlp", "", "Export every parsed line as an OTLP log record to this OpenTelemetry Collector URL, e.g. http://localhost:4318")
+	fs.StringVar(&opts.protocol, "otlp-protocol", otlpHTTP, "OTLP protocol: http/protobuf or grpc")
+	fs.Var(&opts.headers, "otlp-header", "Header sent with OTLP requests, e.g. \"Authorization: Bearer <token>\" (repeatable)")
+	fs.StringVar(&opts.service, "otlp-service", "awsom-lp", "service.name resource attribute of exported log records")
+	return opts
+}
+
+// otlpRecord is a parsed line to export as a LogRecord
+type otlpRecord struct {
+	raw       string
+	fields    map[string]string // Header fields, exported as attributes
+	namespace string            // Exported as an attribute if not empty
+	eventID   int
+	template  string
+	params    []string
+	observed  time.Time
+}
+
+// otlpExporter sends records to an OpenTelemetry Collector in batches from a
+// background goroutine. A batch that still fails after retries is dropped with
+// an error message, so an unreachable collector does not stop parsing for longer
+// than the retries take.
+type otlpExporter struct {
+	opts    otlpOptions
+	url     string
+	client  *http.Client
+	records chan otlpRecord
+	stop    chan struct{} // Closed by Close
+	done    chan struct{} // Closed when the queued records are sent
+	once    sync.Once
+	failed  atomic.Int64 // Batches dropped after failing
+}
+
+// newOTLPExporter validates the options and starts the exporter
+func newOTLPExporter(opts otlpOptions) (*otlpExporter, error) {
+	endpoint, err := url.Parse(opts.endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %s (want http://host:port or https://host:port)", opts.endpoint)
+	}
+
+	e := &otlpExporter{
+		opts:    opts,
+		client:  &http.Client{Timeout: otlpTimeout},
+		records: make(chan otlpRecord, otlpQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	switch opts.protocol {
+	case otlpHTTP:
+		// Like OTEL_EXPORTER_OTLP_ENDPOINT, a base URL gets the signal path appended
+		e.url = strings.TrimSuffix(opts.endpoint, "/")
+		if !strings.HasSuffix(endpoint.Path, "/v1/logs") {
+			e.url += "/v1/logs"
+		}
+	case otlpGRPC:
+		e.url = strings.TrimSuffix(opts.endpoint, "/") + otlpGRPCMethod
+		if endpoint.Scheme == "http" {
+			transport, err := h2cTransport()
+			if err != nil {
+				return nil, err
+			}
+			e.client.Transport = transport
+		} else {
+			e.client.Transport = &http.Transport{ForceAttemptHTTP2: true}
+		}
+	default:
+		return nil, fmt.Errorf("invalid OTLP protocol: %s (use %s or %s)", opts.protocol, otlpHTTP, otlpGRPC)
+	}
+
+	go e.run()
+	return e, nil
+}
+
+// export queues a record, waiting while the queue is full. Records exported
+// after Close are dropped.
+func (e *otlpExporter) export(record otlpRecord) {
+	select {
+	case e.records <- record:
+	case <-e.stop:
+	}
+}
+
+// Close sends the queued records and stops the exporter
+func (e *otlpExporter) Close() {
+	e.once.Do(func() { close(e.stop) })
+	<-e.done
+}
+
+// run collects records into batches, sent when full or after the batch interval
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpBatchInterval)
+	defer ticker.Stop()
+
+	batch := make([]otlpRecord, 0, otlpBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			e.failed.Add(1)
+			log.Printf("Error exporting %d log records to %s: %v", len(batch), e.opts.endpoint, err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-e.stop:
+			// Send what is queued, then stop
+			for {
+				select {
+				case record := <-e.records:
+					batch = append(batch, record)
+					if len(batch) == otlpBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case record := <-e.records:
+			batch = append(batch, record)
+			if len(batch) == otlpBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send exports a batch, retrying throttled and unavailable responses with backoff
+func (e *otlpExporter) send(batch []otlpRecord) error {
+	body := encodeLogsRequest(batch, e.opts.service)
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := e.post(body)
+		if err == nil || !retry || attempt == otlpMaxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one export request and reports whether a failure is worth retrying
+func (e *otlpExporter) post(body []byte) (retry bool, err error) {
+	if e.opts.protocol == otlpGRPC {
+		// Length-prefixed message without compression
+		framed := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(framed[1:], uint32(len(body)))
+		body = append(framed, body...)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for _, header := range e.opts.headers {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if e.opts.protocol == otlpGRPC {
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	io.Copy(io.Discard, resp.Body) // Trailers are available after the body
+
+	if e.opts.protocol == otlpGRPC && resp.StatusCode == http.StatusOK {
+		// The status is in the trailers, or in the headers of a trailers-only response
+		status := resp.Trailer.Get("Grpc-Status")
+		message := resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		switch status {
+		case "0":
+			return false, nil
+		case "8", "14": // RESOURCE_EXHAUSTED, UNAVAILABLE
+			return true, fmt.Errorf("gRPC status %s: %s", status, message)
+		default:
+			return false, fmt.Errorf("gRPC status %s: %s", status, message)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return false, nil
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, errors.New(resp.Status)
+	default:
+		return false, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// Severity numbers of the OpenTelemetry log data model by level name
+var otlpSeverities = map[string]int{
+	"TRACE": 1, "DEBUG": 5, "INFO": 9, "NOTICE": 10, "WARN": 13, "WARNING": 13,
+	"ERROR": 17, "ERR": 17, "SEVERE": 17, "CRITICAL": 21, "CRIT": 21, "FATAL": 21, "ALERT": 22, "EMERG": 23,
+}
+
+// encodeLogsRequest encodes an ExportLogsServiceRequest with one resource and scope
+func encodeLogsRequest(batch []otlpRecord, service string) []byte {
+	var scope otlpBuffer
+	scope.string(1, "awsom-lp") // InstrumentationScope.name
+
+	var scopeLogs otlpBuffer
+	scopeLogs.bytes(1, scope)
+	for _, record := range batch {
+		scopeLogs.bytes(2, encodeLogRecord(record))
+	}
+
+	var resource otlpBuffer
+	resource.bytes(1, encodeKeyValue("service.name", stringValue(service)))
+
+	var resourceLogs otlpBuffer
+	resourceLogs.bytes(1, resource)
+	resourceLogs.bytes(2, scopeLogs)
+
+	var request otlpBuffer
+	request.bytes(1, resourceLogs)
+	return request
+}
+
+// encodeLogRecord encodes a LogRecord with the line as body and the parse result as attributes
+func encodeLogRecord(record otlpRecord) []byte {
+	var b otlpBuffer
+	if t, ok := parseTimestamp(record.raw); ok {
+		b.fixed64(1, uint64(t.UnixNano()))
+	}
+	if level := record.fields["level"]; level != "" {
+		b.varint(2, uint64(otlpSeverities[strings.ToUpper(level)]))
+		b.string(3, level)
+	}
+	b.bytes(5, stringValue(record.raw))
+
+	for _, name := range sortedNames(record.fields) {
+		b.bytes(6, encodeKeyValue(name, stringValue(record.fields[name])))
+	}
+	if record.namespace != "" {
+		b.bytes(6, encodeKeyValue("awsomlp.namespace", stringValue(record.namespace)))
+	}
+	b.bytes(6, encodeKeyValue("awsomlp.event_id", intValue(int64(record.eventID))))
+	b.bytes(6, encodeKeyValue("awsomlp.template", stringValue(record.template)))
+	var params otlpBuffer // ArrayValue
+	for _, param := range record.params {
+		params.bytes(1, stringValue(param))
+	}
+	var paramsValue otlpBuffer
+	paramsValue.bytes(5, params)
+	b.bytes(6, encodeKeyValue("awsomlp.params", paramsValue))
+
+	b.fixed64(11, uint64(record.observed.UnixNano()))
+	return b
+}
+
+// encodeKeyValue encodes a KeyValue attribute
+func encodeKeyValue(key string, value []byte) []byte {
+	var b otlpBuffer
+	b.string(1, key)
+	b.bytes(2, value)
+	return b
+}
+
+// stringValue encodes an AnyValue holding a string
+func stringValue(s string) []byte {
+	var b otlpBuffer
+	b.bytes(1, []byte(s)) // Set even when empty, so the value is not absent
+	return b
+}
+
+// intValue encodes an AnyValue holding an integer
+func intValue(v int64) []byte {
+	var b otlpBuffer
+	b.tag(3, 0)
+	b = binary.AppendUvarint(b, uint64(v))
+	return b
+}
+
+// sortedNames returns the keys of a field map in order, for a stable encoding
+func sortedNames(fields map[string]string) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// otlpBuffer appends protobuf fields to a byte slice
+type otlpBuffer []byte
+
+func (b *otlpBuffer) tag(field, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wireType))
+}
+
+func (b *otlpBuffer) varint(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, 0)
+		*b = binary.AppendUvarint(*b, v)
+	}
+}
+
+func (b *otlpBuffer) fixed64(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, 1)
+		*b = binary.LittleEndian.AppendUint64(*b, v)
+	}
+}
+
+func (b *otlpBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *otlpBuffer) string(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+// exportEvents exports parsed events in input order and waits until they are sent
+func exportEvents(exporter *otlpExporter, events []*awsomlp.LogEvent) {
+	observed := time.Now()
+	for _, event := range events {
+		template := strings.TrimSpace(event.Template)
+		exporter.export(otlpRecord{
+			raw:      event.Raw,
+			fields:   event.Fields,
+			eventID:  event.PatternID,
+			template: template,
+			params:   awsomlp.ExtractParams(template, event.Raw),
+			observed: observed,
+		})
+	}
+	exporter.Close()
+}
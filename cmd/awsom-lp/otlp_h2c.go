@@ -0,0 +1,12 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+// h2cTransport returns a transport speaking HTTP/2 without TLS, as gRPC does on http:// endpoints
+func h2cTransport() (http.RoundTripper, error) {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport, nil
+}
@@ -0,0 +1,13 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// h2cTransport reports that HTTP/2 without TLS needs a newer Go release
+func h2cTransport() (http.RoundTripper, error) {
+	return nil, fmt.Errorf("OTLP gRPC on an http:// endpoint needs a build with Go 1.24 or later; use https:// or -otlp-protocol http/protobuf")
+}
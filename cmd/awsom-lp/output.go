@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// Output modes for -output
+const (
+	outputText   = "text"   // Templates with counts, or "<pattern id>\t<template>" per line in serve mode
+	outputNDJSON = "ndjson" // One enriched JSON event per input line
+	outputCSV    = "csv"    // One CSV row per input line with the -fields columns
+)
+
+// Columns selectable with -fields; any other name selects a header field
+const (
+	fieldLineNo   = "lineno"      // 1-based number of the line among the parsed lines
+	fieldEventID  = "eventId"     // ID of the pattern the line was assigned to
+	fieldTemplate = "template"    // Template of the line
+	fieldCount    = "count"       // Number of lines covered by the line's pattern
+	fieldParams   = "params"      // Values of the template's placeholders
+	fieldNamed    = "namedParams" // Values of the template's placeholders by slot name
+	fieldMessage  = "message"     // The original line
+	fieldLevels   = "levels"      // Number of lines of the line's template per log level, set by -levels
+)
+
+// defaultCSVFields are the columns of -output csv without -fields
+var defaultCSVFields = []string{fieldLineNo, fieldEventID, fieldTemplate, fieldCount, fieldParams, fieldMessage}
+
+// checkOutput validates an output mode, accepting jsonl as an alias of ndjson
+func checkOutput(mode string) (string, error) {
+	switch mode {
+	case outputText, outputNDJSON, outputCSV:
+		return mode, nil
+	case "jsonl":
+		return outputNDJSON, nil
+	default:
+		return "", fmt.Errorf("invalid output mode: %s (use text, ndjson or csv)", mode)
+	}
+}
+
+// parseFields splits a comma-separated -fields list, rejecting empty and
+// repeated names
+func parseFields(spec string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	fields := strings.Split(spec, ",")
+	seen := make(map[string]bool, len(fields))
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || seen[field] {
+			return nil, fmt.Errorf("invalid field list %q: empty or repeated field", spec)
+		}
+		seen[field] = true
+		fields[i] = field
+	}
+	return fields, nil
+}
+
+// writeTree writes the template tree, indenting every template by two spaces
+// per level. Templates with variants show the lines of the whole subtree and
+// the number of variants.
+func writeTree(w io.Writer, tree *awsomlp.TemplateTree, templatesOnly bool) {
+	tree.Walk(func(node *awsomlp.TemplateNode, depth int) bool {
+		indent := strings.Repeat("  ", depth)
+		switch {
+		case templatesOnly:
+			fmt.Fprintf(w, "%s%s\n", indent, node.Template)
+		case len(node.Children) > 0:
+			fmt.Fprintf(w, "%s[%d] %s (%d more specific variants)\n", indent, node.Total, node.Template, node.Descendants())
+		default:
+			fmt.Fprintf(w, "%s[%d] %s\n", indent, node.Total, node.Template)
+		}
+		return true
+	})
+}
+
+// writeSegments writes the templates of every segment below a heading with the
+// segment name, its number of lines and the number of templates written,
+// optionally only the templates starting with prefix
+func writeSegments(w io.Writer, segments []awsomlp.SegmentTemplates, prefix string, templatesOnly bool) {
+	written := 0
+	for _, segment := range segments {
+		templates := segment.Templates
+		if prefix != "" {
+			if templates = awsomlp.NewTemplateIndex(templates).WithPrefix(prefix); len(templates) == 0 {
+				continue
+			}
+		}
+		if written > 0 {
+			fmt.Fprintln(w)
+		}
+		written++
+		name := segment.Segment
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(w, "== %s: %d lines, %d templates ==\n", name, segment.Count, len(templates))
+		for _, tc := range templates {
+			if templatesOnly {
+				fmt.Fprintln(w, tc.Template)
+			} else {
+				fmt.Fprintf(w, "[%d] %s\n", tc.Count, tc.Template)
+			}
+		}
+	}
+}
+
+// enrichedEvent encodes a parsed line as a JSON object: the original line as
+// message, its header fields, and the event ID, template, params and params
+// by slot name. extra holds further fields such as the namespace.
+func enrichedEvent(raw string, fields map[string]string, extra map[string]any, eventID int, template string, params []string) []byte {
+	event := make(map[string]any, len(fields)+len(extra)+5)
+	for name, value := range fields {
+		event[name] = value
+	}
+	for name, value := range extra {
+		event[name] = value
+	}
+	event["message"] = raw
+	event["event_id"] = eventID
+	event["template"] = template
+	if params == nil {
+		params = []string{}
+	}
+	event["params"] = params
+	event["named_params"] = namedParams(template, params)
+
+	return encodeJSON(event)
+}
+
+// writeEvents writes parsed events in input order, as NDJSON or CSV rows. With
+// a field list, every event consists of the selected columns in that order;
+// otherwise NDJSON events are enriched events and CSV rows have the
+// defaultCSVFields columns. counts holds the number of lines per pattern ID,
+// and levels, if not nil, the log levels per template, added to enriched
+// events and default CSV rows as the levels column.
+func writeEvents(w io.Writer, events []*awsomlp.LogEvent, mode string, fields []string, counts map[int]int, levels map[string][]levelCount) error {
+	out := bufio.NewWriter(w)
+	var rows *csv.Writer
+	if mode == outputCSV {
+		if fields == nil {
+			fields = defaultCSVFields
+			if levels != nil {
+				fields = append(slices.Clone(fields), fieldLevels)
+			}
+		}
+		rows = csv.NewWriter(out)
+		if err := rows.Write(fields); err != nil {
+			return err
+		}
+	}
+
+	for i, event := range events {
+		template := strings.TrimSpace(event.Template)
+		params := awsomlp.ExtractParams(template, event.Raw)
+		switch {
+		case rows != nil:
+			record := make([]string, len(fields))
+			for j, field := range fields {
+				record[j] = columnText(columnValue(field, i, event, template, params, counts, levels))
+			}
+			if err := rows.Write(record); err != nil {
+				return err
+			}
+		case fields != nil:
+			if _, err := out.Write(selectedEvent(fields, i, event, template, params, counts, levels)); err != nil {
+				return err
+			}
+		default:
+			var extra map[string]any
+			if levels != nil {
+				extra = map[string]any{fieldLevels: levelCounts(levels[event.Template])}
+			}
+			if _, err := out.Write(enrichedEvent(event.Raw, event.Fields, extra, event.PatternID, template, params)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if rows != nil {
+		rows.Flush()
+		if err := rows.Error(); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// columnValue returns the value of a -fields column for the i-th event: a
+// string, an int, for params a string slice, or for namedParams and levels a map
+func columnValue(field string, i int, event *awsomlp.LogEvent, template string, params []string, counts map[int]int, levels map[string][]levelCount) any {
+	switch field {
+	case fieldLineNo:
+		return i + 1
+	case fieldEventID:
+		return event.PatternID
+	case fieldTemplate:
+		return template
+	case fieldCount:
+		return counts[event.PatternID]
+	case fieldParams:
+		if params == nil {
+			return []string{}
+		}
+		return params
+	case fieldNamed:
+		return namedParams(template, params)
+	case fieldMessage:
+		return event.Raw
+	case fieldLevels:
+		return levelCounts(levels[event.Template])
+	default:
+		return event.Fields[field]
+	}
+}
+
+// namedParams pairs params with the slot names of the template, an empty
+// object if the line does not match its template
+func namedParams(template string, params []string) map[string]string {
+	if named := awsomlp.NamedParams(template, params); named != nil {
+		return named
+	}
+	return map[string]string{}
+}
+
+// columnText formats a column value as CSV cell: params as a JSON array, maps
+// as a JSON object
+func columnText(value any) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case string:
+		return v
+	default:
+		return string(bytes.TrimSpace(encodeJSON(v)))
+	}
+}
+
+// selectedEvent encodes the selected columns of an event as a JSON object
+// with the keys in field list order
+func selectedEvent(fields []string, i int, event *awsomlp.LogEvent, template string, params []string, counts map[int]int, levels map[string][]levelCount) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for j, field := range fields {
+		if j > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(bytes.TrimSpace(encodeJSON(field)))
+		buf.WriteByte(':')
+		buf.Write(bytes.TrimSpace(encodeJSON(columnValue(field, i, event, template, params, counts, levels))))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// encodeJSON encodes a value without escaping placeholders as \u003c*\u003e
+func encodeJSON(value any) []byte {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		panic(err) // Strings, ints, string slices and maps of them always encode
+	}
+	return buf.Bytes()
+}
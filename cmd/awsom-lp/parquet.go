@@ -0,0 +1,905 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// This file implements a minimal Parquet reader covering what is needed to
+// template-mine a string column: flat schemas, BYTE_ARRAY columns, PLAIN,
+// dictionary and delta encodings, data pages v1/v2 and UNCOMPRESSED, SNAPPY or GZIP codecs.
+
+// Parquet constants used by the reader
+const (
+	parquetMagic = "PAR1"
+
+	parquetTypeByteArray = 6
+
+	parquetRepetitionRequired = 0
+	parquetRepetitionRepeated = 2
+
+	parquetCodecUncompressed = 0
+	parquetCodecSnappy       = 1
+	parquetCodecGzip         = 2
+
+	parquetPageData       = 0
+	parquetPageDictionary = 2
+	parquetPageDataV2     = 3
+
+	parquetEncodingPlain     = 0
+	parquetEncodingPlainDict = 2
+	parquetEncodingDeltaLen  = 6
+	parquetEncodingDeltaByte = 7
+	parquetEncodingRLEDict   = 8
+
+	// Largest number of values of a page; page headers declare them as i32
+	parquetMaxPageValues = math.MaxInt32
+
+	// Largest output of a Snappy block per input byte: a 3-byte copy yields 64 bytes
+	snappyMaxRatio = 22
+)
+
+// readParquetLogs reads log lines from a string column of a Parquet file.
+// An empty column name selects "message" or, failing that, the first string column.
+func readParquetLogs(file io.ReaderAt, size int64, column string, limit *lineLimit) ([]string, error) {
+	meta, err := readParquetFooter(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	col, err := meta.findColumn(column)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	rowNo := 0
+	for _, rowGroup := range meta.rowGroups {
+		chunk := rowGroup[col.index]
+		err := readParquetChunk(file, size, chunk, col, func(value string) error {
+			rowNo++
+			line := strings.TrimSpace(value)
+			if line == "" {
+				return nil
+			}
+			line, ok, err := limit.apply(line, rowNo)
+			if err != nil {
+				return fmt.Errorf("row %d: %v", rowNo, err)
+			}
+			if ok {
+				lines = append(lines, line)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// parquetColumn describes a leaf column of a flat schema
+type parquetColumn struct {
+	name     string
+	index    int   // Leaf index within each row group
+	typ      int64 // Physical type
+	optional bool  // Whether values carry definition levels
+}
+
+// parquetChunk holds the column chunk metadata needed for reading
+type parquetChunk struct {
+	codec      int64
+	numValues  int64
+	dataOffset int64
+	dictOffset int64 // 0 if the chunk has no dictionary page
+	size       int64 // Total compressed size of all pages
+}
+
+// parquetMeta holds the decoded parts of FileMetaData
+type parquetMeta struct {
+	columns   []parquetColumn
+	rowGroups [][]parquetChunk
+}
+
+// readParquetFooter reads and decodes the file footer
+func readParquetFooter(file io.ReaderAt, size int64) (*parquetMeta, error) {
+	if size < 12 {
+		return nil, errors.New("file too small to be Parquet")
+	}
+	tail := make([]byte, 8)
+	if _, err := file.ReadAt(tail, size-8); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != parquetMagic {
+		return nil, errors.New("not a Parquet file (missing PAR1 magic)")
+	}
+	footerLen := int64(binary.LittleEndian.Uint32(tail))
+	if footerLen <= 0 || footerLen > size-12 {
+		return nil, fmt.Errorf("invalid Parquet footer length %d", footerLen)
+	}
+	footer := make([]byte, footerLen)
+	if _, err := file.ReadAt(footer, size-8-footerLen); err != nil {
+		return nil, err
+	}
+
+	fileMeta, err := newThriftReader(footer).readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("decoding Parquet footer: %v", err)
+	}
+
+	meta := &parquetMeta{}
+
+	// Schema: the first element is the root, followed by the leaves of a flat schema
+	schema := fileMeta.list(2)
+	for i, elem := range schema {
+		element, _ := elem.(thriftStruct)
+		if i == 0 {
+			continue
+		}
+		if element.int(5) > 0 {
+			return nil, errors.New("nested Parquet schemas are not supported")
+		}
+		repetition := element.int(3)
+		if repetition == parquetRepetitionRepeated {
+			return nil, fmt.Errorf("repeated column %q is not supported", element.string(4))
+		}
+		meta.columns = append(meta.columns, parquetColumn{
+			name:     element.string(4),
+			index:    i - 1,
+			typ:      element.int(1),
+			optional: repetition != parquetRepetitionRequired,
+		})
+	}
+
+	for _, rg := range fileMeta.list(4) {
+		rowGroup, _ := rg.(thriftStruct)
+		var chunks []parquetChunk
+		for _, cc := range rowGroup.list(1) {
+			columnChunk, _ := cc.(thriftStruct)
+			if columnChunk.string(1) != "" {
+				return nil, errors.New("Parquet files with external column chunks are not supported")
+			}
+			md := columnChunk.structure(3)
+			chunks = append(chunks, parquetChunk{
+				codec:      md.int(4),
+				numValues:  md.int(5),
+				dataOffset: md.int(9),
+				dictOffset: md.int(11),
+				size:       md.int(7),
+			})
+		}
+		if len(chunks) != len(meta.columns) {
+			return nil, errors.New("Parquet row group does not match schema")
+		}
+		meta.rowGroups = append(meta.rowGroups, chunks)
+	}
+	return meta, nil
+}
+
+// findColumn selects the column to read
+func (m *parquetMeta) findColumn(name string) (parquetColumn, error) {
+	var available []string
+	for _, col := range m.columns {
+		if strings.EqualFold(col.name, name) {
+			if col.typ != parquetTypeByteArray {
+				return col, fmt.Errorf("column '%s' is not a string column", col.name)
+			}
+			return col, nil
+		}
+		available = append(available, col.name)
+	}
+	if strings.EqualFold(name, "message") {
+		for _, col := range m.columns {
+			if col.typ == parquetTypeByteArray {
+				fmt.Fprintf(os.Stderr, "Warning: Column '%s' not found, using column '%s'\n", name, col.name)
+				return col, nil
+			}
+		}
+	}
+	return parquetColumn{}, fmt.Errorf("column '%s' not found in Parquet schema. Available columns: %v", name, available)
+}
+
+// readParquetChunk decodes all values of a column chunk of a file of the given
+// size, calling fn for each non-null value. Sizes and counts of the metadata
+// are checked against the data actually read, so corrupt files fail with an error.
+func readParquetChunk(file io.ReaderAt, size int64, chunk parquetChunk, col parquetColumn, fn func(string) error) error {
+	start := chunk.dataOffset
+	if chunk.dictOffset > 0 && chunk.dictOffset < start {
+		start = chunk.dictOffset
+	}
+	if start < 0 || chunk.size < 0 || chunk.size > size-start {
+		return fmt.Errorf("invalid Parquet column chunk of %d bytes at offset %d", chunk.size, start)
+	}
+	data := make([]byte, chunk.size)
+	if _, err := file.ReadAt(data, start); err != nil {
+		return err
+	}
+
+	var dictionary []string
+	var read int64
+	for read < chunk.numValues && len(data) > 0 {
+		tr := newThriftReader(data)
+		header, err := tr.readStruct()
+		if err != nil {
+			return fmt.Errorf("decoding Parquet page header: %v", err)
+		}
+		data = data[tr.pos:]
+		compressedSize := header.int(3)
+		if compressedSize < 0 || compressedSize > int64(len(data)) {
+			return errors.New("truncated Parquet page")
+		}
+		page := data[:compressedSize]
+		data = data[compressedSize:]
+		uncompressedSize := header.int(2)
+		if uncompressedSize < 0 {
+			return fmt.Errorf("invalid Parquet page size %d", uncompressedSize)
+		}
+
+		switch header.int(1) {
+		case parquetPageDictionary:
+			body, err := decompressParquet(chunk.codec, page, uncompressedSize)
+			if err != nil {
+				return err
+			}
+			count := header.structure(7).int(1)
+			if count < 0 || count > int64(len(body)/4) {
+				return fmt.Errorf("invalid Parquet dictionary size %d", count)
+			}
+			dictionary, _, err = decodePlainByteArrays(body, int(count))
+			if err != nil {
+				return err
+			}
+
+		case parquetPageData:
+			ph := header.structure(5)
+			body, err := decompressParquet(chunk.codec, page, uncompressedSize)
+			if err != nil {
+				return err
+			}
+			numValues, err := parquetPageValues(ph)
+			if err != nil {
+				return err
+			}
+			var defined []bool
+			if col.optional {
+				if len(body) < 4 {
+					return errors.New("truncated Parquet definition levels")
+				}
+				length := int(binary.LittleEndian.Uint32(body))
+				if length > len(body)-4 {
+					return errors.New("truncated Parquet definition levels")
+				}
+				defined, err = decodeDefinitionLevels(body[4:4+length], numValues)
+				if err != nil {
+					return err
+				}
+				body = body[4+length:]
+			}
+			if err := emitParquetValues(body, ph.int(2), numValues, defined, dictionary, fn); err != nil {
+				return err
+			}
+			read += int64(numValues)
+
+		case parquetPageDataV2:
+			ph := header.structure(8)
+			numValues, err := parquetPageValues(ph)
+			if err != nil {
+				return err
+			}
+			defLen, repLen := ph.int(5), ph.int(6)
+			if defLen < 0 || repLen < 0 || defLen+repLen > int64(len(page)) || defLen+repLen > uncompressedSize {
+				return errors.New("truncated Parquet page levels")
+			}
+			var defined []bool
+			if col.optional {
+				defined, err = decodeDefinitionLevels(page[repLen:repLen+defLen], numValues)
+				if err != nil {
+					return err
+				}
+			}
+			body := page[repLen+defLen:]
+			if compressed, ok := ph[7]; !ok || compressed == true {
+				body, err = decompressParquet(chunk.codec, body, uncompressedSize-defLen-repLen)
+				if err != nil {
+					return err
+				}
+			}
+			if err := emitParquetValues(body, ph.int(4), numValues, defined, dictionary, fn); err != nil {
+				return err
+			}
+			read += int64(numValues)
+		}
+	}
+	return nil
+}
+
+// parquetPageValues returns the number of values of a data page header
+func parquetPageValues(header thriftStruct) (int, error) {
+	numValues := header.int(1)
+	if numValues < 0 || numValues > parquetMaxPageValues {
+		return 0, fmt.Errorf("invalid Parquet page value count %d", numValues)
+	}
+	return int(numValues), nil
+}
+
+// emitParquetValues decodes the values section of a data page
+func emitParquetValues(body []byte, encoding int64, numValues int, defined []bool, dictionary []string, fn func(string) error) error {
+	count := numValues
+	if defined != nil {
+		count = 0
+		for _, d := range defined {
+			if d {
+				count++
+			}
+		}
+	}
+
+	var values []string
+	var err error
+	switch encoding {
+	case parquetEncodingPlain:
+		values, _, err = decodePlainByteArrays(body, count)
+	case parquetEncodingDeltaLen:
+		values, err = decodeDeltaLengthByteArrays(body, count)
+	case parquetEncodingDeltaByte:
+		values, err = decodeDeltaByteArrays(body, count)
+	case parquetEncodingPlainDict, parquetEncodingRLEDict:
+		if len(body) == 0 {
+			if count == 0 {
+				return nil
+			}
+			return errors.New("truncated Parquet dictionary indices")
+		}
+		var indices []uint64
+		indices, err = decodeRLEHybrid(body[1:], int(body[0]), count)
+		for _, idx := range indices {
+			if idx >= uint64(len(dictionary)) {
+				return errors.New("Parquet dictionary index out of range")
+			}
+			values = append(values, dictionary[idx])
+		}
+	default:
+		return fmt.Errorf("unsupported Parquet encoding %d", encoding)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if err := fn(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeDefinitionLevels decodes max-level-1 definition levels into a presence mask
+func decodeDefinitionLevels(data []byte, count int) ([]bool, error) {
+	levels, err := decodeRLEHybrid(data, 1, count)
+	if err != nil {
+		return nil, err
+	}
+	defined := make([]bool, len(levels))
+	for i, level := range levels {
+		defined[i] = level == 1
+	}
+	return defined, nil
+}
+
+// decodePlainByteArrays decodes count PLAIN-encoded BYTE_ARRAY values
+func decodePlainByteArrays(data []byte, count int) ([]string, int, error) {
+	if count > len(data)/4 {
+		return nil, 0, errors.New("truncated Parquet byte array")
+	}
+	values := make([]string, 0, count)
+	pos := 0
+	for i := 0; i < count; i++ {
+		if pos+4 > len(data) {
+			return nil, 0, errors.New("truncated Parquet byte array")
+		}
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(data) {
+			return nil, 0, errors.New("truncated Parquet byte array")
+		}
+		values = append(values, string(data[pos:pos+length]))
+		pos += length
+	}
+	return values, pos, nil
+}
+
+// decodeDeltaLengthByteArrays decodes DELTA_LENGTH_BYTE_ARRAY values
+func decodeDeltaLengthByteArrays(data []byte, count int) ([]string, error) {
+	lengths, n, err := decodeDeltaBinaryPacked(data, count)
+	if err != nil {
+		return nil, err
+	}
+	data = data[n:]
+	values := make([]string, 0, len(lengths))
+	for _, length := range lengths {
+		if length < 0 || length > int64(len(data)) {
+			return nil, errors.New("truncated Parquet delta byte array")
+		}
+		values = append(values, string(data[:length]))
+		data = data[length:]
+	}
+	return values, nil
+}
+
+// decodeDeltaByteArrays decodes DELTA_BYTE_ARRAY (incremental prefix) values
+func decodeDeltaByteArrays(data []byte, count int) ([]string, error) {
+	prefixes, n, err := decodeDeltaBinaryPacked(data, count)
+	if err != nil {
+		return nil, err
+	}
+	suffixes, err := decodeDeltaLengthByteArrays(data[n:], count)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefixes) != len(suffixes) {
+		return nil, errors.New("Parquet delta prefix and suffix counts differ")
+	}
+	values := make([]string, 0, len(suffixes))
+	previous := ""
+	for i, suffix := range suffixes {
+		if prefixes[i] < 0 || prefixes[i] > int64(len(previous)) {
+			return nil, errors.New("invalid Parquet delta prefix length")
+		}
+		previous = previous[:prefixes[i]] + suffix
+		values = append(values, previous)
+	}
+	return values, nil
+}
+
+// decodeDeltaBinaryPacked decodes count DELTA_BINARY_PACKED integers and
+// returns them together with the number of bytes consumed
+func decodeDeltaBinaryPacked(data []byte, count int) ([]int64, int, error) {
+	tr := newThriftReader(data)
+	var header [3]uint64
+	for i := range header {
+		v, err := tr.readUvarint()
+		if err != nil {
+			return nil, 0, errors.New("truncated Parquet delta header")
+		}
+		header[i] = v
+	}
+	blockSize, miniblocks, total := header[0], header[1], header[2]
+	first, err := tr.readVarint()
+	if err != nil {
+		return nil, 0, errors.New("truncated Parquet delta header")
+	}
+	if miniblocks == 0 || blockSize%miniblocks != 0 || blockSize > 1<<20 {
+		return nil, 0, errors.New("invalid Parquet delta block size")
+	}
+	perMiniblock := int(blockSize / miniblocks)
+
+	if total < uint64(count) {
+		count = int(total)
+	}
+	// Miniblocks of width 0 hold any number of values in no data, so the
+	// declared count is not trusted for preallocation
+	capacity := count
+	if capacity > 8*len(data) {
+		capacity = 8 * len(data)
+	}
+	values := make([]int64, 0, capacity)
+	if total == 0 {
+		return values, tr.pos, nil
+	}
+	values = append(values, first)
+	last := first
+
+	for uint64(len(values)) < total {
+		minDelta, err := tr.readVarint()
+		if err != nil {
+			return nil, 0, err
+		}
+		if tr.pos+int(miniblocks) > len(data) {
+			return nil, 0, errThriftTruncated
+		}
+		widths := data[tr.pos : tr.pos+int(miniblocks)]
+		tr.pos += int(miniblocks)
+
+		for _, width := range widths {
+			if uint64(len(values)) >= total {
+				break
+			}
+			size := perMiniblock * int(width) / 8
+			if width > 64 || tr.pos+size > len(data) {
+				return nil, 0, errors.New("truncated Parquet delta miniblock")
+			}
+			packed := data[tr.pos : tr.pos+size]
+			tr.pos += size
+			for i := 0; i < perMiniblock && uint64(len(values)) < total; i++ {
+				var delta uint64
+				for b := 0; b < int(width); b++ {
+					bit := i*int(width) + b
+					if packed[bit/8]&(1<<(bit%8)) != 0 {
+						delta |= 1 << b
+					}
+				}
+				last += minDelta + int64(delta)
+				values = append(values, last)
+			}
+		}
+	}
+	return values[:count], tr.pos, nil
+}
+
+// decodeRLEHybrid decodes count values of the RLE/bit-packing hybrid encoding
+func decodeRLEHybrid(data []byte, bitWidth, count int) ([]uint64, error) {
+	if bitWidth < 0 || bitWidth > 32 {
+		return nil, fmt.Errorf("invalid Parquet bit width %d", bitWidth)
+	}
+	// A run may stand for any number of values, so only the values of the
+	// bit-packed runs the data can hold are preallocated
+	capacity := count
+	if capacity > 8*len(data) {
+		capacity = 8 * len(data)
+	}
+	values := make([]uint64, 0, capacity)
+	pos := 0
+	byteWidth := (bitWidth + 7) / 8
+
+	for len(values) < count {
+		header, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return nil, errors.New("truncated Parquet RLE data")
+		}
+		pos += n
+
+		if header&1 == 0 {
+			// RLE run: a repeated value stored in byteWidth bytes
+			run := int(header >> 1)
+			if pos+byteWidth > len(data) {
+				return nil, errors.New("truncated Parquet RLE run")
+			}
+			var value uint64
+			for i := 0; i < byteWidth; i++ {
+				value |= uint64(data[pos+i]) << (8 * i)
+			}
+			pos += byteWidth
+			for i := 0; i < run && len(values) < count; i++ {
+				values = append(values, value)
+			}
+			continue
+		}
+
+		// Bit-packed run: groups of 8 values, least significant bit first
+		groups := int(header >> 1)
+		size := groups * bitWidth
+		if pos+size > len(data) {
+			return nil, errors.New("truncated Parquet bit-packed run")
+		}
+		packed := data[pos : pos+size]
+		pos += size
+		for i := 0; i < groups*8 && len(values) < count; i++ {
+			var value uint64
+			for b := 0; b < bitWidth; b++ {
+				bit := i*bitWidth + b
+				if packed[bit/8]&(1<<(bit%8)) != 0 {
+					value |= 1 << b
+				}
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// decompressParquet decompresses a page body of uncompressedSize bytes,
+// failing if the data decompresses to a different size
+func decompressParquet(codec int64, data []byte, uncompressedSize int64) ([]byte, error) {
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid Parquet page size %d", uncompressedSize)
+	}
+	switch codec {
+	case parquetCodecUncompressed:
+		return data, nil
+	case parquetCodecSnappy:
+		out, err := decodeSnappy(data)
+		if err == nil && int64(len(out)) != uncompressedSize {
+			err = fmt.Errorf("Parquet page decompressed to %d bytes, want %d", len(out), uncompressedSize)
+		}
+		return out, err
+	case parquetCodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		// The declared size is not trusted for preallocation, and reading stops
+		// one byte past it, so a page cannot decompress to more than it declares
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, io.LimitReader(zr, uncompressedSize+1)); err != nil {
+			return nil, err
+		}
+		if int64(out.Len()) != uncompressedSize {
+			return nil, fmt.Errorf("Parquet page decompressed to %d bytes, want %d", out.Len(), uncompressedSize)
+		}
+		return out.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported Parquet compression codec %d (supported: uncompressed, snappy, gzip)", codec)
+	}
+}
+
+// decodeSnappy decodes a raw (unframed) Snappy block
+func decodeSnappy(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > math.MaxInt32 || length > uint64(len(src))*snappyMaxRatio {
+		return nil, errors.New("invalid snappy header")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, size int
+		switch tag & 3 {
+		case 0: // Literal
+			size = int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				extra := size - 59
+				if len(src) < extra {
+					return nil, errors.New("truncated snappy literal")
+				}
+				size = 0
+				for i := 0; i < extra; i++ {
+					size |= int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			size++
+			if len(src) < size {
+				return nil, errors.New("truncated snappy literal")
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case 1: // Copy with 1-byte offset
+			if len(src) < 2 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			size = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2: // Copy with 2-byte offset
+			if len(src) < 3 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3: // Copy with 4-byte offset
+			if len(src) < 5 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errors.New("invalid snappy copy offset")
+		}
+		// Copies may overlap their own output, so copy byte by byte
+		from := len(dst) - offset
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[from+i])
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, errors.New("snappy length mismatch")
+	}
+	return dst, nil
+}
+
+// thriftStruct is a decoded Thrift struct keyed by field ID
+type thriftStruct map[int16]interface{}
+
+func (s thriftStruct) int(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftStruct) string(id int16) string {
+	v, _ := s[id].([]byte)
+	return string(v)
+}
+
+func (s thriftStruct) list(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+func (s thriftStruct) structure(id int16) thriftStruct {
+	v, _ := s[id].(thriftStruct)
+	return v
+}
+
+// Thrift compact protocol type IDs
+const (
+	thriftTypeTrue   = 1
+	thriftTypeFalse  = 2
+	thriftTypeByte   = 3
+	thriftTypeI16    = 4
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeDouble = 7
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeSet    = 10
+	thriftTypeMap    = 11
+	thriftTypeStruct = 12
+)
+
+// thriftReader decodes the Thrift compact protocol used by Parquet metadata
+type thriftReader struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func newThriftReader(data []byte) *thriftReader {
+	return &thriftReader{data: data}
+}
+
+var errThriftTruncated = errors.New("truncated thrift data")
+
+func (t *thriftReader) readByte() (byte, error) {
+	if t.pos >= len(t.data) {
+		return 0, errThriftTruncated
+	}
+	b := t.data[t.pos]
+	t.pos++
+	return b, nil
+}
+
+func (t *thriftReader) readUvarint() (uint64, error) {
+	v, n := binary.Uvarint(t.data[t.pos:])
+	if n <= 0 {
+		return 0, errThriftTruncated
+	}
+	t.pos += n
+	return v, nil
+}
+
+func (t *thriftReader) readVarint() (int64, error) {
+	v, err := t.readUvarint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+// readStruct reads a struct into a map of field ID to value
+func (t *thriftReader) readStruct() (thriftStruct, error) {
+	if t.depth++; t.depth > 32 {
+		return nil, errors.New("thrift nesting too deep")
+	}
+	defer func() { t.depth-- }()
+
+	result := thriftStruct{}
+	var lastID int16
+	for {
+		b, err := t.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return result, nil
+		}
+		typ := b & 0x0f
+		if delta := int16(b >> 4); delta != 0 {
+			lastID += delta
+		} else {
+			id, err := t.readVarint()
+			if err != nil {
+				return nil, err
+			}
+			lastID = int16(id)
+		}
+		value, err := t.readValue(typ)
+		if err != nil {
+			return nil, err
+		}
+		result[lastID] = value
+	}
+}
+
+// readValue reads a single value of the given compact type
+func (t *thriftReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case thriftTypeTrue:
+		return true, nil
+	case thriftTypeFalse:
+		return false, nil
+	case thriftTypeByte:
+		b, err := t.readByte()
+		return int64(int8(b)), err
+	case thriftTypeI16, thriftTypeI32, thriftTypeI64:
+		return t.readVarint()
+	case thriftTypeDouble:
+		if t.pos+8 > len(t.data) {
+			return nil, errThriftTruncated
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(t.data[t.pos:]))
+		t.pos += 8
+		return v, nil
+	case thriftTypeBinary:
+		length, err := t.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(len(t.data)-t.pos) {
+			return nil, errThriftTruncated
+		}
+		v := t.data[t.pos : t.pos+int(length)]
+		t.pos += int(length)
+		return v, nil
+	case thriftTypeList, thriftTypeSet:
+		header, err := t.readByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = t.readUvarint(); err != nil {
+				return nil, err
+			}
+		}
+		if size > uint64(len(t.data)-t.pos) {
+			return nil, errThriftTruncated
+		}
+		elemType := header & 0x0f
+		list := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			var v interface{}
+			if elemType == thriftTypeTrue || elemType == thriftTypeFalse {
+				// Booleans inside collections are encoded as one byte each
+				b, err := t.readByte()
+				if err != nil {
+					return nil, err
+				}
+				v = b == thriftTypeTrue
+			} else if v, err = t.readValue(elemType); err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case thriftTypeMap:
+		size, err := t.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return map[interface{}]interface{}{}, nil
+		}
+		types, err := t.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(len(t.data)-t.pos) {
+			return nil, errThriftTruncated
+		}
+		// Map contents are not needed by the reader; decode and discard
+		for i := uint64(0); i < size; i++ {
+			if _, err := t.readValue(types >> 4); err != nil {
+				return nil, err
+			}
+			if _, err := t.readValue(types & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return map[interface{}]interface{}{}, nil
+	case thriftTypeStruct:
+		return t.readStruct()
+	default:
+		return nil, fmt.Errorf("unknown thrift type %d", typ)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// prettyWidth is the number of characters of a template shown by -pretty
+// without -expand
+const prettyWidth = 120
+
+// ANSI escape sequences of -pretty output
+const (
+	ansiBold        = "\x1b[1m"
+	ansiDim         = "\x1b[2m"
+	ansiPlaceholder = "\x1b[36m"
+	ansiError       = "\x1b[31m"
+	ansiWarning     = "\x1b[33m"
+	ansiReset       = "\x1b[0m"
+)
+
+// prettyWriter writes templates for reading in a terminal: counts right-aligned
+// with their share of all lines, placeholders highlighted, and templates cut
+// to prettyWidth characters unless expanded
+type prettyWriter struct {
+	color         bool // Use ANSI colors; only on a terminal and without NO_COLOR
+	expand        bool // Show templates in full
+	templatesOnly bool // Omit counts and percentages
+
+	levels map[string][]levelCount // Log levels of the lines of every template, set by -levels
+}
+
+// newPrettyWriter creates a prettyWriter for out, with colors if out is a
+// terminal and NO_COLOR is not set
+func newPrettyWriter(out *os.File, expand, templatesOnly bool, levels map[string][]levelCount) prettyWriter {
+	return prettyWriter{
+		color:         os.Getenv("NO_COLOR") == "" && isTerminal(out),
+		expand:        expand,
+		templatesOnly: templatesOnly,
+		levels:        levels,
+	}
+}
+
+// isTerminal reports whether a file is a terminal rather than a pipe or a
+// regular file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// write writes the templates in order, total being the number of lines the
+// percentages refer to
+func (p prettyWriter) write(w io.Writer, stats []awsomlp.TemplateCount, total int) {
+	width := 0
+	for _, stat := range stats {
+		width = max(width, len(strconv.Itoa(stat.Count)))
+	}
+	for _, stat := range stats {
+		template := p.template(stat.Template)
+		if p.templatesOnly {
+			fmt.Fprintln(w, template)
+			continue
+		}
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(stat.Count) / float64(total)
+		}
+		count := fmt.Sprintf("%*d", width, stat.Count)
+		percent := fmt.Sprintf("%5.1f%%", share)
+		fmt.Fprintf(w, "%s  %s  %s", p.paint(ansiBold, count), p.paint(ansiDim, percent), template)
+		if levels := p.levels[stat.Template]; levels != nil {
+			fmt.Fprintf(w, "  %s", p.paintLevels(levels))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// paintLevels formats the levels of a template like formatLevels, with error
+// levels in red and warnings in yellow, so that templates seen at an unusual
+// severity stand out
+func (p prettyWriter) paintLevels(levels []levelCount) string {
+	total := 0
+	for _, level := range levels {
+		total += level.count
+	}
+	parts := make([]string, 0, len(levels))
+	for _, level := range levels {
+		part := level.level + " " + formatShare(level.count, total)
+		switch level.level {
+		case "ERROR", "ERR", "FATAL", "CRITICAL", "CRIT", "ALERT", "EMERG", "PANIC", "SEVERE":
+			part = p.paint(ansiError, part)
+		case "WARN", "WARNING":
+			part = p.paint(ansiWarning, part)
+		}
+		parts = append(parts, part)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// template cuts a template to prettyWidth characters and highlights its placeholders
+func (p prettyWriter) template(template string) string {
+	cut := ""
+	if !p.expand && utf8.RuneCountInString(template) > prettyWidth {
+		template = string([]rune(template)[:prettyWidth-1])
+		cut = p.paint(ansiDim, "…")
+	}
+	if p.color {
+		template = strings.ReplaceAll(template, "<*>", ansiPlaceholder+"<*>"+ansiReset)
+	}
+	return template + cut
+}
+
+// paint wraps text in an ANSI sequence if colors are enabled
+func (p prettyWriter) paint(sequence, text string) string {
+	if !p.color {
+		return text
+	}
+	return sequence + text + ansiReset
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// Progress formats of -progress
+const (
+	progressNone = "none"
+	progressText = "text"
+	progressJSON = "json"
+)
+
+// progressRecord is a -progress json line
+type progressRecord struct {
+	Lines    int      `json:"lines"`
+	Total    int      `json:"total,omitempty"` // Absent if unknown
+	Patterns int      `json:"patterns"`
+	Elapsed  float64  `json:"elapsed_seconds"`
+	Rate     float64  `json:"lines_per_second"`
+	Percent  *float64 `json:"percent,omitempty"`     // Absent if the total is unknown
+	ETA      *float64 `json:"eta_seconds,omitempty"` // Absent if the total is unknown
+	Done     bool     `json:"done"`
+}
+
+// progressReporter writes the progress of the parser to stderr for -progress
+type progressReporter struct {
+	w      io.Writer
+	format string
+
+	// Without a line total (-chunk), the total is estimated from the size of
+	// the input and the average length of the lines read so far
+	read      int64      // Bytes read so far
+	size      int64      // Bytes of all inputs, 0 if unknown
+	linesRead func() int // Lines read so far
+}
+
+// newProgressReporter checks the -progress format; the reporter is nil for none
+func newProgressReporter(w io.Writer, format string) (*progressReporter, error) {
+	switch format {
+	case progressNone, "":
+		return nil, nil
+	case progressText, progressJSON:
+		return &progressReporter{w: w, format: format}, nil
+	}
+	return nil, fmt.Errorf("unknown -progress format %q (want none, text or json)", format)
+}
+
+// countBytes makes the reporter estimate the progress of chunked parsing from
+// the bytes read from reader; set linesRead to the number of lines read from
+// it. The estimate is only made if the sizes of all inputs are known.
+func (r *progressReporter) countBytes(reader io.Reader, inputs []string) io.Reader {
+	for _, input := range inputs {
+		info, err := os.Stat(input)
+		if isRemote(input) || err != nil || !info.Mode().IsRegular() {
+			r.size = 0
+			break
+		}
+		r.size += info.Size()
+	}
+	return &countingReader{r: reader, n: &r.read}
+}
+
+// report writes a progress record
+func (r *progressReporter) report(p awsomlp.Progress) {
+	record := progressRecord{
+		Lines:    p.Lines,
+		Total:    p.Total,
+		Patterns: p.Patterns,
+		Elapsed:  p.Elapsed.Seconds(),
+		Rate:     p.Rate,
+		Done:     p.Done,
+	}
+	var share float64
+	switch {
+	case p.Total > 0:
+		share = float64(p.Lines) / float64(p.Total)
+	case r.size > 0 && r.read > 0 && r.linesRead != nil:
+		total := float64(r.linesRead()) * float64(r.size) / float64(r.read)
+		share = min(float64(p.Lines)/total, 1)
+	}
+	if share > 0 || p.Done {
+		if p.Done {
+			share = 1
+		}
+		percent := 100 * share
+		eta := p.Elapsed.Seconds() * (1 - share) / share
+		record.Percent, record.ETA = &percent, &eta
+	}
+
+	if r.format == progressJSON {
+		r.w.Write(encodeJSON(record))
+		return
+	}
+	fmt.Fprintf(r.w, "Progress: %d", record.Lines)
+	if record.Total > 0 {
+		fmt.Fprintf(r.w, "/%d", record.Total)
+	}
+	fmt.Fprintf(r.w, " lines")
+	if record.Percent != nil {
+		fmt.Fprintf(r.w, " (%.1f%%)", *record.Percent)
+	}
+	fmt.Fprintf(r.w, ", %.0f lines/s, %d patterns, elapsed %s", record.Rate, record.Patterns, p.Elapsed.Round(time.Second))
+	if record.ETA != nil && !p.Done {
+		fmt.Fprintf(r.w, ", ETA %s", (time.Duration(*record.ETA * float64(time.Second))).Round(time.Second))
+	}
+	fmt.Fprintln(r.w)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
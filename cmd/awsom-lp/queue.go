@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Policies for a full line queue
+const (
+	overflowBlock  = "block"  // Stop reading until the parser catches up
+	overflowDrop   = "drop"   // Drop the incoming line
+	overflowOldest = "oldest" // Drop the oldest queued line
+)
+
+// queuedLine is a line waiting to be parsed
+type queuedLine struct {
+	text string
+	ack  func() // Called once the line is parsed, nil if the source needs no acknowledgment
+}
+
+// lineQueue is a bounded FIFO between the input reader and the parser that
+// applies an overflow policy when lines arrive faster than they are parsed
+type lineQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	lines    []queuedLine // Ring buffer
+	head     int          // Index of the oldest line
+	size     int          // Number of queued lines
+	policy   string
+	closed   bool
+	received int // Lines pushed
+	dropped  int // Lines dropped by the overflow policy
+}
+
+// newLineQueue creates a queue holding up to capacity lines
+func newLineQueue(capacity int, policy string) (*lineQueue, error) {
+	if capacity < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1, got %d", capacity)
+	}
+	switch policy {
+	case overflowBlock, overflowDrop, overflowOldest:
+	default:
+		return nil, fmt.Errorf("invalid overflow policy: %s (use block, drop or oldest)", policy)
+	}
+	q := &lineQueue{lines: make([]queuedLine, capacity), policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+// push adds a line, blocking or dropping a line if the queue is full
+func (q *lineQueue) push(line string) {
+	q.pushAcked(line, nil)
+}
+
+// pushAcked adds a line to be acknowledged with ack once parsed. A line dropped
+// by the overflow policy is never acknowledged.
+func (q *lineQueue) pushAcked(line string, ack func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.received++
+	for q.size == len(q.lines) {
+		switch q.policy {
+		case overflowDrop:
+			q.dropped++
+			return
+		case overflowOldest:
+			q.head = (q.head + 1) % len(q.lines)
+			q.size--
+			q.dropped++
+		default:
+			q.cond.Wait()
+		}
+	}
+	q.lines[(q.head+q.size)%len(q.lines)] = queuedLine{text: line, ack: ack}
+	q.size++
+	q.cond.Broadcast()
+}
+
+// pop removes the oldest line, waiting for one; ok is false once the queue is closed and empty
+func (q *lineQueue) pop() (line queuedLine, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size == 0 {
+		if q.closed {
+			return queuedLine{}, false
+		}
+		q.cond.Wait()
+	}
+	line, q.lines[q.head] = q.lines[q.head], queuedLine{}
+	q.head = (q.head + 1) % len(q.lines)
+	q.size--
+	q.cond.Broadcast()
+	return line, true
+}
+
+// close marks the end of the input; queued lines can still be popped
+func (q *lineQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// stats returns the number of received, dropped and currently queued lines
+func (q *lineQueue) stats() (received, dropped, queued int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.received, q.dropped, q.size
+}
+
+// rateLimiter spaces calls to wait evenly to at most rate per second
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter creates a limiter; a rate of 0 means unlimited
+func newRateLimiter(rate float64) (*rateLimiter, error) {
+	if rate < 0 {
+		return nil, fmt.Errorf("rate must be non-negative, got %g", rate)
+	}
+	if rate == 0 {
+		return &rateLimiter{}, nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}, nil
+}
+
+// wait blocks until the next call is allowed
+func (l *rateLimiter) wait() {
+	if l.interval == 0 {
+		return
+	}
+	now := time.Now()
+	if l.next.After(now) {
+		time.Sleep(l.next.Sub(now))
+		now = l.next
+	}
+	l.next = now.Add(l.interval)
+}
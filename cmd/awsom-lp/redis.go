@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis Streams consumer parameters
+const (
+	redisReadCount    = 100                    // Entries per XREADGROUP
+	redisBlock        = 5 * time.Second        // XREADGROUP wait, bounds the reaction to cancellation
+	redisAckBatch     = 100                    // Maximum IDs per XACK
+	redisAckInterval  = 100 * time.Millisecond // Maximum delay of an acknowledgment
+	redisMaxBulkBytes = 512 << 20              // Redis' own maximum string size
+)
+
+// redisOptions configures the Redis Streams consumer
+type redisOptions struct {
+	server   string // redis://[user:password@]host[:port][/db] or rediss:// for TLS
+	stream   string // Stream key
+	group    string // Consumer group, created at the beginning of the stream if missing
+	consumer string // Consumer name within the group
+	field    string // Entry field holding the log line
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn is a minimal RESP2 client connection
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRedis connects to a server, authenticates and selects the database from the URL
+func dialRedis(ctx context.Context, server string) (*redisConn, error) {
+	addr, err := url.Parse(server)
+	if err != nil || (addr.Scheme != "redis" && addr.Scheme != "rediss") || addr.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Redis server %s (want redis://host[:port][/db] or rediss://)", server)
+	}
+	host := addr.Host
+	if addr.Port() == "" {
+		host = net.JoinHostPort(addr.Hostname(), "6379")
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if addr.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: addr.Hostname()})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if user := addr.User; user != nil {
+		args := []string{"AUTH"}
+		password, ok := user.Password()
+		if !ok {
+			password = user.Username() // redis://secret@host is a password without a user
+		} else if user.Username() != "" {
+			args = append(args, user.Username())
+		}
+		if _, err := c.do(append(args, password)...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(addr.Path, "/"); db != "" && db != "0" {
+		if _, err := c.do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply; an error reply is returned as redisError
+func (c *redisConn) do(args ...string) (any, error) {
+	var cmd []byte
+	cmd = append(cmd, '*')
+	cmd = strconv.AppendInt(cmd, int64(len(args)), 10)
+	cmd = append(cmd, "\r\n"...)
+	for _, arg := range args {
+		cmd = append(cmd, '$')
+		cmd = strconv.AppendInt(cmd, int64(len(arg)), 10)
+		cmd = append(cmd, "\r\n"...)
+		cmd = append(cmd, arg...)
+		cmd = append(cmd, "\r\n"...)
+	}
+	if _, err := c.conn.Write(cmd); err != nil {
+		return nil, err
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// readReply reads a reply: string, int64, []any, nil or redisError
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed Redis reply %q", line)
+	}
+	kind, text := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return redisError(text), nil
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < -1 || n > redisMaxBulkBytes {
+			return nil, fmt.Errorf("malformed Redis bulk length %q", text)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		if string(data[n:]) != "\r\n" {
+			return nil, fmt.Errorf("malformed Redis bulk string of length %d", n)
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("malformed Redis array length %q", text)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, 0, min(n, redisReadCount)) // The length is not trusted before the items arrive
+		for range n {
+			item, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown Redis reply type %q", kind)
+	}
+}
+
+// redisEntry is a stream entry
+type redisEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// parseStreamEntries extracts the entries of the single stream in an XREADGROUP reply
+func parseStreamEntries(reply any) ([]redisEntry, error) {
+	streams, _ := reply.([]any)
+	if len(streams) == 0 {
+		return nil, nil // Timed out without entries
+	}
+	stream, _ := streams[0].([]any)
+	if len(stream) != 2 {
+		return nil, fmt.Errorf("malformed XREADGROUP reply")
+	}
+	items, _ := stream[1].([]any)
+
+	entries := make([]redisEntry, 0, len(items))
+	for _, item := range items {
+		pair, _ := item.([]any)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("malformed stream entry")
+		}
+		id, _ := pair[0].(string)
+		entry := redisEntry{id: id, fields: make(map[string]string)}
+		values, _ := pair[1].([]any) // Nil for a pending entry deleted from the stream
+		for i := 0; i+1 < len(values); i += 2 {
+			name, _ := values[i].(string)
+			value, _ := values[i+1].(string)
+			entry.fields[name] = value
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// readRedis consumes a stream with XREADGROUP into the queue, acknowledging every
+// entry once its line is parsed, until the context is cancelled. Entries left
+// pending by an earlier run of the same consumer are read first.
+func readRedis(ctx context.Context, opts redisOptions, queue *lineQueue, limit *lineLimit) error {
+	defer queue.close()
+
+	reads, err := dialRedis(ctx, opts.server)
+	if err != nil {
+		return err
+	}
+	defer reads.conn.Close()
+	acks, err := dialRedis(ctx, opts.server)
+	if err != nil {
+		return err
+	}
+
+	_, err = reads.do("XGROUP", "CREATE", opts.stream, opts.group, "0", "MKSTREAM")
+	var replyErr redisError
+	if err != nil && !(errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "BUSYGROUP")) {
+		return err
+	}
+
+	ids := make(chan string, redisAckBatch)
+	go ackRedis(ctx, acks, opts, ids)
+	ack := func(id string) func() {
+		return func() {
+			select {
+			case ids <- id:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	// Own pending entries are paged through from ID 0, then new entries are read with >
+	next := "0"
+	for lineNo := 1; ctx.Err() == nil; {
+		reply, err := reads.do("XREADGROUP", "GROUP", opts.group, opts.consumer,
+			"COUNT", strconv.Itoa(redisReadCount), "BLOCK", strconv.FormatInt(redisBlock.Milliseconds(), 10),
+			"STREAMS", opts.stream, next)
+		if err != nil {
+			return err
+		}
+		entries, err := parseStreamEntries(reply)
+		if err != nil {
+			return err
+		}
+		if next != ">" {
+			if len(entries) == 0 {
+				next = ">"
+				continue
+			}
+			next = entries[len(entries)-1].id
+		}
+
+		for _, entry := range entries {
+			line := newlineReplacer.Replace(strings.TrimSpace(entry.fields[opts.field]))
+			if line == "" {
+				ack(entry.id)() // Nothing to parse
+				continue
+			}
+			text, ok, limitErr := limit.apply(line, lineNo)
+			lineNo++
+			if limitErr != nil {
+				return limitErr
+			}
+			if !ok {
+				ack(entry.id)()
+				continue
+			}
+			queue.pushAcked(text, ack(entry.id))
+		}
+	}
+	return nil
+}
+
+// ackRedis acknowledges parsed entries in batches until the context is cancelled
+func ackRedis(ctx context.Context, conn *redisConn, opts redisOptions, ids chan string) {
+	defer conn.conn.Close()
+	ticker := time.NewTicker(redisAckInterval)
+	defer ticker.Stop()
+
+	batch := []string{"XACK", opts.stream, opts.group}
+	flush := func() {
+		if len(batch) == 3 {
+			return
+		}
+		if _, err := conn.do(batch...); err != nil {
+			log.Printf("Error acknowledging Redis entries: %v", err)
+		}
+		batch = batch[:3]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case id := <-ids:
+			batch = append(batch, id)
+			if len(batch)-3 >= redisAckBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
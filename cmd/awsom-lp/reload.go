@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// maxConfigBytes limits the size of a configuration sent to /config
+const maxConfigBytes = 1 << 20
+
+// liveConfig holds the parser configuration of serve mode: the parser flags of
+// the command line with overrides from the -config file or the /config
+// endpoint. Every change of the overrides replaces the previous ones.
+type liveConfig struct {
+	mu        sync.Mutex
+	flags     *flag.FlagSet              // Command line providing the values of flags not overridden
+	apply     func(awsomlp.Config) error // Reconfigures the model
+	effective []string                   // Parser flags in effect, as "name value" lines
+}
+
+// newLiveConfig creates the live configuration of a model configured from the
+// parser flags of fs
+func newLiveConfig(fs *flag.FlagSet, apply func(awsomlp.Config) error) *liveConfig {
+	c := &liveConfig{flags: fs, apply: apply}
+	c.effective, _, _ = c.build(nil) // Without overrides the command line is already validated
+	return c
+}
+
+// load replaces the overrides with the content of a configuration file
+func (c *liveConfig) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := c.set(string(data)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// set replaces the overrides, one flag per line as "name value" or
+// "name=value" with an optional leading dash. Blank lines and lines starting
+// with # are ignored, and a boolean flag without a value is set to true. The
+// model is only reconfigured if the whole configuration is valid.
+func (c *liveConfig) set(overrides string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(overrides))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	effective, config, err := c.build(lines)
+	if err != nil {
+		return err
+	}
+	if err := c.apply(config); err != nil {
+		return fmt.Errorf("configuring parser: %w", err)
+	}
+	c.effective = effective
+	return nil
+}
+
+// build returns the effective parser flags and configuration with the given overrides
+func (c *liveConfig) build(overrides []string) ([]string, awsomlp.Config, error) {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	options := registerParserFlags(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		fs.Set(f.Name, c.flags.Lookup(f.Name).Value.String())
+	})
+
+	for _, line := range overrides {
+		name, value, found := strings.TrimLeft(line, "-"), "", false
+		if i := strings.IndexAny(name, " \t="); i >= 0 {
+			name, value, found = name[:i], strings.TrimSpace(name[i+1:]), true
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			return nil, awsomlp.Config{}, fmt.Errorf("unknown parser flag: %s", name)
+		}
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() && !found {
+			value = "true"
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, awsomlp.Config{}, fmt.Errorf("invalid value %q for flag %s: %w", value, name, err)
+		}
+	}
+
+	if options.autoHeader() {
+		return nil, awsomlp.Config{}, fmt.Errorf("-header auto is not supported in serve mode")
+	}
+	config, err := options.config()
+	if err != nil {
+		return nil, awsomlp.Config{}, err
+	}
+	// Validate on a scratch parser, so that an invalid configuration, e.g. with
+	// a regex that does not compile, never reaches the model
+	if err := awsomlp.NewAWSOMLP().WithConfig(config); err != nil {
+		return nil, awsomlp.Config{}, err
+	}
+	var effective []string
+	fs.VisitAll(func(f *flag.Flag) {
+		effective = append(effective, f.Name+" "+f.Value.String())
+	})
+	return effective, config, nil
+}
+
+// ServeHTTP serves /config: GET returns the parser flags in effect, one per
+// line, and PUT or POST replaces the overrides with the request body
+func (c *liveConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := c.set(string(body)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range c.effective {
+		fmt.Fprintln(w, line)
+	}
+}
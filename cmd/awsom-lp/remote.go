@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// httpHeaders collects the repeatable -http-header flag
+type httpHeaders []string
+
+// String implements flag.Value
+func (h *httpHeaders) String() string {
+	return strings.Join(*h, ", ")
+}
+
+// Set implements flag.Value, accepting "Name: value"
+func (h *httpHeaders) Set(value string) error {
+	name, _, found := strings.Cut(value, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid HTTP header %q (want \"Name: value\")", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// isURL reports whether an input is an HTTP(S) URL rather than a file path
+func isURL(input string) bool {
+	return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://")
+}
+
+// isRemote reports whether an input is read from a remote source rather than a local file
+func isRemote(input string) bool {
+	return isURL(input) || isSSH(input) || isGCP(input) || isAzure(input)
+}
+
+// inputPath returns the path used to detect the format of an input: the file
+// path, or the path component of a URL without its query string
+func inputPath(input string) string {
+	if !isURL(input) {
+		return input
+	}
+	if u, err := url.Parse(input); err == nil {
+		return u.Path
+	}
+	return input
+}
+
+// openInput opens a local file or streams a remote one over HTTP(S), SSH, from
+// Cloud Logging or from Log Analytics
+func openInput(input string, opts inputOptions) (io.ReadCloser, error) {
+	switch {
+	case isURL(input):
+		return openURL(input, opts.headers)
+	case isSSH(input):
+		return openSSH(input, false, false)
+	case isGCP(input):
+		return openGCP(input, opts.gcp)
+	case isAzure(input):
+		return openAzure(input, opts)
+	}
+	return os.Open(input)
+}
+
+// openURL starts a GET request and returns the response body, decompressing
+// gzip content encoding
+func openURL(rawURL string, headers httpHeaders) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	// Ask for gzip explicitly: the transport then leaves decompression to us,
+	// which also covers headers that set Accept-Encoding themselves
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %w", rawURL, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, resp.Body}, nil
+}
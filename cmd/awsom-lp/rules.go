@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// Alert rule defaults and limits
+const (
+	defaultRuleWindow = time.Minute
+	maxRuleWindow     = 24 * time.Hour
+	ruleActionTimeout = 10 * time.Second
+)
+
+// Actions of alert rules
+const (
+	actionLog     = "log"
+	actionWebhook = "webhook"
+	actionExec    = "exec"
+)
+
+// alertRule raises an alert when the number or rate of lines matching its
+// selector crosses a threshold within a sliding window
+type alertRule struct {
+	name           string
+	template       string // Exact template (optional)
+	templatePrefix string // Template prefix (optional)
+	eventID        int    // Pattern ID, -1 = any
+	namespace      string // Namespace with -namespace-sep (optional)
+	metric         string // count or rate (lines per second)
+	op             string // <, <=, >, >=, == or !=
+	threshold      float64
+	window         time.Duration
+	action         string
+	url            string // Webhook URL
+	command        string // Shell command of the exec action
+
+	// Lines per second in a ring buffer covering the window
+	counts  []int
+	seconds []int64 // Unix second of every slot
+	firing  bool
+}
+
+// ruleAlert describes an alert raised or resolved by a rule
+type ruleAlert struct {
+	Rule      string    `json:"rule"`
+	Status    string    `json:"status"` // firing or resolved
+	Condition string    `json:"condition"`
+	Value     float64   `json:"value"` // Count or rate in the window
+	Window    string    `json:"window"`
+	Time      time.Time `json:"time"`
+}
+
+// ruleEngine evaluates alert rules on parsed lines. Time is passed in by the
+// caller: the wall clock in serve mode, the timestamps of the lines when logs
+// are replayed. A rule is only evaluated once a whole window has been observed.
+type ruleEngine struct {
+	mu      sync.Mutex
+	rules   []*alertRule
+	span    int64 // Seconds of the longest window
+	start   int64 // Unix second of the first observation or evaluation
+	last    int64 // Last evaluated Unix second
+	actions sync.WaitGroup
+}
+
+// loadRules reads alert rules from a YAML file
+func loadRules(path string) (*ruleEngine, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	items, err := parseRuleYAML(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	engine := &ruleEngine{}
+	for i, item := range items {
+		rule, err := newAlertRule(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+		engine.rules = append(engine.rules, rule)
+		engine.span = max(engine.span, int64(len(rule.seconds)))
+	}
+	return engine, nil
+}
+
+// newAlertRule validates the fields of a rule
+func newAlertRule(item map[string]string) (*alertRule, error) {
+	rule := &alertRule{
+		name:           item["name"],
+		template:       item["template"],
+		templatePrefix: item["template_prefix"],
+		eventID:        -1,
+		namespace:      item["namespace"],
+		window:         defaultRuleWindow,
+		action:         actionLog,
+		url:            item["url"],
+		command:        item["command"],
+	}
+	for key := range item {
+		switch key {
+		case "name", "template", "template_prefix", "event_id", "namespace", "when", "window", "action", "url", "command":
+		default:
+			return nil, fmt.Errorf("unknown field: %s", key)
+		}
+	}
+	if rule.name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if id, ok := item["event_id"]; ok {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid event_id: %s", id)
+		}
+		rule.eventID = n
+	}
+
+	// Condition: <count|rate> <op> <threshold>
+	condition := strings.Fields(item["when"])
+	if len(condition) != 3 || (condition[0] != "count" && condition[0] != "rate") {
+		return nil, fmt.Errorf("invalid condition %q (want e.g. \"count < 1\" or \"rate > 100\")", item["when"])
+	}
+	switch condition[1] {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return nil, fmt.Errorf("invalid operator in condition %q", item["when"])
+	}
+	threshold, err := strconv.ParseFloat(condition[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold in condition %q", item["when"])
+	}
+	rule.metric, rule.op, rule.threshold = condition[0], condition[1], threshold
+
+	if window, ok := item["window"]; ok {
+		if rule.window, err = time.ParseDuration(window); err != nil {
+			return nil, fmt.Errorf("invalid window: %w", err)
+		}
+		if rule.window < time.Second || rule.window > maxRuleWindow {
+			return nil, fmt.Errorf("window must be between 1s and %v, got %v", maxRuleWindow, rule.window)
+		}
+	}
+	slots := int((rule.window + time.Second - 1) / time.Second)
+	rule.counts, rule.seconds = make([]int, slots), make([]int64, slots)
+
+	if action, ok := item["action"]; ok {
+		rule.action = action
+	}
+	switch rule.action {
+	case actionLog:
+	case actionWebhook:
+		if !strings.HasPrefix(rule.url, "http://") && !strings.HasPrefix(rule.url, "https://") {
+			return nil, fmt.Errorf("webhook action needs an http(s) url")
+		}
+	case actionExec:
+		if rule.command == "" {
+			return nil, fmt.Errorf("exec action needs a command")
+		}
+	default:
+		return nil, fmt.Errorf("invalid action: %s (use log, webhook or exec)", rule.action)
+	}
+	return rule, nil
+}
+
+// matches reports whether a parsed line is selected by the rule
+func (r *alertRule) matches(namespace string, eventID int, template string) bool {
+	return (r.template == "" || template == r.template) &&
+		(r.templatePrefix == "" || strings.HasPrefix(template, r.templatePrefix)) &&
+		(r.eventID < 0 || eventID == r.eventID) &&
+		(r.namespace == "" || namespace == r.namespace)
+}
+
+// value returns the count or rate of matching lines in the window ending at second now
+func (r *alertRule) value(now int64) float64 {
+	total := 0
+	for i, second := range r.seconds {
+		if second > now-int64(len(r.seconds)) && second <= now {
+			total += r.counts[i]
+		}
+	}
+	if r.metric == "rate" {
+		return float64(total) / r.window.Seconds()
+	}
+	return float64(total)
+}
+
+// holds reports whether the condition is met by value
+func (r *alertRule) holds(value float64) bool {
+	switch r.op {
+	case "<":
+		return value < r.threshold
+	case "<=":
+		return value <= r.threshold
+	case ">":
+		return value > r.threshold
+	case ">=":
+		return value >= r.threshold
+	case "==":
+		return value == r.threshold
+	default:
+		return value != r.threshold
+	}
+}
+
+// observe counts a parsed line at the given time, evaluating the rules first
+// if a new second began
+func (e *ruleEngine) observe(namespace string, eventID int, template string, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.evaluateLocked(at)
+	second := at.Unix()
+	for _, rule := range e.rules {
+		if !rule.matches(namespace, eventID, template) {
+			continue
+		}
+		slot := int(second % int64(len(rule.counts)))
+		if rule.seconds[slot] != second {
+			rule.seconds[slot], rule.counts[slot] = second, 0
+		}
+		rule.counts[slot]++
+	}
+}
+
+// evaluate checks the rules at the given time, e.g. every second from a ticker
+func (e *ruleEngine) evaluate(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.evaluateLocked(now)
+}
+
+// evaluateLocked evaluates the rules at every second since the last evaluation,
+// so that alerts carry the time their condition changed even if no line
+// arrived in between. Once the longest window has passed without lines, nothing
+// changes anymore, so the seconds up to now are skipped.
+func (e *ruleEngine) evaluateLocked(now time.Time) {
+	second := now.Unix()
+	if e.start == 0 {
+		e.start, e.last = second, second-1
+	}
+	if second <= e.last {
+		return
+	}
+	from := e.last + 1
+	for s := from; s <= second; s++ {
+		if s > from+e.span {
+			s = second
+		}
+		e.evaluateAt(s, now.Location())
+	}
+	e.last = second
+}
+
+// evaluateAt raises or resolves alerts for the windows ending before second s
+func (e *ruleEngine) evaluateAt(s int64, loc *time.Location) {
+	for _, rule := range e.rules {
+		if s-e.start < int64(len(rule.seconds)) {
+			continue // The window is not complete yet
+		}
+		value := rule.value(s - 1)
+		if holds := rule.holds(value); holds != rule.firing {
+			rule.firing = holds
+			status := "resolved"
+			if holds {
+				status = "firing"
+			}
+			e.act(rule, ruleAlert{
+				Rule:      rule.name,
+				Status:    status,
+				Condition: fmt.Sprintf("%s %s %g", rule.metric, rule.op, rule.threshold),
+				Value:     value,
+				Window:    rule.window.String(),
+				Time:      time.Unix(s, 0).In(loc),
+			})
+		}
+	}
+}
+
+// replayEvents passes parsed events to the rules at the timestamps of their
+// lines, as if they were received live. Lines without a timestamp take the one
+// of the line before them; lines before the first timestamp are ignored.
+func replayEvents(rules *ruleEngine, events []*awsomlp.LogEvent) {
+	var last time.Time
+	for _, event := range events {
+		if t, ok := parseTimestamp(event.Raw); ok {
+			last = t
+		}
+		if !last.IsZero() {
+			rules.observe("", event.PatternID, event.Template, last)
+		}
+	}
+	if last.IsZero() {
+		log.Print("No timestamps found, alert rules were not evaluated")
+		return
+	}
+	rules.evaluate(last.Add(time.Second)) // The last second is complete
+	rules.wait()
+}
+
+// act runs the action of a rule in the background
+func (e *ruleEngine) act(rule *alertRule, alert ruleAlert) {
+	if rule.action == actionLog {
+		log.Printf("Alert %s %s at %s: %s (%g in %s)", alert.Rule, alert.Status, alert.Time.Format(time.RFC3339), alert.Condition, alert.Value, alert.Window)
+		return
+	}
+
+	e.actions.Add(1)
+	go func() {
+		defer e.actions.Done()
+		var err error
+		switch rule.action {
+		case actionWebhook:
+			err = postAlert(rule.url, alert)
+		case actionExec:
+			err = execAlert(rule.command, alert)
+		}
+		if err != nil {
+			log.Printf("Error running %s action of rule %s: %v", rule.action, rule.name, err)
+		}
+	}()
+}
+
+// wait waits for the running actions to finish
+func (e *ruleEngine) wait() {
+	e.actions.Wait()
+}
+
+// postAlert sends an alert as JSON to a webhook
+func postAlert(url string, alert ruleAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: ruleActionTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// execAlert runs a shell command with the alert in ALERT_* environment variables
+func execAlert(command string, alert ruleAlert) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"ALERT_RULE="+alert.Rule,
+		"ALERT_STATUS="+alert.Status,
+		"ALERT_CONDITION="+alert.Condition,
+		"ALERT_VALUE="+strconv.FormatFloat(alert.Value, 'g', -1, 64),
+		"ALERT_WINDOW="+alert.Window,
+		"ALERT_TIME="+alert.Time.Format(time.RFC3339),
+	)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	timer := time.AfterFunc(ruleActionTimeout, func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+	return cmd.Run()
+}
+
+// parseRuleYAML parses the subset of YAML used by rule files: a list of
+// mappings with scalar values, either at the top level or under a "rules" key.
+// Values may be plain, single-quoted or double-quoted, and # starts a comment
+// outside of quotes.
+func parseRuleYAML(r io.Reader) ([]map[string]string, error) {
+	var items []map[string]string
+	var item map[string]string
+	itemIndent := -1
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+		}
+		indent := len(text) - len(content)
+		if content == "rules:" && indent == 0 && item == nil {
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(content, "-"); ok && (rest == "" || rest[0] == ' ') {
+			item = make(map[string]string)
+			items = append(items, item)
+			itemIndent = indent
+			content = strings.TrimLeft(rest, " ")
+			if content == "" {
+				continue
+			}
+		} else if item == nil || indent <= itemIndent {
+			return nil, fmt.Errorf("line %d: expected a list item", lineNo)
+		}
+
+		key, value, found := strings.Cut(content, ":")
+		if !found || strings.ContainsAny(key, " \"'") {
+			return nil, fmt.Errorf("line %d: expected key: value", lineNo)
+		}
+		value, err := yamlScalar(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if _, dup := item[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %s", lineNo, key)
+		}
+		item[key] = value
+	}
+	return items, scanner.Err()
+}
+
+// yamlScalar decodes a plain, single-quoted or double-quoted scalar
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) || !isYAMLComment(s[end+1:]) {
+			return "", fmt.Errorf("invalid double-quoted value: %s", s)
+		}
+		return strconv.Unquote(s[:end+1])
+	case strings.HasPrefix(s, "'"):
+		var sb strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				sb.WriteByte(s[i])
+			} else if i+1 < len(s) && s[i+1] == '\'' {
+				sb.WriteByte('\'')
+				i++
+			} else if isYAMLComment(s[i+1:]) {
+				return sb.String(), nil
+			} else {
+				break
+			}
+		}
+		return "", fmt.Errorf("invalid single-quoted value: %s", s)
+	default:
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(s), nil
+	}
+}
+
+// isYAMLComment reports whether the rest of a line after a value is blank or a comment
+func isYAMLComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// runServe runs the long-lived serve mode: log lines are read from stdin and
+// learned one at a time, and the model is snapshotted to a state file
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	parserOptions := registerParserFlags(fs)
+	otlpOptions := registerOTLPFlags(fs)
+	var (
+		statePath    = fs.String("state", "", "State file to restore at startup and snapshot to (empty = no persistence)")
+		interval     = fs.Duration("snapshot-interval", 5*time.Minute, "Interval between state snapshots (0 = only on SIGHUP and exit)")
+		quiet        = fs.Bool("quiet", false, "Do not print the template of every line")
+		verbose      = fs.Bool("verbose", false, "Log snapshots to stderr")
+		maxLineBytes = fs.Int("max-line-bytes", defaultMaxLineBytes, "Maximum line length in bytes (-1 = unlimited)")
+		longLines    = fs.String("long-lines", "truncate", "Policy for lines longer than -max-line-bytes: truncate, skip, error")
+		namespaceSep = fs.String("namespace-sep", "", "Split each line at the first occurrence of this separator into a namespace and the message, learning each namespace separately")
+		rate         = fs.Float64("rate", 0, "Maximum number of lines parsed per second (0 = unlimited)")
+		queueSize    = fs.Int("queue", 10000, "Maximum number of lines waiting to be parsed")
+		overflow     = fs.String("overflow", overflowBlock, "Policy for a full queue: block (stop reading), drop (drop new lines), oldest (drop the oldest queued line)")
+		followPath   = fs.String("follow", "", "Follow this file or ssh://[user@]host/path like tail -F instead of reading stdin, reopening it when rotated or truncated")
+		fromStart    = fs.Bool("from-start", false, "With -follow, read the existing content of the file before following it")
+		rotatedTail  = fs.Bool("rotated-tail", false, "With -follow, read the lines missed before a truncation from the rotated copy (<file>.1 or <file>.1.gz)")
+		pollInterval = fs.Duration("poll", time.Second, "With -follow, interval between checks for new data")
+		mqttBroker   = fs.String("mqtt", "", "Subscribe to an MQTT broker instead of reading stdin: mqtt://[user[:password]@]host[:port] or mqtts:// for TLS")
+		mqttTopic    = fs.String("mqtt-topic", "#", "MQTT topic filter to subscribe to")
+		mqttQoS      = fs.Int("mqtt-qos", 0, "MQTT subscription QoS: 0, 1 or 2")
+		mqttClientID = fs.String("mqtt-client-id", "", "MQTT client ID (empty = random)")
+		redisServer  = fs.String("redis", "", "Consume a Redis stream instead of reading stdin: redis://[user:password@]host[:port][/db] or rediss:// for TLS")
+		redisStream  = fs.String("redis-stream", "logs", "Redis stream key")
+		redisGroup   = fs.String("redis-group", "awsom-lp", "Redis consumer group, created if missing")
+		redisName    = fs.String("redis-consumer", "", "Redis consumer name (empty = host name)")
+		redisField   = fs.String("redis-field", "message", "Stream entry field holding the log line")
+		natsServer   = fs.String("nats", "", "Consume a NATS JetStream stream instead of reading stdin: nats://[user:password@|token@]host[:port] or tls:// for TLS")
+		natsStream   = fs.String("nats-stream", "", "JetStream stream name")
+		natsDurable  = fs.String("nats-durable", "awsom-lp", "Durable JetStream consumer name, created if missing")
+		natsSubject  = fs.String("nats-subject", "", "Only consume messages of this subject filter (empty = whole stream)")
+		forwardAddr  = fs.String("forward", "", "Accept the Fluentd/Fluent Bit forward protocol on this address (e.g. :24224) instead of reading stdin")
+		forwardKeys  = fs.String("forward-key", "log,message", "Record keys holding the log line for -forward, comma-separated, the first one present is used")
+		outputMode   = fs.String("output", outputText, "Output format: text (pattern ID and template per line) or ndjson (every line as JSON with event_id, template and params)")
+		configPath   = fs.String("config", "", "File overriding parser flags, one per line as \"name value\", loaded at startup and reloaded on SIGHUP")
+		httpAddr     = fs.String("http", "", "Serve the HTTP control API on this address (e.g. :8080): GET/PUT /config, GET /healthz and /readyz")
+		ingest       = fs.Bool("ingest", false, "Accept log lines POSTed to /ingest on the -http address instead of reading stdin")
+		clientRate   = fs.Float64("client-rate", 0, "Maximum number of lines per second each client may send to -ingest or -forward (0 = unlimited)")
+		clientBurst  = fs.Int("client-burst", 0, "Number of lines a client may send at once above -client-rate (0 = one second's worth)")
+		maxBatch     = fs.Int("max-batch", 0, "Maximum number of lines per -ingest request or -forward chunk (0 = unlimited)")
+		rulesPath    = fs.String("rules", "", "YAML file of alert rules evaluated on the parsed lines")
+		reclusterN   = fs.Int("recluster-window", 0, "Periodically regroup this many most recent lines and move those that no longer fit their template to a template of their own (0 = disabled)")
+		reclusterInt = fs.Duration("recluster-interval", time.Minute, "Interval between -recluster-window runs")
+	)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [options] < logs\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reads log lines from stdin and prints \"<pattern id>\\t<template>\" for each line.\n")
+		fmt.Fprintf(os.Stderr, "With -state the learned model is restored at startup and saved periodically,\n")
+		fmt.Fprintf(os.Stderr, "on SIGHUP and on exit. With -namespace-sep every namespace has its own templates\n")
+		fmt.Fprintf(os.Stderr, "and the output is \"<namespace>\\t<pattern id>\\t<template>\".\n")
+		fmt.Fprintf(os.Stderr, "Lines wait in a bounded queue; with -rate and a drop policy bursts are shed\n")
+		fmt.Fprintf(os.Stderr, "instead of growing memory, and dropped lines are reported on exit.\n")
+		fmt.Fprintf(os.Stderr, "With -follow a file is read like tail -F, surviving rotation and truncation.\n")
+		fmt.Fprintf(os.Stderr, "With -mqtt the payload of every message received on -mqtt-topic is a line.\n")
+		fmt.Fprintf(os.Stderr, "With -redis or -nats a stream is consumed by a durable consumer that\n")
+		fmt.Fprintf(os.Stderr, "acknowledges every message once it is parsed. With -forward Fluentd and\n")
+		fmt.Fprintf(os.Stderr, "Fluent Bit agents can send records with their forward output.\n")
+		fmt.Fprintf(os.Stderr, "With -output ndjson every line is re-emitted as a JSON object with its header\n")
+		fmt.Fprintf(os.Stderr, "fields, event_id, template and the params extracted from it. With -otlp every\n")
+		fmt.Fprintf(os.Stderr, "line is also exported as an OTLP log record to an OpenTelemetry Collector.\n")
+		fmt.Fprintf(os.Stderr, "Parser flags can be changed without a restart: -config is reloaded on SIGHUP,\n")
+		fmt.Fprintf(os.Stderr, "and PUT /config on the -http address replaces the overrides with its body.\n")
+		fmt.Fprintf(os.Stderr, "Learned patterns are kept and regrouped if every line was retained;\n")
+		fmt.Fprintf(os.Stderr, "otherwise only their templates are regenerated. /healthz and /readyz report the\n")
+		fmt.Fprintf(os.Stderr, "queue depth, snapshot age and error counts for probes and load balancers.\n")
+		fmt.Fprintf(os.Stderr, "With -ingest clients POST lines to /ingest; -client-rate and -max-batch limit\n")
+		fmt.Fprintf(os.Stderr, "every client of -ingest and -forward, rejecting excess batches with 429 and 413.\n")
+		fmt.Fprintf(os.Stderr, "With -rules alerts are raised when the count or rate of lines of a template\n")
+		fmt.Fprintf(os.Stderr, "crosses a threshold in a sliding window. With -recluster-window the most recent\n")
+		fmt.Fprintf(os.Stderr, "lines are regrouped periodically, so templates follow wording changed by a deploy.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  tail -F app.log | %s serve -state app.model -snapshot-interval 1m -max-events 5\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  collector | %s serve -state tenants.model -namespace-sep $'\\t'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  tail -F app.log | %s serve -rate 5000 -queue 50000 -overflow oldest\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -follow /var/log/app.log -rotated-tail -state app.model\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -follow ssh://ops@web1:/var/log/app.log\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -mqtt mqtts://broker:8883 -mqtt-topic 'devices/+/logs' -mqtt-qos 1\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -redis redis://cache:6379/0 -redis-stream app-logs -state app.model\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -nats nats://bus:4222 -nats-stream LOGS -nats-subject 'logs.app.>' -state app.model\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -forward :24224 -forward-key log -state app.model\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -follow /var/log/app.log -output ndjson | vector --config ship.toml\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -follow /var/log/app.log -quiet -otlp http://collector:4317 -otlp-protocol grpc\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -follow /var/log/app.log -config parser.conf -http :8080 -state app.model\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -http :8080 -ingest -client-rate 1000 -max-batch 5000 -state app.model\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -follow /var/log/hdfs.log -header hdfs -rules alerts.yaml -quiet\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s serve -follow /var/log/app.log -recluster-window 5000 -recluster-interval 5m -state app.model\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	limit, err := newLineLimit(*maxLineBytes, *longLines)
+	if err != nil {
+		log.Fatal(err)
+	}
+	queue, err := newLineQueue(*queueSize, *overflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limiter, err := newRateLimiter(*rate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clients, err := newClientLimiter(*clientRate, *clientBurst, *maxBatch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	health := &serveHealth{started: time.Now(), queue: queue, interval: *interval, clients: clients}
+
+	if parserOptions.autoHeader() {
+		log.Fatal("-header auto is not supported in serve mode")
+	}
+	config, err := parserOptions.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mode, err := checkOutput(*outputMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mode == outputCSV {
+		log.Fatal("-output csv is not supported in serve mode")
+	}
+	if *reclusterN < 0 {
+		log.Fatal("-recluster-window must not be negative")
+	}
+	if *reclusterN > 0 && *reclusterInt <= 0 {
+		log.Fatal("-recluster-interval must be positive")
+	}
+	var rules *ruleEngine
+	if *rulesPath != "" {
+		if rules, err = loadRules(*rulesPath); err != nil {
+			log.Fatalf("Error loading rules: %v", err)
+		}
+	}
+	var exporter *otlpExporter
+	if otlpOptions.endpoint != "" {
+		if exporter, err = newOTLPExporter(*otlpOptions); err != nil {
+			log.Fatal(err)
+		}
+		health.exporter = exporter
+	}
+	// export sends a parsed line to the alert rules and the OTLP exporter, if any
+	export := func(namespace string, result awsomlp.ParseResult) {
+		if rules != nil {
+			rules.observe(namespace, result.PatternID, result.Template, time.Now())
+		}
+		if exporter == nil {
+			return
+		}
+		exporter.export(otlpRecord{
+			raw:       result.Raw,
+			fields:    result.Fields,
+			namespace: namespace,
+			eventID:   result.PatternID,
+			template:  result.Template,
+			params:    awsomlp.ExtractParams(result.Template, result.Raw),
+			observed:  time.Now(),
+		})
+	}
+
+	// A single parser learns all lines unless they are split into namespaces
+	var model awsomlp.Snapshotter
+	var feed func(line string) string
+	var reconfigure func(awsomlp.Config) error
+	var recluster func(window int) (int, error)
+	if *namespaceSep == "" {
+		parser := awsomlp.NewAWSOMLP()
+		if err := parser.WithConfig(config); err != nil {
+			log.Fatalf("Error configuring parser: %v", err)
+		}
+		model, reconfigure, recluster = parser, parser.Reconfigure, parser.Recluster
+		feed = func(line string) string {
+			result, ok := parser.Feed(line)
+			if !ok {
+				return ""
+			}
+			export("", result)
+			if mode == outputNDJSON {
+				params := awsomlp.ExtractParams(result.Template, result.Raw)
+				return string(enrichedEvent(result.Raw, result.Fields, nil, result.PatternID, result.Template, params))
+			}
+			return fmt.Sprintf("%d\t%s\n", result.PatternID, result.Template)
+		}
+	} else {
+		set, err := awsomlp.NewParserSet(config)
+		if err != nil {
+			log.Fatalf("Error configuring parser: %v", err)
+		}
+		model, reconfigure, recluster = set, set.Reconfigure, set.Recluster
+		feed = func(line string) string {
+			namespace, message, found := strings.Cut(line, *namespaceSep)
+			if !found {
+				namespace, message = "", line // Lines without a namespace share the default one
+			}
+			result, ok := set.Feed(namespace, message)
+			if !ok {
+				return ""
+			}
+			export(namespace, result)
+			if mode == outputNDJSON {
+				params := awsomlp.ExtractParams(result.Template, result.Raw)
+				extra := map[string]any{"namespace": namespace}
+				return string(enrichedEvent(result.Raw, result.Fields, extra, result.PatternID, result.Template, params))
+			}
+			return fmt.Sprintf("%s\t%d\t%s\n", namespace, result.PatternID, result.Template)
+		}
+	}
+
+	// Parser flags can be overridden at runtime
+	live := newLiveConfig(fs, reconfigure)
+	if *configPath != "" {
+		if err := live.load(*configPath); err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+
+	var snapshots *awsomlp.SnapshotManager
+	if *statePath != "" {
+		snapshots = awsomlp.NewSnapshotManager(model, *statePath, *interval)
+		snapshots.OnError = func(err error) {
+			health.snapshotErrors.Add(1)
+			log.Printf("Error writing snapshot: %v", err)
+		}
+		health.snapshots = snapshots
+		restored, err := snapshots.Restore()
+		if err != nil {
+			log.Fatalf("Error restoring state from %s: %v", *statePath, err)
+		}
+		if restored && *verbose {
+			log.Printf("Restored state from %s", *statePath)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	if snapshots != nil {
+		go snapshots.Run(ctx)
+	}
+	if rules != nil {
+		// Rules are evaluated every second, also while no lines arrive
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					rules.evaluate(now)
+				}
+			}
+		}()
+	}
+
+	if *reclusterN > 0 {
+		// Recent lines are regrouped in the background while learning continues
+		go func() {
+			ticker := time.NewTicker(*reclusterInt)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					moved, err := recluster(*reclusterN)
+					if err != nil {
+						log.Printf("Error reclustering: %v", err)
+					} else if *verbose && moved > 0 {
+						log.Printf("Reclustered %d lines", moved)
+					}
+				}
+			}
+		}()
+	}
+
+	var input io.Reader = os.Stdin
+	sources := 0
+	for _, source := range []string{*followPath, *mqttBroker, *redisServer, *natsServer, *forwardAddr} {
+		if source != "" {
+			sources++
+		}
+	}
+	if *ingest {
+		sources++
+		if *httpAddr == "" {
+			log.Fatal("-ingest requires -http")
+		}
+	}
+	if sources > 1 {
+		log.Fatal("only one of -follow, -mqtt, -redis, -nats, -forward and -ingest can be used")
+	}
+
+	// Lines are read from stdin, a followed file or a message source
+	read := func() error { return readLines(input, queue, limit) }
+	switch {
+	case *redisServer != "":
+		consumer := *redisName
+		if consumer == "" {
+			if consumer, err = os.Hostname(); err != nil {
+				log.Fatalf("Error getting host name for -redis-consumer: %v", err)
+			}
+		}
+		opts := redisOptions{
+			server:   *redisServer,
+			stream:   *redisStream,
+			group:    *redisGroup,
+			consumer: consumer,
+			field:    *redisField,
+		}
+		read = func() error { return readRedis(ctx, opts, queue, limit) }
+	case *natsServer != "":
+		opts := natsOptions{
+			server:   *natsServer,
+			stream:   *natsStream,
+			durable:  *natsDurable,
+			subject:  *natsSubject,
+			clientID: "awsom-lp " + *natsDurable,
+		}
+		read = func() error { return readNATS(ctx, opts, queue, limit) }
+	case *forwardAddr != "":
+		opts := forwardOptions{
+			addr:    *forwardAddr,
+			keys:    strings.Split(*forwardKeys, ","),
+			clients: clients,
+		}
+		read = func() error { return serveForward(ctx, opts, queue, limit) }
+	case *ingest:
+		// Lines are pushed by the /ingest handler until shutdown
+		read = func() error {
+			<-ctx.Done()
+			queue.close()
+			return nil
+		}
+	case *mqttBroker != "":
+		subscriber, err := newMQTTReader(ctx, mqttOptions{
+			broker:   *mqttBroker,
+			topic:    *mqttTopic,
+			qos:      *mqttQoS,
+			clientID: *mqttClientID,
+		})
+		if err != nil {
+			log.Fatalf("Error subscribing to %s: %v", *mqttBroker, err)
+		}
+		input = subscriber
+	case isSSH(*followPath):
+		// The remote tail -F takes care of rotation
+		remote, err := openSSH(*followPath, true, *fromStart)
+		if err != nil {
+			log.Fatalf("Error opening %s: %v", *followPath, err)
+		}
+		defer remote.Close()
+		input = remote
+	case *followPath != "":
+		follower, err := newFollower(ctx, *followPath, *fromStart, *rotatedTail, *pollInterval)
+		if err != nil {
+			log.Fatalf("Error opening %s: %v", *followPath, err)
+		}
+		defer follower.Close()
+		input = follower
+	}
+
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/config", live)
+		mux.HandleFunc("/healthz", health.serveHealthz)
+		mux.HandleFunc("/readyz", health.serveReadyz)
+		if *ingest {
+			mux.Handle("/ingest", &ingestHandler{queue: queue, clients: clients, limit: limit})
+		}
+		server := &http.Server{Addr: *httpAddr, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Error serving HTTP: %v", err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	var output io.Writer = os.Stdout
+	if *quiet {
+		output = io.Discard
+	}
+	go func() {
+		if err := read(); err != nil {
+			health.inputErrors.Add(1)
+			log.Printf("Error reading input: %v", err)
+		}
+		health.inputDone.Store(true)
+	}()
+	done := make(chan struct{})
+	go func() {
+		processLines(queue, output, feed, limiter)
+		close(done)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-done:
+			running = false
+		case <-hup:
+			if *configPath != "" {
+				if err := live.load(*configPath); err != nil {
+					health.configErrors.Add(1)
+					log.Printf("Error reloading config: %v", err)
+				} else if *verbose {
+					log.Printf("Reloaded config from %s", *configPath)
+				}
+			}
+			if snapshots != nil && saveSnapshot(snapshots, *statePath, *verbose) != nil {
+				health.snapshotErrors.Add(1)
+			}
+			if *verbose {
+				reportQueue(queue)
+			}
+		}
+	}
+
+	health.stopping.Store(true)
+	if snapshots != nil {
+		saveSnapshot(snapshots, *statePath, *verbose)
+	}
+	if exporter != nil {
+		exporter.Close()
+	}
+	if rules != nil {
+		rules.wait()
+	}
+	if _, dropped, _ := queue.stats(); *verbose || dropped > 0 {
+		reportQueue(queue)
+	}
+}
+
+// readLines reads lines from r into the queue and closes it at the end of the input
+func readLines(r io.Reader, queue *lineQueue, limit *lineLimit) error {
+	defer queue.close()
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for lineNo := 1; ; lineNo++ {
+		line, err := readLine(reader, limit.maxBytes)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if line != "" {
+			text, ok, limitErr := limit.apply(line, lineNo)
+			if limitErr != nil {
+				return limitErr
+			}
+			if ok {
+				queue.push(text)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// processLines passes queued lines to feed at the limited rate and writes the returned output to w
+func processLines(queue *lineQueue, w io.Writer, feed func(line string) string, limiter *rateLimiter) {
+	for {
+		line, ok := queue.pop()
+		if !ok {
+			return
+		}
+		limiter.wait()
+		io.WriteString(w, feed(line.text))
+		if line.ack != nil {
+			line.ack()
+		}
+	}
+}
+
+// reportQueue logs the input line counters
+func reportQueue(queue *lineQueue) {
+	received, dropped, queued := queue.stats()
+	log.Printf("Input lines: %d received, %d dropped, %d queued", received, dropped, queued)
+}
+
+// saveSnapshot writes a snapshot and reports the outcome
+func saveSnapshot(snapshots *awsomlp.SnapshotManager, path string, verbose bool) error {
+	if err := snapshots.Save(); err != nil {
+		log.Printf("Error writing snapshot: %v", err)
+		return err
+	}
+	if verbose {
+		log.Printf("State saved to %s", path)
+	}
+	return nil
+}
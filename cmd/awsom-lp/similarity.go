@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// writeSimilarityMatrix writes the -similarity-matrix CSV file for an evenly
+// spaced sample of the parsed lines: per sampled line its number, event ID,
+// the most similar pattern of another event with the similarity and the
+// threshold to join it, the line, and its similarity to every sampled line
+func writeSimilarityMatrix(path string, parser *awsomlp.AWSOMLP, events []*awsomlp.LogEvent, eventIDs map[int]int, sample int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeSimilarityCSV(file, parser, events, eventIDs, sample); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeSimilarityCSV writes the similarity matrix of a sample of events to w
+func writeSimilarityCSV(w io.Writer, parser *awsomlp.AWSOMLP, events []*awsomlp.LogEvent, eventIDs map[int]int, sample int) error {
+	indexes := make([]int, 0, sample)
+	for i := range min(sample, len(events)) {
+		indexes = append(indexes, i*len(events)/min(sample, len(events)))
+	}
+	lines := make([]string, len(indexes))
+	for i, index := range indexes {
+		lines[i] = events[index].Raw
+	}
+	matrix := parser.SimilarityMatrix(lines)
+
+	out := csv.NewWriter(w)
+	header := []string{"lineno", "event_id", "nearest_event_id", "nearest_similarity", "nearest_threshold", "message"}
+	for _, index := range indexes {
+		header = append(header, strconv.Itoa(index+1))
+	}
+	out.Write(header)
+	for i, index := range indexes {
+		event := events[index]
+		row := []string{strconv.Itoa(index + 1), strconv.Itoa(event.PatternID), "", "", ""}
+		for _, score := range parser.NearestPatterns(event.Raw, 0) {
+			if id := eventIDs[score.PatternID]; id != event.PatternID {
+				row[2], row[3], row[4] = strconv.Itoa(id), formatScore(score.Similarity), formatScore(score.Threshold)
+				break
+			}
+		}
+		row = append(row, event.Raw)
+		for _, similarity := range matrix[i] {
+			row = append(row, formatScore(similarity))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// formatScore formats a similarity with four decimals
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', 4, 64)
+}
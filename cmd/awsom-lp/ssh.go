@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// sshTarget is a remote file given as ssh://[user@]host[:port]/path; the
+// scp-like form ssh://user@host:/path is accepted as well
+type sshTarget struct {
+	host string // [user@]host
+	port string // Empty for the ssh default
+	path string
+}
+
+// isSSH reports whether an input is an ssh:// URL
+func isSSH(input string) bool {
+	return strings.HasPrefix(input, "ssh://")
+}
+
+// parseSSHTarget splits an ssh:// URL into host, port and remote path
+func parseSSHTarget(input string) (sshTarget, error) {
+	rest := strings.TrimPrefix(input, "ssh://")
+	slash := strings.IndexByte(rest, '/')
+	if slash < 0 {
+		return sshTarget{}, fmt.Errorf("invalid SSH input %s: no remote path", input)
+	}
+	target := sshTarget{host: strings.TrimSuffix(rest[:slash], ":"), path: rest[slash:]}
+
+	// A colon after the user part separates the port
+	at := strings.LastIndexByte(target.host, '@')
+	if colon := strings.LastIndexByte(target.host, ':'); colon > at {
+		target.host, target.port = target.host[:colon], target.host[colon+1:]
+	}
+	if target.host == "" || strings.HasSuffix(target.host, "@") {
+		return sshTarget{}, fmt.Errorf("invalid SSH input %s: no host", input)
+	}
+	return target, nil
+}
+
+// sshReader streams the output of a command run on a remote host by the
+// system ssh client, so keys, agents and ~/.ssh/config apply as usual
+type sshReader struct {
+	host   string
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool // The command was waited for
+}
+
+// openSSH streams a remote file. With follow it is followed like tail -F,
+// from its beginning if fromStart is set or else from its end.
+func openSSH(input string, follow, fromStart bool) (*sshReader, error) {
+	target, err := parseSSHTarget(input)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := "cat -- " + shellQuote(target.path)
+	if follow {
+		lines := "0"
+		if fromStart {
+			lines = "+1"
+		}
+		remote = "tail -n " + lines + " -F -- " + shellQuote(target.path)
+	}
+	args := []string{}
+	if target.port != "" {
+		args = append(args, "-p", target.port)
+	}
+	args = append(args, "--", target.host, remote)
+
+	r := &sshReader{host: target.host, cmd: exec.Command("ssh", args...)}
+	r.cmd.Stderr = &r.stderr
+	if r.stdout, err = r.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := r.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting ssh: %w", err)
+	}
+	return r, nil
+}
+
+// Read reads the remote output; a failure of the remote command is reported at its end
+func (r *sshReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		if waitErr := r.cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("ssh %s: %v: %s", r.host, waitErr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+// Close stops the ssh client if it is still running
+func (r *sshReader) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+	return nil
+}
+
+// shellQuote quotes a string for the remote POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
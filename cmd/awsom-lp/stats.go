@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// statsPercentiles are the group-size percentiles printed by the stats command
+var statsPercentiles = []float64{50, 90, 99}
+
+// statsCoverage are the shares of lines the coverage curve is printed for
+var statsCoverage = []float64{50, 80, 90, 95, 99, 100}
+
+// runStats runs the stats command: distribution summaries of a saved model
+func runStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var (
+		modelPath = fs.String("model", "", "State file of the model, e.g. written by -save-state or serve -state (required)")
+		top       = fs.Int("top", 10, "Number of largest and most wildcarded templates to list")
+	)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s stats -model <file> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Summarizes a learned model as a health check: percentiles of the number of lines\n")
+		fmt.Fprintf(os.Stderr, "per template, the distribution of the share of placeholders in the templates,\n")
+		fmt.Fprintf(os.Stderr, "how many templates cover a share of the lines, and the largest and most\n")
+		fmt.Fprintf(os.Stderr, "wildcarded templates.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  %s -input app.log -save-state model.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s stats -model model.json -top 5\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	if *modelPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *top < 0 {
+		log.Fatalf("-top must not be negative, got %d", *top)
+	}
+
+	file, err := os.Open(*modelPath)
+	if err != nil {
+		log.Fatalf("Error reading model: %v", err)
+	}
+	model := awsomlp.NewAWSOMLP()
+	err = model.ImportState(file)
+	file.Close()
+	if err != nil {
+		log.Fatalf("Error reading model %s: %v", *modelPath, err)
+	}
+	writeStats(os.Stdout, model.GetTemplatesByFrequency(), *top)
+}
+
+// templateStats is a template with the share of its tokens holding a placeholder
+type templateStats struct {
+	awsomlp.TemplateCount
+	ratio float64
+}
+
+// placeholderRatio returns the share of the tokens of a template containing a placeholder
+func placeholderRatio(template string) float64 {
+	tokens := strings.Fields(template)
+	if len(tokens) == 0 {
+		return 0
+	}
+	wildcards := 0
+	for _, token := range tokens {
+		if strings.Contains(token, "<*>") {
+			wildcards++
+		}
+	}
+	return float64(wildcards) / float64(len(tokens))
+}
+
+// percentile returns the nearest-rank percentile of ascending values
+func percentile(sorted []int, p float64) int {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// writeStats writes the distribution summaries of templates ordered by count,
+// most frequent first
+func writeStats(w io.Writer, counts []awsomlp.TemplateCount, top int) {
+	if len(counts) == 0 {
+		fmt.Fprintln(w, "The model has no templates")
+		return
+	}
+	templates := make([]templateStats, len(counts))
+	sizes := make([]int, len(counts))
+	lines, singletons := 0, 0
+	for i, tc := range counts {
+		templates[i] = templateStats{tc, placeholderRatio(tc.Template)}
+		sizes[i] = tc.Count
+		lines += tc.Count
+		if tc.Count == 1 {
+			singletons++
+		}
+	}
+	sort.Ints(sizes)
+
+	fmt.Fprintf(w, "Templates: %d\nLines: %d\nSingletons: %d (%.1f%%)\n", len(counts), lines, singletons, 100*float64(singletons)/float64(len(counts)))
+
+	fmt.Fprintf(w, "\nLines per template:\n  min %d", sizes[0])
+	for _, p := range statsPercentiles {
+		fmt.Fprintf(w, "  p%g %d", p, percentile(sizes, p))
+	}
+	fmt.Fprintf(w, "  max %d  mean %.1f\n", sizes[len(sizes)-1], float64(lines)/float64(len(sizes)))
+
+	// Placeholder ratio in quarters, with no placeholders apart
+	buckets := []struct {
+		label            string
+		templates, lines int
+	}{{label: "0%"}, {label: "1-25%"}, {label: "26-50%"}, {label: "51-75%"}, {label: "76-100%"}}
+	for _, t := range templates {
+		bucket := 0
+		if t.ratio > 0 {
+			bucket = 1 + min(int(math.Ceil(t.ratio*4))-1, 3)
+		}
+		buckets[bucket].templates++
+		buckets[bucket].lines += t.Count
+	}
+	fmt.Fprintf(w, "\nPlaceholders per token:\n")
+	for _, b := range buckets {
+		fmt.Fprintf(w, "  %-8s %6d templates %10d lines\n", b.label, b.templates, b.lines)
+	}
+
+	// counts is ordered by count, so the curve takes the largest templates first
+	fmt.Fprintf(w, "\nTemplates covering a share of lines:\n")
+	covered, next := 0, 0
+	for i, tc := range counts {
+		covered += tc.Count
+		for next < len(statsCoverage) && float64(covered) >= statsCoverage[next]/100*float64(lines) {
+			fmt.Fprintf(w, "  %3g%% %6d templates\n", statsCoverage[next], i+1)
+			next++
+		}
+	}
+
+	if top == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nLargest templates:\n")
+	for _, t := range templates[:min(top, len(templates))] {
+		fmt.Fprintf(w, "  [%d] %s\n", t.Count, t.Template)
+	}
+
+	// The stable sort keeps larger templates first among equal ratios
+	sort.SliceStable(templates, func(i, j int) bool { return templates[i].ratio > templates[j].ratio })
+	fmt.Fprintf(w, "\nMost wildcarded templates:\n")
+	for _, t := range templates[:min(top, len(templates))] {
+		if t.ratio == 0 {
+			break
+		}
+		fmt.Fprintf(w, "  [%.0f%%, %d] %s\n", 100*t.ratio, t.Count, t.Template)
+	}
+}
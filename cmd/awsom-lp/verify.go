@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	awsomlp "github.com/n0madic/awsom-lp"
+)
+
+// reportRoundTrip writes the issues found by -verify and returns their number
+func reportRoundTrip(w io.Writer, issues []awsomlp.RoundTripIssue) int {
+	lossy := 0
+	for _, issue := range issues {
+		switch issue.Kind {
+		case awsomlp.RoundTripLossy:
+			lossy++
+			fmt.Fprintf(w, "lossy: line %d cannot be reconstructed from %q: %s\n", issue.Index+1, issue.Template, issue.Raw)
+		case awsomlp.RoundTripConstant:
+			fmt.Fprintf(w, "constant: placeholder %d of %q is %q in all %d lines, e.g. line %d: %s\n",
+				issue.Placeholder+1, issue.Template, issue.Value, issue.Lines, issue.Index+1, issue.Raw)
+		}
+	}
+	if len(issues) > 0 {
+		fmt.Fprintf(w, "Round trip: %d lossy lines, %d constant placeholders\n", lossy, len(issues)-lossy)
+	}
+	return len(issues)
+}
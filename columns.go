@@ -0,0 +1,84 @@
+package awsomlp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ColumnRule masks tokens by their position rather than their content, for
+// fields of free text that no regex can describe, such as the comment of an
+// audit line
+type ColumnRule struct {
+	Match  string `json:"match,omitempty"`  // Regex the content must match for the rule to apply, e.g. `^audit:` (default: every line)
+	Column int    `json:"column"`           // Position of the first masked token: 1 = first, -1 = last
+	Tokens int    `json:"tokens,omitempty"` // Number of masked tokens, replaced by a single <*> (default 1, -1 = up to the end of the line)
+}
+
+// columnMask is a compiled ColumnRule
+type columnMask struct {
+	rule ColumnRule
+	re   *regexp.Regexp // nil for rules applying to every line
+}
+
+// compileColumns validates and compiles column rules
+func compileColumns(rules []ColumnRule) ([]columnMask, error) {
+	masks := make([]columnMask, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Column == 0 {
+			return nil, fmt.Errorf("%w: column rule %q has no Column, want 1 for the first token or -1 for the last", ErrInvalidConfig, rule.Match)
+		}
+		if rule.Tokens < -1 {
+			return nil, fmt.Errorf("%w: invalid Tokens %d of column %d, want a count or -1", ErrInvalidConfig, rule.Tokens, rule.Column)
+		}
+		if rule.Tokens == 0 {
+			rule.Tokens = 1
+		}
+		mask := columnMask{rule: rule}
+		if rule.Match != "" {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, &RegexError{Field: "ColumnRules", Pattern: rule.Match, Err: err}
+			}
+			mask.re = re
+		}
+		masks = append(masks, mask)
+	}
+	return masks, nil
+}
+
+// mask replaces the rule's tokens with a single <*> if the content matches,
+// returning the tokens unchanged if the line has too few of them
+func (m columnMask) mask(content string, tokens []string) ([]string, bool) {
+	if m.re != nil && !m.re.MatchString(content) {
+		return tokens, false
+	}
+	start := m.rule.Column - 1
+	if m.rule.Column < 0 {
+		start = len(tokens) + m.rule.Column
+	}
+	if start < 0 || start >= len(tokens) {
+		return tokens, false
+	}
+	end := len(tokens)
+	if m.rule.Tokens > 0 {
+		end = min(end, start+m.rule.Tokens)
+	}
+
+	masked := make([]string, 0, len(tokens)-(end-start)+1)
+	masked = append(masked, tokens[:start]...)
+	masked = append(masked, "<*>")
+	return append(masked, tokens[end:]...), true
+}
+
+// maskColumns applies the ColumnRules in order to a tokenized event, each to
+// the result of the previous one, and rebuilds the content from the tokens
+// whenever a rule applied
+func (lp *AWSOMLP) maskColumns(event *LogEvent) {
+	for _, m := range lp.columns {
+		var masked bool
+		if event.Tokens, masked = m.mask(event.Content, event.Tokens); masked {
+			event.Content = strings.Join(event.Tokens, " ")
+		}
+	}
+}
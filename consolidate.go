@@ -0,0 +1,87 @@
+package awsomlp
+
+// consolidateSingletons merges every pattern of a single line into the larger
+// pattern of the same segment whose representative shares the most tokens with
+// it, if their token similarity reaches SingletonSimilarity. One-off lines
+// that missed a group by a few letters, such as a user name of another length,
+// thus join the template instead of becoming templates of their own. It
+// returns the pattern each merged singleton was merged into.
+func (lp *AWSOMLP) consolidateSingletons() map[*Pattern]*Pattern {
+	if lp.config.SingletonSimilarity == 0 {
+		return nil
+	}
+
+	// Only patterns that are already groups take singletons, so a singleton
+	// never absorbs another
+	var groups []*Pattern
+	for _, pattern := range lp.patterns {
+		if pattern.Count > 1 && len(pattern.Events) > 0 {
+			groups = append(groups, pattern)
+		}
+	}
+
+	merged := make(map[*Pattern]*Pattern)
+	for _, pattern := range lp.patterns {
+		if pattern.Count != 1 || len(pattern.Events) != 1 {
+			continue
+		}
+		event := pattern.Events[0]
+		var best *Pattern
+		var bestSimilarity float64
+		for _, group := range groups {
+			if group.Segment != pattern.Segment {
+				continue
+			}
+			if similarity := tokenSimilarity(event.Tokens, group.Events[0].Tokens); similarity >= lp.config.SingletonSimilarity && similarity > bestSimilarity {
+				best, bestSimilarity = group, similarity
+			}
+		}
+		if best != nil {
+			lp.mergeSingleton(best, pattern)
+			merged[pattern] = best
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	kept := lp.patterns[:0]
+	for _, pattern := range lp.patterns {
+		if merged[pattern] == nil {
+			kept = append(kept, pattern)
+		}
+	}
+	for i := len(kept); i < len(lp.patterns); i++ {
+		lp.patterns[i] = nil
+	}
+	lp.patterns = kept
+	lp.resetIndexes()
+	return merged
+}
+
+// mergeSingleton moves the line of a single-line pattern into another pattern
+func (lp *AWSOMLP) mergeSingleton(target, single *Pattern) {
+	event := single.Events[0]
+	event.PatternID = target.ID
+	if lp.config.MaxEventsPerPattern == 0 || len(target.Events) < lp.config.MaxEventsPerPattern {
+		target.Events = append(target.Events, event)
+	}
+	target.Count++
+	for _, token := range event.Tokens {
+		lp.countToken(target, token)
+	}
+	if lp.config.FreqCounting == FreqCountPositional {
+		lp.countPositions(target, event.Tokens)
+	}
+	lp.sampleExample(target, event.Raw)
+
+	if single.FirstSeen.Before(target.FirstSeen) {
+		target.FirstSeen = single.FirstSeen
+	}
+	if single.LastSeen.After(target.LastSeen) {
+		target.Weight = lp.decay(target.Weight, single.LastSeen.Sub(target.LastSeen))
+		target.LastSeen = single.LastSeen
+		target.lastLine = single.lastLine
+	}
+	target.Weight += lp.decay(single.Weight, target.LastSeen.Sub(single.LastSeen))
+}
@@ -0,0 +1,134 @@
+package awsomlp
+
+import (
+	"fmt"
+	"math"
+)
+
+// Stability reports how consistent the templates of independently parsed
+// folds of the same input are
+type Stability struct {
+	Folds            []FoldStats // Lines and templates of each fold
+	MeanJaccard      float64     // Mean Jaccard similarity of the template sets of all pairs of folds (1 = identical sets)
+	MinJaccard       float64     // Lowest Jaccard similarity of a pair of folds
+	TemplateMean     float64     // Mean number of templates per fold
+	TemplateVariance float64     // Variance of the number of templates per fold
+	CountVariation   float64     // Mean coefficient of variation of the per-fold line counts of each template, missing ones counted as 0 (0 = identical counts)
+	Shared           int         // Number of templates found in every fold
+	Templates        int         // Number of distinct templates across all folds
+}
+
+// FoldStats describes one fold of a cross-validation
+type FoldStats struct {
+	Lines     int // Number of lines in the fold
+	Templates int // Number of templates learned from the fold
+}
+
+// CrossValidate splits lines into the given number of folds, parses each with
+// a fresh parser of the same configuration, and reports how consistent their
+// template sets are. Lines are dealt to the folds in turn, so every fold
+// samples the whole input. With well-tuned thresholds the folds find about the
+// same templates with proportional counts; a low MeanJaccard or a high
+// CountVariation means the templates depend on which lines were seen, e.g.
+// because MinSimilarity splits or merges groups by chance. The model of lp is
+// not changed, and OnProgress and OnExpire are not called for the folds.
+func (lp *AWSOMLP) CrossValidate(lines []string, folds int) (Stability, error) {
+	if folds < 2 {
+		return Stability{}, fmt.Errorf("%w: fold count must be at least 2, got %d", ErrInvalidConfig, folds)
+	}
+
+	config := lp.config
+	config.OnProgress = nil
+	config.OnExpire = nil
+
+	parts := make([][]string, folds)
+	for i, line := range lines {
+		parts[i%folds] = append(parts[i%folds], line)
+	}
+
+	// Line counts of every template per fold
+	counts := make(map[string][]int)
+	sets := make([]map[string]bool, folds)
+	stability := Stability{Folds: make([]FoldStats, folds)}
+	for i, part := range parts {
+		parser := NewAWSOMLP()
+		if err := parser.WithConfig(config); err != nil {
+			return Stability{}, err
+		}
+		parser.ParseEvents(part)
+
+		templates := parser.GetTemplatesByFrequency()
+		sets[i] = make(map[string]bool, len(templates))
+		for _, tc := range templates {
+			sets[i][tc.Template] = true
+			if counts[tc.Template] == nil {
+				counts[tc.Template] = make([]int, folds)
+			}
+			counts[tc.Template][i] += tc.Count
+		}
+		stability.Folds[i] = FoldStats{Lines: len(part), Templates: len(sets[i])}
+	}
+
+	stability.MinJaccard = 1
+	pairs := 0
+	for i := range sets {
+		for j := i + 1; j < len(sets); j++ {
+			similarity := jaccard(sets[i], sets[j])
+			stability.MeanJaccard += similarity
+			stability.MinJaccard = min(stability.MinJaccard, similarity)
+			pairs++
+		}
+	}
+	stability.MeanJaccard /= float64(pairs)
+
+	sizes := make([]float64, folds)
+	for i, fold := range stability.Folds {
+		sizes[i] = float64(fold.Templates)
+	}
+	stability.TemplateMean, stability.TemplateVariance = meanVariance(sizes)
+
+	stability.Templates = len(counts)
+	perFold := make([]float64, folds)
+	for _, templateCounts := range counts {
+		shared := true
+		for i, count := range templateCounts {
+			perFold[i] = float64(count)
+			shared = shared && count > 0
+		}
+		if shared {
+			stability.Shared++
+		}
+		mean, variance := meanVariance(perFold)
+		stability.CountVariation += math.Sqrt(variance) / mean
+	}
+	if len(counts) > 0 {
+		stability.CountVariation /= float64(len(counts))
+	}
+	return stability, nil
+}
+
+// jaccard returns the Jaccard similarity of two sets, 1 for two empty sets
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	intersection := 0
+	for key := range a {
+		if b[key] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
+
+// meanVariance returns the mean and population variance of values
+func meanVariance(values []float64) (mean, variance float64) {
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, variance / float64(len(values))
+}
@@ -0,0 +1,89 @@
+package awsomlp
+
+import (
+	"math"
+	"time"
+)
+
+// expireCheckInterval is the number of streamed lines between expiration sweeps
+const expireCheckInterval = 1024
+
+// touch records that a line was assigned to the pattern and updates its decayed weight
+func (lp *AWSOMLP) touch(pattern *Pattern) {
+	now := lp.now()
+	if lp.config.Deterministic {
+		now = time.Time{} // Wall-clock time differs between runs
+	}
+	if pattern.Count == 1 {
+		pattern.FirstSeen = now
+	} else {
+		pattern.Weight = lp.decay(pattern.Weight, now.Sub(pattern.LastSeen))
+	}
+	pattern.Weight++
+	pattern.LastSeen = now
+	pattern.lastLine = lp.lines
+}
+
+// decay applies exponential decay with DecayHalfLife to a weight after elapsed time
+func (lp *AWSOMLP) decay(weight float64, elapsed time.Duration) float64 {
+	if lp.config.DecayHalfLife <= 0 || elapsed <= 0 {
+		return weight
+	}
+	return weight * math.Exp2(-float64(elapsed)/float64(lp.config.DecayHalfLife))
+}
+
+// PatternWeight returns the pattern's occurrence weight decayed to the current time.
+// Without DecayHalfLife it equals the pattern's Count.
+func (lp *AWSOMLP) PatternWeight(pattern *Pattern) float64 {
+	return lp.decay(pattern.Weight, lp.now().Sub(pattern.LastSeen))
+}
+
+// Expire removes patterns that have not been seen within PatternTTL or within
+// the last PatternTTLLines lines, calling OnExpire for each of them, and returns
+// the number of removed patterns. Parsing calls it automatically; services that
+// receive logs rarely can call it from a timer, as it synchronizes with Feed
+// like the other locked methods. OnExpire is called with the lock held, so it
+// must not call those methods.
+func (lp *AWSOMLP) Expire() int {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.expire()
+}
+
+// expire implements Expire for callers holding the lock or owning the parser
+func (lp *AWSOMLP) expire() int {
+	if lp.config.PatternTTL <= 0 && lp.config.PatternTTLLines <= 0 {
+		return 0
+	}
+
+	now := lp.now()
+	kept := lp.patterns[:0]
+	var expired []*Pattern
+	for _, pattern := range lp.patterns {
+		if lp.isExpired(pattern, now) {
+			expired = append(expired, pattern)
+		} else {
+			kept = append(kept, pattern)
+		}
+	}
+	for i := len(kept); i < len(lp.patterns); i++ {
+		lp.patterns[i] = nil
+	}
+	lp.patterns = kept
+	lp.resetIndexes()
+
+	if lp.config.OnExpire != nil {
+		for _, pattern := range expired {
+			lp.config.OnExpire(pattern)
+		}
+	}
+	return len(expired)
+}
+
+// isExpired reports whether the pattern has outlived PatternTTL or PatternTTLLines
+func (lp *AWSOMLP) isExpired(pattern *Pattern, now time.Time) bool {
+	if lp.config.PatternTTL > 0 && now.Sub(pattern.LastSeen) > lp.config.PatternTTL {
+		return true
+	}
+	return lp.config.PatternTTLLines > 0 && lp.lines-pattern.lastLine >= lp.config.PatternTTLLines
+}
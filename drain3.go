@@ -0,0 +1,328 @@
+package awsomlp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Drain3 defaults used when exporting, matching drain3.drain.Drain
+const (
+	drain3Depth       = 4
+	drain3SimTh       = 0.4
+	drain3MaxChildren = 100
+	drain3ParamStr    = "<*>"
+)
+
+// drain3Cluster is a log cluster found in a Drain3 snapshot
+type drain3Cluster struct {
+	id     int
+	tokens []string
+	size   int
+}
+
+// ImportDrain3 replaces the learned patterns with the clusters of a Drain3
+// TemplateMiner snapshot (the jsonpickle state written by its persistence
+// handlers). Compressed snapshots (snapshot_compress_state) are detected
+// automatically. Each cluster becomes a pattern with the cluster's template
+// and size; pattern IDs are the cluster IDs minus one.
+func (lp *AWSOMLP) ImportDrain3(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if data, err = drain3Decompress(data); err != nil {
+		return fmt.Errorf("decode Drain3 state: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return fmt.Errorf("decode Drain3 state: %w", err)
+	}
+
+	clusters := make(map[int]drain3Cluster)
+	collectDrain3Clusters(root, clusters)
+	if len(clusters) == 0 {
+		if obj, ok := root.(map[string]interface{}); !ok || obj["id_to_cluster"] == nil {
+			return fmt.Errorf("decode Drain3 state: no id_to_cluster found")
+		}
+	}
+
+	ids := make([]int, 0, len(clusters))
+	for id := range clusters {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	patterns := make([]*Pattern, 0, len(ids))
+	nextID := 0
+	for _, id := range ids {
+		cluster := clusters[id]
+		template := strings.Join(cluster.tokens, " ")
+		pattern := &Pattern{
+			ID:        cluster.id - 1,
+			Template:  template,
+			Frequency: make(map[string]int),
+			Count:     cluster.size,
+			Weight:    float64(cluster.size),
+		}
+		for _, token := range cluster.tokens {
+			pattern.Frequency[token] += cluster.size
+		}
+		pattern.Events = []*LogEvent{{
+			Raw:       template,
+			Content:   template,
+			Tokens:    cluster.tokens,
+			Template:  template,
+			PatternID: pattern.ID,
+		}}
+		patterns = append(patterns, pattern)
+		if pattern.ID >= nextID {
+			nextID = pattern.ID + 1
+		}
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	// Drain3 keeps no timestamps; count the clusters as seen now so that
+	// PatternTTL and PatternTTLLines do not expire them on the next parse
+	now := lp.now()
+	if lp.config.Deterministic {
+		now = time.Time{}
+	}
+	for _, pattern := range patterns {
+		pattern.FirstSeen = now
+		pattern.LastSeen = now
+		pattern.lastLine = lp.lines
+	}
+	lp.patterns = patterns
+	lp.resetIndexes()
+	lp.nextID = nextID
+	return nil
+}
+
+// drain3Decompress undoes Drain3's state compression (zlib, then base64) if present
+func drain3Decompress(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] == '{' {
+		return trimmed, nil
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(string(trimmed))
+	if err != nil {
+		return nil, fmt.Errorf("state is neither JSON nor base64: %w", err)
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// collectDrain3Clusters walks a decoded jsonpickle document and collects every
+// LogCluster object. Clusters are identified by their fields rather than by
+// position, so both plain dict and LRU cache layouts of id_to_cluster work.
+func collectDrain3Clusters(node interface{}, clusters map[int]drain3Cluster) {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		if cluster, ok := parseDrain3Cluster(value); ok {
+			clusters[cluster.id] = cluster
+			return
+		}
+		for _, child := range value {
+			collectDrain3Clusters(child, clusters)
+		}
+	case []interface{}:
+		for _, child := range value {
+			collectDrain3Clusters(child, clusters)
+		}
+	}
+}
+
+// parseDrain3Cluster converts a jsonpickle LogCluster object
+func parseDrain3Cluster(obj map[string]interface{}) (drain3Cluster, bool) {
+	id, ok := obj["cluster_id"].(json.Number)
+	if !ok {
+		return drain3Cluster{}, false
+	}
+	tokensValue := obj["log_template_tokens"]
+	if tuple, ok := tokensValue.(map[string]interface{}); ok {
+		tokensValue = tuple["py/tuple"]
+	}
+	list, ok := tokensValue.([]interface{})
+	if !ok {
+		return drain3Cluster{}, false
+	}
+
+	cluster := drain3Cluster{tokens: make([]string, 0, len(list))}
+	clusterID, err := id.Int64()
+	if err != nil {
+		return drain3Cluster{}, false
+	}
+	cluster.id = int(clusterID)
+	for _, token := range list {
+		text, ok := token.(string)
+		if !ok {
+			return drain3Cluster{}, false
+		}
+		cluster.tokens = append(cluster.tokens, text)
+	}
+	if size, ok := obj["size"].(json.Number); ok {
+		if n, err := size.Int64(); err == nil {
+			cluster.size = int(n)
+		}
+	}
+	return cluster, true
+}
+
+// drain3Node is a node of Drain's prefix tree
+type drain3Node struct {
+	children   map[string]*drain3Node
+	clusterIDs []int
+}
+
+// MarshalJSON encodes the node as a jsonpickle drain3.drain.Node
+func (n *drain3Node) MarshalJSON() ([]byte, error) {
+	children := n.children
+	if children == nil {
+		children = map[string]*drain3Node{}
+	}
+	clusterIDs := n.clusterIDs
+	if clusterIDs == nil {
+		clusterIDs = []int{}
+	}
+	return json.Marshal(map[string]interface{}{
+		"py/object":         "drain3.drain.Node",
+		"key_to_child_node": children,
+		"cluster_ids":       clusterIDs,
+	})
+}
+
+// ExportDrain3 writes the learned patterns as a Drain3 TemplateMiner snapshot
+// that Drain3's persistence handlers can load. Each pattern becomes a cluster
+// with ID+1 as cluster ID, its template tokens and Count as size, and the
+// prefix tree is rebuilt with Drain3's default depth and max_children. Set
+// compress to match a Drain3 config with snapshot_compress_state enabled.
+func (lp *AWSOMLP) ExportDrain3(w io.Writer, compress bool) error {
+	lp.mu.Lock()
+	root := &drain3Node{}
+	clusters := make(map[string]interface{}, len(lp.patterns))
+	counter := 0
+	for _, pattern := range lp.patterns {
+		if len(pattern.Events) == 0 {
+			continue
+		}
+		id := pattern.ID + 1
+		tokens := strings.Fields(lp.result(0, pattern.Events[0], pattern).Template)
+		clusters[strconv.Itoa(id)] = map[string]interface{}{
+			"py/object":           "drain3.drain.LogCluster",
+			"log_template_tokens": map[string]interface{}{"py/tuple": tokens},
+			"cluster_id":          id,
+			"size":                pattern.Count,
+		}
+		addDrain3Cluster(root, tokens, id)
+		if id > counter {
+			counter = id
+		}
+	}
+	lp.mu.Unlock()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"py/object":                  "drain3.drain.Drain",
+		"log_cluster_depth":          drain3Depth,
+		"max_node_depth":             drain3Depth - 2,
+		"sim_th":                     drain3SimTh,
+		"max_children":               drain3MaxChildren,
+		"root_node":                  root,
+		"profiler":                   map[string]interface{}{"py/object": "drain3.simple_profiler.NullProfiler"},
+		"extra_delimiters":           []string{},
+		"max_clusters":               nil,
+		"param_str":                  drain3ParamStr,
+		"parametrize_numeric_tokens": true,
+		"id_to_cluster":              clusters,
+		"clusters_counter":           counter,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !compress {
+		_, err = w.Write(data)
+		return err
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	encoder := base64.NewEncoder(base64.StdEncoding, bw)
+	if _, err := encoder.Write(compressed.Bytes()); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// addDrain3Cluster inserts a cluster into the prefix tree the way Drain's
+// add_seq_to_prefix_tree does: the first level is keyed by token count, the
+// following levels by leading tokens, with tokens containing digits or
+// overflowing max_children collapsed into the parameter node
+func addDrain3Cluster(root *drain3Node, tokens []string, id int) {
+	node := drain3Child(root, strconv.Itoa(len(tokens)))
+	if len(tokens) == 0 {
+		node.clusterIDs = append(node.clusterIDs, id)
+		return
+	}
+
+	depth := 1
+	for _, token := range tokens {
+		if depth >= drain3Depth-2 || depth >= len(tokens) {
+			break
+		}
+		if _, ok := node.children[token]; !ok {
+			switch {
+			case strings.IndexFunc(token, unicode.IsDigit) >= 0:
+				token = drain3ParamStr
+			case node.children[drain3ParamStr] != nil && len(node.children) >= drain3MaxChildren:
+				token = drain3ParamStr
+			case node.children[drain3ParamStr] == nil && len(node.children)+1 >= drain3MaxChildren:
+				token = drain3ParamStr
+			}
+		}
+		node = drain3Child(node, token)
+		depth++
+	}
+	node.clusterIDs = append(node.clusterIDs, id)
+}
+
+// drain3Child returns the child node for key, creating it if needed
+func drain3Child(node *drain3Node, key string) *drain3Node {
+	if node.children == nil {
+		node.children = make(map[string]*drain3Node)
+	}
+	child, ok := node.children[key]
+	if !ok {
+		child = &drain3Node{}
+		node.children[key] = child
+	}
+	return child
+}
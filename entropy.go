@@ -0,0 +1,61 @@
+package awsomlp
+
+import (
+	"math"
+	"strings"
+)
+
+// entropyMinEvents is the number of aligned events needed to estimate the entropy of a position
+const entropyMinEvents = 10
+
+// maskHighEntropy replaces static tokens of a template with placeholders where
+// the tokens at the same position vary too much across the pattern's retained
+// events. It catches variables such as user names whose values repeat often
+// enough to pass the frequency threshold. Only events with as many tokens as the
+// representative are compared, so that positions line up.
+func (lp *AWSOMLP) maskHighEntropy(pattern *Pattern, template string) string {
+	if lp.config.EntropyThreshold <= 0 {
+		return template
+	}
+
+	tokens := strings.Split(template, " ")
+	representative := pattern.Events[0].Tokens
+	if len(tokens) != len(representative) {
+		return template
+	}
+
+	var aligned []*LogEvent
+	for _, event := range pattern.Events {
+		if len(event.Tokens) == len(representative) {
+			aligned = append(aligned, event)
+		}
+	}
+	if len(aligned) < entropyMinEvents {
+		return template
+	}
+
+	counts := make(map[string]int)
+	for i, token := range tokens {
+		if token == "<*>" {
+			continue
+		}
+		clear(counts)
+		for _, event := range aligned {
+			counts[event.Tokens[i]]++
+		}
+		if entropy(counts, len(aligned)) >= lp.config.EntropyThreshold {
+			tokens[i] = "<*>"
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// entropy returns the Shannon entropy in bits of a distribution of total observations
+func entropy(counts map[string]int, total int) float64 {
+	var h float64
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
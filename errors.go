@@ -0,0 +1,43 @@
+package awsomlp
+
+import "errors"
+
+// Sentinel errors returned by the parser. Returned errors wrap these values,
+// so callers should use errors.Is / errors.As instead of matching messages.
+var (
+	ErrInvalidConfig    = errors.New("invalid configuration")            // A configuration value is out of range
+	ErrRegexCompile     = errors.New("regex compilation failed")         // A configured regex pattern failed to compile
+	ErrStateVersion     = errors.New("unsupported state version")        // Serialized parser state has an unknown format version
+	ErrEventsDiscarded  = errors.New("events were not retained")         // An operation needs events the parser did not retain
+	ErrInvalidSyslog    = errors.New("invalid syslog message")           // A line is not a syslog message of the parsed format
+	ErrInvalidCEF       = errors.New("invalid CEF event")                // A line is not a Common Event Format event
+	ErrInvalidLEEF      = errors.New("invalid LEEF event")               // A line is not a Log Event Extended Format event
+	ErrInvalidSlowQuery = errors.New("invalid slow query log record")    // A line is not a folded MySQL slow query log record
+	ErrParamCount       = errors.New("parameter count mismatch")         // The number of parameters differs from the placeholders of a template
+	ErrUnmatchedLine    = errors.New("line does not match any template") // A line could not be matched against known templates
+)
+
+// RegexError describes a configured regex pattern that failed to compile.
+// It matches both ErrRegexCompile and ErrInvalidConfig with errors.Is.
+type RegexError struct {
+	Field   string // Configuration field holding the pattern (e.g. "HeaderRegex")
+	Pattern string // The offending pattern
+	Err     error  // Underlying compilation error
+}
+
+func (e *RegexError) Error() string {
+	if e.Field == "CustomRegexes" {
+		return "invalid custom regex pattern " + e.Pattern + ": " + e.Err.Error()
+	}
+	return "invalid " + e.Field + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying compilation error
+func (e *RegexError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error matches ErrRegexCompile or ErrInvalidConfig
+func (e *RegexError) Is(target error) bool {
+	return target == ErrRegexCompile || target == ErrInvalidConfig
+}
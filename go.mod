@@ -1,3 +1,3 @@
 module github.com/n0madic/awsom-lp
 
-go 1.19
+go 1.23
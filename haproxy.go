@@ -0,0 +1,55 @@
+package awsomlp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// StageHAProxy is the name of the HAProxy HTTP log stage
+const StageHAProxy = "haproxy"
+
+// HAProxyHTTPRegex matches HAProxy's HTTP log format ("option httplog"),
+// optionally preceded by a syslog header:
+//
+//	10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"
+//
+// The timers (TR/Tw/Tc/Tr/Ta), connection counters (actconn/feconn/beconn/srv_conn/retries)
+// and queues (srv_queue/backend_queue) are captured as a whole; captured headers are optional.
+const HAProxyHTTPRegex = `^(?:(?P<timestamp>\w{3}\s+\d{1,2}\s+\d{2}:\d{2}:\d{2})\s+(?P<host>\S+)\s+(?P<process>[^:\s]+):\s+)?` +
+	`(?P<client>\S+):(?P<client_port>\d+) \[(?P<accept_date>[^\]]+)\] (?P<frontend>\S+) (?P<backend>[^/\s]+)/(?P<server>\S+) ` +
+	`(?P<timers>[-+\d]+(?:/[-+\d]+){4}) (?P<status>-?\d+) (?P<bytes>\+?\d+) (?P<request_cookie>\S+) (?P<response_cookie>\S+) ` +
+	`(?P<termination_state>\S{2,4}) (?P<connections>[+\d]+(?:/[+\d]+){4}) (?P<queues>\d+/\d+)` +
+	`(?: (?P<request_headers>\{[^}]*\}))?(?: (?P<response_headers>\{[^}]*\}))? "(?P<request>[^"]*)"?$`
+
+// haproxyRegex is the compiled HAProxyHTTPRegex
+var haproxyRegex = regexp.MustCompile(HAProxyHTTPRegex)
+
+// HAProxyStage parses HAProxy HTTP logs with HAProxyHTTPRegex and captures
+// every part as a field (frontend, backend, server, timers, status, bytes,
+// termination_state, ...). The text to template is the frontend, the backend
+// with the server masked, the status code, the termination state and the
+// request line, e.g. "http-in static/<*> status=200 ---- GET /index.html HTTP/1.1":
+// backend names stay static while timers, byte counts, counters and client
+// addresses are left out. Lines in another format fall back to HeaderRegex.
+// Use it in place of HeaderStage.
+func HAProxyStage() Stage {
+	return NewStage(StageHAProxy, func(lp *AWSOMLP, event *LogEvent) {
+		matches := haproxyRegex.FindStringSubmatch(event.Content)
+		if matches == nil {
+			event.Content, event.Fields = lp.splitHeader(event.Content)
+			return
+		}
+
+		fields := make(map[string]string)
+		for i, name := range haproxyRegex.SubexpNames() {
+			if name != "" && matches[i] != "" {
+				fields[name] = matches[i]
+			}
+		}
+		event.Content = strings.Join([]string{
+			fields["frontend"], fields["backend"] + "/<*>", "status=" + fields["status"],
+			fields["termination_state"], fields["request"],
+		}, " ")
+		event.Fields = fields
+	})
+}
@@ -0,0 +1,331 @@
+package awsomlp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Parameters of header learning
+const (
+	learnMaxHeaderTokens = 8   // Maximum number of tokens in a learned header
+	learnMinSupport      = 0.8 // Share of lines that must agree on a header token
+)
+
+// HeaderGuess is a header regex inferred from sample lines by LearnHeaderRegex
+type HeaderGuess struct {
+	Regex      string   // Inferred HeaderRegex with named groups, empty if the lines share no header
+	Fields     []string // Names of the captured header fields in order of appearance
+	Confidence float64  // Share of the sample lines matched by Regex (0-1)
+}
+
+// headerKind is the role of a token in a log header
+type headerKind int
+
+const (
+	kindWord      headerKind = iota // Any other token; only part of a header before a delimiter
+	kindTimestamp                   // Date, time or timestamp part
+	kindLevel                       // Log level such as INFO or [ERROR]
+	kindNumber                      // Number such as a process or thread ID
+	kindBracket                     // Bracketed value such as a thread name
+	kindDash                        // Standalone "-" separating the header from the message
+)
+
+// headerToken is a classified header token split into the value and its surrounding punctuation
+type headerToken struct {
+	kind   headerKind
+	prefix string // Leading punctuation, matched literally
+	value  string // Regex matching the value
+	suffix string // Trailing punctuation, matched literally
+}
+
+// ends reports whether the token is the last one of a header (component delimiter)
+func (t headerToken) ends() bool {
+	return t.kind == kindDash || strings.Contains(t.suffix, ":")
+}
+
+// timestampTokenRegexes match a single whitespace-separated part of a timestamp
+var timestampTokenRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`^\d{4}[-/.]\d{1,2}[-/.]\d{1,2}$`),                                                // 2024-01-15
+	regexp.MustCompile(`^\d{1,2}[-/.]\d{1,2}[-/.]\d{2,4}$`),                                              // 15.01.2024
+	regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}(:\d{2})?([.,]\d+)?(Z|[+-]\d{2}:?\d{2})?$`),        // 2024-01-15T10:30:15.123Z
+	regexp.MustCompile(`^\d{1,2}:\d{2}(:\d{2})?([.,]\d+)?$`),                                             // 10:30:15,123
+	regexp.MustCompile(`^(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)[a-z]*$`),                      // Jan
+	regexp.MustCompile(`^(Mon|Tue|Wed|Thu|Fri|Sat|Sun)[a-z]*$`),                                          // Mon
+	regexp.MustCompile(`^\d{1,2}-(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)-\d{4}(:\d{2}){0,3}$`), // 31-Jul-2025
+	regexp.MustCompile(`^\d{6}$|^\d{8}$`),                                                                // 081109 (HDFS), 20240115
+	regexp.MustCompile(`^1\d{9}(\d{3})?(\.\d+)?$`),                                                       // Unix timestamp
+}
+
+// dayRegex matches the day following a month name
+var dayRegex = regexp.MustCompile(`^\d{1,2}$`)
+
+// logLevels are the level names recognized in headers
+var logLevels = map[string]bool{
+	"TRACE": true, "DEBUG": true, "INFO": true, "NOTICE": true, "WARN": true, "WARNING": true,
+	"ERROR": true, "ERR": true, "FATAL": true, "CRITICAL": true, "CRIT": true, "SEVERE": true,
+	"ALERT": true, "EMERG": true,
+}
+
+// LearnHeaderRegex infers a header regex from sample lines, typically a few hundred
+// lines of one log. It looks for the leading tokens the lines have in common:
+// timestamp parts, log level, numbers and bracketed values, optionally followed
+// by further fields up to a component delimiter (a token ending with ":" or a
+// standalone "-"). The result captures the timestamp, level, pid, thread, host,
+// component and logger fields by name and the message as "content", so it can be
+// used as Config.HeaderRegex. Confidence is the share of sample lines the regex
+// matches; with few or very diverse samples it is only a rough estimate.
+func LearnHeaderRegex(lines []string) HeaderGuess {
+	var samples [][]headerToken
+	for _, line := range lines {
+		if tokens := classifyHeader(line); tokens != nil {
+			samples = append(samples, tokens)
+		}
+	}
+	if len(samples) == 0 {
+		return HeaderGuess{}
+	}
+
+	// Take the most common token at each position while enough lines agree on it
+	var header []headerToken
+	for pos := 0; pos < learnMaxHeaderTokens; pos++ {
+		token, support := dominantToken(samples, pos)
+		if support < learnMinSupport {
+			break
+		}
+		header = append(header, token)
+		if token.ends() {
+			break
+		}
+	}
+
+	// Without a delimiter, words are already part of the message
+	if len(header) == 0 || !header[len(header)-1].ends() {
+		for i, token := range header {
+			if token.kind == kindWord {
+				header = header[:i]
+				break
+			}
+		}
+	}
+	if len(header) == 0 {
+		return HeaderGuess{}
+	}
+
+	regex, fields := buildHeaderRegex(header)
+	re := regexp.MustCompile(regex)
+	matched := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" && re.MatchString(line) {
+			matched++
+		}
+	}
+
+	return HeaderGuess{
+		Regex:      regex,
+		Fields:     fields,
+		Confidence: float64(matched) / float64(len(samples)),
+	}
+}
+
+// classifyHeader classifies the leading tokens of a line; it returns nil for blank lines
+func classifyHeader(line string) []headerToken {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return nil
+	}
+	if len(words) > learnMaxHeaderTokens {
+		words = words[:learnMaxHeaderTokens]
+	}
+
+	tokens := make([]headerToken, len(words))
+	for i, word := range words {
+		tokens[i] = classifyToken(word)
+
+		// The day after a month name is part of the timestamp
+		if i > 0 && tokens[i].kind == kindNumber && dayRegex.MatchString(word) &&
+			tokens[i-1].kind == kindTimestamp && !strings.ContainsAny(words[i-1], "0123456789") {
+			tokens[i].kind = kindTimestamp
+		}
+	}
+	return tokens
+}
+
+// classifyToken determines the role of a single token in a header
+func classifyToken(word string) headerToken {
+	if word == "-" {
+		return headerToken{kind: kindDash, prefix: word}
+	}
+
+	// Split off the delimiter and enclosing brackets
+	core := strings.TrimRight(word, ",:;")
+	token := headerToken{suffix: word[len(core):]}
+	switch {
+	case len(core) > 2 && strings.IndexByte("[(", core[0]) >= 0 && strings.IndexByte("])", core[len(core)-1]) >= 0:
+		token.prefix, token.suffix = core[:1], core[len(core)-1:]+token.suffix
+		core = core[1 : len(core)-1]
+	case len(core) > 1 && strings.IndexByte("])", core[len(core)-1]) >= 0 && !strings.ContainsAny(core, "[("):
+		token.suffix = core[len(core)-1:] + token.suffix
+		core = core[:len(core)-1]
+	case len(core) > 1 && strings.IndexByte("[(", core[0]) >= 0 && !strings.ContainsAny(core, "])"):
+		token.prefix = core[:1]
+		core = core[1:]
+	}
+
+	switch {
+	case isTimestampToken(core):
+		token.kind, token.value = kindTimestamp, shapeRegex(core)
+	case logLevels[strings.ToUpper(core)]:
+		token.kind, token.value = kindLevel, `[A-Za-z]+`
+	case isNumber(core):
+		token.kind, token.value = kindNumber, `\d+`
+	case token.prefix != "" && token.suffix != "" && strings.IndexByte("])", token.suffix[0]) >= 0:
+		token.kind, token.value = kindBracket, `[^`+regexp.QuoteMeta(token.suffix[:1])+`]+`
+	default:
+		token.kind, token.value = kindWord, `\S+`
+		if token.suffix != "" {
+			token.value = `\S+?`
+		}
+	}
+	return token
+}
+
+// isTimestampToken reports whether a token looks like part of a timestamp
+func isTimestampToken(token string) bool {
+	for _, re := range timestampTokenRegexes {
+		if re.MatchString(token) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNumber reports whether a token consists of digits only
+func isNumber(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// shapeRegex generalizes a token into a regex: runs of digits and letters match
+// any run of the same class, other characters match literally
+func shapeRegex(token string) string {
+	var sb strings.Builder
+	for _, r := range tokenShape(token) {
+		switch r {
+		case '9':
+			sb.WriteString(`\d+`)
+		case 'a':
+			sb.WriteString(`[A-Za-z]+`)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
+
+// dominantToken returns the most common token at a position together with the
+// share of samples having it
+func dominantToken(samples [][]headerToken, pos int) (headerToken, float64) {
+	counts := make(map[headerToken]int)
+	var best headerToken
+	for _, tokens := range samples {
+		if pos >= len(tokens) {
+			continue
+		}
+		token := tokens[pos]
+		counts[token]++
+		if counts[token] > counts[best] {
+			best = token
+		}
+	}
+	return best, float64(counts[best]) / float64(len(samples))
+}
+
+// buildHeaderRegex builds the header regex and its field names from the header tokens.
+// Consecutive timestamp parts are captured as a single timestamp field.
+func buildHeaderRegex(header []headerToken) (string, []string) {
+	var sb strings.Builder
+	var fields []string
+	used := make(map[string]int)
+	field := func(name string) string {
+		used[name]++
+		if used[name] > 1 {
+			name = fmt.Sprintf("%s%d", name, used[name])
+		}
+		fields = append(fields, name)
+		return name
+	}
+
+	sb.WriteString("^")
+	for i := 0; i < len(header); i++ {
+		token := header[i]
+		if i > 0 {
+			sb.WriteString(`\s+`)
+		}
+		if token.kind == kindDash {
+			sb.WriteString(regexp.QuoteMeta(token.prefix))
+			continue
+		}
+
+		// Extend a timestamp over the following timestamp parts
+		last := i
+		if token.kind == kindTimestamp {
+			for last+1 < len(header) && header[last+1].kind == kindTimestamp && !header[last].ends() {
+				last++
+			}
+		}
+
+		var name string
+		switch token.kind {
+		case kindTimestamp:
+			name = "timestamp"
+		case kindLevel:
+			name = "level"
+		case kindNumber:
+			name = "pid"
+		case kindBracket:
+			name = "thread"
+		default:
+			switch {
+			case token.ends():
+				name = "component"
+			case i+1 < len(header) && header[i+1].kind == kindDash:
+				name = "logger"
+			default:
+				name = "host"
+			}
+		}
+
+		sb.WriteString(regexp.QuoteMeta(token.prefix))
+		sb.WriteString("(?P<" + field(name) + ">")
+		for j := i; j <= last; j++ {
+			if j > i {
+				sb.WriteString(regexp.QuoteMeta(header[j].prefix))
+			}
+			sb.WriteString(header[j].value)
+			if j < last {
+				sb.WriteString(regexp.QuoteMeta(header[j].suffix) + `\s+`)
+			}
+		}
+		sb.WriteString(")")
+		sb.WriteString(regexp.QuoteMeta(header[last].suffix))
+		i = last
+	}
+
+	// Content follows the header, separated by whitespace unless a delimiter was matched
+	last := header[len(header)-1]
+	if last.suffix == "" && last.kind != kindDash {
+		sb.WriteString(`\s+`)
+	} else {
+		sb.WriteString(`\s*`)
+	}
+	sb.WriteString(`(?P<content>.+)$`)
+	return sb.String(), fields
+}
@@ -0,0 +1,195 @@
+package awsomlp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TemplateNode is a template in a TemplateTree. Its children are the more
+// specific templates it subsumes directly.
+type TemplateNode struct {
+	Template string
+	Count    int // Number of lines of the template itself
+	Total    int // Number of lines of the template and all its descendants
+	Parent   *TemplateNode
+	Children []*TemplateNode // Ordered by Total, largest first
+}
+
+// Descendants returns the number of templates below the node
+func (n *TemplateNode) Descendants() int {
+	count := len(n.Children)
+	for _, child := range n.Children {
+		count += child.Descendants()
+	}
+	return count
+}
+
+// TemplateTree relates templates by subsumption: a template subsumes another
+// if its placeholders can stand for parts of the other one, so every line of
+// the specific template also matches the general one. For example
+// "User <*> logged in" subsumes "User admin logged in" and
+// "User <*> logged in from <*>" subsumes "User <*> logged in from 10.0.0.<*>".
+type TemplateTree struct {
+	Roots []*TemplateNode // Templates not subsumed by any other, ordered by Total
+}
+
+// TemplateTree builds the subsumption tree of the current templates. The
+// parent of a template is the most specific of the templates subsuming it,
+// the one with the most static text.
+func (lp *AWSOMLP) TemplateTree() *TemplateTree {
+	counts := lp.GetTemplatesByFrequency()
+	nodes := make([]*TemplateNode, len(counts))
+	general := make([]*subsumer, len(counts))
+	for i, tc := range counts {
+		nodes[i] = &TemplateNode{Template: tc.Template, Count: tc.Count}
+		general[i] = newSubsumer(tc.Template)
+	}
+	subsumes := func(i, j int) bool {
+		return general[i].subsumes(nodes[j].Template)
+	}
+
+	tree := &TemplateTree{}
+	for j, node := range nodes {
+		parent := -1
+		for i := range nodes {
+			// Templates subsuming each other are not related, which keeps the tree acyclic
+			if i == j || !subsumes(i, j) || subsumes(j, i) {
+				continue
+			}
+			if parent < 0 || moreSpecific(nodes[i].Template, nodes[parent].Template) {
+				parent = i
+			}
+		}
+		if parent < 0 {
+			tree.Roots = append(tree.Roots, node)
+			continue
+		}
+		node.Parent = nodes[parent]
+		nodes[parent].Children = append(nodes[parent].Children, node)
+	}
+
+	for _, root := range tree.Roots {
+		root.total()
+	}
+	sortNodes(tree.Roots)
+	return tree
+}
+
+// subsumer tests whether a template subsumes others
+type subsumer struct {
+	re       *regexp.Regexp // nil for templates without placeholders
+	literals []string       // Static text of the template
+}
+
+// newSubsumer prepares a template for subsumption tests
+func newSubsumer(template string) *subsumer {
+	if !strings.Contains(template, "<*>") {
+		return &subsumer{}
+	}
+	return &subsumer{
+		re:       regexp.MustCompile(`^` + templateExpr(template) + `$`),
+		literals: strings.Fields(strings.ReplaceAll(template, "<*>", " ")),
+	}
+}
+
+// subsumes reports whether every line of the specific template also matches
+// the template of the subsumer. A template does not subsume itself unless it
+// has placeholders.
+func (s *subsumer) subsumes(specific string) bool {
+	if s.re == nil {
+		return false
+	}
+	// The static text of the general template must occur in the specific one,
+	// which rules out most pairs before the regex runs
+	for _, literal := range s.literals {
+		if !strings.Contains(specific, literal) {
+			return false
+		}
+	}
+	return s.re.MatchString(specific)
+}
+
+// moreSpecific reports whether template a has more static text than b,
+// breaking ties by fewer placeholders and then by order
+func moreSpecific(a, b string) bool {
+	placeholdersA, placeholdersB := strings.Count(a, "<*>"), strings.Count(b, "<*>")
+	staticA, staticB := len(a)-3*placeholdersA, len(b)-3*placeholdersB
+	if staticA != staticB {
+		return staticA > staticB
+	}
+	if placeholdersA != placeholdersB {
+		return placeholdersA < placeholdersB
+	}
+	return a < b
+}
+
+// total computes the Total of a node and its descendants and orders its children
+func (n *TemplateNode) total() int {
+	n.Total = n.Count
+	for _, child := range n.Children {
+		n.Total += child.total()
+	}
+	sortNodes(n.Children)
+	return n.Total
+}
+
+// sortNodes orders nodes by Total, largest first, then by template
+func sortNodes(nodes []*TemplateNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Total != nodes[j].Total {
+			return nodes[i].Total > nodes[j].Total
+		}
+		return nodes[i].Template < nodes[j].Template
+	})
+}
+
+// Walk visits the nodes of the tree depth-first, parents before children,
+// with the depth of each node (0 for roots). Returning false from fn skips
+// the children of the node.
+func (t *TemplateTree) Walk(fn func(node *TemplateNode, depth int) bool) {
+	var walk func(nodes []*TemplateNode, depth int)
+	walk = func(nodes []*TemplateNode, depth int) {
+		for _, node := range nodes {
+			if fn(node, depth) {
+				walk(node.Children, depth+1)
+			}
+		}
+	}
+	walk(t.Roots, 0)
+}
+
+// Find returns the node of a template, or nil
+func (t *TemplateTree) Find(template string) *TemplateNode {
+	var found *TemplateNode
+	t.Walk(func(node *TemplateNode, depth int) bool {
+		if node.Template == template {
+			found = node
+		}
+		return found == nil
+	})
+	return found
+}
+
+// AtDepth aggregates the tree at a level of detail: templates deeper than
+// depth are counted in their ancestor at depth. AtDepth(0) returns the most
+// general templates only; a large depth returns every template with its own
+// count. Templates are ordered by count, most frequent first.
+func (t *TemplateTree) AtDepth(depth int) []TemplateCount {
+	var templates []TemplateCount
+	t.Walk(func(node *TemplateNode, d int) bool {
+		if d == depth {
+			templates = append(templates, TemplateCount{Template: node.Template, Count: node.Total})
+			return false
+		}
+		templates = append(templates, TemplateCount{Template: node.Template, Count: node.Count})
+		return true
+	})
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Count != templates[j].Count {
+			return templates[i].Count > templates[j].Count
+		}
+		return templates[i].Template < templates[j].Template
+	})
+	return templates
+}
@@ -0,0 +1,68 @@
+package awsomlp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// StageK8s is the name of the Kubernetes resource name masking stage
+const StageK8s = "k8s"
+
+// k8sRandom is the alphabet Kubernetes generates name suffixes and pod
+// template hashes from: lowercase consonants and digits without 0, 1 and 3,
+// so generated parts never spell words
+const k8sRandom = `[bcdfghjklmnpqrstvwxz245-9]`
+
+var (
+	// k8sPodRegex matches pods of Deployments (api-7f9c6d5b4-xk2lp) and
+	// CronJobs (backup-28391220-xk2lp): the workload name, a pod template hash
+	// or scheduled time, and a random suffix
+	k8sPodRegex = regexp.MustCompile(`\b([a-z0-9](?:[-a-z0-9]*[a-z0-9])?)-(?:` + k8sRandom + `{5,10}|\d{8,10})-` + k8sRandom + `{5}\b`)
+	// k8sSuffixRegex matches names with a random suffix only, such as pods of
+	// DaemonSets and Jobs (fluentd-x7k2p)
+	k8sSuffixRegex = regexp.MustCompile(`\b([a-z0-9](?:[-a-z0-9]*[a-z0-9])?)-` + k8sRandom + `{5}\b`)
+	// k8sContainerIDRegex matches container IDs with the runtime prefix of the
+	// pod status (containerd://4f2a...)
+	k8sContainerIDRegex = regexp.MustCompile(`\b((?:containerd|docker|cri-o)://)[0-9a-f]{12,64}\b`)
+	// k8sNamespaceRegex matches namespaces after a namespace key
+	// (namespace=default, "namespace":"default", namespace "default")
+	k8sNamespaceRegex = regexp.MustCompile(`(?i)\b(namespaces?"?\s*[=:]\s*"?|namespaces?\s+")[a-z0-9](?:[-a-z0-9]*[a-z0-9])?`)
+	// k8sObjectRegex matches the namespace of a namespace/name object
+	// reference after a kind, as klog writes them (pod="kube-system/coredns-...")
+	k8sObjectRegex = regexp.MustCompile(`(?i)\b((?:pod|deployment|replicaset|statefulset|daemonset|job|cronjob|service|endpoints|configmap|secret|ingress|object)="?)[a-z0-9](?:[-a-z0-9]*[a-z0-9])?/`)
+)
+
+// NormalizeK8s masks the generated parts of Kubernetes resource names in text
+// with <*>: the pod template hash and random suffix of Deployment pods
+// (api-7f9c6d5b4-xk2lp → api-<*>), the scheduled time and suffix of CronJob
+// pods, the random suffix of DaemonSet and Job pods (fluentd-x7k2p →
+// fluentd-<*>), container IDs (containerd://4f2a... → containerd://<*>), and
+// namespaces after a namespace key or in the namespace/name references of
+// klog (pod="kube-system/coredns-..." → pod="<*>/coredns-<*>"). Workload
+// names are kept, so the pods of one workload share a template. A lone random
+// suffix is only masked if it contains a digit, as a word of five consonants
+// such as "https" would look the same.
+func NormalizeK8s(text string) string {
+	text = k8sContainerIDRegex.ReplaceAllString(text, "${1}<*>")
+	text = k8sNamespaceRegex.ReplaceAllString(text, "${1}<*>")
+	text = k8sObjectRegex.ReplaceAllString(text, "${1}<*>/")
+	text = k8sPodRegex.ReplaceAllString(text, "${1}-<*>")
+	return k8sSuffixRegex.ReplaceAllStringFunc(text, func(name string) string {
+		suffix := name[len(name)-5:]
+		if !strings.ContainsAny(suffix, "0123456789") {
+			return name
+		}
+		return name[:len(name)-5] + "<*>"
+	})
+}
+
+// K8sStage masks Kubernetes resource names in messages with NormalizeK8s, as
+// pod names, container IDs and namespaces in cluster logs otherwise make a
+// template per pod. Insert it after the header stage:
+//
+//	Pipeline: []Stage{HeaderStage(), K8sStage(), TrivialStage(), CustomStage(), TokenizeStage()}
+func K8sStage() Stage {
+	return NewStage(StageK8s, func(lp *AWSOMLP, event *LogEvent) {
+		event.Content = NormalizeK8s(event.Content)
+	})
+}
@@ -0,0 +1,149 @@
+package awsomlp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StageLEEF is the name of the LEEF header and attribute stage
+const StageLEEF = "leef"
+
+// leefHeaderFields names the header fields after the version, in order
+var leefHeaderFields = []string{"device_vendor", "device_product", "device_version", "event_id"}
+
+// LEEFEvent is a parsed IBM QRadar Log Event Extended Format event, version 1.0
+// or 2.0:
+//
+//	LEEF:Version|Vendor|Product|Version|EventID|[Delimiter|]Attributes
+//
+// The delimiter field exists in LEEF 2.0 only; attributes are separated by a
+// tab otherwise.
+type LEEFEvent struct {
+	Prefix        string     // Text before "LEEF:", usually a syslog header
+	Version       string     // LEEF format version, "1.0" or "2.0"
+	DeviceVendor  string     // Vendor of the sending device
+	DeviceProduct string     // Product of the sending device
+	DeviceVersion string     // Version of the sending product
+	EventID       string     // Event identifier, unique per vendor and product
+	Delimiter     byte       // Attribute delimiter
+	Attributes    []CEFField // key=value pairs in order
+}
+
+// ParseLEEF parses a LEEF 1.0 or 2.0 event, optionally preceded by a prefix
+// such as a syslog header. The LEEF 2.0 delimiter may be a character or its hex
+// code (x09, 0x5E). Attributes are split at the delimiter; if the delimiter is
+// a tab that does not occur, as when a relay replaced tabs by spaces, they are
+// split like a CEF extension instead. The error wraps ErrInvalidLEEF if the
+// line is not a LEEF event.
+func ParseLEEF(line string) (*LEEFEvent, error) {
+	start := strings.Index(line, "LEEF:")
+	if start < 0 {
+		return nil, fmt.Errorf("%w: no LEEF: marker", ErrInvalidLEEF)
+	}
+	event := &LEEFEvent{Prefix: strings.TrimSpace(line[:start]), Delimiter: '\t'}
+
+	// Five header fields, unlike CEF without escaping
+	header := strings.SplitN(line[start+len("LEEF:"):], "|", 6)
+	if len(header) < 6 {
+		return nil, fmt.Errorf("%w: %d of 5 header fields", ErrInvalidLEEF, len(header)-1)
+	}
+	switch event.Version = strings.TrimSpace(header[0]); event.Version {
+	case "1.0", "1":
+	case "2.0", "2":
+		// The delimiter field is optional: it is present if it is not an attribute
+		if delim, rest, ok := strings.Cut(header[5], "|"); ok && !strings.Contains(delim, "=") {
+			c, err := parseLEEFDelimiter(delim)
+			if err != nil {
+				return nil, err
+			}
+			event.Delimiter, header[5] = c, rest
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidLEEF, header[0])
+	}
+	event.DeviceVendor, event.DeviceProduct, event.DeviceVersion, event.EventID = header[1], header[2], header[3], header[4]
+
+	attributes := header[5]
+	if event.Delimiter == '\t' && !strings.Contains(attributes, "\t") {
+		event.Attributes = parseCEFExtension(attributes)
+		return event, nil
+	}
+	for _, pair := range strings.Split(attributes, string(event.Delimiter)) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			continue
+		}
+		event.Attributes = append(event.Attributes, CEFField{Key: strings.TrimSpace(key), Value: value})
+	}
+	return event, nil
+}
+
+// parseLEEFDelimiter decodes a LEEF 2.0 delimiter field: a single character or
+// a hex code prefixed by x or 0x
+func parseLEEFDelimiter(delim string) (byte, error) {
+	if len(delim) == 1 {
+		return delim[0], nil
+	}
+	hex, ok := strings.CutPrefix(strings.ToLower(delim), "0x")
+	if !ok {
+		hex, ok = strings.CutPrefix(strings.ToLower(delim), "x")
+	}
+	if ok {
+		c, err := strconv.ParseUint(hex, 16, 8)
+		if err == nil && c > 0 {
+			return byte(c), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: invalid delimiter %q", ErrInvalidLEEF, delim)
+}
+
+// Message returns the text to template: the product and EventID followed by
+// the attributes with every value masked as <*>, except free-text values such
+// as msg. Numeric event IDs are masked like any number, so segment by the
+// event_id field to keep the templates of such events apart.
+func (e *LEEFEvent) Message() string {
+	var sb strings.Builder
+	sb.WriteString(e.DeviceProduct)
+	sb.WriteByte(' ')
+	sb.WriteString(e.EventID)
+	writeMaskedExtension(&sb, e.Attributes)
+	return sb.String()
+}
+
+// Fields returns the header as the fields leef_version, device_vendor,
+// device_product, device_version and event_id, plus every attribute under its
+// key. Empty values are left out.
+func (e *LEEFEvent) Fields() map[string]string {
+	fields := map[string]string{"leef_version": e.Version}
+	values := []string{e.DeviceVendor, e.DeviceProduct, e.DeviceVersion, e.EventID}
+	for i, name := range leefHeaderFields {
+		if values[i] != "" {
+			fields[name] = values[i]
+		}
+	}
+	for _, field := range e.Attributes {
+		if field.Value != "" {
+			fields[field.Key] = field.Value
+		}
+	}
+	return fields
+}
+
+// LEEFStage replaces a LEEF event by its Message and captures the header and
+// attributes as fields (see LEEFEvent.Fields). CEF events are handled like
+// CEFStage does, so mixed CEF/LEEF exports need a single stage, and other lines
+// fall back to HeaderRegex. Use it in place of HeaderStage.
+func LEEFStage() Stage {
+	return NewStage(StageLEEF, func(lp *AWSOMLP, event *LogEvent) {
+		if leef, err := ParseLEEF(event.Content); err == nil {
+			event.Content, event.Fields = leef.Message(), leef.Fields()
+			return
+		}
+		if cef, err := ParseCEF(event.Content); err == nil {
+			event.Content, event.Fields = cef.Message(), cef.Fields()
+			return
+		}
+		event.Content, event.Fields = lp.splitHeader(event.Content)
+	})
+}
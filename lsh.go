@@ -0,0 +1,103 @@
+package awsomlp
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// findApproximate looks for a similar pattern only among candidates retrieved by
+// locality-sensitive hashing: the MinHash signature of an event's alphabetical
+// tokens is split into LSHBands bands of LSHRows values, and patterns whose
+// representative shares at least one band are compared. Events whose word sets
+// overlap little are never compared, so a similar pattern can be missed, but the
+// number of comparisons no longer grows with the number of patterns.
+func (lp *AWSOMLP) findApproximate(event *LogEvent) (*Pattern, float64) {
+	if lp.lsh == nil {
+		lp.lsh = make(map[uint64][]*Pattern)
+		for _, pattern := range lp.patterns {
+			if len(pattern.Events) > 0 {
+				lp.indexLSH(pattern, pattern.Events[0])
+			}
+		}
+	}
+
+	seen := make(map[*Pattern]bool)
+	var candidates []*Pattern
+	for _, key := range lp.bandKeys(event) {
+		for _, pattern := range lp.lsh[key] {
+			if seen[pattern] {
+				continue
+			}
+			seen[pattern] = true
+			if lp.config.BucketByTokenCount && !lp.withinTokenCount(pattern, event) {
+				continue
+			}
+			candidates = append(candidates, pattern)
+		}
+	}
+
+	// Keep the first-match order of the exact search
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+	return lp.findSimilar(candidates, event)
+}
+
+// indexLSH adds a pattern to the LSH band buckets if they are built
+func (lp *AWSOMLP) indexLSH(pattern *Pattern, representative *LogEvent) {
+	if lp.lsh == nil {
+		return
+	}
+	for _, key := range lp.bandKeys(representative) {
+		lp.lsh[key] = append(lp.lsh[key], pattern)
+	}
+}
+
+// withinTokenCount reports whether the pattern's representative has about as many tokens as the event
+func (lp *AWSOMLP) withinTokenCount(pattern *Pattern, event *LogEvent) bool {
+	if len(pattern.Events) == 0 {
+		return false
+	}
+	diff := len(pattern.Events[0].Tokens) - len(event.Tokens)
+	return diff >= -lp.config.TokenCountTolerance && diff <= lp.config.TokenCountTolerance
+}
+
+// bandKeys returns the bucket keys of an event, one per LSH band
+func (lp *AWSOMLP) bandKeys(event *LogEvent) []uint64 {
+	bands, rows := lp.config.LSHBands, lp.config.LSHRows
+
+	// MinHash signature over the distinct alphabetical tokens
+	signature := make([]uint64, bands*rows)
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+	for _, token := range lp.getAlphabeticalTokens(event) {
+		h := fnv.New64a()
+		h.Write([]byte(token))
+		base := h.Sum64()
+		for i := range signature {
+			if v := mix64(base + uint64(i)*0x9e3779b97f4a7c15); v < signature[i] {
+				signature[i] = v
+			}
+		}
+	}
+
+	keys := make([]uint64, bands)
+	for band := range keys {
+		key := mix64(uint64(band) + 1)
+		for _, v := range signature[band*rows : (band+1)*rows] {
+			key = mix64(key ^ v)
+		}
+		keys[band] = key
+	}
+	return keys
+}
+
+// mix64 is the SplitMix64 finalizer, used to derive independent hash functions
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,172 @@
+package awsomlp
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Matcher classifies lines against a frozen set of learned templates without
+// learning from them. It is created by Freeze, never changes, and is safe for
+// concurrent use.
+type Matcher struct {
+	preprocessor *AWSOMLP // Preprocesses lines; never learns
+	templates    []frozenTemplate
+}
+
+// MatchResult is the classification of a line by a Matcher with the confidence
+// of the match
+type MatchResult struct {
+	ParseResult
+	Similarity float64 // Token similarity of the line to the matched template, placeholders counting half (1 = identical)
+	Margin     float64 // Similarity minus the highest similarity to another template of the segment (Similarity if there is none)
+}
+
+// frozenTemplate is a template of a Matcher with its compiled regex
+type frozenTemplate struct {
+	id       int
+	template string
+	segment  string
+	static   int // Number of static characters; more specific templates are tried first
+	count    int
+	tokens   []string
+	re       *regexp.Regexp
+}
+
+// Freeze returns a Matcher for the current templates, separating training from
+// inference: the parser may keep learning, or be discarded, without affecting
+// the Matcher. Like Feed, it is safe for concurrent use with learning.
+func (lp *AWSOMLP) Freeze() *Matcher {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	preprocessor := NewAWSOMLP()
+	preprocessor.WithConfig(lp.config) // Validated when lp was configured
+
+	m := &Matcher{preprocessor: preprocessor}
+	for _, pattern := range lp.patterns {
+		template := strings.TrimSpace(pattern.Template)
+		if template == "" {
+			continue
+		}
+		m.templates = append(m.templates, frozenTemplate{
+			id:       pattern.ID,
+			template: template,
+			segment:  pattern.Segment,
+			static:   len(strings.ReplaceAll(strings.Join(strings.Fields(template), ""), "<*>", "")),
+			count:    pattern.Count,
+			tokens:   strings.Fields(template),
+			re:       regexp.MustCompile(`^` + templateExpr(template) + `$`),
+		})
+	}
+	sort.SliceStable(m.templates, func(i, j int) bool {
+		if m.templates[i].static != m.templates[j].static {
+			return m.templates[i].static > m.templates[j].static
+		}
+		return m.templates[i].count > m.templates[j].count
+	})
+	return m
+}
+
+// Len returns the number of frozen templates
+func (m *Matcher) Len() int {
+	return len(m.templates)
+}
+
+// Match preprocesses a line and returns the result of the most specific frozen
+// template of its segment matching the line's tokens, the template with the
+// most static characters. The result's Index is 0. Unlike Feed, the line is
+// compared with the templates rather than by similarity, so it never joins a
+// template whose static tokens it lacks. Similarity and Margin tell how
+// confident the match is: a line matched mostly by placeholders has a low
+// similarity, and one that another template fits about as well has a small
+// or even negative margin, so such lines can be routed to review.
+//
+// ok is false, and the result empty, exactly when MatchLine returns
+// ErrUnmatchedLine: for blank lines, lines rejected by RejectOversized and
+// lines that no template of their segment matches.
+func (m *Matcher) Match(line string) (result MatchResult, ok bool) {
+	result, err := m.MatchLine(line)
+	return result, err == nil
+}
+
+// MatchLine is Match returning an error wrapping ErrUnmatchedLine, which tells
+// why the line was not matched, instead of false
+func (m *Matcher) MatchLine(line string) (MatchResult, error) {
+	if line = strings.TrimSpace(line); line == "" {
+		return MatchResult{}, fmt.Errorf("%w: blank line", ErrUnmatchedLine)
+	}
+	event := m.preprocessor.prepareLine(line)
+	if m.preprocessor.rejected(event) {
+		return MatchResult{}, fmt.Errorf("%w: line exceeds MaxTokens", ErrUnmatchedLine)
+	}
+	content := strings.Join(event.Tokens, " ")
+
+	matched := -1
+	for i, t := range m.templates {
+		if t.segment == event.Segment && t.re.MatchString(content) {
+			matched = i
+			break
+		}
+	}
+	if matched < 0 {
+		return MatchResult{}, fmt.Errorf("%w: no template of segment %q fits", ErrUnmatchedLine, event.Segment)
+	}
+
+	t := m.templates[matched]
+	result := MatchResult{
+		ParseResult: ParseResult{Raw: event.Raw, Template: t.template, PatternID: t.id, Fields: event.Fields},
+		Similarity:  templateSimilarity(event.Tokens, t.tokens),
+	}
+	second := 0.0
+	for i, other := range m.templates {
+		if i != matched && other.segment == event.Segment {
+			second = max(second, templateSimilarity(event.Tokens, other.tokens))
+		}
+	}
+	result.Margin = result.Similarity - second
+	return result, nil
+}
+
+// templateSimilarity is tokenSimilarity of a line's tokens and a template's,
+// where a template token with placeholders matches a line token it fits, but
+// only counts half, as it does not confirm the line's text
+func templateSimilarity(tokens, template []string) float64 {
+	if len(tokens)+len(template) == 0 {
+		return 1
+	}
+	// One row of the weighted LCS table at a time
+	prev := make([]float64, len(template)+1)
+	curr := make([]float64, len(template)+1)
+	for i := range tokens {
+		for j := range template {
+			curr[j+1] = max(prev[j+1], curr[j])
+			if tokens[i] == template[j] && !strings.Contains(template[j], "<*>") {
+				curr[j+1] = max(curr[j+1], prev[j]+1)
+			} else if fitsToken(tokens[i], template[j]) {
+				curr[j+1] = max(curr[j+1], prev[j]+0.5)
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return 2 * prev[len(template)] / float64(len(tokens)+len(template))
+}
+
+// fitsToken reports whether a template token with placeholders, such as
+// "blk_<*>", fits a token of a line
+func fitsToken(token, template string) bool {
+	parts := strings.Split(template, "<*>")
+	if len(parts) == 1 || !strings.HasPrefix(token, parts[0]) {
+		return false
+	}
+	token = token[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(token, part)
+		if i < 0 {
+			return false
+		}
+		token = token[i+len(part):]
+	}
+	return strings.HasSuffix(token, parts[len(parts)-1])
+}
@@ -0,0 +1,82 @@
+package awsomlp
+
+import (
+	"bytes"
+	"iter"
+	"os"
+	"unsafe"
+)
+
+// MappedFile is a log file mapped into memory. Its lines are slices of the
+// mapping rather than copies, so large files are parsed without read system
+// calls or an allocation per line. On platforms without mmap the file is read
+// into memory instead.
+//
+// The strings yielded by Lines point into the mapping and must not be used
+// after Close. A parser keeps such strings as LogEvent.Raw and in its
+// templates, so close the file only when the parser is no longer used, or
+// pass strings.Clone of the lines it may retain.
+type MappedFile struct {
+	data  []byte
+	unmap func() error // nil after Close or for files read into memory
+}
+
+// MapFile maps a file into memory for reading
+func MapFile(path string) (*MappedFile, error) {
+	return mapFile(path)
+}
+
+// readFile reads a file into memory in place of a mapping
+func readFile(path string) (*MappedFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{data: data}, nil
+}
+
+// Len returns the size of the file in bytes
+func (m *MappedFile) Len() int {
+	return len(m.data)
+}
+
+// Lines yields the lines of the file without their line terminators ("\n" or
+// "\r\n"), in order. Empty lines are yielded as empty strings.
+func (m *MappedFile) Lines() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		data := m.data
+		for len(data) > 0 {
+			line := data
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line, data = data[:i], data[i+1:]
+			} else {
+				data = nil
+			}
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if !yield(unsafe.String(unsafe.SliceData(line), len(line))) {
+				return
+			}
+		}
+	}
+}
+
+// Close unmaps the file
+func (m *MappedFile) Close() error {
+	m.data = nil
+	if m.unmap == nil {
+		return nil
+	}
+	unmap := m.unmap
+	m.unmap = nil
+	return unmap()
+}
+
+// ParseMapped parses the lines of a mapped file like ParseEvents, returning
+// the events in line order and skipping empty lines
+func (lp *AWSOMLP) ParseMapped(m *MappedFile) []*LogEvent {
+	var lines []string
+	for line := range m.Lines() {
+		lines = append(lines, line)
+	}
+	return lp.ParseEvents(lines)
+}
@@ -0,0 +1,8 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package awsomlp
+
+// mapFile reads a file into memory where mmap is not available
+func mapFile(path string) (*MappedFile, error) {
+	return readFile(path)
+}
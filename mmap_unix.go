@@ -0,0 +1,37 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package awsomlp
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps a file read-only with mmap
+func mapFile(path string) (*MappedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // The mapping stays valid after the file is closed
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 || !info.Mode().IsRegular() {
+		// Empty files cannot be mapped, and pipes or devices have no size
+		return readFile(path)
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("mapping %s: file too large (%d bytes)", path, size)
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mapping %s: %w", path, err)
+	}
+	return &MappedFile{data: data, unmap: func() error { return syscall.Munmap(data) }}, nil
+}
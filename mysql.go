@@ -0,0 +1,149 @@
+package awsomlp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StageMySQLSlowLog is the name of the MySQL slow query log stage
+const StageMySQLSlowLog = "mysql-slow"
+
+// MySQL slow query log syntax
+var (
+	mysqlBannerRegex   = regexp.MustCompile(`^(?:\S+, Version: .*started with:|Tcp port: \d+.*|Time\s+Id\s+Command\s+Argument)$`)
+	mysqlUserHostRegex = regexp.MustCompile(`User@Host: ([^\[\s]*)\[[^\]]*\] @ (\S*) ?\[([^\]]*)\]`)
+	mysqlAttrRegex     = regexp.MustCompile(`\b(\w+):\s+(\S+)`)
+	mysqlStartRegex    = regexp.MustCompile(`^(?:use ([^;\s]+);\s*)?SET timestamp=(\d+);\s*`)
+)
+
+// MySQLSlowQuery is a record of the MySQL slow query log:
+//
+//	# Time: 2024-01-15T10:30:15.123456Z
+//	# User@Host: app[app] @ localhost [127.0.0.1]  Id:    42
+//	# Query_time: 2.000123  Lock_time: 0.000045 Rows_sent: 1  Rows_examined: 100000
+//	use shop;
+//	SET timestamp=1705314615;
+//	SELECT * FROM orders WHERE customer_id = 42;
+type MySQLSlowQuery struct {
+	Time         string            // Value of "# Time:", empty if the record has none
+	User         string            // Account user name
+	Host         string            // Client host name, may be empty
+	IP           string            // Client address, may be empty
+	ThreadID     string            // Connection id
+	QueryTime    float64           // Query_time in seconds
+	LockTime     float64           // Lock_time in seconds
+	RowsSent     int               // Rows_sent
+	RowsExamined int               // Rows_examined
+	Database     string            // Database selected by a "use" statement, if any
+	Timestamp    int64             // Unix time of the SET timestamp statement
+	SQL          string            // The statement
+	Attributes   map[string]string // Every "Name: value" pair of the header, e.g. Percona's Bytes_sent
+}
+
+// FoldMySQLSlowLog joins the lines of every slow query log record into one
+// line, separated by spaces. A record starts with "# Time:", or with
+// "# User@Host:" if it has no time line. The banner a server writes when it
+// starts is dropped, as are lines before the first record.
+func FoldMySQLSlowLog(lines []string) []string {
+	var folded []string
+	timeLine := false // Whether the last record so far consists of a time line only
+	for _, line := range lines {
+		text := strings.TrimSpace(line)
+		if text == "" || mysqlBannerRegex.MatchString(text) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(text, "# Time:"):
+			folded = append(folded, text)
+			timeLine = true
+		case strings.HasPrefix(text, "# User@Host:") && !timeLine:
+			folded = append(folded, text)
+		case len(folded) > 0:
+			folded[len(folded)-1] += " " + text
+			timeLine = false
+		}
+	}
+	return folded
+}
+
+// ParseMySQLSlowQuery parses a slow query log record folded into one line by
+// FoldMySQLSlowLog. The trailing semicolon of the statement is removed. The
+// error wraps ErrInvalidSlowQuery if the record has no header or no
+// SET timestamp statement.
+func ParseMySQLSlowQuery(record string) (*MySQLSlowQuery, error) {
+	if !strings.HasPrefix(record, "# ") {
+		return nil, fmt.Errorf("%w: no header", ErrInvalidSlowQuery)
+	}
+	// MySQL writes SET timestamp before every statement, so it ends the header
+	idx := strings.Index(record, "SET timestamp=")
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: no SET timestamp statement", ErrInvalidSlowQuery)
+	}
+	if use := strings.LastIndex(record[:idx], "use "); use >= 0 && !strings.Contains(record[use:idx], "# ") {
+		idx = use
+	}
+	header, body := record[:idx], record[idx:]
+	start := mysqlStartRegex.FindStringSubmatchIndex(body)
+	if start == nil {
+		return nil, fmt.Errorf("%w: invalid SET timestamp statement", ErrInvalidSlowQuery)
+	}
+
+	query := &MySQLSlowQuery{
+		SQL:        strings.TrimSuffix(strings.TrimSpace(body[start[1]:]), ";"),
+		Attributes: make(map[string]string),
+	}
+	if start[2] >= 0 {
+		query.Database = body[start[2]:start[3]]
+	}
+	query.Timestamp, _ = strconv.ParseInt(body[start[4]:start[5]], 10, 64)
+	if m := mysqlUserHostRegex.FindStringSubmatch(header); m != nil {
+		query.User, query.Host, query.IP = m[1], m[2], m[3]
+		header = strings.Replace(header, m[0], "", 1)
+	}
+	for _, m := range mysqlAttrRegex.FindAllStringSubmatch(header, -1) {
+		query.Attributes[m[1]] = m[2]
+	}
+	query.Time = query.Attributes["Time"]
+	query.ThreadID = query.Attributes["Id"]
+	query.QueryTime, _ = strconv.ParseFloat(query.Attributes["Query_time"], 64)
+	query.LockTime, _ = strconv.ParseFloat(query.Attributes["Lock_time"], 64)
+	query.RowsSent, _ = strconv.Atoi(query.Attributes["Rows_sent"])
+	query.RowsExamined, _ = strconv.Atoi(query.Attributes["Rows_examined"])
+	return query, nil
+}
+
+// Fields returns the header attributes as event fields with lower-case names
+// (time, query_time, lock_time, rows_sent, rows_examined, ...) plus user, host,
+// ip, thread_id, database and timestamp. Empty values are left out.
+func (q *MySQLSlowQuery) Fields() map[string]string {
+	fields := make(map[string]string, len(q.Attributes)+6)
+	for name, value := range q.Attributes {
+		fields[strings.ToLower(name)] = value
+	}
+	delete(fields, "id")
+	for name, value := range map[string]string{"user": q.User, "host": q.Host, "ip": q.IP, "thread_id": q.ThreadID, "database": q.Database} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	fields["timestamp"] = strconv.FormatInt(q.Timestamp, 10)
+	return fields
+}
+
+// MySQLSlowLogStage replaces a slow query log record, folded by
+// FoldMySQLSlowLog, by its statement normalized with NormalizeSQL, so slow
+// queries group into query-shape templates, and captures the header
+// as fields (see MySQLSlowQuery.Fields). Other lines fall back to HeaderRegex.
+// Use it in place of HeaderStage.
+func MySQLSlowLogStage() Stage {
+	return NewStage(StageMySQLSlowLog, func(lp *AWSOMLP, event *LogEvent) {
+		query, err := ParseMySQLSlowQuery(event.Content)
+		if err != nil {
+			event.Content, event.Fields = lp.splitHeader(event.Content)
+			return
+		}
+		event.Content, event.Fields = NormalizeSQL(query.SQL), query.Fields()
+	})
+}
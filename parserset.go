@@ -0,0 +1,177 @@
+package awsomlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ParserSet maintains independent parsers per namespace (tenant, service or
+// source) with a shared configuration, so that templates learned from one
+// namespace never absorb lines from another. It is safe for concurrent use;
+// lines of different namespaces are learned in parallel.
+type ParserSet struct {
+	config  Config
+	mu      sync.Mutex
+	parsers map[string]*AWSOMLP
+}
+
+// NamespaceStats holds statistics of a single namespace
+type NamespaceStats struct {
+	Namespace string
+	Patterns  int // Number of patterns
+	Lines     int // Number of lines learned
+	Truncated int // Number of lines truncated to MaxLineLength
+}
+
+// parserSetState is the serialized form of a parser set
+type parserSetState struct {
+	Namespaces map[string]json.RawMessage `json:"namespaces"`
+}
+
+// NewParserSet creates an empty parser set. The configuration is validated
+// once and applied to every namespace created later.
+func NewParserSet(config Config) (*ParserSet, error) {
+	if err := NewAWSOMLP().WithConfig(config); err != nil {
+		return nil, err
+	}
+	return &ParserSet{
+		config:  config,
+		parsers: make(map[string]*AWSOMLP),
+	}, nil
+}
+
+// Parser returns the parser of a namespace, creating it on first use
+func (s *ParserSet) Parser(namespace string) *AWSOMLP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lp, ok := s.parsers[namespace]
+	if !ok {
+		lp = NewAWSOMLP()
+		lp.WithConfig(s.config) // Validated by NewParserSet
+		s.parsers[namespace] = lp
+	}
+	return lp
+}
+
+// Feed learns a single line in the given namespace; ok is false for blank lines
+func (s *ParserSet) Feed(namespace, line string) (result ParseResult, ok bool) {
+	return s.Parser(namespace).Feed(line)
+}
+
+// Reconfigure applies a new configuration to every namespace and to the
+// namespaces created later (see AWSOMLP.Reconfigure). The parser set is left
+// unchanged if the configuration is invalid.
+func (s *ParserSet) Reconfigure(config Config) error {
+	if err := NewAWSOMLP().WithConfig(config); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	for namespace, lp := range s.parsers {
+		if err := lp.Reconfigure(config); err != nil {
+			return fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+	}
+	return nil
+}
+
+// Recluster adapts the templates of every namespace to its window most recent
+// lines (see AWSOMLP.Recluster) and returns the number of moved lines
+func (s *ParserSet) Recluster(window int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	moved := 0
+	for _, namespace := range sortedKeys(s.parsers) {
+		n, err := s.parsers[namespace].Recluster(window)
+		if err != nil {
+			return moved, fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+		moved += n
+	}
+	return moved, nil
+}
+
+// Namespaces returns the names of all namespaces in ascending order
+func (s *ParserSet) Namespaces() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.parsers)
+}
+
+// Remove drops a namespace and everything learned in it
+func (s *ParserSet) Remove(namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.parsers, namespace)
+}
+
+// Stats returns statistics for every namespace, ordered by namespace
+func (s *ParserSet) Stats() []NamespaceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]NamespaceStats, 0, len(s.parsers))
+	for _, namespace := range sortedKeys(s.parsers) {
+		lp := s.parsers[namespace]
+		lp.mu.Lock()
+		stats = append(stats, NamespaceStats{
+			Namespace: namespace,
+			Patterns:  len(lp.patterns),
+			Lines:     lp.lines,
+			Truncated: lp.truncated,
+		})
+		lp.mu.Unlock()
+	}
+	return stats
+}
+
+// ExportState writes the state of every namespace to w as JSON. Each namespace
+// is stored as a complete parser state (see AWSOMLP.ExportState).
+func (s *ParserSet) ExportState(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := parserSetState{Namespaces: make(map[string]json.RawMessage, len(s.parsers))}
+	for namespace, lp := range s.parsers {
+		var buf bytes.Buffer
+		if err := lp.ExportState(&buf); err != nil {
+			return fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+		st.Namespaces[namespace] = buf.Bytes()
+	}
+	return json.NewEncoder(w).Encode(st)
+}
+
+// ImportState replaces all namespaces with a state written by ExportState.
+// The parser set is left unchanged on error.
+func (s *ParserSet) ImportState(r io.Reader) error {
+	var st parserSetState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return fmt.Errorf("decode parser set state: %w", err)
+	}
+	if st.Namespaces == nil {
+		return fmt.Errorf("decode parser set state: no namespaces found")
+	}
+
+	parsers := make(map[string]*AWSOMLP, len(st.Namespaces))
+	for namespace, data := range st.Namespaces {
+		lp := NewAWSOMLP()
+		lp.WithConfig(s.config)
+		if err := lp.ImportState(bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+		parsers[namespace] = lp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parsers = parsers
+	return nil
+}
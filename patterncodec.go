@@ -0,0 +1,80 @@
+package awsomlp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// PatternVersion is the version of the format written by the JSON and gob
+// encoders of Pattern. Decoding a pattern of a newer version fails.
+const PatternVersion = 1
+
+// patternDocument is the serialized form of a single pattern: the pattern as
+// stored in parser state, with a version of its own. In JSON the pattern's
+// fields are inlined next to the version.
+type patternDocument struct {
+	Version int `json:"version"`
+	patternState
+}
+
+// patternGob is the gob form of patternDocument; gob does not encode the
+// embedded state, as its type is unexported
+type patternGob struct {
+	Version int
+	Pattern patternState
+}
+
+// MarshalJSON encodes the pattern with its token frequencies, positional
+// frequencies, examples, retained events and the statistics kept in
+// unexported fields, so that UnmarshalJSON restores it completely. The field
+// names are those of the patterns in ExportState.
+func (pattern *Pattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(patternDocument{Version: PatternVersion, patternState: newPatternState(pattern)})
+}
+
+// UnmarshalJSON decodes a pattern written by MarshalJSON. It returns an error
+// wrapping ErrStateVersion if the pattern has no version or was written by a
+// newer version; the pattern is left unchanged on error.
+func (pattern *Pattern) UnmarshalJSON(data []byte) error {
+	var doc patternDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("decode pattern: %w", err)
+	}
+	return pattern.restore(doc.Version, doc.patternState)
+}
+
+// GobEncode encodes the pattern like MarshalJSON
+func (pattern *Pattern) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(patternGob{Version: PatternVersion, Pattern: newPatternState(pattern)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode decodes a pattern written by GobEncode like UnmarshalJSON
+func (pattern *Pattern) GobDecode(data []byte) error {
+	var doc patternGob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		return fmt.Errorf("decode pattern: %w", err)
+	}
+	return pattern.restore(doc.Version, doc.Pattern)
+}
+
+// restore replaces the pattern with a decoded one after checking its version
+func (pattern *Pattern) restore(version int, ps patternState) error {
+	if version < 1 {
+		return fmt.Errorf("%w: missing or invalid pattern version", ErrStateVersion)
+	}
+	if version > PatternVersion {
+		return fmt.Errorf("%w: pattern version %d is newer than supported version %d", ErrStateVersion, version, PatternVersion)
+	}
+	decoded, err := ps.pattern()
+	if err != nil {
+		return fmt.Errorf("decode pattern: %w", err)
+	}
+	*pattern = *decoded
+	return nil
+}
@@ -1,14 +1,197 @@
 package awsomlp
 
-import "regexp"
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lineFeatures is a set of characters found in a line. Most masking patterns
+// can only match lines containing digits or certain punctuation, so checking
+// the features of a line first skips regexes that cannot match.
+type lineFeatures uint8
+
+const (
+	featDigit lineFeatures = 1 << iota
+	featColon
+	featSlash
+	featBackslash
+	featDash
+	featDot
+	featAt
+)
+
+// scanFeatures returns the features of a line
+func scanFeatures(s string) lineFeatures {
+	var features lineFeatures
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			features |= featDigit
+		case c == ':':
+			features |= featColon
+		case c == '/':
+			features |= featSlash
+		case c == '\\':
+			features |= featBackslash
+		case c == '-':
+			features |= featDash
+		case c == '.':
+			features |= featDot
+		case c == '@':
+			features |= featAt
+		}
+	}
+	return features
+}
+
+// maskPattern is a masking regex with the features a line needs to match it
+type maskPattern struct {
+	re    *regexp.Regexp
+	needs lineFeatures
+}
+
+// CalendarWordMasking defines how month and weekday names outside of complete
+// timestamps are masked
+type CalendarWordMasking int
+
+const (
+	CalendarWordsAlways  CalendarWordMasking = iota // Mask every standalone month and weekday name (original behavior)
+	CalendarWordsInDates                            // Only mask names next to a day number, a year or another calendar name
+	CalendarWordsNever                              // Never mask names outside of complete timestamps
+)
+
+// DefaultPathMinSegments is the minimum number of segments of a Unix path
+// masked when PathMinSegments is 0
+const DefaultPathMinSegments = 3
+
+// pathSegment is a segment of a Windows path; spaces are only allowed inside
+// directory names, which a separator follows, so a path ends at the first space
+// after its last segment. Separators may be doubled, as in JSON strings.
+const pathSegment = `[\w.$~-]+(?: [\w.$~-]+)*[\\/]+`
+
+// windowsPathPatterns mask Windows paths, which their prefix marks as paths
+// from the first segment
+var windowsPathPatterns = []maskPattern{
+	// Drive paths (C:\Windows, C:\Program Files\app.exe, D:/data)
+	{regexp.MustCompile(`\b[a-zA-Z]:[\\/]+(?:` + pathSegment + `)*[\w.$~-]*`), featColon},
+
+	// Drive-relative paths (C:dir\file.txt), only with backslashes as "a:b/c"
+	// is rarely a path
+	{regexp.MustCompile(`\b[a-zA-Z]:(?:[\w.$~-]+(?: [\w.$~-]+)*\\+)+[\w.$~-]*`), featColon | featBackslash},
+
+	// UNC paths (\\server\share\dir\file.txt), after drive paths whose
+	// doubled separators would look like one
+	{regexp.MustCompile(`\\{2,}[\w.$-]+\\+[\w.$-]+(?:\\+(?:` + pathSegment + `)*[\w.$~-]*)?`), featBackslash},
+}
+
+// defaultUnixPathRegex masks Unix paths of DefaultPathMinSegments segments
+var defaultUnixPathRegex = unixPathRegex(DefaultPathMinSegments)
+
+// unixPathRegex matches Unix paths of at least minSegments segments
+func unixPathRegex(minSegments int) *regexp.Regexp {
+	return regexp.MustCompile(`(/[a-zA-Z0-9._/-]+){` + strconv.Itoa(minSegments) + `,}`)
+}
+
+// pathPatterns returns the masking patterns of the paths category: Windows
+// drive, drive-relative and UNC paths, and Unix paths of at least minSegments
+// segments
+func pathPatterns(minSegments int) []maskPattern {
+	re := defaultUnixPathRegex
+	if minSegments != DefaultPathMinSegments {
+		re = unixPathRegex(minSegments)
+	}
+	return append(slices.Clip(windowsPathPatterns), maskPattern{re, featSlash})
+}
+
+// Thread names and IDs, masked with MaskThreads
+var (
+	// threadNameRegex matches thread names numbered with dashes, as thread
+	// pools name them (pool-2-thread-17, Thread-42, http-nio-8080-exec-10,
+	// ForkJoinPool.commonPool-worker-5)
+	threadNameRegex = regexp.MustCompile(`\b[\w.-]*(?i:thread|pool|worker|exec)[\w.-]*-\d+\b`)
+	// threadNumberRegex matches the numbers of a thread name
+	threadNumberRegex = regexp.MustCompile(`-\d+\b`)
+	// threadIDRegex matches thread and goroutine IDs after their key
+	// (goroutine 1234, thread 17, tid=4711, thread_id: 5)
+	threadIDRegex = regexp.MustCompile(`(?i)\b((?:goroutine|thread|tid)\s+|(?:tid|thread[-_]?id)\s*[=:]\s*)\d+\b`)
+)
+
+// maskThreads replaces the numbers of thread names and thread and goroutine
+// IDs with <*>, keeping the names: pool-2-thread-17 becomes
+// pool-<*>-thread-<*>, so threads of one pool share a token
+func maskThreads(content string) string {
+	content = threadNameRegex.ReplaceAllStringFunc(content, func(name string) string {
+		return threadNumberRegex.ReplaceAllString(name, "-<*>")
+	})
+	return threadIDRegex.ReplaceAllString(content, "${1}<*>")
+}
+
+// maskQuoted replaces the contents of single- and double-quoted strings with
+// <*>, keeping the quotes: open 'a.txt' as "bob" becomes open '<*>' as "<*>".
+// A quote only opens a string after a non-alphanumeric character and only
+// closes it before one, so apostrophes as in "don't" or "users' files" are
+// kept, and backslash-escaped quotes do not end a string. Double-quoted keys
+// followed by a colon, as in JSON, are kept too.
+func maskQuoted(content string) string {
+	if !strings.ContainsAny(content, `"'`) {
+		return content
+	}
+	var sb strings.Builder
+	sb.Grow(len(content))
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		if (c != '"' && c != '\'') || (i > 0 && isAlphanumeric(content[i-1])) {
+			sb.WriteByte(c)
+			continue
+		}
+		end := closingQuote(content, i)
+		if end < 0 {
+			sb.WriteByte(c)
+			continue
+		}
+		if c == '"' && strings.HasPrefix(strings.TrimLeft(content[end+1:], " "), ":") {
+			sb.WriteString(content[i : end+1])
+		} else {
+			sb.WriteByte(c)
+			sb.WriteString("<*>")
+			sb.WriteByte(c)
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// closingQuote returns the index of the quote closing the string opened at
+// start, or -1 if there is none
+func closingQuote(content string, start int) int {
+	quote := content[start]
+	for j := start + 1; j < len(content); j++ {
+		switch content[j] {
+		case '\\':
+			j++ // Skip the escaped character
+		case quote:
+			if j+1 == len(content) || !isAlphanumeric(content[j+1]) {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// isAlphanumeric reports whether c is an ASCII letter or digit
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
 
 // Default header regex patterns for common log formats
 const (
 	// Universal pattern - matches timestamp/datetime prefix and captures content
 	DefaultHeaderRegex = `^(?:\d{4}-\d{2}-\d{2}[T\s]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:[+-]\d{2}:\d{2}|Z)?[,:]\s*)?(.+)$`
-	HDFSHeaderRegex    = `(\d{6} \d{6}) (\d+) (\w+) ([^:]+): (.+)`                                                   // HDFS format from paper
-	SyslogHeaderRegex  = `^(\w{3}\s+\d{1,2}\s+\d{2}:\d{2}:\d{2})\s+(\w+)\s+([^:]+):\s*(.+)$`                         // Syslog format
-	JavaAppHeaderRegex = `^(\d{4}-\d{2}-\d{2}\s+\d{2}:\d{2}:\d{2}\.\d{3})\s+(\w+)\s+\[([^\]]+)\]\s+([^-]+)-\s*(.+)$` // Java app format
+	HDFSHeaderRegex    = `(?P<timestamp>\d{6} \d{6}) (?P<pid>\d+) (?P<level>\w+) (?P<component>[^:]+): (?P<content>.+)`                                                   // HDFS format from paper
+	SyslogHeaderRegex  = `^(?P<timestamp>\w{3}\s+\d{1,2}\s+\d{2}:\d{2}:\d{2})\s+(?P<host>\w+)\s+(?P<process>[^:]+):\s*(?P<content>.+)$`                                   // Syslog format
+	JavaAppHeaderRegex = `^(?P<timestamp>\d{4}-\d{2}-\d{2}\s+\d{2}:\d{2}:\d{2}\.\d{3})\s+(?P<level>\w+)\s+\[(?P<thread>[^\]]+)\]\s+(?P<logger>[^-]+)-\s*(?P<content>.+)$` // Java app format
 )
 
 // numericalPatterns are pre-compiled regular expressions for numerical variables
@@ -41,12 +224,26 @@ var numericalPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`\s-?\d+(\.\d+)?[eE][+-]?\d+$`), // At end of line
 	regexp.MustCompile(`^-?\d+(\.\d+)?[eE][+-]?\d+\s`), // At beginning of line
 
-	// Numbers with units (e.g., 100KB, 2.5MB, 10ms)
-	regexp.MustCompile(`\s-?\d+(\.\d+)?[a-zA-Z]+\s`),
-	regexp.MustCompile(`\(-?\d+(\.\d+)?[a-zA-Z]+\)`),
-	regexp.MustCompile(`\[-?\d+(\.\d+)?[a-zA-Z]+\]`),
-	regexp.MustCompile(`\s-?\d+(\.\d+)?[a-zA-Z]+$`), // At end of line
-	regexp.MustCompile(`^-?\d+(\.\d+)?[a-zA-Z]+\s`), // At beginning of line
+	// Numbers with units, percentages and rates (e.g., 100KB, 1.5GiB, 10ms, 85%, 20MB/s)
+	regexp.MustCompile(`\s-?\d+(\.\d+)?(?:[a-zA-Z]+(?:/[a-zA-Z]+)?|%)\s`),
+	regexp.MustCompile(`\(-?\d+(\.\d+)?(?:[a-zA-Z]+(?:/[a-zA-Z]+)?|%)\)`),
+	regexp.MustCompile(`\[-?\d+(\.\d+)?(?:[a-zA-Z]+(?:/[a-zA-Z]+)?|%)\]`),
+	regexp.MustCompile(`\s-?\d+(\.\d+)?(?:[a-zA-Z]+(?:/[a-zA-Z]+)?|%)$`), // At end of line
+	regexp.MustCompile(`^-?\d+(\.\d+)?(?:[a-zA-Z]+(?:/[a-zA-Z]+)?|%)\s`), // At beginning of line
+
+	// Ranges with an optional unit (e.g., 10-20, 10-20ms, 5-10%)
+	regexp.MustCompile(`\s-?\d+(\.\d+)?-\d+(\.\d+)?(?:[a-zA-Z]+|%)?\s`),
+	regexp.MustCompile(`\(-?\d+(\.\d+)?-\d+(\.\d+)?(?:[a-zA-Z]+|%)?\)`),
+	regexp.MustCompile(`\[-?\d+(\.\d+)?-\d+(\.\d+)?(?:[a-zA-Z]+|%)?\]`),
+	regexp.MustCompile(`\s-?\d+(\.\d+)?-\d+(\.\d+)?(?:[a-zA-Z]+|%)?$`), // At end of line
+	regexp.MustCompile(`^-?\d+(\.\d+)?-\d+(\.\d+)?(?:[a-zA-Z]+|%)?\s`), // At beginning of line
+
+	// Ratios (e.g., 3/4, 0.5/1.0)
+	regexp.MustCompile(`\s\d+(\.\d+)?/\d+(\.\d+)?\s`),
+	regexp.MustCompile(`\(\d+(\.\d+)?/\d+(\.\d+)?\)`),
+	regexp.MustCompile(`\[\d+(\.\d+)?/\d+(\.\d+)?\]`),
+	regexp.MustCompile(`\s\d+(\.\d+)?/\d+(\.\d+)?$`), // At end of line
+	regexp.MustCompile(`^\d+(\.\d+)?/\d+(\.\d+)?\s`), // At beginning of line
 
 	// Identifiers with format prefix_number (e.g., blk_123, id_456, task_789)
 	regexp.MustCompile(`\s[a-zA-Z]+_-?\d+\s`),
@@ -56,87 +253,107 @@ var numericalPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`^[a-zA-Z]+_-?\d+\s`), // At beginning of line
 }
 
-// trivialVarPatterns are pre-compiled regular expressions for trivial variables
-var trivialVarPatterns = []*regexp.Regexp{
-	// Directory paths (Unix and Windows) - keep full paths
-	regexp.MustCompile(`(/[a-zA-Z0-9._/-]+){3,}`),       // Only long paths (3+ segments)
-	regexp.MustCompile(`([a-zA-Z]:\\[\w\s\\./-]+){2,}`), // Only long Windows paths
+// trivialVarPatterns are pre-compiled regular expressions for trivial
+// variables with the characters a line needs to contain to match them
+var trivialVarPatterns = []maskPattern{
+	// Directory paths are masked before these, see pathPatterns
 
 	// IPv4 addresses with optional port and optional leading slash (for HDFS logs)
-	regexp.MustCompile(`/?(?:\d{1,3}\.){3}\d{1,3}(?::\d{1,5})?`),
+	{regexp.MustCompile(`/?(?:\d{1,3}\.){3}\d{1,3}(?::\d{1,5})?`), featDigit | featDot},
 
 	// IPv6 addresses
-	regexp.MustCompile(`\b([0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b`),
+	{regexp.MustCompile(`\b([0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b`), featColon},
 
 	// Hex values (0x...)
-	regexp.MustCompile(`0x[0-9a-fA-F]{4,}`), // Only longer hex values
+	{regexp.MustCompile(`0x[0-9a-fA-F]{4,}`), featDigit}, // Only longer hex values
 
 	// MAC addresses
-	regexp.MustCompile(`([0-9a-fA-F]{2}[:-]){5}[0-9a-fA-F]{2}`),
+	{regexp.MustCompile(`([0-9a-fA-F]{2}[:-]){5}[0-9a-fA-F]{2}`), 0},
 
 	// UUIDs
-	regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`),
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), featDash},
 
 	// Hashes (MD5, SHA1, SHA256, etc.)
-	regexp.MustCompile(`\b[a-fA-F0-9]{32,64}\b`),
+	{regexp.MustCompile(`\b[a-fA-F0-9]{32,64}\b`), 0},
 
 	// === Comprehensive datetime format recognition ===
 
 	// ISO 8601 timestamps with T separator and optional timezone
-	regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?([+-]\d{2}:\d{2}|Z)?`), // 2024-01-15T10:30:15.123Z
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?([+-]\d{2}:\d{2}|Z)?`), featDigit | featColon | featDash}, // 2024-01-15T10:30:15.123Z
 
 	// Standard datetime with space separator
-	regexp.MustCompile(`\d{4}-\d{2}-\d{2}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), // 2024-01-15 10:30:15.123
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), featDigit | featColon | featDash}, // 2024-01-15 10:30:15.123
 
 	// Date with slashes DD/MM/YYYY or MM/DD/YYYY with time
-	regexp.MustCompile(`\d{1,2}/\d{1,2}/\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), // 15/01/2024 10:30:15 or 01/15/2024 10:30:15
+	{regexp.MustCompile(`\d{1,2}/\d{1,2}/\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), featDigit | featSlash | featColon}, // 15/01/2024 10:30:15 or 01/15/2024 10:30:15
 
 	// Date with month name - various formats
-	regexp.MustCompile(`\d{1,2}[- ](Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)[- ]\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), // 31-Jul-2025 10:38:24
-	regexp.MustCompile(`(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+\d{1,2}\s+\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`),   // Jul 31 2025 10:38:30.789
-	regexp.MustCompile(`\d{1,2}\s+(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`),   // 31 Jul 2025 10:38:30.789
+	{regexp.MustCompile(`\d{1,2}[- ](Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)[- ]\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), featDigit | featColon}, // 31-Jul-2025 10:38:24
+	{regexp.MustCompile(`(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+\d{1,2}\s+\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), featDigit | featColon},   // Jul 31 2025 10:38:30.789
+	{regexp.MustCompile(`\d{1,2}\s+(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), featDigit | featColon},   // 31 Jul 2025 10:38:30.789
 
 	// Syslog-style timestamps (month day time, no year)
-	regexp.MustCompile(`(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+\d{1,2}\s+\d{2}:\d{2}:\d{2}`), // Jan 15 10:30:15
+	{regexp.MustCompile(`(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+\d{1,2}\s+\d{2}:\d{2}:\d{2}`), featDigit | featColon}, // Jan 15 10:30:15
 
 	// Reverse date format YYYY/MM/DD
-	regexp.MustCompile(`\d{4}/\d{2}/\d{2}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), // 2024/01/15 10:30:15
+	{regexp.MustCompile(`\d{4}/\d{2}/\d{2}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), featDigit | featSlash | featColon}, // 2024/01/15 10:30:15
 
 	// European format DD.MM.YYYY
-	regexp.MustCompile(`\d{2}\.\d{2}\.\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), // 15.01.2024 10:30:15
+	{regexp.MustCompile(`\d{2}\.\d{2}\.\d{4}\s+\d{2}:\d{2}:\d{2}(\.\d+)?`), featDigit | featDot | featColon}, // 15.01.2024 10:30:15
 
 	// Date only formats (without time)
-	regexp.MustCompile(`\d{4}-\d{2}-\d{2}`),     // 2024-01-15
-	regexp.MustCompile(`\d{1,2}/\d{1,2}/\d{4}`), // 15/01/2024 or 01/15/2024
-	regexp.MustCompile(`\d{2}\.\d{2}\.\d{4}`),   // 15.01.2024
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}`), featDigit | featDash},      // 2024-01-15
+	{regexp.MustCompile(`\d{1,2}/\d{1,2}/\d{4}`), featDigit | featSlash}, // 15/01/2024 or 01/15/2024
+	{regexp.MustCompile(`\d{2}\.\d{2}\.\d{4}`), featDigit | featDot},     // 15.01.2024
 
 	// Compact formats (with word boundaries to avoid matching parts of IDs)
-	regexp.MustCompile(`\b\d{8}T\d{6}\b`), // 20240115T103015
-	regexp.MustCompile(`\b\d{14}\b`),      // 20240115103015
+	{regexp.MustCompile(`\b\d{8}T\d{6}\b`), featDigit}, // 20240115T103015
+	{regexp.MustCompile(`\b\d{14}\b`), featDigit},      // 20240115103015
 
 	// Unix timestamps (10 or 13 digits, starting with 1 for year 2001+ timestamps)
-	regexp.MustCompile(`\b1[0-9]{9}\b`),  // 10-digit Unix timestamp (seconds since 1970)
-	regexp.MustCompile(`\b1[0-9]{12}\b`), // 13-digit Unix timestamp (milliseconds since 1970)
-
-	// Months standalone (for partial date matching)
-	regexp.MustCompile(`\b(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec|January|February|March|April|May|June|July|August|September|October|November|December)\b`),
+	{regexp.MustCompile(`\b1[0-9]{9}\b`), featDigit},  // 10-digit Unix timestamp (seconds since 1970)
+	{regexp.MustCompile(`\b1[0-9]{12}\b`), featDigit}, // 13-digit Unix timestamp (milliseconds since 1970)
 
-	// Days of week
-	regexp.MustCompile(`\b(Mon|Tue|Wed|Thu|Fri|Sat|Sun|Monday|Tuesday|Wednesday|Thursday|Friday|Saturday|Sunday)\b`),
+	// Months standalone (for partial date matching) and days of week, see CalendarWords
+	{monthNameRegex, 0},
+	{weekdayNameRegex, 0},
 
 	// Time only patterns (without date)
-	regexp.MustCompile(`\b\d{1,2}:\d{2}:\d{2}(\.\d{1,6})?\b`), // 10:30:15.123
+	{regexp.MustCompile(`\b\d{1,2}:\d{2}:\d{2}(\.\d{1,6})?\b`), featDigit | featColon}, // 10:30:15.123
 
 	// Full URLs
-	regexp.MustCompile(`https?://[^\s]+`),
-	regexp.MustCompile(`ftp://[^\s]+`),
+	{regexp.MustCompile(`https?://[^\s]+`), featColon | featSlash},
+	{regexp.MustCompile(`ftp://[^\s]+`), featColon | featSlash},
 
 	// Email addresses
-	regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`),
+	{regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`), featAt | featDot},
 
-	// Words in parentheses (like controller names, user roles, etc.)
-	regexp.MustCompile(`\([a-zA-Z][a-zA-Z0-9_-]*\)`),
+	// Bracket contents are masked after these, see Config.Brackets
 
 	// Very long alphanumeric strings (likely IDs/tokens)
-	regexp.MustCompile(`\b[a-zA-Z0-9]{32,}\b`), // Only very long strings
+	{regexp.MustCompile(`\b[a-zA-Z0-9]{32,}\b`), 0}, // Only very long strings
+}
+
+// Month and weekday names, masked depending on Config.CalendarWords
+var (
+	monthNameRegex   = regexp.MustCompile(`\b(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec|January|February|March|April|May|June|July|August|September|October|November|December)\b`)
+	weekdayNameRegex = regexp.MustCompile(`\b(Mon|Tue|Wed|Thu|Fri|Sat|Sun|Monday|Tuesday|Wednesday|Thursday|Friday|Saturday|Sunday)\b`)
+
+	// calendarDateRegex matches month and weekday names in a date context: a
+	// name followed by a day number or year ("May 5", "Jun, 2024", "Mon 12"),
+	// preceded by a day number ("5 May", "5th of May", "31-Jul") or followed
+	// by another name ("Mon Jan")
+	calendarDateRegex = regexp.MustCompile(`\b(?:` + calendarNames + `)\.?,?[\s-]+(?:\d{1,4}(?:st|nd|rd|th)?\b|(?:` + calendarNames + `)\b)` +
+		`|\b\d{1,2}(?:st|nd|rd|th)?(?:[\s-]+of)?[\s-]+(?:` + calendarNames + `)\b`)
+)
+
+// calendarNames are the month and weekday names as a regex alternation
+const calendarNames = `Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec|January|February|March|April|June|July|August|September|October|November|December|` +
+	`Mon|Tue|Wed|Thu|Fri|Sat|Sun|Monday|Tuesday|Wednesday|Thursday|Friday|Saturday|Sunday`
+
+// maskCalendarNames replaces the month and weekday names of a date with <*>,
+// keeping the day numbers and years for numerical masking
+func maskCalendarNames(date string) string {
+	date = monthNameRegex.ReplaceAllString(date, "<*>")
+	return weekdayNameRegex.ReplaceAllString(date, "<*>")
 }
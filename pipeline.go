@@ -0,0 +1,73 @@
+package awsomlp
+
+import "strings"
+
+// Names of the built-in preprocessing stages
+const (
+	StageHeader   = "header"   // Header removal using HeaderRegex
+	StageTrivial  = "trivial"  // Masking of built-in trivial variables (paths, IPs, timestamps, ...)
+	StageCustom   = "custom"   // Masking with CustomRegexes
+	StageTokenize = "tokenize" // Splitting content into tokens
+)
+
+// Stage is a single step of the preprocessing pipeline. Stages work on
+// event.Content, which starts out as the raw line, and may also set Fields
+// or Tokens. The parser is passed so stages can use its compiled configuration.
+type Stage interface {
+	Name() string
+	Process(lp *AWSOMLP, event *LogEvent)
+}
+
+// DefaultPipeline returns the built-in stages in their default order
+func DefaultPipeline() []Stage {
+	return []Stage{HeaderStage(), TrivialStage(), CustomStage(), TokenizeStage()}
+}
+
+// HeaderStage removes the header matched by HeaderRegex and captures its named fields
+func HeaderStage() Stage {
+	return NewStage(StageHeader, func(lp *AWSOMLP, event *LogEvent) {
+		event.Content, event.Fields = lp.splitHeader(event.Content)
+	})
+}
+
+// TrivialStage replaces built-in trivial variables with <*>
+func TrivialStage() Stage {
+	return NewStage(StageTrivial, func(lp *AWSOMLP, event *LogEvent) {
+		event.Content = lp.maskTrivial(event.Content)
+	})
+}
+
+// CustomStage replaces matches of CustomRegexes with <*>
+func CustomStage() Stage {
+	return NewStage(StageCustom, func(lp *AWSOMLP, event *LogEvent) {
+		event.Content = replaceAll(lp.customRegexes, event.Content)
+	})
+}
+
+// TokenizeStage splits the content into whitespace-separated tokens and masks
+// the token positions of ColumnRules
+func TokenizeStage() Stage {
+	return NewStage(StageTokenize, func(lp *AWSOMLP, event *LogEvent) {
+		event.Tokens = strings.Fields(event.Content)
+		lp.maskColumns(event)
+	})
+}
+
+// NewStage creates a stage from a function
+func NewStage(name string, fn func(lp *AWSOMLP, event *LogEvent)) Stage {
+	return &funcStage{name: name, fn: fn}
+}
+
+// funcStage is a Stage backed by a function
+type funcStage struct {
+	name string
+	fn   func(lp *AWSOMLP, event *LogEvent)
+}
+
+func (s *funcStage) Name() string {
+	return s.name
+}
+
+func (s *funcStage) Process(lp *AWSOMLP, event *LogEvent) {
+	s.fn(lp, event)
+}
@@ -0,0 +1,48 @@
+package awsomlp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FreqCounting defines how token occurrences are counted for frequency analysis
+type FreqCounting int
+
+const (
+	FreqCountGlobal     FreqCounting = iota // Count each token once per occurrence anywhere in the line (paper-compliant)
+	FreqCountPositional                     // Count tokens per position, so a token is static only where it repeats
+)
+
+// countPositions adds the tokens of an event to the pattern's per-position frequencies
+func (lp *AWSOMLP) countPositions(pattern *Pattern, tokens []string) {
+	for i, token := range tokens {
+		if i == len(pattern.PositionFrequency) {
+			pattern.PositionFrequency = append(pattern.PositionFrequency, make(map[string]int))
+		}
+		pattern.PositionFrequency[i][token]++
+	}
+}
+
+// generatePositionalTemplate generates the template of a pattern from its
+// per-position frequencies. The threshold is chosen by FreqThresholdStrategy
+// over the frequencies of all positions, and a token of the representative is
+// static if it occurs at its position often enough.
+func (lp *AWSOMLP) generatePositionalTemplate(pattern *Pattern) string {
+	frequency := make(map[string]int)
+	for i, counts := range pattern.PositionFrequency {
+		prefix := strconv.Itoa(i) + " "
+		for token, count := range counts {
+			frequency[prefix+token] = count
+		}
+	}
+	freqThreshold := lp.chooseFreqThreshold(frequency, pattern.Count)
+
+	tokens := make([]string, len(pattern.Events[0].Tokens))
+	for i, token := range pattern.Events[0].Tokens {
+		if token == "<*>" || i >= len(pattern.PositionFrequency) || pattern.PositionFrequency[i][token] < freqThreshold {
+			token = "<*>"
+		}
+		tokens[i] = token
+	}
+	return strings.Join(tokens, " ")
+}
@@ -0,0 +1,93 @@
+package awsomlp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// StagePostgreSQL is the name of the PostgreSQL log stage
+const StagePostgreSQL = "postgresql"
+
+// PostgreSQLHeaderRegex matches PostgreSQL log lines written with the default
+// log_line_prefix '%m [%p] ', optionally followed by user@database:
+//
+//	2024-01-15 10:30:15.123 UTC [12345] LOG:  duration: 0.512 ms  statement: SELECT 1
+const PostgreSQLHeaderRegex = `^(?P<timestamp>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?(?: ?(?:[A-Za-z]{2,5}|[+-]\d{2}(?::?\d{2})?))?) ` +
+	`\[(?P<pid>\d+)\]:? (?:(?P<user>[^@\s\[]+)@(?P<database>\S+) )?(?P<level>[A-Z]+[0-9]?):\s+(?P<content>.*)$`
+
+// postgresRegex is the compiled PostgreSQLHeaderRegex
+var postgresRegex = regexp.MustCompile(PostgreSQLHeaderRegex)
+
+// postgresSecondaryLevels are the message types PostgreSQL writes as separate
+// lines after the primary message of a report
+var postgresSecondaryLevels = map[string]bool{
+	"DETAIL":    true,
+	"HINT":      true,
+	"QUERY":     true,
+	"CONTEXT":   true,
+	"LOCATION":  true,
+	"STATEMENT": true,
+}
+
+// FoldPostgreSQL joins the lines of multi-line PostgreSQL log entries: lines
+// without the log line prefix, such as the further lines of a multi-line SQL
+// statement, and the DETAIL, HINT, QUERY, CONTEXT, LOCATION and STATEMENT
+// lines following a message of the same process are appended to it, separated
+// by a space and without their prefix. Lines before the first entry are kept.
+func FoldPostgreSQL(lines []string) []string {
+	folded := make([]string, 0, len(lines))
+	pid := ""
+	for _, line := range lines {
+		last := len(folded) - 1
+		matches := postgresRegex.FindStringSubmatch(line)
+		if matches == nil {
+			if last >= 0 && pid != "" {
+				if text := strings.TrimSpace(line); text != "" {
+					folded[last] += " " + text
+				}
+				continue
+			}
+			folded = append(folded, line)
+			continue
+		}
+
+		linePID := matches[postgresRegex.SubexpIndex("pid")]
+		level := matches[postgresRegex.SubexpIndex("level")]
+		if last >= 0 && linePID == pid && postgresSecondaryLevels[level] {
+			folded[last] += " " + level + ": " + matches[postgresRegex.SubexpIndex("content")]
+			continue
+		}
+		folded = append(folded, line)
+		pid = linePID
+	}
+	return folded
+}
+
+// PostgreSQLStage removes the log line prefix matched by PostgreSQLHeaderRegex,
+// capturing timestamp, pid, user, database and level as fields, and
+// normalizes the message with NormalizeSQL, so statements and their durations
+// group by query shape:
+//
+//	LOG:  duration: 0.512 ms  statement: SELECT * FROM users WHERE id = 42 AND name = 'bob'
+//	→ duration: <*> ms statement: SELECT * FROM users WHERE id = <*> AND name = <*>
+//
+// Multi-line entries must be joined with FoldPostgreSQL first. Lines in another
+// format fall back to HeaderRegex. Use it in place of HeaderStage.
+func PostgreSQLStage() Stage {
+	return NewStage(StagePostgreSQL, func(lp *AWSOMLP, event *LogEvent) {
+		matches := postgresRegex.FindStringSubmatch(event.Content)
+		if matches == nil {
+			event.Content, event.Fields = lp.splitHeader(event.Content)
+			return
+		}
+
+		fields := make(map[string]string)
+		for i, name := range postgresRegex.SubexpNames() {
+			if name != "" && name != "content" && matches[i] != "" {
+				fields[name] = matches[i]
+			}
+		}
+		event.Content = NormalizeSQL(matches[postgresRegex.SubexpIndex("content")])
+		event.Fields = fields
+	})
+}
@@ -0,0 +1,98 @@
+package awsomlp
+
+import "time"
+
+// DefaultProgressInterval is the interval between progress reports when
+// ProgressInterval is 0
+const DefaultProgressInterval = time.Second
+
+// Progress describes how far a Parse, ParseEvents or ParseChunked call has
+// come. It is passed to Config.OnProgress.
+type Progress struct {
+	Lines    int           // Lines grouped so far by the call
+	Total    int           // Lines the call groups in all, 0 if unknown as with ParseChunked
+	Patterns int           // Current number of patterns
+	Elapsed  time.Duration // Time since the call started grouping
+	Rate     float64       // Lines grouped per second
+	ETA      time.Duration // Estimated time until grouping ends, 0 if Total is unknown
+	Done     bool          // Grouping has ended; this is the last report of the call
+}
+
+// progressTracker reports progress to Config.OnProgress at most once per interval
+type progressTracker struct {
+	lp     *AWSOMLP
+	start  time.Time
+	last   time.Time // Time of the last report
+	lines  int
+	total  int
+	nested int // Number of calls sharing the tracker; only the outermost one ends it
+}
+
+// progressCheckInterval is the number of lines between clock reads
+const progressCheckInterval = 256
+
+// startProgress starts tracking the progress of a call grouping total lines
+// (0 if unknown). A call made by another tracked call, such as Parse by
+// ParseChunked, adds its lines to the outer tracker instead.
+func (lp *AWSOMLP) startProgress(total int) *progressTracker {
+	if lp.config.OnProgress == nil {
+		return nil
+	}
+	if lp.progress != nil {
+		lp.progress.nested++
+		return lp.progress
+	}
+	now := lp.now()
+	lp.progress = &progressTracker{lp: lp, start: now, last: now, total: total}
+	return lp.progress
+}
+
+// step counts a grouped line and reports progress if the interval has passed
+func (t *progressTracker) step() {
+	if t == nil {
+		return
+	}
+	t.lines++
+	if t.lines%progressCheckInterval != 0 {
+		return
+	}
+	interval := t.lp.config.ProgressInterval
+	if interval == 0 {
+		interval = DefaultProgressInterval
+	}
+	if now := t.lp.now(); now.Sub(t.last) >= interval {
+		t.last = now
+		t.lp.config.OnProgress(t.report(now, false))
+	}
+}
+
+// end finishes the call, sending the final report for the outermost one
+func (t *progressTracker) end() {
+	if t == nil {
+		return
+	}
+	if t.nested > 0 {
+		t.nested--
+		return
+	}
+	t.lp.progress = nil
+	t.lp.config.OnProgress(t.report(t.lp.now(), true))
+}
+
+// report builds the progress as of now
+func (t *progressTracker) report(now time.Time, done bool) Progress {
+	p := Progress{
+		Lines:    t.lines,
+		Total:    t.total,
+		Patterns: len(t.lp.patterns),
+		Elapsed:  now.Sub(t.start),
+		Done:     done,
+	}
+	if seconds := p.Elapsed.Seconds(); seconds > 0 {
+		p.Rate = float64(p.Lines) / seconds
+	}
+	if p.Total > p.Lines && p.Rate > 0 {
+		p.ETA = time.Duration(float64(p.Total-p.Lines) / p.Rate * float64(time.Second))
+	}
+	return p
+}
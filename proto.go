@@ -0,0 +1,586 @@
+package awsomlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireBytes  = 2
+	wireI32    = 5
+)
+
+// errProtoTruncated reports a message that ends in the middle of a field
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// ExportProto writes the learned patterns and the configuration as a protobuf
+// Model message (see awsomlp.proto). It carries the same data as ExportState.
+func (lp *AWSOMLP) ExportProto(w io.Writer) error {
+	lp.mu.Lock()
+	st := lp.snapshotState()
+	lp.mu.Unlock()
+
+	_, err := w.Write(encodeModel(st))
+	return err
+}
+
+// ImportProto replaces the learned patterns with a protobuf Model message
+// written by ExportProto or by any other protobuf implementation using
+// awsomlp.proto, and the configuration like ImportState if the message has
+// one. It returns an error wrapping ErrStateVersion if the model has no
+// version or was written by a newer version; the parser is left unchanged on error.
+func (lp *AWSOMLP) ImportProto(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	st, err := decodeModel(data)
+	if err != nil {
+		return fmt.Errorf("decode protobuf model: %w", err)
+	}
+	if st.Version < 1 || st.Version > StateVersion {
+		return fmt.Errorf("%w: %d", ErrStateVersion, st.Version)
+	}
+	if st.Version < 4 && st.Config != nil && st.Config.MaxLineLength == 0 {
+		st.Config.MaxLineLength = -1 // Unlimited before version 4
+	}
+
+	return lp.applyState(st)
+}
+
+// protoBuffer appends protobuf fields to a byte slice
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wireType))
+}
+
+func (b *protoBuffer) int(field int, v int64) {
+	if v != 0 {
+		b.tag(field, wireVarint)
+		*b = binary.AppendUvarint(*b, uint64(v))
+	}
+}
+
+func (b *protoBuffer) bool(field int, v bool) {
+	if v {
+		b.int(field, 1)
+	}
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+	if v != 0 {
+		b.tag(field, wireI64)
+		*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+	}
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+// counts encodes a token frequency map as map<string, int64>
+func (b *protoBuffer) counts(field int, counts map[string]int) {
+	for _, token := range sortedKeys(counts) {
+		var entry protoBuffer
+		entry.string(1, token)
+		entry.int(2, int64(counts[token]))
+		b.bytes(field, entry)
+	}
+}
+
+// encodeModel encodes a state as a Model message
+func encodeModel(st state) []byte {
+	var b protoBuffer
+	b.int(1, int64(st.Version))
+	b.int(2, int64(st.NextID))
+	b.int(3, int64(st.Lines))
+	b.int(4, int64(st.Truncated))
+	for _, ps := range st.Patterns {
+		b.bytes(5, encodePattern(ps))
+	}
+	if st.Config != nil {
+		b.bytes(6, encodeConfig(st.Config))
+	}
+	return b
+}
+
+// encodeConfig encodes a Config message
+func encodeConfig(cs *configState) []byte {
+	var b protoBuffer
+	b.double(1, cs.MinSimilarity)
+	b.int(2, int64(cs.SimilarityStrategy))
+	b.int(3, int64(cs.SortingStrategy))
+	for _, re := range cs.CustomRegexes {
+		b.bytes(4, []byte(re))
+	}
+	b.string(5, cs.HeaderRegex)
+	b.int(6, int64(cs.MinGroupSize))
+	b.double(7, cs.MaxPlaceholderRatio)
+	b.int(8, int64(cs.MinTemplateTokens))
+	b.int(9, int64(cs.FreqThresholdStrategy))
+	b.double(10, cs.FreqPercentile)
+	b.int(11, int64(cs.FreqCounting))
+	b.int(12, int64(cs.FreqSketchThreshold))
+	b.bool(13, cs.StrictAlphabeticalMatching)
+	b.bool(14, cs.BucketByTokenCount)
+	b.int(15, int64(cs.TokenCountTolerance))
+	b.bool(16, cs.ApproximateGrouping)
+	b.int(17, int64(cs.LSHBands))
+	b.int(18, int64(cs.LSHRows))
+	b.bool(19, cs.ApplyFreqAnalysisToSmallGroups)
+	b.double(20, cs.EntropyThreshold)
+	b.int(21, int64(cs.MaxLineLength))
+	b.int(22, int64(cs.MaxEventsPerPattern))
+	b.int(23, int64(cs.MaxExamplesPerPattern))
+	b.int(24, int64(cs.PatternTTL))
+	b.int(25, int64(cs.PatternTTLLines))
+	b.int(26, int64(cs.DecayHalfLife))
+	b.bool(27, cs.Canonical)
+	b.bool(28, cs.Deterministic)
+	b.int(29, int64(cs.Segmentation))
+	b.string(30, cs.SegmentField)
+	b.int(31, int64(cs.CalendarWords))
+	b.int(32, int64(cs.PathMinSegments))
+	b.bool(33, cs.KeepPaths)
+	b.bool(34, cs.MaskThreads)
+	b.bool(35, cs.MaskQuoted)
+	for _, rule := range cs.Brackets {
+		var r protoBuffer
+		r.string(1, rule.Brackets)
+		r.string(2, rule.Content)
+		r.int(3, int64(rule.MinLength))
+		r.int(4, int64(rule.MaxLength))
+		r.bool(5, rule.KeepBrackets)
+		b.bytes(36, r)
+	}
+	b.double(37, cs.SingletonSimilarity)
+	b.int(38, int64(cs.ProgressInterval))
+	for _, rule := range cs.ColumnRules {
+		var r protoBuffer
+		r.string(1, rule.Match)
+		r.int(2, int64(rule.Column))
+		r.int(3, int64(rule.Tokens))
+		b.bytes(39, r)
+	}
+	b.int(40, int64(cs.MaxTokens))
+	b.bool(41, cs.RejectOversized)
+	return b
+}
+
+// encodePattern encodes a Pattern message
+func encodePattern(ps patternState) []byte {
+	var b protoBuffer
+	b.int(1, int64(ps.ID))
+	b.string(2, ps.Template)
+	b.counts(3, ps.Frequency)
+	b.int(4, int64(ps.Count))
+	for _, example := range ps.Examples {
+		b.bytes(5, []byte(example))
+	}
+	b.int(6, unixNano(ps.FirstSeen))
+	b.int(7, unixNano(ps.LastSeen))
+	b.double(8, ps.Weight)
+	b.int(9, int64(ps.LastLine))
+	for _, es := range ps.Events {
+		b.bytes(10, encodeEvent(es))
+	}
+	b.string(11, ps.Segment)
+	b.int(12, int64(ps.SimilaritySamples))
+	b.double(13, ps.SimilarityMean)
+	b.double(14, ps.SimilarityM2)
+	for _, counts := range ps.PositionFrequency {
+		var position protoBuffer
+		position.counts(1, counts)
+		b.bytes(15, position)
+	}
+	if ps.Sketch != nil {
+		b.bytes(16, ps.Sketch)
+	}
+	return b
+}
+
+// encodeEvent encodes an Event message
+func encodeEvent(es eventState) []byte {
+	var b protoBuffer
+	b.string(1, es.Raw)
+	b.string(2, es.Content)
+	for _, token := range es.Tokens {
+		b.bytes(3, []byte(token))
+	}
+	b.bool(4, es.Truncated)
+	for _, name := range sortedKeys(es.Fields) {
+		var entry protoBuffer
+		entry.string(1, name)
+		entry.string(2, es.Fields[name])
+		b.bytes(5, entry)
+	}
+	return b
+}
+
+// protoField is a decoded protobuf field
+type protoField struct {
+	num      int
+	wireType int
+	varint   uint64 // Value of varint and fixed-size fields
+	data     []byte // Value of length-delimited fields
+}
+
+// forEachField decodes the fields of a message, calling fn for each of them
+func forEachField(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+
+		f := protoField{num: int(key >> 3), wireType: int(key & 7)}
+		switch f.wireType {
+		case wireVarint:
+			if f.varint, n = binary.Uvarint(data); n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case wireI64:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			f.varint, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireI32:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			f.varint, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errProtoTruncated
+			}
+			f.data, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", f.wireType)
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeModel decodes a Model message; unknown fields are skipped
+func decodeModel(data []byte) (state, error) {
+	st := state{Format: stateFormat}
+	err := forEachField(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			st.Version = int(f.varint)
+		case 2:
+			st.NextID = int(f.varint)
+		case 3:
+			st.Lines = int(f.varint)
+		case 4:
+			st.Truncated = int(f.varint)
+		case 5:
+			ps, err := decodePattern(f.data)
+			if err != nil {
+				return err
+			}
+			st.Patterns = append(st.Patterns, ps)
+		case 6:
+			cs, err := decodeConfig(f.data)
+			if err != nil {
+				return err
+			}
+			st.Config = cs
+		}
+		return nil
+	})
+	return st, err
+}
+
+// decodeConfig decodes a Config message. Lists are never nil, as an empty
+// Brackets list means no bracket masking rather than the default rules.
+func decodeConfig(data []byte) (*configState, error) {
+	cs := &configState{CustomRegexes: []string{}, Brackets: []BracketRule{}}
+	err := forEachField(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			cs.MinSimilarity = math.Float64frombits(f.varint)
+		case 2:
+			cs.SimilarityStrategy = SimilarityStrategy(f.varint)
+		case 3:
+			cs.SortingStrategy = SortingStrategy(f.varint)
+		case 4:
+			cs.CustomRegexes = append(cs.CustomRegexes, string(f.data))
+		case 5:
+			cs.HeaderRegex = string(f.data)
+		case 6:
+			cs.MinGroupSize = int(f.varint)
+		case 7:
+			cs.MaxPlaceholderRatio = math.Float64frombits(f.varint)
+		case 8:
+			cs.MinTemplateTokens = int(f.varint)
+		case 9:
+			cs.FreqThresholdStrategy = FreqThresholdStrategy(f.varint)
+		case 10:
+			cs.FreqPercentile = math.Float64frombits(f.varint)
+		case 11:
+			cs.FreqCounting = FreqCounting(f.varint)
+		case 12:
+			cs.FreqSketchThreshold = int(f.varint)
+		case 13:
+			cs.StrictAlphabeticalMatching = f.varint != 0
+		case 14:
+			cs.BucketByTokenCount = f.varint != 0
+		case 15:
+			cs.TokenCountTolerance = int(f.varint)
+		case 16:
+			cs.ApproximateGrouping = f.varint != 0
+		case 17:
+			cs.LSHBands = int(f.varint)
+		case 18:
+			cs.LSHRows = int(f.varint)
+		case 19:
+			cs.ApplyFreqAnalysisToSmallGroups = f.varint != 0
+		case 20:
+			cs.EntropyThreshold = math.Float64frombits(f.varint)
+		case 21:
+			cs.MaxLineLength = int(f.varint)
+		case 22:
+			cs.MaxEventsPerPattern = int(f.varint)
+		case 23:
+			cs.MaxExamplesPerPattern = int(f.varint)
+		case 24:
+			cs.PatternTTL = time.Duration(f.varint)
+		case 25:
+			cs.PatternTTLLines = int(f.varint)
+		case 26:
+			cs.DecayHalfLife = time.Duration(f.varint)
+		case 27:
+			cs.Canonical = f.varint != 0
+		case 28:
+			cs.Deterministic = f.varint != 0
+		case 29:
+			cs.Segmentation = Segmentation(f.varint)
+		case 30:
+			cs.SegmentField = string(f.data)
+		case 31:
+			cs.CalendarWords = CalendarWordMasking(f.varint)
+		case 32:
+			cs.PathMinSegments = int(f.varint)
+		case 33:
+			cs.KeepPaths = f.varint != 0
+		case 34:
+			cs.MaskThreads = f.varint != 0
+		case 35:
+			cs.MaskQuoted = f.varint != 0
+		case 36:
+			var rule BracketRule
+			err := forEachField(f.data, func(r protoField) error {
+				switch r.num {
+				case 1:
+					rule.Brackets = string(r.data)
+				case 2:
+					rule.Content = string(r.data)
+				case 3:
+					rule.MinLength = int(r.varint)
+				case 4:
+					rule.MaxLength = int(r.varint)
+				case 5:
+					rule.KeepBrackets = r.varint != 0
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			cs.Brackets = append(cs.Brackets, rule)
+		case 37:
+			cs.SingletonSimilarity = math.Float64frombits(f.varint)
+		case 38:
+			cs.ProgressInterval = time.Duration(f.varint)
+		case 39:
+			var rule ColumnRule
+			err := forEachField(f.data, func(r protoField) error {
+				switch r.num {
+				case 1:
+					rule.Match = string(r.data)
+				case 2:
+					rule.Column = int(r.varint)
+				case 3:
+					rule.Tokens = int(r.varint)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			cs.ColumnRules = append(cs.ColumnRules, rule)
+		case 40:
+			cs.MaxTokens = int(f.varint)
+		case 41:
+			cs.RejectOversized = f.varint != 0
+		}
+		return nil
+	})
+	return cs, err
+}
+
+// decodePattern decodes a Pattern message
+func decodePattern(data []byte) (patternState, error) {
+	ps := patternState{Frequency: make(map[string]int)}
+	err := forEachField(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			ps.ID = int(f.varint)
+		case 2:
+			ps.Template = string(f.data)
+		case 3:
+			return decodeCount(f.data, ps.Frequency)
+		case 4:
+			ps.Count = int(f.varint)
+		case 5:
+			ps.Examples = append(ps.Examples, string(f.data))
+		case 6:
+			ps.FirstSeen = fromUnixNano(int64(f.varint))
+		case 7:
+			ps.LastSeen = fromUnixNano(int64(f.varint))
+		case 8:
+			ps.Weight = math.Float64frombits(f.varint)
+		case 9:
+			ps.LastLine = int(f.varint)
+		case 10:
+			es, err := decodeEvent(f.data)
+			if err != nil {
+				return err
+			}
+			ps.Events = append(ps.Events, es)
+		case 11:
+			ps.Segment = string(f.data)
+		case 12:
+			ps.SimilaritySamples = int(f.varint)
+		case 13:
+			ps.SimilarityMean = math.Float64frombits(f.varint)
+		case 14:
+			ps.SimilarityM2 = math.Float64frombits(f.varint)
+		case 15:
+			counts := make(map[string]int)
+			err := forEachField(f.data, func(c protoField) error {
+				if c.num == 1 {
+					return decodeCount(c.data, counts)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ps.PositionFrequency = append(ps.PositionFrequency, counts)
+		case 16:
+			ps.Sketch = f.data
+		}
+		return nil
+	})
+	return ps, err
+}
+
+// decodeCount decodes a map<string, int64> entry into counts
+func decodeCount(data []byte, counts map[string]int) error {
+	var token string
+	var count int
+	err := forEachField(data, func(e protoField) error {
+		switch e.num {
+		case 1:
+			token = string(e.data)
+		case 2:
+			count = int(e.varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	counts[token] = count
+	return nil
+}
+
+// decodeEvent decodes an Event message
+func decodeEvent(data []byte) (eventState, error) {
+	var es eventState
+	err := forEachField(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			es.Raw = string(f.data)
+		case 2:
+			es.Content = string(f.data)
+		case 3:
+			es.Tokens = append(es.Tokens, string(f.data))
+		case 4:
+			es.Truncated = f.varint != 0
+		case 5:
+			var name, value string
+			err := forEachField(f.data, func(e protoField) error {
+				switch e.num {
+				case 1:
+					name = string(e.data)
+				case 2:
+					value = string(e.data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if es.Fields == nil {
+				es.Fields = make(map[string]string)
+			}
+			es.Fields[name] = value
+		}
+		return nil
+	})
+	return es, err
+}
+
+// sortedKeys returns the keys of a map in ascending order, for deterministic output
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unixNano converts a time to Unix nanoseconds, using 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano converts Unix nanoseconds to a time, mapping 0 to the zero time
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
@@ -0,0 +1,190 @@
+package awsomlp
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Recluster adapts the templates to recent lines, as a service does when an
+// application's log wording changes after a deploy. It regroups the window
+// most recently learned retained events newest first with a fresh parser of
+// the same configuration, so a group takes the current wording, and reconciles
+// the result with the long-term model: a recent line that no longer fits the
+// template of its pattern, because the pattern absorbed it by similarity,
+// moves to the pattern of its recent group's template, an existing pattern of
+// the segment with the same template or a new one. Lines that fit their
+// template stay, so the long-term model only changes where the wording
+// drifted. It returns the number of moved lines.
+//
+// Only retained events can move (see MaxEventsPerPattern), and the token
+// frequencies of a pattern counted in a sketch are decremented approximately.
+// A pattern left without lines is removed. OnProgress, OnExpire and
+// BeforeGroup are not called for the regrouping. Like Feed, Recluster is safe
+// for concurrent use with learning, so it can run periodically in the
+// background of a stream.
+func (lp *AWSOMLP) Recluster(window int) (int, error) {
+	if window < 1 {
+		return 0, fmt.Errorf("%w: window must be at least 1, got %d", ErrInvalidConfig, window)
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	var events []*LogEvent
+	for _, pattern := range lp.patterns {
+		events = append(events, pattern.Events...)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].seq < events[j].seq
+	})
+	events = events[max(0, len(events)-window):]
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	// The recent events are regrouped as copies, so the model is not touched,
+	// newest first, so the current wording of a group becomes its representative
+	config := lp.config
+	config.OnProgress = nil
+	config.OnExpire = nil
+	config.BeforeGroup = nil
+	recent := NewAWSOMLP()
+	if err := recent.WithConfig(config); err != nil {
+		return 0, err
+	}
+	copies := make([]*LogEvent, len(events))
+	for i, event := range events {
+		copied := *event
+		copies[len(events)-1-i] = &copied
+	}
+	groups := recent.patternRecognition(copies)
+	slices.Reverse(groups)
+	recent.frequencyAnalysis()
+	recent.replaceRemainingNumericalVariables()
+
+	owners := make(map[int]*Pattern, len(lp.patterns))
+	for _, pattern := range lp.patterns {
+		owners[pattern.ID] = pattern
+	}
+	fits := make(map[string]*regexp.Regexp)
+	fit := func(template string, event *LogEvent) bool {
+		re := fits[template]
+		if re == nil {
+			re = regexp.MustCompile(`^` + templateExpr(template) + `$`)
+			fits[template] = re
+		}
+		return re.MatchString(strings.Join(event.Tokens, " "))
+	}
+
+	changed := make(map[*Pattern]bool)
+	moved := 0
+	for i, event := range events {
+		owner := owners[event.PatternID]
+		template := strings.TrimSpace(groups[i].Template)
+		current := strings.TrimSpace(owner.Template)
+		if template == "" || template == current || fit(current, event) || !fit(template, event) {
+			continue
+		}
+		target := lp.templatePattern(owner.Segment, template)
+		if target == nil {
+			target = &Pattern{
+				ID:        lp.nextID,
+				Template:  template,
+				Frequency: make(map[string]int),
+				Segment:   owner.Segment,
+				FirstSeen: owner.LastSeen,
+				LastSeen:  owner.LastSeen,
+				lastLine:  owner.lastLine,
+			}
+			lp.nextID++
+			lp.patterns = append(lp.patterns, target)
+		}
+		lp.moveEvent(owner, target, event)
+		changed[owner], changed[target] = true, true
+		moved++
+	}
+	if moved == 0 {
+		return 0, nil
+	}
+
+	kept := lp.patterns[:0]
+	for _, pattern := range lp.patterns {
+		if pattern.Count > 0 {
+			kept = append(kept, pattern)
+		}
+	}
+	clear(lp.patterns[len(kept):])
+	lp.patterns = kept
+	lp.resetIndexes()
+
+	for pattern := range changed {
+		if pattern.Count > 0 {
+			lp.analyzePattern(pattern)
+			lp.replacePatternNumericalVariables(pattern)
+		}
+	}
+	return moved, nil
+}
+
+// templatePattern returns the first pattern of the segment with the given
+// template and retained events, or nil
+func (lp *AWSOMLP) templatePattern(segment, template string) *Pattern {
+	for _, pattern := range lp.patterns {
+		if pattern.Segment == segment && len(pattern.Events) > 0 && strings.TrimSpace(pattern.Template) == template {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// moveEvent moves a retained event with its token counts, example and share
+// of the weight from one pattern to another
+func (lp *AWSOMLP) moveEvent(from, to *Pattern, event *LogEvent) {
+	for i, e := range from.Events {
+		if e == event {
+			from.Events = append(from.Events[:i], from.Events[i+1:]...)
+			break
+		}
+	}
+	for _, token := range event.Tokens {
+		lp.discountToken(from, token)
+	}
+	for i, token := range event.Tokens {
+		if i < len(from.PositionFrequency) {
+			if from.PositionFrequency[i][token]--; from.PositionFrequency[i][token] <= 0 {
+				delete(from.PositionFrequency[i], token)
+			}
+		}
+	}
+	for i, example := range from.Examples {
+		if example == event.Raw {
+			from.Examples = append(from.Examples[:i], from.Examples[i+1:]...)
+			break
+		}
+	}
+	share := from.Weight / float64(from.Count)
+	from.Weight -= share
+	from.Count--
+
+	event.PatternID = to.ID
+	if lp.config.MaxEventsPerPattern == 0 || len(to.Events) < lp.config.MaxEventsPerPattern {
+		to.Events = append(to.Events, event)
+	}
+	to.Count++
+	for _, token := range event.Tokens {
+		lp.countToken(to, token)
+	}
+	if lp.config.FreqCounting == FreqCountPositional {
+		lp.countPositions(to, event.Tokens)
+	}
+	lp.sampleExample(to, event.Raw)
+	if from.LastSeen.After(to.LastSeen) {
+		to.Weight = lp.decay(to.Weight, from.LastSeen.Sub(to.LastSeen))
+		to.LastSeen = from.LastSeen
+		to.lastLine = from.lastLine
+	}
+	to.Weight += lp.decay(share, to.LastSeen.Sub(from.LastSeen))
+}
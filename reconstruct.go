@@ -0,0 +1,125 @@
+package awsomlp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// paramCacheSize bounds the compiled template regexes kept for ExtractParams
+const paramCacheSize = 10000
+
+// paramRegexes caches the regexes of ExtractParams by template
+var paramRegexes = struct {
+	sync.Mutex
+	cache map[string]*regexp.Regexp
+}{cache: make(map[string]*regexp.Regexp)}
+
+// Reconstruct substitutes params for the <*> placeholders of a template in
+// order, reversing the masking of a line. It returns an error wrapping
+// ErrParamCount if the number of params differs from the number of
+// placeholders. Whitespace is taken from the template, so the result matches
+// the original line up to the runs of spaces collapsed by tokenization.
+func Reconstruct(template string, params []string) (string, error) {
+	if n := strings.Count(template, "<*>"); n != len(params) {
+		return "", fmt.Errorf("%w: template has %d placeholders, got %d parameters", ErrParamCount, n, len(params))
+	}
+
+	var sb strings.Builder
+	rest := template
+	for _, param := range params {
+		i := strings.Index(rest, "<*>")
+		sb.WriteString(rest[:i])
+		sb.WriteString(param)
+		rest = rest[i+len("<*>"):]
+	}
+	sb.WriteString(rest)
+	return sb.String(), nil
+}
+
+// ExtractParams returns the values a template's <*> placeholders stand for in
+// a raw line, in order, reversing Reconstruct: for "PacketResponder <*> for
+// block <*> terminating" and the line "... PacketResponder 1 for block
+// blk_38865049064139660 terminating" it returns ["1",
+// "blk_38865049064139660"]. The template is matched against the end of the
+// line, so a header removed before templating is skipped. It returns nil if
+// the line does not match, e.g. because a custom pipeline stage rewrote it.
+// Compiled templates are cached, and it is safe for concurrent use.
+func ExtractParams(template, raw string) []string {
+	template = strings.TrimSpace(template)
+	paramRegexes.Lock()
+	re, ok := paramRegexes.cache[template]
+	if !ok {
+		if len(paramRegexes.cache) >= paramCacheSize {
+			clear(paramRegexes.cache) // Templates of a long-running service change as they generalize
+		}
+		re = templateRegex(template)
+		paramRegexes.cache[template] = re
+	}
+	paramRegexes.Unlock()
+
+	params, _, _ := matchTemplate(re, raw)
+	return params
+}
+
+// Params returns the values of the event's template placeholders in its raw
+// line (see ExtractParams)
+func (e *LogEvent) Params() []string {
+	return ExtractParams(e.Template, e.Raw)
+}
+
+// Params returns the values of the result's template placeholders in its raw
+// line (see ExtractParams)
+func (r ParseResult) Params() []string {
+	return ExtractParams(r.Template, r.Raw)
+}
+
+// templateRegex builds a regex matching lines of a template at the end of a
+// line: tokens are separated by whitespace and every <*> captures a lazy group
+func templateRegex(template string) *regexp.Regexp {
+	return regexp.MustCompile(`(?:^|\s)` + templateExpr(template) + `\s*$`)
+}
+
+// templateExpr returns the regex of a template's tokens without anchors
+func templateExpr(template string) string {
+	return templateGroups(template, nil)
+}
+
+// templateGroups is templateExpr with the groups of the placeholders named by
+// names, or unnamed if names is nil
+func templateGroups(template string, names []string) string {
+	var sb strings.Builder
+	slot := 0
+	for i, token := range strings.Fields(template) {
+		if i > 0 {
+			sb.WriteString(`\s+`)
+		}
+		for j, literal := range strings.Split(token, "<*>") {
+			if j > 0 {
+				if names != nil {
+					sb.WriteString(`(?P<` + names[slot] + `>.*?)`)
+				} else {
+					sb.WriteString(`(.*?)`)
+				}
+				slot++
+			}
+			sb.WriteString(regexp.QuoteMeta(literal))
+		}
+	}
+	return sb.String()
+}
+
+// matchTemplate extracts the parameters of a line from a regex built by
+// templateRegex, also returning the matched end of the line
+func matchTemplate(re *regexp.Regexp, raw string) (params []string, matched string, ok bool) {
+	loc := re.FindStringSubmatchIndex(raw)
+	if loc == nil {
+		return nil, "", false
+	}
+	params = make([]string, 0, len(loc)/2-1)
+	for k := 2; k < len(loc); k += 2 {
+		params = append(params, raw[loc[k]:loc[k+1]])
+	}
+	return params, raw[loc[0]:loc[1]], true
+}
@@ -0,0 +1,164 @@
+package awsomlp
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Reparse applies a new configuration to the data parsed so far without
+// reading it again. Depending on what changed, it does as little work as
+// possible:
+//
+//   - Template settings only (MinGroupSize, MaxPlaceholderRatio,
+//     FreqThresholdStrategy, SortingStrategy, EntropyThreshold, ...): the
+//     templates are regenerated from the patterns' token frequencies.
+//   - Grouping settings (MinSimilarity, SimilarityStrategy, bucketing,
+//     ApproximateGrouping, Segmentation, Canonical, FreqCounting, ...): the
+//     retained events are regrouped in their original order.
+//   - Preprocessing settings (HeaderRegex, CustomRegexes, MaxLineLength,
+//     MaxTokens, CalendarWords, or a Pipeline with other stage names): the
+//     retained events are preprocessed again from their raw lines, then
+//     regrouped. Events now rejected by RejectOversized are dropped.
+//
+// Events keep their identity, so events returned by ParseEvents see their new
+// templates and pattern IDs. Regrouping starts a new set of patterns whose
+// timestamps and weights restart at the current time. It needs every line of
+// every pattern: if events were not retained because of MaxEventsPerPattern or
+// ParseChunked, the error wraps ErrEventsDiscarded and the configuration is
+// left unchanged, as it is for an invalid configuration. Like Feed, Reparse is
+// safe for concurrent use with Feed, ExportState and ImportState.
+func (lp *AWSOMLP) Reparse(config Config) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.reparse(config, true)
+}
+
+// Reconfigure applies a new configuration to a parser that keeps learning, as
+// a service reloading its settings does. It works like Reparse, except that
+// the patterns keep their grouping instead of failing if some lines were not
+// retained: their templates are regenerated with the new template settings,
+// while new preprocessing and grouping settings only apply to the lines
+// learned from now on.
+func (lp *AWSOMLP) Reconfigure(config Config) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.reparse(config, false)
+}
+
+// reparse implements Reparse and Reconfigure; strict makes discarded events an error
+func (lp *AWSOMLP) reparse(config Config, strict bool) error {
+	// Validate on a scratch parser, so that lp is only changed once nothing can fail
+	configured := NewAWSOMLP()
+	if err := configured.WithConfig(config); err != nil {
+		return err
+	}
+
+	repreprocess := preprocessingChanged(lp.config, configured.config)
+	regroup := repreprocess || groupingChanged(lp.config, configured.config)
+	if regroup {
+		if pattern := lp.discardingPattern(); pattern != nil {
+			if strict {
+				return fmt.Errorf("%w: pattern %d retains %d of %d events", ErrEventsDiscarded, pattern.ID, len(pattern.Events), pattern.Count)
+			}
+			regroup = false
+		}
+	}
+
+	lp.adoptConfig(configured)
+	if regroup {
+		lp.regroup(repreprocess)
+	}
+
+	lp.frequencyAnalysis()
+	lp.replaceRemainingNumericalVariables()
+	return nil
+}
+
+// adoptConfig takes over the validated configuration of another parser with
+// its compiled regexes
+func (lp *AWSOMLP) adoptConfig(configured *AWSOMLP) {
+	lp.config = configured.config
+	lp.headerRegex = configured.headerRegex
+	lp.customRegexes = configured.customRegexes
+	lp.brackets = configured.brackets
+	lp.columns = configured.columns
+	lp.pathPatterns = configured.pathPatterns
+}
+
+// discardingPattern returns the first pattern that did not retain all its events, if any
+func (lp *AWSOMLP) discardingPattern() *Pattern {
+	for _, pattern := range lp.patterns {
+		if len(pattern.Events) < pattern.Count {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// regroup assigns the retained events to new patterns in the order they were
+// first assigned, preprocessing them again from their raw lines if requested
+// and dropping those rejected by RejectOversized
+func (lp *AWSOMLP) regroup(repreprocess bool) {
+	var events []*LogEvent
+	for _, pattern := range lp.patterns {
+		events = append(events, pattern.Events...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].seq < events[j].seq
+	})
+
+	if repreprocess {
+		lp.truncated = 0
+		lp.oversized = 0
+		kept := events[:0]
+		for _, event := range events {
+			*event = *lp.preprocessLine(event.Raw)
+			if !lp.rejected(event) {
+				kept = append(kept, event)
+			}
+		}
+		events = kept
+	}
+
+	lp.patterns = make([]*Pattern, 0)
+	lp.lines = 0
+	lp.nextID = 0
+	lp.resetIndexes()
+	lp.patternRecognition(events)
+}
+
+// preprocessingChanged reports whether events must be preprocessed again.
+// Pipelines are compared by stage names, as DefaultPipeline returns new
+// stages every time.
+func preprocessingChanged(a, b Config) bool {
+	if a.HeaderRegex != b.HeaderRegex || a.MaxLineLength != b.MaxLineLength || a.CalendarWords != b.CalendarWords ||
+		a.MaxTokens != b.MaxTokens || a.RejectOversized != b.RejectOversized ||
+		a.PathMinSegments != b.PathMinSegments || a.KeepPaths != b.KeepPaths ||
+		a.MaskThreads != b.MaskThreads || a.MaskQuoted != b.MaskQuoted ||
+		!slices.Equal(a.CustomRegexes, b.CustomRegexes) || !slices.Equal(a.Brackets, b.Brackets) ||
+		!slices.Equal(a.ColumnRules, b.ColumnRules) {
+		return true
+	}
+	return !slices.EqualFunc(a.Pipeline, b.Pipeline, func(x, y Stage) bool {
+		return x.Name() == y.Name()
+	})
+}
+
+// groupingChanged reports whether events must be assigned to patterns again
+func groupingChanged(a, b Config) bool {
+	return a.MinSimilarity != b.MinSimilarity ||
+		a.SimilarityStrategy != b.SimilarityStrategy ||
+		a.StrictAlphabeticalMatching != b.StrictAlphabeticalMatching ||
+		a.BucketByTokenCount != b.BucketByTokenCount ||
+		a.TokenCountTolerance != b.TokenCountTolerance ||
+		a.ApproximateGrouping != b.ApproximateGrouping ||
+		a.LSHBands != b.LSHBands ||
+		a.LSHRows != b.LSHRows ||
+		a.Segmentation != b.Segmentation ||
+		a.SegmentField != b.SegmentField ||
+		a.Canonical != b.Canonical || a.Deterministic != b.Deterministic ||
+		a.SingletonSimilarity != b.SingletonSimilarity ||
+		a.FreqCounting != b.FreqCounting ||
+		a.FreqSketchThreshold != b.FreqSketchThreshold
+}
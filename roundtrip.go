@@ -0,0 +1,120 @@
+package awsomlp
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RoundTripKind classifies a problem found by VerifyRoundTrip
+type RoundTripKind int
+
+const (
+	RoundTripLossy    RoundTripKind = iota // The line cannot be reconstructed from its template and parameters
+	RoundTripConstant                      // A placeholder holds the same value in every line of its template
+)
+
+// String returns the name of the kind
+func (k RoundTripKind) String() string {
+	switch k {
+	case RoundTripLossy:
+		return "lossy"
+	case RoundTripConstant:
+		return "constant"
+	default:
+		return "unknown"
+	}
+}
+
+// RoundTripIssue is a line or placeholder whose masking lost information
+type RoundTripIssue struct {
+	Kind        RoundTripKind
+	Template    string
+	Index       int    // Index of the (first) affected event
+	Raw         string // The affected line, or the first line of the template for RoundTripConstant
+	Placeholder int    // Position of the placeholder among those of the template (RoundTripConstant)
+	Value       string // The value the placeholder always holds (RoundTripConstant)
+	Lines       int    // Number of lines the issue covers
+}
+
+// VerifyRoundTrip checks that parsing is lossless: the parameters of every
+// event are extracted from its raw line and the line is reconstructed from
+// its template, which must reproduce the line up to whitespace and the
+// header. A line that cannot be reconstructed is reported as RoundTripLossy,
+// typically because a custom stage rewrote it. A placeholder that holds the
+// same value in all of at least two lines of a template is reported as
+// RoundTripConstant: a masking regex replaced static text. Truncated events
+// are skipped. Issues are ordered by the index of their first event.
+func (lp *AWSOMLP) VerifyRoundTrip(events []*LogEvent) []RoundTripIssue {
+	// constant tracks the placeholders of a template whose values never changed
+	type constant struct {
+		first  int // Index of the first event
+		values []string
+		same   []bool
+		lines  int
+	}
+
+	var issues []RoundTripIssue
+	regexes := make(map[string]*regexp.Regexp)
+	templates := make(map[string]*constant)
+	var order []string
+	for i, event := range events {
+		template := strings.TrimSpace(event.Template)
+		if template == "" || event.Truncated {
+			continue
+		}
+		re, ok := regexes[template]
+		if !ok {
+			re = templateRegex(template)
+			regexes[template] = re
+		}
+
+		params, matched, ok := matchTemplate(re, event.Raw)
+		if ok {
+			reconstructed, err := Reconstruct(template, params)
+			ok = err == nil && slices.Equal(strings.Fields(reconstructed), strings.Fields(matched))
+		}
+		if !ok {
+			issues = append(issues, RoundTripIssue{Kind: RoundTripLossy, Template: template, Index: i, Raw: event.Raw, Lines: 1})
+			continue
+		}
+
+		c, ok := templates[template]
+		if !ok {
+			c = &constant{first: i, values: params, same: make([]bool, len(params))}
+			for j := range c.same {
+				c.same[j] = true
+			}
+			templates[template] = c
+			order = append(order, template)
+		}
+		for j, param := range params {
+			c.same[j] = c.same[j] && param == c.values[j]
+		}
+		c.lines++
+	}
+
+	for _, template := range order {
+		c := templates[template]
+		if c.lines < 2 {
+			continue
+		}
+		for j, same := range c.same {
+			if same {
+				issues = append(issues, RoundTripIssue{
+					Kind:        RoundTripConstant,
+					Template:    template,
+					Index:       c.first,
+					Raw:         events[c.first].Raw,
+					Placeholder: j,
+					Value:       c.values[j],
+					Lines:       c.lines,
+				})
+			}
+		}
+	}
+	slices.SortStableFunc(issues, func(a, b RoundTripIssue) int {
+		return a.Index - b.Index
+	})
+	return issues
+}
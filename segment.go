@@ -0,0 +1,130 @@
+package awsomlp
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Segmentation defines how lines of a mixed stream are split into segments.
+// Each segment has its own pattern set, so lines of different segments are
+// never grouped together.
+type Segmentation int
+
+const (
+	SegmentNone     Segmentation = iota // Single pattern set for all lines (original behavior)
+	SegmentByHeader                     // Segment by the detected header format of the raw line
+	SegmentByField                      // Segment by the header field named by SegmentField
+)
+
+// headerSignatureTokens is the number of leading tokens describing a header format
+const headerSignatureTokens = 2
+
+// segmentOf returns the segment key of a preprocessed event
+func (lp *AWSOMLP) segmentOf(event *LogEvent) string {
+	switch lp.config.Segmentation {
+	case SegmentByHeader:
+		return headerSignature(event.Raw)
+	case SegmentByField:
+		return event.Fields[lp.config.SegmentField]
+	default:
+		return ""
+	}
+}
+
+// headerSignature describes the format of a line's header by the shape of its
+// leading tokens: runs of digits become 9, runs of letters become a, and other
+// characters are kept. Lines written by the same logger share a signature
+// ("2024-01-02 10:00:00,123" and "2023-12-31 23:59:59,999" both give
+// "9-9-9 9:9:9,9"), while different timestamp and prefix layouts differ.
+// Lines starting with a plain word have the signature "a", as do messages
+// without a header at all.
+func headerSignature(raw string) string {
+	var sig strings.Builder
+	for i, token := range strings.Fields(raw) {
+		if i == headerSignatureTokens {
+			break
+		}
+		shape := tokenShape(token)
+		if shape == "a" {
+			// A word ends the header: loggers differ in what follows the timestamp
+			if i == 0 {
+				sig.WriteString(shape)
+			}
+			break
+		}
+		if i > 0 {
+			sig.WriteByte(' ')
+		}
+		sig.WriteString(shape)
+	}
+	return sig.String()
+}
+
+// tokenShape collapses a token into its character class shape
+func tokenShape(token string) string {
+	var shape strings.Builder
+	var last rune
+	for _, r := range token {
+		class := r
+		switch {
+		case unicode.IsDigit(r):
+			class = '9'
+		case unicode.IsLetter(r):
+			class = 'a'
+		}
+		if class != last || (class != '9' && class != 'a') {
+			shape.WriteRune(class)
+		}
+		last = class
+	}
+	return shape.String()
+}
+
+// SegmentTemplates holds the templates of one segment
+type SegmentTemplates struct {
+	Segment   string
+	Count     int             // Number of lines of the segment
+	Templates []TemplateCount // Most frequent first, then alphabetically
+}
+
+// GetTemplatesBySegment returns the templates of every segment with the number
+// of lines they cover, the segment with the most lines first and then
+// alphabetically. With SegmentByField this reports the templates per
+// component, e.g. per logger name. Without segmentation all templates belong
+// to the segment "".
+func (lp *AWSOMLP) GetTemplatesBySegment() []SegmentTemplates {
+	counts := make(map[string]map[string]int)
+	for _, pattern := range lp.patterns {
+		if len(pattern.Events) == 0 {
+			continue
+		}
+		if counts[pattern.Segment] == nil {
+			counts[pattern.Segment] = make(map[string]int)
+		}
+		counts[pattern.Segment][lp.result(0, pattern.Events[0], pattern).Template] += pattern.Count
+	}
+
+	segments := make([]SegmentTemplates, 0, len(counts))
+	for segment, templateCounts := range counts {
+		st := SegmentTemplates{Segment: segment, Templates: make([]TemplateCount, 0, len(templateCounts))}
+		for template, count := range templateCounts {
+			st.Templates = append(st.Templates, TemplateCount{Template: template, Count: count})
+			st.Count += count
+		}
+		sort.Slice(st.Templates, func(i, j int) bool {
+			if st.Templates[i].Count != st.Templates[j].Count {
+				return st.Templates[i].Count > st.Templates[j].Count
+			}
+			return st.Templates[i].Template < st.Templates[j].Template
+		})
+		segments = append(segments, st)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].Count != segments[j].Count {
+			return segments[i].Count > segments[j].Count
+		}
+		return segments[i].Segment < segments[j].Segment
+	})
+	return segments
+}
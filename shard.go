@@ -0,0 +1,115 @@
+package awsomlp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// ShardedParser learns lines concurrently by splitting the patterns across
+// shards, each an independent parser with its own lock. A line is
+// preprocessed outside any lock and learned by the shard selected by the
+// letter count of its alphabetical tokens, the quantity the similarity
+// compares. With MinSimilarity 1 (the default) lines that a single parser
+// would group always meet in the same shard, so Feed calls on different
+// templates proceed in parallel instead of serializing on one mutex. Lower
+// similarity thresholds may keep lines of similar length in separate shards.
+//
+// The pattern IDs of results are unique across shards. Hooks are called
+// concurrently by different shards, and custom stages must not modify the
+// parser.
+type ShardedParser struct {
+	preprocessor *AWSOMLP // Preprocesses lines; never learns, so it is safe for concurrent use
+	shards       []*AWSOMLP
+	lines        atomic.Int64 // Number of lines fed so far
+}
+
+// NewShardedParser creates a parser with the given number of shards, at least 1
+func NewShardedParser(config Config, shards int) (*ShardedParser, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("%w: shard count must be at least 1, got %d", ErrInvalidConfig, shards)
+	}
+	preprocessor := NewAWSOMLP()
+	if err := preprocessor.WithConfig(config); err != nil {
+		return nil, err
+	}
+	s := &ShardedParser{preprocessor: preprocessor, shards: make([]*AWSOMLP, shards)}
+	for i := range s.shards {
+		s.shards[i] = NewAWSOMLP()
+		s.shards[i].WithConfig(config) // Validated above
+	}
+	return s, nil
+}
+
+// Feed learns a single line and returns its result; ok is false for blank
+// lines and lines rejected by RejectOversized. It is safe for concurrent use.
+func (s *ShardedParser) Feed(line string) (result ParseResult, ok bool) {
+	if line = strings.TrimSpace(line); line == "" {
+		return ParseResult{}, false
+	}
+	event := s.preprocessor.prepareLine(line)
+	shard := s.preprocessor.countAlphabeticalLetters(event) % len(s.shards)
+	index := int(s.lines.Add(1) - 1)
+
+	lp := s.shards[shard]
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.countLimits(event)
+	if lp.rejected(event) {
+		return ParseResult{}, false
+	}
+	event, pattern := lp.learnEvent(event)
+	result = lp.result(index, event, pattern)
+	result.PatternID = result.PatternID*len(s.shards) + shard
+	return result, true
+}
+
+// Lines returns the number of lines fed so far
+func (s *ShardedParser) Lines() int {
+	return int(s.lines.Load())
+}
+
+// GetTemplates returns the unique templates of all shards in ascending order
+func (s *ShardedParser) GetTemplates() []string {
+	seen := make(map[string]bool)
+	var templates []string
+	for _, lp := range s.shards {
+		lp.mu.Lock()
+		for _, template := range lp.GetTemplates() {
+			if !seen[template] {
+				seen[template] = true
+				templates = append(templates, template)
+			}
+		}
+		lp.mu.Unlock()
+	}
+	sort.Strings(templates)
+	return templates
+}
+
+// GetTemplatesByFrequency returns the templates of all shards with the number
+// of lines they cover, most frequent first
+func (s *ShardedParser) GetTemplatesByFrequency() []TemplateCount {
+	counts := make(map[string]int)
+	for _, lp := range s.shards {
+		lp.mu.Lock()
+		for _, tc := range lp.GetTemplatesByFrequency() {
+			counts[tc.Template] += tc.Count
+		}
+		lp.mu.Unlock()
+	}
+
+	templates := make([]TemplateCount, 0, len(counts))
+	for template, count := range counts {
+		templates = append(templates, TemplateCount{Template: template, Count: count})
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Count != templates[j].Count {
+			return templates[i].Count > templates[j].Count
+		}
+		return templates[i].Template < templates[j].Template
+	})
+	return templates
+}
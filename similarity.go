@@ -0,0 +1,112 @@
+package awsomlp
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// SimilarityStrategy defines how the similarity threshold of a pattern adapts to its group
+type SimilarityStrategy int
+
+const (
+	SimilarityFixed       SimilarityStrategy = iota // MinSimilarity for every pattern (paper-compliant)
+	SimilarityByGroupSize                           // Threshold tightens towards 1.0 as the group grows
+	SimilarityByVariance                            // Threshold derived from the similarities of the group's members
+)
+
+// Parameters of the adaptive similarity strategies
+const (
+	varianceMinSamples = 5 // Members needed before SimilarityByVariance departs from MinSimilarity
+	varianceTolerance  = 3 // Accepted deviation from the mean member similarity, in standard deviations
+)
+
+// similarityThreshold returns the similarity an event needs to join the pattern.
+// Adaptive thresholds never fall below MinSimilarity, so with MinSimilarity 1.0
+// all strategies behave the same.
+func (lp *AWSOMLP) similarityThreshold(pattern *Pattern) float64 {
+	minSimilarity := lp.config.MinSimilarity
+
+	switch lp.config.SimilarityStrategy {
+	case SimilarityByGroupSize:
+		// The slack below 1.0 halves when the group grows tenfold
+		if pattern.Count > 1 {
+			return 1 - (1-minSimilarity)/(1+math.Log10(float64(pattern.Count)))
+		}
+	case SimilarityByVariance:
+		if pattern.simSamples >= varianceMinSamples {
+			stddev := math.Sqrt(pattern.simM2 / float64(pattern.simSamples))
+			return math.Min(1, math.Max(minSimilarity, pattern.simMean-varianceTolerance*stddev))
+		}
+	}
+	return minSimilarity
+}
+
+// recordSimilarity adds the similarity of a new member to the pattern's running
+// mean and variance (Welford's algorithm)
+func (lp *AWSOMLP) recordSimilarity(pattern *Pattern, similarity float64) {
+	if lp.config.SimilarityStrategy != SimilarityByVariance {
+		return
+	}
+	pattern.simSamples++
+	delta := similarity - pattern.simMean
+	pattern.simMean += delta / float64(pattern.simSamples)
+	pattern.simM2 += delta * (similarity - pattern.simMean)
+}
+
+// PatternScore is the similarity of a line to a pattern, see NearestPatterns
+type PatternScore struct {
+	PatternID  int
+	Template   string
+	Similarity float64 // Similarity of the line to the first event of the pattern
+	Threshold  float64 // Similarity the line needs to join the pattern
+}
+
+// SimilarityMatrix preprocesses lines and returns their pairwise similarities
+// as computed when grouping: matrix[i][j] is the similarity of lines i and j,
+// 0 for lines of different segments, which are never grouped together. It
+// shows which lines a threshold would merge and does not modify the parser.
+func (lp *AWSOMLP) SimilarityMatrix(lines []string) [][]float64 {
+	events := make([]*LogEvent, len(lines))
+	for i, line := range lines {
+		events[i] = lp.prepareLine(strings.TrimSpace(line))
+	}
+	matrix := make([][]float64, len(events))
+	for i := range events {
+		matrix[i] = make([]float64, len(events))
+	}
+	for i, a := range events {
+		for j := i; j < len(events); j++ {
+			if a.Segment == events[j].Segment {
+				similarity := lp.calculateSimilarity(a, events[j])
+				matrix[i][j], matrix[j][i] = similarity, similarity
+			}
+		}
+	}
+	return matrix
+}
+
+// NearestPatterns returns the n learned patterns most similar to a line (all
+// for n <= 0), most similar first, with the similarity the line would need to
+// join each of them. Patterns of other segments are left out. It does not
+// modify the parser.
+func (lp *AWSOMLP) NearestPatterns(line string, n int) []PatternScore {
+	event := lp.prepareLine(strings.TrimSpace(line))
+	var scores []PatternScore
+	for _, pattern := range lp.patterns {
+		if len(pattern.Events) == 0 || pattern.Segment != event.Segment {
+			continue
+		}
+		scores = append(scores, PatternScore{
+			PatternID:  pattern.ID,
+			Template:   lp.result(0, pattern.Events[0], pattern).Template,
+			Similarity: lp.calculateSimilarity(event, pattern.Events[0]),
+			Threshold:  lp.similarityThreshold(pattern),
+		})
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Similarity > scores[j].Similarity })
+	if n > 0 && len(scores) > n {
+		scores = scores[:n]
+	}
+	return scores
+}
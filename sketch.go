@@ -0,0 +1,144 @@
+package awsomlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// Dimensions of the count-min sketches used with FreqSketchThreshold: counts are
+// overestimated by at most e/sketchWidth (about 0.13%) of the pattern's token
+// occurrences with probability 1-e^-sketchDepth (about 98%)
+const (
+	sketchWidth = 2048
+	sketchDepth = 4
+)
+
+// errSketchSize reports serialized sketch data of the wrong size
+var errSketchSize = errors.New("invalid frequency sketch size")
+
+// countMinSketch counts token occurrences in constant memory, never underestimating
+type countMinSketch struct {
+	counts []uint32 // sketchDepth rows of sketchWidth counters
+}
+
+// newCountMinSketch creates an empty sketch
+func newCountMinSketch() *countMinSketch {
+	return &countMinSketch{counts: make([]uint32, sketchDepth*sketchWidth)}
+}
+
+// cells returns the counter index of a token in every row
+func (s *countMinSketch) cells(token string) [sketchDepth]int {
+	h := fnv.New64a()
+	h.Write([]byte(token))
+	base := h.Sum64()
+
+	var cells [sketchDepth]int
+	for row := range cells {
+		cells[row] = row*sketchWidth + int(mix64(base+uint64(row)*0x9e3779b97f4a7c15)%sketchWidth)
+	}
+	return cells
+}
+
+// add counts n occurrences of a token
+func (s *countMinSketch) add(token string, n int) {
+	for _, cell := range s.cells(token) {
+		if uint64(s.counts[cell])+uint64(n) > math.MaxUint32 {
+			s.counts[cell] = math.MaxUint32
+		} else {
+			s.counts[cell] += uint32(n)
+		}
+	}
+}
+
+// remove uncounts one occurrence of a token that was counted before
+func (s *countMinSketch) remove(token string) {
+	for _, cell := range s.cells(token) {
+		if s.counts[cell] > 0 && s.counts[cell] < math.MaxUint32 {
+			s.counts[cell]--
+		}
+	}
+}
+
+// estimate returns the estimated number of occurrences of a token
+func (s *countMinSketch) estimate(token string) int {
+	estimate := uint32(math.MaxUint32)
+	for _, cell := range s.cells(token) {
+		estimate = min(estimate, s.counts[cell])
+	}
+	return int(estimate)
+}
+
+// bytes encodes the counters as little-endian uint32 values
+func (s *countMinSketch) bytes() []byte {
+	data := make([]byte, 0, 4*len(s.counts))
+	for _, count := range s.counts {
+		data = binary.LittleEndian.AppendUint32(data, count)
+	}
+	return data
+}
+
+// sketchFromBytes decodes counters encoded by bytes
+func sketchFromBytes(data []byte) (*countMinSketch, error) {
+	if len(data) != 4*sketchDepth*sketchWidth {
+		return nil, errSketchSize
+	}
+	s := newCountMinSketch()
+	for i := range s.counts {
+		s.counts[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return s, nil
+}
+
+// countToken counts a token of a pattern, moving the pattern's frequencies into a
+// sketch once it holds more than FreqSketchThreshold distinct tokens
+func (lp *AWSOMLP) countToken(pattern *Pattern, token string) {
+	if pattern.sketch != nil {
+		pattern.sketch.add(token, 1)
+		return
+	}
+
+	pattern.Frequency[token]++
+	if lp.config.FreqSketchThreshold > 0 && len(pattern.Frequency) > lp.config.FreqSketchThreshold {
+		pattern.sketch = newCountMinSketch()
+		for t, count := range pattern.Frequency {
+			pattern.sketch.add(t, count)
+		}
+		pattern.Frequency = make(map[string]int)
+	}
+}
+
+// discountToken uncounts a token of a pattern when an event leaves it
+func (lp *AWSOMLP) discountToken(pattern *Pattern, token string) {
+	if pattern.sketch != nil {
+		pattern.sketch.remove(token)
+		return
+	}
+	if pattern.Frequency[token]--; pattern.Frequency[token] <= 0 {
+		delete(pattern.Frequency, token)
+	}
+}
+
+// tokenFrequency returns the frequency of a token in the pattern, estimated if
+// the pattern counts in a sketch
+func (pattern *Pattern) tokenFrequency(token string) int {
+	if pattern.sketch != nil {
+		return pattern.sketch.estimate(token)
+	}
+	return pattern.Frequency[token]
+}
+
+// representativeFrequency returns the frequencies used for template generation:
+// all token frequencies, or the estimated frequencies of the representative's
+// tokens if the pattern counts in a sketch
+func (lp *AWSOMLP) representativeFrequency(pattern *Pattern) map[string]int {
+	if pattern.sketch == nil {
+		return pattern.Frequency
+	}
+	frequency := make(map[string]int, len(pattern.Events[0].Tokens))
+	for _, token := range pattern.Events[0].Tokens {
+		frequency[token] = pattern.sketch.estimate(token)
+	}
+	return frequency
+}
@@ -0,0 +1,111 @@
+package awsomlp
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// slotSynonyms names the slots following prepositions by the role of their value
+var slotSynonyms = map[string]string{
+	"from": "source",
+	"src":  "source",
+	"to":   "destination",
+	"dst":  "destination",
+	"dest": "destination",
+}
+
+// slotStopWords are tokens that say nothing about the value following them
+var slotStopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "and": true, "or": true,
+	"is": true, "are": true, "was": true, "were": true, "be": true, "been": true,
+	"of": true, "in": true, "on": true, "at": true, "for": true, "with": true, "by": true, "as": true,
+}
+
+// SlotNames names the <*> placeholders of a template in order, inferring each
+// name from the static text before the placeholder: the key of a key=value
+// token ("user=<*>" gives "user"), the prefix of the token ("blk_<*>" gives
+// "blk"), or else the preceding static token ("size <*>" gives "size"), with
+// "from", "src", "to", "dst" and "dest" named "source" and "destination".
+// Placeholders without a meaningful neighbor, such as one following another
+// placeholder or a stop word like "the", are named p1, p2, ... by their
+// position. Repeated names get the first free suffix: size, size_2. Names
+// consist of lowercase letters, digits and underscores, so they are valid
+// regex group names.
+func SlotNames(template string) []string {
+	var names []string
+	used := make(map[string]int)
+	previous := "" // Last static token before the current one, "" after a placeholder
+	for _, token := range strings.Fields(template) {
+		parts := strings.Split(token, "<*>")
+		for j, part := range parts[:len(parts)-1] {
+			name := slotName(part)
+			if name == "" && j == 0 && part == "" {
+				name = slotName(previous)
+			}
+			if name == "" {
+				name = "p" + strconv.Itoa(len(names)+1)
+			}
+			if used[name] > 0 {
+				// The suffixed name may itself be taken, e.g. by a size_2 token
+				base := name
+				for n := used[base] + 1; used[name] > 0; n++ {
+					name = base + "_" + strconv.Itoa(n)
+					used[base] = n
+				}
+			}
+			used[name]++
+			names = append(names, name)
+		}
+		if len(parts) > 1 {
+			previous = ""
+		} else {
+			previous = token
+		}
+	}
+	return names
+}
+
+// slotName turns static text before a placeholder into a slot name, or ""
+func slotName(text string) string {
+	// Keep the last word of the text, e.g. the key of "user=" or "path:"
+	text = strings.ToLower(text)
+	end := strings.LastIndexFunc(text, isSlotRune) + 1
+	start := strings.LastIndexFunc(text[:end], func(r rune) bool { return !isSlotRune(r) }) + 1
+	word := strings.Trim(text[start:end], "_")
+	if word == "" || slotStopWords[word] || unicode.IsDigit(rune(word[0])) {
+		return ""
+	}
+	if synonym, ok := slotSynonyms[word]; ok {
+		return synonym
+	}
+	return word
+}
+
+// isSlotRune reports whether r may appear in a slot name
+func isSlotRune(r rune) bool {
+	return r == '_' || ('a' <= r && r <= 'z') || ('0' <= r && r <= '9')
+}
+
+// ToRegex builds a regex matching lines of a template, with a named group per
+// placeholder as named by SlotNames. Like the parameter extraction of the CLI,
+// it matches the template at the end of a line, so a header removed before
+// templating is skipped.
+func ToRegex(template string) *regexp.Regexp {
+	return regexp.MustCompile(`(?:^|\s)` + templateGroups(template, SlotNames(template)) + `\s*$`)
+}
+
+// NamedParams pairs the parameters of a line with the slot names of its
+// template. It returns nil if their numbers differ.
+func NamedParams(template string, params []string) map[string]string {
+	names := SlotNames(template)
+	if len(names) != len(params) {
+		return nil
+	}
+	named := make(map[string]string, len(names))
+	for i, name := range names {
+		named[name] = params[i]
+	}
+	return named
+}
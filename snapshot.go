@@ -0,0 +1,126 @@
+package awsomlp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Snapshotter is a model whose state can be saved and restored, such as
+// *AWSOMLP or *ParserSet
+type Snapshotter interface {
+	ExportState(w io.Writer) error
+	ImportState(r io.Reader) error
+}
+
+// SnapshotManager periodically persists a parser's state to a file so that a
+// long-running process can resume with its learned templates after a restart.
+// Snapshots are written atomically: the state goes to a temporary file in the
+// same directory, which then replaces the target.
+type SnapshotManager struct {
+	OnError func(err error) // Called when a periodic snapshot fails (optional)
+
+	model    Snapshotter
+	path     string
+	interval time.Duration
+	mu       sync.Mutex // Serializes snapshot writes
+	saved    time.Time  // Time of the last snapshot written or restored
+}
+
+// NewSnapshotManager creates a snapshot manager writing the model's state to path every interval
+func NewSnapshotManager(model Snapshotter, path string, interval time.Duration) *SnapshotManager {
+	return &SnapshotManager{
+		model:    model,
+		path:     path,
+		interval: interval,
+	}
+}
+
+// Restore loads the state from the snapshot file. It reports false without an
+// error if no snapshot exists yet.
+func (m *SnapshotManager) Restore() (bool, error) {
+	file, err := os.Open(m.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if err := m.model.ImportState(file); err != nil {
+		return false, err
+	}
+	if info, err := file.Stat(); err == nil {
+		m.mu.Lock()
+		m.saved = info.ModTime()
+		m.mu.Unlock()
+	}
+	return true, nil
+}
+
+// LastSaved returns when the last snapshot was written, or the modification
+// time of the snapshot loaded by Restore. It is zero before either happened.
+func (m *SnapshotManager) LastSaved() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saved
+}
+
+// Save writes a snapshot immediately, e.g. on SIGHUP or before shutdown
+func (m *SnapshotManager) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+
+	if err := m.model.ExportState(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return err
+	}
+	m.saved = time.Now()
+	return nil
+}
+
+// Run writes a snapshot every interval until ctx is cancelled. Failed snapshots
+// are reported to OnError and retried at the next interval. Run does not save
+// on return; call Save after it to persist the final state.
+func (m *SnapshotManager) Run(ctx context.Context) {
+	if m.interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Save(); err != nil && m.OnError != nil {
+				m.OnError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package awsomlp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// StageSQL is the name of the SQL literal masking stage
+const StageSQL = "sql"
+
+var (
+	// sqlStatementRegex finds the start of an SQL statement in a message
+	sqlStatementRegex = regexp.MustCompile(`(?i)\b(?:SELECT\b.+?\bFROM|INSERT\s+INTO|UPDATE\s+\S+\s+SET|DELETE\s+FROM|REPLACE\s+INTO|MERGE\s+INTO)\b`)
+	// sqlInListRegex matches IN lists of masked literals or bind parameters
+	sqlInListRegex = regexp.MustCompile(`(?i)\b(IN\s*)\(\s*(?:<\*>|\?|[$:]\w+)(?:\s*,\s*(?:<\*>|\?|[$:]\w+))*\s*\)`)
+)
+
+// NormalizeSQL replaces the string and number literals of SQL text with <*>
+// and collapses IN lists of any length, of literals or of bind parameters,
+// to "IN (<*>)", so statements differing only in their values have the same
+// shape:
+//
+//	SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'bob'
+//	→ SELECT * FROM t WHERE id IN (<*>) AND name = <*>
+func NormalizeSQL(sql string) string {
+	return sqlInListRegex.ReplaceAllString(maskSQLLiterals(sql), "${1}(<*>)")
+}
+
+// SQLStage normalizes SQL statements embedded in any message, as ORMs and
+// database drivers log them, with NormalizeSQL. A statement is recognized by
+// its leading keywords (SELECT ... FROM, INSERT INTO, UPDATE ... SET,
+// DELETE FROM, REPLACE INTO, MERGE INTO, in any case) and is assumed to run to
+// the end of the message. Messages without a statement are left unchanged.
+// Insert it after the header stage:
+//
+//	Pipeline: []Stage{HeaderStage(), SQLStage(), TrivialStage(), CustomStage(), TokenizeStage()}
+func SQLStage() Stage {
+	return NewStage(StageSQL, func(lp *AWSOMLP, event *LogEvent) {
+		if loc := sqlStatementRegex.FindStringIndex(event.Content); loc != nil {
+			event.Content = event.Content[:loc[0]] + NormalizeSQL(event.Content[loc[0]:])
+		}
+	})
+}
+
+// maskSQLLiterals replaces the string and number literals of SQL text with <*>.
+// Strings are single-quoted with a doubled quote as escape and an optional E,
+// N, B or X prefix; numbers are only masked when they do not continue an
+// identifier, a $n parameter or a double-quoted name, which are kept.
+func maskSQLLiterals(sql string) string {
+	var sb strings.Builder
+	sb.Grow(len(sql))
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'' || (c == 'E' || c == 'e' || c == 'N' || c == 'n' || c == 'B' || c == 'b' || c == 'X' || c == 'x') &&
+			i+1 < len(sql) && sql[i+1] == '\'' && (i == 0 || !isSQLIdentChar(sql[i-1])):
+			escapes := c == 'E' || c == 'e' // Backslash escapes are only allowed in E strings
+			if c != '\'' {
+				i++
+			}
+			i = skipSQLQuoted(sql, i, '\'', escapes)
+			sb.WriteString("<*>")
+		case c == '"':
+			end := skipSQLQuoted(sql, i, '"', false)
+			sb.WriteString(sql[i:end])
+			i = end
+		case c >= '0' && c <= '9' && (i == 0 || !isSQLIdentChar(sql[i-1]) && sql[i-1] != '$' && sql[i-1] != '.'):
+			start := i
+			for i < len(sql) && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.' ||
+				(sql[i] == 'e' || sql[i] == 'E') && i+1 < len(sql) && (sql[i+1] >= '0' && sql[i+1] <= '9' || sql[i+1] == '-' || sql[i+1] == '+')) {
+				if sql[i] == 'e' || sql[i] == 'E' {
+					i++ // Exponent sign or first digit
+				}
+				i++
+			}
+			if i < len(sql) && isSQLIdentChar(sql[i]) {
+				// Not a number after all, e.g. 3rd or 2fa: keep the word
+				for i < len(sql) && isSQLIdentChar(sql[i]) {
+					i++
+				}
+				sb.WriteString(sql[start:i])
+				continue
+			}
+			sb.WriteString("<*>")
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// skipSQLQuoted returns the position after the quoted text starting at i,
+// treating a doubled quote, and with escapes a backslash, as escaping the
+// next character
+func skipSQLQuoted(sql string, i int, quote byte, escapes bool) int {
+	for i++; i < len(sql); i++ {
+		if escapes && sql[i] == '\\' {
+			i++
+			continue
+		}
+		if sql[i] != quote {
+			continue
+		}
+		if i+1 < len(sql) && sql[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(sql)
+}
+
+// isSQLIdentChar reports whether c may appear in an unquoted SQL identifier
+func isSQLIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
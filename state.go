@@ -0,0 +1,444 @@
+package awsomlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"time"
+)
+
+// StateVersion is the version of the state format written by ExportState.
+// States of older versions are migrated on import.
+//
+// Version history:
+//   - 1: initial format
+//   - 2: adds the "format" marker identifying the file as parser state
+//   - 3: adds the "config" the model was learned with
+//   - 4: an unlimited MaxLineLength is -1 instead of 0, which now means the default
+const StateVersion = 4
+
+// stateFormat identifies serialized parser state
+const stateFormat = "awsom-lp-state"
+
+// stateMigration upgrades a decoded state document by one version in place
+type stateMigration func(doc map[string]json.RawMessage) error
+
+// stateMigrations maps a version to the migration upgrading it to the next version
+var stateMigrations = map[int]stateMigration{
+	1: func(doc map[string]json.RawMessage) error {
+		doc["format"] = json.RawMessage(`"` + stateFormat + `"`)
+		return nil
+	},
+	2: func(doc map[string]json.RawMessage) error {
+		return nil // No config: the parser keeps its own
+	},
+	3: func(doc map[string]json.RawMessage) error {
+		raw, ok := doc["config"]
+		if !ok || string(raw) == "null" {
+			return nil
+		}
+		var config map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return err
+		}
+		if length, ok := config["max_line_length"]; !ok || string(length) == "0" {
+			config["max_line_length"] = json.RawMessage("-1")
+		}
+		raw, err := json.Marshal(config)
+		doc["config"] = raw
+		return err
+	},
+}
+
+// state is the serialized form of the learned model
+type state struct {
+	Format    string         `json:"format"`
+	Version   int            `json:"version"`
+	NextID    int            `json:"next_id"`
+	Lines     int            `json:"lines"`
+	Truncated int            `json:"truncated"`
+	Config    *configState   `json:"config,omitempty"`
+	Patterns  []patternState `json:"patterns"`
+}
+
+// configState is the serialized form of the configuration. Pipeline and the
+// callbacks are code, so they are not part of it.
+type configState struct {
+	MinSimilarity                  float64               `json:"min_similarity"`
+	SimilarityStrategy             SimilarityStrategy    `json:"similarity_strategy"`
+	SortingStrategy                SortingStrategy       `json:"sorting_strategy"`
+	CustomRegexes                  []string              `json:"custom_regexes"`
+	HeaderRegex                    string                `json:"header_regex"`
+	MinGroupSize                   int                   `json:"min_group_size"`
+	MaxPlaceholderRatio            float64               `json:"max_placeholder_ratio"`
+	MinTemplateTokens              int                   `json:"min_template_tokens"`
+	FreqThresholdStrategy          FreqThresholdStrategy `json:"freq_threshold_strategy"`
+	FreqPercentile                 float64               `json:"freq_percentile"`
+	FreqCounting                   FreqCounting          `json:"freq_counting"`
+	FreqSketchThreshold            int                   `json:"freq_sketch_threshold"`
+	StrictAlphabeticalMatching     bool                  `json:"strict_alphabetical_matching"`
+	BucketByTokenCount             bool                  `json:"bucket_by_token_count"`
+	TokenCountTolerance            int                   `json:"token_count_tolerance"`
+	ApproximateGrouping            bool                  `json:"approximate_grouping"`
+	LSHBands                       int                   `json:"lsh_bands"`
+	LSHRows                        int                   `json:"lsh_rows"`
+	ApplyFreqAnalysisToSmallGroups bool                  `json:"apply_freq_analysis_to_small_groups"`
+	EntropyThreshold               float64               `json:"entropy_threshold"`
+	MaxLineLength                  int                   `json:"max_line_length"`
+	MaxEventsPerPattern            int                   `json:"max_events_per_pattern"`
+	MaxExamplesPerPattern          int                   `json:"max_examples_per_pattern"`
+	PatternTTL                     time.Duration         `json:"pattern_ttl"`
+	PatternTTLLines                int                   `json:"pattern_ttl_lines"`
+	DecayHalfLife                  time.Duration         `json:"decay_half_life"`
+	Canonical                      bool                  `json:"canonical"`
+	Deterministic                  bool                  `json:"deterministic"`
+	Segmentation                   Segmentation          `json:"segmentation"`
+	SegmentField                   string                `json:"segment_field,omitempty"`
+	CalendarWords                  CalendarWordMasking   `json:"calendar_words"`
+	PathMinSegments                int                   `json:"path_min_segments"`
+	KeepPaths                      bool                  `json:"keep_paths"`
+	MaskThreads                    bool                  `json:"mask_threads"`
+	MaskQuoted                     bool                  `json:"mask_quoted"`
+	Brackets                       []BracketRule         `json:"brackets"`
+	ColumnRules                    []ColumnRule          `json:"column_rules,omitempty"`
+	MaxTokens                      int                   `json:"max_tokens,omitempty"`
+	RejectOversized                bool                  `json:"reject_oversized,omitempty"`
+	SingletonSimilarity            float64               `json:"singleton_similarity"`
+	ProgressInterval               time.Duration         `json:"progress_interval"`
+}
+
+// newConfigState copies the serializable settings of a configuration
+func newConfigState(c Config) *configState {
+	return &configState{
+		MinSimilarity:                  c.MinSimilarity,
+		SimilarityStrategy:             c.SimilarityStrategy,
+		SortingStrategy:                c.SortingStrategy,
+		CustomRegexes:                  c.CustomRegexes,
+		HeaderRegex:                    c.HeaderRegex,
+		MinGroupSize:                   c.MinGroupSize,
+		MaxPlaceholderRatio:            c.MaxPlaceholderRatio,
+		MinTemplateTokens:              c.MinTemplateTokens,
+		FreqThresholdStrategy:          c.FreqThresholdStrategy,
+		FreqPercentile:                 c.FreqPercentile,
+		FreqCounting:                   c.FreqCounting,
+		FreqSketchThreshold:            c.FreqSketchThreshold,
+		StrictAlphabeticalMatching:     c.StrictAlphabeticalMatching,
+		BucketByTokenCount:             c.BucketByTokenCount,
+		TokenCountTolerance:            c.TokenCountTolerance,
+		ApproximateGrouping:            c.ApproximateGrouping,
+		LSHBands:                       c.LSHBands,
+		LSHRows:                        c.LSHRows,
+		ApplyFreqAnalysisToSmallGroups: c.ApplyFreqAnalysisToSmallGroups,
+		EntropyThreshold:               c.EntropyThreshold,
+		MaxLineLength:                  c.MaxLineLength,
+		MaxEventsPerPattern:            c.MaxEventsPerPattern,
+		MaxExamplesPerPattern:          c.MaxExamplesPerPattern,
+		PatternTTL:                     c.PatternTTL,
+		PatternTTLLines:                c.PatternTTLLines,
+		DecayHalfLife:                  c.DecayHalfLife,
+		Canonical:                      c.Canonical,
+		Deterministic:                  c.Deterministic,
+		Segmentation:                   c.Segmentation,
+		SegmentField:                   c.SegmentField,
+		CalendarWords:                  c.CalendarWords,
+		PathMinSegments:                c.PathMinSegments,
+		KeepPaths:                      c.KeepPaths,
+		MaskThreads:                    c.MaskThreads,
+		MaskQuoted:                     c.MaskQuoted,
+		Brackets:                       c.Brackets,
+		ColumnRules:                    c.ColumnRules,
+		MaxTokens:                      c.MaxTokens,
+		RejectOversized:                c.RejectOversized,
+		SingletonSimilarity:            c.SingletonSimilarity,
+		ProgressInterval:               c.ProgressInterval,
+	}
+}
+
+// apply returns base with the serialized settings, keeping its Pipeline and callbacks
+func (cs *configState) apply(base Config) Config {
+	base.MinSimilarity = cs.MinSimilarity
+	base.SimilarityStrategy = cs.SimilarityStrategy
+	base.SortingStrategy = cs.SortingStrategy
+	base.CustomRegexes = cs.CustomRegexes
+	base.HeaderRegex = cs.HeaderRegex
+	base.MinGroupSize = cs.MinGroupSize
+	base.MaxPlaceholderRatio = cs.MaxPlaceholderRatio
+	base.MinTemplateTokens = cs.MinTemplateTokens
+	base.FreqThresholdStrategy = cs.FreqThresholdStrategy
+	base.FreqPercentile = cs.FreqPercentile
+	base.FreqCounting = cs.FreqCounting
+	base.FreqSketchThreshold = cs.FreqSketchThreshold
+	base.StrictAlphabeticalMatching = cs.StrictAlphabeticalMatching
+	base.BucketByTokenCount = cs.BucketByTokenCount
+	base.TokenCountTolerance = cs.TokenCountTolerance
+	base.ApproximateGrouping = cs.ApproximateGrouping
+	base.LSHBands = cs.LSHBands
+	base.LSHRows = cs.LSHRows
+	base.ApplyFreqAnalysisToSmallGroups = cs.ApplyFreqAnalysisToSmallGroups
+	base.EntropyThreshold = cs.EntropyThreshold
+	base.MaxLineLength = cs.MaxLineLength
+	base.MaxEventsPerPattern = cs.MaxEventsPerPattern
+	base.MaxExamplesPerPattern = cs.MaxExamplesPerPattern
+	base.PatternTTL = cs.PatternTTL
+	base.PatternTTLLines = cs.PatternTTLLines
+	base.DecayHalfLife = cs.DecayHalfLife
+	base.Canonical = cs.Canonical
+	base.Deterministic = cs.Deterministic
+	base.Segmentation = cs.Segmentation
+	base.SegmentField = cs.SegmentField
+	base.CalendarWords = cs.CalendarWords
+	base.PathMinSegments = cs.PathMinSegments
+	base.KeepPaths = cs.KeepPaths
+	base.MaskThreads = cs.MaskThreads
+	base.MaskQuoted = cs.MaskQuoted
+	base.Brackets = cs.Brackets
+	base.ColumnRules = cs.ColumnRules
+	base.MaxTokens = cs.MaxTokens
+	base.RejectOversized = cs.RejectOversized
+	base.SingletonSimilarity = cs.SingletonSimilarity
+	base.ProgressInterval = cs.ProgressInterval
+	return base
+}
+
+// patternState is the serialized form of a pattern
+type patternState struct {
+	ID        int            `json:"id"`
+	Template  string         `json:"template"`
+	Frequency map[string]int `json:"frequency"`
+	Count     int            `json:"count"`
+	Examples  []string       `json:"examples,omitempty"`
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+	Weight    float64        `json:"weight"`
+	LastLine  int            `json:"last_line"`
+	Segment   string         `json:"segment,omitempty"`
+	Events    []eventState   `json:"events"`
+
+	// Member similarity statistics of SimilarityByVariance
+	SimilaritySamples int     `json:"similarity_samples,omitempty"`
+	SimilarityMean    float64 `json:"similarity_mean,omitempty"`
+	SimilarityM2      float64 `json:"similarity_m2,omitempty"`
+
+	PositionFrequency []map[string]int `json:"position_frequency,omitempty"`
+	Sketch            []byte           `json:"sketch,omitempty"` // Count-min sketch replacing Frequency
+}
+
+// eventState is the serialized form of a retained event
+type eventState struct {
+	Raw       string            `json:"raw"`
+	Content   string            `json:"content"`
+	Tokens    []string          `json:"tokens"`
+	Truncated bool              `json:"truncated,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// ExportState writes the learned patterns and the configuration to w as JSON.
+// Retained events are included, so set MaxEventsPerPattern to keep the state
+// small. Pipeline and the callbacks of the configuration are not stored.
+func (lp *AWSOMLP) ExportState(w io.Writer) error {
+	lp.mu.Lock()
+	st := lp.snapshotState()
+	lp.mu.Unlock()
+
+	return json.NewEncoder(w).Encode(st)
+}
+
+// snapshotState copies the model into its serialized form
+func (lp *AWSOMLP) snapshotState() state {
+	st := state{
+		Format:    stateFormat,
+		Version:   StateVersion,
+		NextID:    lp.nextID,
+		Lines:     lp.lines,
+		Truncated: lp.truncated,
+		Config:    newConfigState(lp.config),
+		Patterns:  make([]patternState, 0, len(lp.patterns)),
+	}
+
+	for _, pattern := range lp.patterns {
+		st.Patterns = append(st.Patterns, newPatternState(pattern))
+	}
+	return st
+}
+
+// newPatternState copies a pattern into its serialized form
+func newPatternState(pattern *Pattern) patternState {
+	ps := patternState{
+		ID:        pattern.ID,
+		Template:  pattern.Template,
+		Frequency: maps.Clone(pattern.Frequency),
+		Count:     pattern.Count,
+		Examples:  append([]string(nil), pattern.Examples...),
+		FirstSeen: pattern.FirstSeen,
+		LastSeen:  pattern.LastSeen,
+		Weight:    pattern.Weight,
+		LastLine:  pattern.lastLine,
+		Segment:   pattern.Segment,
+		Events:    make([]eventState, 0, len(pattern.Events)),
+
+		SimilaritySamples: pattern.simSamples,
+		SimilarityMean:    pattern.simMean,
+		SimilarityM2:      pattern.simM2,
+	}
+	if ps.Frequency == nil {
+		ps.Frequency = make(map[string]int)
+	}
+	for _, counts := range pattern.PositionFrequency {
+		ps.PositionFrequency = append(ps.PositionFrequency, maps.Clone(counts))
+	}
+	if pattern.sketch != nil {
+		ps.Sketch = pattern.sketch.bytes()
+	}
+	for _, event := range pattern.Events {
+		ps.Events = append(ps.Events, eventState{
+			Raw:       event.Raw,
+			Content:   event.Content,
+			Tokens:    event.Tokens,
+			Truncated: event.Truncated,
+			Fields:    event.Fields,
+		})
+	}
+	return ps
+}
+
+// ImportState replaces the learned patterns and the configuration with a state
+// written by ExportState, keeping the parser's Pipeline and callbacks; use
+// Reconfigure afterwards to change the restored settings. States written by
+// older versions of the package are migrated to the current format, and those
+// without a configuration keep the parser's. It returns an error wrapping
+// ErrStateVersion if the state has no version or was written by a newer
+// version; the parser is left unchanged on error.
+func (lp *AWSOMLP) ImportState(r io.Reader) error {
+	st, err := decodeState(r)
+	if err != nil {
+		return err
+	}
+
+	return lp.applyState(st)
+}
+
+// applyState replaces the model with a decoded state
+func (lp *AWSOMLP) applyState(st state) error {
+	patterns := make([]*Pattern, 0, len(st.Patterns))
+	for _, ps := range st.Patterns {
+		pattern, err := ps.pattern()
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	// Validate the configuration on a scratch parser, so that lp is only
+	// changed once nothing can fail
+	var configured *AWSOMLP
+	if st.Config != nil {
+		configured = NewAWSOMLP()
+		if err := configured.WithConfig(st.Config.apply(lp.currentConfig())); err != nil {
+			return fmt.Errorf("state config: %w", err)
+		}
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if configured != nil {
+		lp.adoptConfig(configured)
+	}
+	lp.patterns = patterns
+	lp.resetIndexes()
+	lp.nextID = st.NextID
+	lp.lines = st.Lines
+	lp.truncated = st.Truncated
+	return nil
+}
+
+// pattern restores a pattern from its serialized form
+func (ps patternState) pattern() (*Pattern, error) {
+	pattern := &Pattern{
+		ID:        ps.ID,
+		Template:  ps.Template,
+		Frequency: ps.Frequency,
+		Count:     ps.Count,
+		Examples:  ps.Examples,
+		FirstSeen: ps.FirstSeen,
+		LastSeen:  ps.LastSeen,
+		Weight:    ps.Weight,
+		lastLine:  ps.LastLine,
+		Segment:   ps.Segment,
+		Events:    make([]*LogEvent, 0, len(ps.Events)),
+
+		simSamples: ps.SimilaritySamples,
+		simMean:    ps.SimilarityMean,
+		simM2:      ps.SimilarityM2,
+
+		PositionFrequency: ps.PositionFrequency,
+	}
+	if pattern.Frequency == nil {
+		pattern.Frequency = make(map[string]int)
+	}
+	if ps.Sketch != nil {
+		sketch, err := sketchFromBytes(ps.Sketch)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %d: %w", ps.ID, err)
+		}
+		pattern.sketch = sketch
+	}
+	for _, es := range ps.Events {
+		pattern.Events = append(pattern.Events, &LogEvent{
+			Raw:       es.Raw,
+			Content:   es.Content,
+			Tokens:    es.Tokens,
+			Template:  ps.Template,
+			Truncated: es.Truncated,
+			Fields:    es.Fields,
+			PatternID: ps.ID,
+			Segment:   ps.Segment,
+		})
+	}
+	return pattern, nil
+}
+
+// currentConfig returns the configuration under the lock
+func (lp *AWSOMLP) currentConfig() Config {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.config
+}
+
+// decodeState decodes a state document, migrating it to StateVersion
+func decodeState(r io.Reader) (state, error) {
+	var st state
+
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return st, fmt.Errorf("decode state: %w", err)
+	}
+
+	var version int
+	if raw, ok := doc["version"]; !ok || json.Unmarshal(raw, &version) != nil || version < 1 {
+		return st, fmt.Errorf("%w: missing or invalid version", ErrStateVersion)
+	}
+	if version > StateVersion {
+		return st, fmt.Errorf("%w: version %d is newer than supported version %d", ErrStateVersion, version, StateVersion)
+	}
+
+	for ; version < StateVersion; version++ {
+		if err := stateMigrations[version](doc); err != nil {
+			return st, fmt.Errorf("migrate state from version %d: %w", version, err)
+		}
+	}
+	doc["version"] = json.RawMessage(strconv.Itoa(version))
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return st, fmt.Errorf("decode state: %w", err)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("decode state: %w", err)
+	}
+	if st.Format != stateFormat {
+		return st, fmt.Errorf("decode state: unknown format %q", st.Format)
+	}
+	return st, nil
+}
@@ -0,0 +1,203 @@
+package awsomlp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+)
+
+// ParseResult is the parsing outcome for a single log line
+type ParseResult struct {
+	Index     int               // Position of the line in the input
+	Raw       string            // Original log line
+	Template  string            // Template assigned to the line
+	PatternID int               // ID of the pattern the line belongs to
+	Fields    map[string]string // Named header fields captured by HeaderRegex (nil if none)
+}
+
+// learn incrementally processes a single trimmed, non-empty line: it assigns the
+// line to a pattern and regenerates that pattern's template from the updated
+// frequencies. Unlike Parse, the returned template reflects the model at the
+// time the line was seen and may change as more lines arrive. The pattern is
+// nil for a line rejected by RejectOversized.
+func (lp *AWSOMLP) learn(line string) (*LogEvent, *Pattern) {
+	event := lp.preprocessLine(line)
+	if lp.rejected(event) {
+		return event, nil
+	}
+	return lp.learnEvent(event)
+}
+
+// learnEvent is learn for a preprocessed event
+func (lp *AWSOMLP) learnEvent(event *LogEvent) (*LogEvent, *Pattern) {
+	pattern := lp.assignEvent(event)
+	lp.analyzePattern(pattern)
+	lp.replacePatternNumericalVariables(pattern)
+	event.Template = pattern.Template
+
+	if lp.lines%expireCheckInterval == 0 {
+		lp.expire()
+	}
+	return event, pattern
+}
+
+// result builds the ParseResult for an event assigned to a pattern
+func (lp *AWSOMLP) result(index int, event *LogEvent, pattern *Pattern) ParseResult {
+	template := strings.TrimSpace(pattern.Template)
+	if template == "" {
+		// Fallback to preprocessed content if no template was generated
+		template = strings.TrimSpace(event.Content)
+		if template == "" {
+			template = event.Raw // Ultimate fallback
+		}
+	}
+	return ParseResult{
+		Index:     index,
+		Raw:       event.Raw,
+		Template:  template,
+		PatternID: pattern.ID,
+		Fields:    event.Fields,
+	}
+}
+
+// ParseSeq parses lines from an iterator as they are produced, yielding each
+// non-empty line not rejected by RejectOversized together with its result.
+// Patterns are updated incrementally, so a yielded template reflects the lines
+// seen so far. Set MaxEventsPerPattern to keep memory bounded for long or
+// unbounded sequences.
+func (lp *AWSOMLP) ParseSeq(lines iter.Seq[string]) iter.Seq2[string, ParseResult] {
+	return func(yield func(string, ParseResult) bool) {
+		index := 0
+		for line := range lines {
+			i := index
+			index++
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			event, pattern := lp.learn(line)
+			if pattern == nil {
+				continue
+			}
+			if !yield(event.Raw, lp.result(i, event, pattern)) {
+				return
+			}
+		}
+	}
+}
+
+// ParseStream parses lines from a channel as they arrive and sends the result
+// of each non-empty line on the returned channel, which is closed once lines
+// is closed or ctx is done. Patterns are updated incrementally like with
+// ParseSeq; set MaxEventsPerPattern to keep memory bounded. The results are
+// unbuffered, so a slow reader throttles parsing, and they must be drained or
+// ctx canceled to stop the parsing goroutine. Lines are learned under the same
+// lock as Feed, so snapshots may be taken while the stream runs.
+func (lp *AWSOMLP) ParseStream(ctx context.Context, lines <-chan string) <-chan ParseResult {
+	results := make(chan ParseResult)
+	go func() {
+		defer close(results)
+		for index := 0; ; index++ {
+			var line string
+			select {
+			case <-ctx.Done():
+				return
+			case l, ok := <-lines:
+				if !ok {
+					return
+				}
+				line = l
+			}
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+
+			lp.mu.Lock()
+			event, pattern := lp.learn(line)
+			var result ParseResult
+			if pattern != nil {
+				result = lp.result(index, event, pattern)
+			}
+			lp.mu.Unlock()
+			if pattern == nil {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case results <- result:
+			}
+		}
+	}()
+	return results
+}
+
+// ParseBatches reads lines from r and passes their results to fn in batches of
+// up to batchSize, the last batch holding the remainder. fn is called
+// synchronously, so a slow sink naturally throttles reading. A non-nil error
+// from fn stops parsing and is returned. Each batch is a new slice that fn may
+// retain.
+func (lp *AWSOMLP) ParseBatches(r io.Reader, batchSize int, fn func([]ParseResult) error) error {
+	if batchSize < 1 {
+		return fmt.Errorf("%w: batch size must be at least 1, got %d", ErrInvalidConfig, batchSize)
+	}
+
+	reader := bufio.NewReader(r)
+	batch := make([]ParseResult, 0, batchSize)
+	for index := 0; ; index++ {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			if event, pattern := lp.learn(line); pattern != nil {
+				batch = append(batch, lp.result(index, event, pattern))
+			}
+		}
+		if len(batch) == batchSize || (err != nil && len(batch) > 0) {
+			if fnErr := fn(batch); fnErr != nil {
+				return fnErr
+			}
+			batch = make([]ParseResult, 0, batchSize)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Feed learns a single line and returns its result; ok is false for blank lines
+// and lines rejected by RejectOversized.
+// Feed, ExportState, ImportState, Reparse and Reconfigure are safe for concurrent
+// use, so a service can feed lines while snapshots are taken in the background.
+// Other methods must not be called concurrently with them.
+func (lp *AWSOMLP) Feed(line string) (result ParseResult, ok bool) {
+	if line = strings.TrimSpace(line); line == "" {
+		return ParseResult{}, false
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	event, pattern := lp.learn(line)
+	if pattern == nil {
+		return ParseResult{}, false
+	}
+	return lp.result(lp.lines-1, event, pattern), true
+}
+
+// ParseLine learns a single line like Feed and returns the ID and current
+// template of its pattern, or -1 and "" for a blank or rejected line. The line
+// joins the first existing pattern whose similarity reaches the threshold, the
+// same rule Feed uses, updating its token frequencies and template, or starts
+// a new pattern. It is safe for concurrent use like Feed.
+func (lp *AWSOMLP) ParseLine(line string) (templateID int, template string) {
+	result, ok := lp.Feed(line)
+	if !ok {
+		return -1, ""
+	}
+	return result.PatternID, result.Template
+}
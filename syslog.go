@@ -0,0 +1,346 @@
+package awsomlp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the syslog header stages
+const (
+	StageRFC5424 = "rfc5424" // RFC 5424 header and structured data removal
+	StageRFC3164 = "rfc3164" // BSD syslog header removal
+)
+
+// syslogSeverities are the keywords of the RFC 5424 severities, reported as the level field
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// SyslogMessage is a parsed RFC 5424 or RFC 3164 syslog message. Header
+// fields given as NILVALUE ("-") are empty.
+type SyslogMessage struct {
+	Priority       int         // PRI value, Facility*8 + Severity (-1 if an RFC 3164 message has none)
+	Facility       int         // Facility code 0-23 (-1 without PRI)
+	Severity       int         // Severity code 0 (emergency) to 7 (debug) (-1 without PRI)
+	Version        int         // Protocol version, 1 for RFC 5424 and 0 for RFC 3164
+	Timestamp      time.Time   // Zero if not given; in year 0 for RFC 3164, which has no year
+	Hostname       string      // HOSTNAME
+	AppName        string      // APP-NAME, or the TAG of RFC 3164
+	ProcID         string      // PROCID, or the pid of an RFC 3164 TAG[pid]
+	MsgID          string      // MSGID
+	StructuredData []SDElement // SD-ELEMENTs in order (RFC 5424 only)
+	Message        string      // MSG without a leading byte order mark, or the CONTENT of RFC 3164
+}
+
+// SDElement is a structured data element of a syslog message
+type SDElement struct {
+	ID     string    // SD-ID, e.g. "timeQuality" or "exampleSDID@32473"
+	Params []SDParam // SD-PARAMs in order, names may repeat
+}
+
+// SDParam is a structured data parameter with its value unescaped
+type SDParam struct {
+	Name  string
+	Value string
+}
+
+// ParseRFC5424 parses a syslog message in RFC 5424 format:
+//
+//	<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+//
+// The error wraps ErrInvalidSyslog if the line is not such a message, e.g.
+// because it is in the older BSD (RFC 3164) format.
+func ParseRFC5424(line string) (*SyslogMessage, error) {
+	p := &syslogScanner{line: line}
+	msg := &SyslogMessage{}
+
+	// PRI and VERSION
+	if !p.consume('<') {
+		return nil, p.errorf("missing PRI")
+	}
+	pri, ok := p.number(3)
+	if !ok || pri > 191 || !p.consume('>') {
+		return nil, p.errorf("invalid PRI")
+	}
+	msg.Priority, msg.Facility, msg.Severity = pri, pri/8, pri%8
+	if msg.Version, ok = p.number(2); !ok || msg.Version == 0 || !p.consume(' ') {
+		return nil, p.errorf("invalid VERSION")
+	}
+
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	header := make([]string, 5)
+	for i := range header {
+		if header[i], ok = p.field(); !ok {
+			return nil, p.errorf("missing header field")
+		}
+	}
+	if header[0] != "" {
+		ts, err := time.Parse(time.RFC3339Nano, header[0])
+		if err != nil {
+			return nil, p.errorf("invalid TIMESTAMP %q", header[0])
+		}
+		msg.Timestamp = ts
+	}
+	msg.Hostname, msg.AppName, msg.ProcID, msg.MsgID = header[1], header[2], header[3], header[4]
+
+	// STRUCTURED-DATA, then an optional space and MSG
+	if p.consume('-') {
+		if !p.done() && !p.consume(' ') {
+			return nil, p.errorf("invalid STRUCTURED-DATA")
+		}
+	} else {
+		for p.peek() == '[' {
+			element, err := p.sdElement()
+			if err != nil {
+				return nil, err
+			}
+			msg.StructuredData = append(msg.StructuredData, element)
+		}
+		if msg.StructuredData == nil || (!p.done() && !p.consume(' ')) {
+			return nil, p.errorf("invalid STRUCTURED-DATA")
+		}
+	}
+	msg.Message = strings.TrimPrefix(line[p.pos:], "\ufeff")
+	return msg, nil
+}
+
+// Fields returns the header and structured data as event fields: priority,
+// facility, severity, level (severity keyword such as "err"), version,
+// timestamp, host, app, procid and msgid, plus every SD-PARAM as
+// "<SD-ID>.<name>". Values of a repeated parameter are joined with commas,
+// and empty values are left out, as are the PRI fields of an RFC 3164
+// message without PRI and its version. The timestamp of an RFC 3164 message
+// keeps its "Jan _2 15:04:05" layout.
+func (m *SyslogMessage) Fields() map[string]string {
+	fields := make(map[string]string)
+	if m.Priority >= 0 {
+		fields["priority"] = strconv.Itoa(m.Priority)
+		fields["facility"] = strconv.Itoa(m.Facility)
+		fields["severity"] = strconv.Itoa(m.Severity)
+		fields["level"] = syslogSeverities[m.Severity]
+	}
+	if m.Version > 0 {
+		fields["version"] = strconv.Itoa(m.Version)
+		if !m.Timestamp.IsZero() {
+			fields["timestamp"] = m.Timestamp.Format(time.RFC3339Nano)
+		}
+	} else {
+		fields["timestamp"] = m.Timestamp.Format(time.Stamp)
+	}
+	for name, value := range map[string]string{"host": m.Hostname, "app": m.AppName, "procid": m.ProcID, "msgid": m.MsgID} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	for _, element := range m.StructuredData {
+		for _, param := range element.Params {
+			if param.Value == "" {
+				continue
+			}
+			key := element.ID + "." + param.Name
+			if previous, ok := fields[key]; ok {
+				fields[key] = previous + "," + param.Value
+			} else {
+				fields[key] = param.Value
+			}
+		}
+	}
+	return fields
+}
+
+// RFC5424Stage removes an RFC 5424 syslog header and captures the header and
+// structured data fields (see SyslogMessage.Fields), so that only MSG is
+// templated. Lines in another format fall back to HeaderRegex. Use it in place
+// of HeaderStage:
+//
+//	Pipeline: []Stage{RFC5424Stage(), TrivialStage(), CustomStage(), TokenizeStage()}
+func RFC5424Stage() Stage {
+	return NewStage(StageRFC5424, func(lp *AWSOMLP, event *LogEvent) {
+		msg, err := ParseRFC5424(event.Content)
+		if err != nil {
+			event.Content, event.Fields = lp.splitHeader(event.Content)
+			return
+		}
+		event.Content, event.Fields = msg.Message, msg.Fields()
+	})
+}
+
+// ParseRFC3164 strictly parses a BSD syslog message as described by RFC 3164:
+//
+//	[<PRI>]Mmm dd hh:mm:ss HOSTNAME TAG[[pid]]: CONTENT
+//
+// PRI is optional because syslog daemons leave it out of log files. Unlike
+// SyslogHeaderRegex, the PRI is decoded into facility and severity, the
+// timestamp must be valid, and the TAG must end with ':' (after an optional
+// [pid]). The error wraps ErrInvalidSyslog for lines in any other format.
+func ParseRFC3164(line string) (*SyslogMessage, error) {
+	p := &syslogScanner{line: line}
+	msg := &SyslogMessage{Priority: -1, Facility: -1, Severity: -1}
+
+	if p.consume('<') {
+		pri, ok := p.number(3)
+		if !ok || pri > 191 || !p.consume('>') {
+			return nil, p.errorf("invalid PRI")
+		}
+		msg.Priority, msg.Facility, msg.Severity = pri, pri/8, pri%8
+	}
+
+	// TIMESTAMP has a fixed width, days are padded with a space
+	if len(line)-p.pos < len(time.Stamp)+1 {
+		return nil, p.errorf("missing TIMESTAMP")
+	}
+	ts, err := time.Parse(time.Stamp, line[p.pos:p.pos+len(time.Stamp)])
+	if err != nil {
+		return nil, p.errorf("invalid TIMESTAMP %q", line[p.pos:p.pos+len(time.Stamp)])
+	}
+	msg.Timestamp = ts
+	p.pos += len(time.Stamp)
+	if !p.consume(' ') {
+		return nil, p.errorf("invalid TIMESTAMP")
+	}
+
+	// HOSTNAME and TAG[pid]:
+	var ok bool
+	if msg.Hostname, ok = p.field(); !ok || msg.Hostname == "" {
+		return nil, p.errorf("missing HOSTNAME")
+	}
+	start := p.pos
+	for c := p.peek(); c > ' ' && c != ':' && c != '['; c = p.peek() {
+		p.pos++
+	}
+	if msg.AppName = line[start:p.pos]; msg.AppName == "" {
+		return nil, p.errorf("missing TAG")
+	}
+	if p.consume('[') {
+		end := strings.IndexByte(line[p.pos:], ']')
+		if end <= 0 {
+			return nil, p.errorf("invalid pid of TAG %s", msg.AppName)
+		}
+		msg.ProcID = line[p.pos : p.pos+end]
+		p.pos += end + 1
+	}
+	if !p.consume(':') {
+		return nil, p.errorf("missing ':' after TAG %s", msg.AppName)
+	}
+	p.consume(' ')
+	msg.Message = line[p.pos:]
+	return msg, nil
+}
+
+// RFC3164Stage removes a BSD syslog header and captures its fields (see
+// SyslogMessage.Fields), decoding the PRI into facility, severity and level.
+// Lines in another format fall back to HeaderRegex. Use it in place of
+// HeaderStage.
+func RFC3164Stage() Stage {
+	return NewStage(StageRFC3164, func(lp *AWSOMLP, event *LogEvent) {
+		msg, err := ParseRFC3164(event.Content)
+		if err != nil {
+			event.Content, event.Fields = lp.splitHeader(event.Content)
+			return
+		}
+		event.Content, event.Fields = msg.Message, msg.Fields()
+	})
+}
+
+// syslogScanner reads the parts of a syslog line
+type syslogScanner struct {
+	line string
+	pos  int
+}
+
+func (p *syslogScanner) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrInvalidSyslog, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *syslogScanner) done() bool {
+	return p.pos >= len(p.line)
+}
+
+func (p *syslogScanner) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.line[p.pos]
+}
+
+func (p *syslogScanner) consume(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// number reads a decimal number of 1 to maxDigits digits
+func (p *syslogScanner) number(maxDigits int) (int, bool) {
+	start := p.pos
+	for p.pos-start < maxDigits && p.peek() >= '0' && p.peek() <= '9' {
+		p.pos++
+	}
+	if p.pos == start {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(p.line[start:p.pos])
+	return n, true
+}
+
+// field reads a space-terminated header field, returning "" for NILVALUE
+func (p *syslogScanner) field() (string, bool) {
+	end := strings.IndexByte(p.line[p.pos:], ' ')
+	if end <= 0 {
+		return "", false
+	}
+	value := p.line[p.pos : p.pos+end]
+	p.pos += end + 1
+	if value == "-" {
+		return "", true
+	}
+	return value, true
+}
+
+// name reads an SD-ID or PARAM-NAME: printable ASCII except '=', ' ', ']' and '"'
+func (p *syslogScanner) name() string {
+	start := p.pos
+	for c := p.peek(); c > ' ' && c < 0x7f && c != '=' && c != ']' && c != '"'; c = p.peek() {
+		p.pos++
+	}
+	return p.line[start:p.pos]
+}
+
+// sdElement reads "[SD-ID *(SP PARAM-NAME="PARAM-VALUE")]"
+func (p *syslogScanner) sdElement() (SDElement, error) {
+	p.consume('[')
+	element := SDElement{ID: p.name()}
+	if element.ID == "" {
+		return element, p.errorf("missing SD-ID")
+	}
+	for !p.consume(']') {
+		if !p.consume(' ') {
+			return element, p.errorf("invalid SD-ELEMENT %s", element.ID)
+		}
+		param := SDParam{Name: p.name()}
+		if param.Name == "" || !p.consume('=') || !p.consume('"') {
+			return element, p.errorf("invalid SD-PARAM in %s", element.ID)
+		}
+		// PARAM-VALUE escapes '"', '\' and ']' with a backslash; other backslashes are literal
+		var value strings.Builder
+		for {
+			if p.done() {
+				return element, p.errorf("unterminated SD-PARAM value in %s", element.ID)
+			}
+			c := p.line[p.pos]
+			p.pos++
+			if c == '"' {
+				break
+			}
+			if c == '\\' && p.pos < len(p.line) && strings.IndexByte(`"\]`, p.line[p.pos]) >= 0 {
+				c = p.line[p.pos]
+				p.pos++
+			}
+			value.WriteByte(c)
+		}
+		param.Value = value.String()
+		element.Params = append(element.Params, param)
+	}
+	return element, nil
+}
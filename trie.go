@@ -0,0 +1,82 @@
+package awsomlp
+
+import (
+	"sort"
+	"strings"
+)
+
+// TemplateIndex answers prefix queries over templates with a trie of their
+// whitespace-separated tokens, e.g. all templates starting with
+// "BLOCK* NameSystem.addStoredBlock:" for a report scoped to one component
+type TemplateIndex struct {
+	root trieNode
+	size int
+}
+
+// trieNode is a token of the index; templates ending at the node are stored in it
+type trieNode struct {
+	children  map[string]*trieNode
+	templates []TemplateCount
+}
+
+// NewTemplateIndex indexes templates with their counts
+func NewTemplateIndex(templates []TemplateCount) *TemplateIndex {
+	ix := &TemplateIndex{}
+	for _, tc := range templates {
+		node := &ix.root
+		for _, token := range strings.Fields(tc.Template) {
+			child, ok := node.children[token]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[string]*trieNode)
+				}
+				child = &trieNode{}
+				node.children[token] = child
+			}
+			node = child
+		}
+		node.templates = append(node.templates, tc)
+		ix.size++
+	}
+	return ix
+}
+
+// TemplateIndex indexes the current templates (see GetTemplatesByFrequency)
+func (lp *AWSOMLP) TemplateIndex() *TemplateIndex {
+	return NewTemplateIndex(lp.GetTemplatesByFrequency())
+}
+
+// Len returns the number of indexed templates
+func (ix *TemplateIndex) Len() int {
+	return ix.size
+}
+
+// WithPrefix returns the templates whose first tokens equal the tokens of
+// prefix, most frequent first. Tokens are compared exactly, so "<*>" in the
+// prefix only matches a placeholder; an empty prefix returns all templates.
+func (ix *TemplateIndex) WithPrefix(prefix string) []TemplateCount {
+	node := &ix.root
+	for _, token := range strings.Fields(prefix) {
+		if node = node.children[token]; node == nil {
+			return nil
+		}
+	}
+
+	var templates []TemplateCount
+	var collect func(n *trieNode)
+	collect = func(n *trieNode) {
+		templates = append(templates, n.templates...)
+		for _, child := range n.children {
+			collect(child)
+		}
+	}
+	collect(node)
+
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Count != templates[j].Count {
+			return templates[i].Count > templates[j].Count
+		}
+		return templates[i].Template < templates[j].Template
+	})
+	return templates
+}
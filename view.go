@@ -0,0 +1,57 @@
+package awsomlp
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// PatternView is a copy of a pattern's statistics taken by Snapshot. It
+// shares no memory with the parser, so it may be kept, modified or passed to
+// other goroutines while the parser keeps learning.
+type PatternView struct {
+	ID             int
+	Template       string
+	Count          int            // Number of lines assigned to the pattern
+	Retained       int            // Number of events retained in Pattern.Events
+	Representative string         // Raw line of the event the template was generated from ("" if none is retained)
+	Examples       []string       // Raw example lines
+	Frequency      map[string]int // Token frequencies (empty once counted in a sketch)
+	FirstSeen      time.Time
+	LastSeen       time.Time
+	Weight         float64 // Occurrence weight decayed to the time of the snapshot (equals Count without decay)
+	Segment        string
+}
+
+// Snapshot returns deep copies of all patterns ordered by ID, i.e. by first
+// appearance. Unlike GetPatterns, which returns the parser's own patterns, it
+// is safe for concurrent use with Feed and the other locked methods, and the
+// views stay unchanged as the parser learns. Retained events are not copied.
+func (lp *AWSOMLP) Snapshot() []PatternView {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	views := make([]PatternView, 0, len(lp.patterns))
+	for _, pattern := range lp.patterns {
+		view := PatternView{
+			ID:        pattern.ID,
+			Template:  pattern.Template,
+			Count:     pattern.Count,
+			Retained:  len(pattern.Events),
+			Examples:  slices.Clone(pattern.Examples),
+			Frequency: maps.Clone(pattern.Frequency),
+			FirstSeen: pattern.FirstSeen,
+			LastSeen:  pattern.LastSeen,
+			Weight:    lp.PatternWeight(pattern),
+			Segment:   pattern.Segment,
+		}
+		if len(pattern.Events) > 0 {
+			view.Representative = pattern.Events[0].Raw
+		}
+		views = append(views, view)
+	}
+	slices.SortFunc(views, func(a, b PatternView) int {
+		return a.ID - b.ID
+	})
+	return views
+}
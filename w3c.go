@@ -0,0 +1,82 @@
+package awsomlp
+
+import (
+	"strings"
+	"sync"
+)
+
+// StageW3C is the name of the W3C extended log file stage
+const StageW3C = "w3c"
+
+// w3cRequestFields are the W3C fields forming the request line of a template
+var w3cRequestFields = []string{"cs-method", "cs-uri-stem"}
+
+// w3cTemplateFields are the W3C fields kept in templates as field=value pairs
+// after the request line; the values of all other fields (times, addresses,
+// byte counts, query strings, user agents, ...) are left out
+var w3cTemplateFields = map[string]bool{
+	"s-sitename":      true,
+	"s-port":          true,
+	"cs-version":      true,
+	"sc-status":       true,
+	"sc-substatus":    true,
+	"sc-win32-status": true,
+}
+
+// W3CStage parses W3C extended log files as written by IIS and some proxies.
+// The columns are defined by the latest "#Fields:" directive, so the stage
+// keeps state: use a new stage for every file or stream. Data lines are split
+// on spaces and every value except the "-" placeholder is captured in Fields
+// under its column name. The text to template is the request line (method
+// and URI stem) followed by the fields that identify the outcome of a request
+// as field=value pairs, e.g. "GET /default.htm s-port=80 sc-status=200", so
+// status codes are not masked like other numbers. Other values are left out.
+//
+// Directive lines ("#Software:", "#Fields:", ...) are templated as the
+// directive name with its value masked, and set the field w3c_directive. Lines
+// before the first "#Fields:" directive or with a different number of values
+// fall back to HeaderRegex. Use it in place of HeaderStage.
+func W3CStage() Stage {
+	var mu sync.Mutex
+	var columns []string
+	return NewStage(StageW3C, func(lp *AWSOMLP, event *LogEvent) {
+		if directive, ok := strings.CutPrefix(event.Content, "#"); ok {
+			name, value, _ := strings.Cut(directive, ":")
+			if name == "Fields" {
+				mu.Lock()
+				columns = strings.Fields(value)
+				mu.Unlock()
+			}
+			event.Content, event.Fields = "#"+name+": <*>", map[string]string{"w3c_directive": name}
+			return
+		}
+
+		mu.Lock()
+		current := columns
+		mu.Unlock()
+		values := strings.Fields(event.Content)
+		if len(current) == 0 || len(values) != len(current) {
+			event.Content, event.Fields = lp.splitHeader(event.Content)
+			return
+		}
+
+		fields := make(map[string]string, len(current))
+		for i, column := range current {
+			if values[i] != "-" {
+				fields[column] = values[i]
+			}
+		}
+		parts := make([]string, 0, len(current))
+		for _, column := range w3cRequestFields {
+			if value, ok := fields[column]; ok {
+				parts = append(parts, value)
+			}
+		}
+		for i, column := range current {
+			if w3cTemplateFields[column] {
+				parts = append(parts, column+"="+values[i])
+			}
+		}
+		event.Content, event.Fields = strings.Join(parts, " "), fields
+	})
+}